@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	config "github.com/jonkeyguan/vfio-device-plugin/pkg/config"
+	device_manager "github.com/jonkeyguan/vfio-device-plugin/pkg/device-manager"
+)
+
+// runDiscover reports what the device plugin would advertise for a configuration file.
+// It never opens a device plugin socket nor talks to kubelet. The exit code is 1 when
+// any configured address would be rejected.
+func runDiscover(args []string) int {
+	flags := flag.NewFlagSet("discover", flag.ContinueOnError)
+	configPath := flags.String("config", *configFile, "Path of the resource configuration file to check")
+	output := flags.String("output", "table", "Output format, table or json")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	resourceConfig, err := config.NewResourceConfigFromFile(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load %s: %v\n", *configPath, err)
+		return 1
+	}
+
+	deviceController := device_manager.NewDeviceController(DeviceAccessPermissions, resourceConfig, nil, "", nil)
+	results := deviceController.DiscoveryReport()
+
+	switch *output {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(results); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to encode discovery report: %v\n", err)
+			return 1
+		}
+	case "table":
+		printDiscoveryTable(os.Stdout, results)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", *output)
+		return 2
+	}
+
+	for _, result := range results {
+		if !result.Advertised {
+			return 1
+		}
+	}
+	return 0
+}
+
+func printDiscoveryTable(out io.Writer, results []device_manager.DiscoveryResult) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RESOURCE\tBUS\tADDRESS\tID\tDRIVER\tIOMMU GROUP\tNUMA\tLOCAL CPUS\tADVERTISED\tREASON")
+	for _, result := range results {
+		reason := "-"
+		if !result.Advertised {
+			reason = fmt.Sprintf("%s: %s", result.Reason, result.Message)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%t\t%s\n",
+			result.Resource, valueOrDash(result.Bus), result.Address, valueOrDash(result.PCIID), valueOrDash(result.Driver),
+			valueOrDash(result.IOMMUGroup), result.NUMANode, valueOrDash(result.LocalCPUs), result.Advertised, reason)
+	}
+	w.Flush()
+}
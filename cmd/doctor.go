@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/preflight"
+)
+
+// runDoctor runs the host preflight checks and prints their findings.
+// The exit code is 1 when any check failed.
+func runDoctor(args []string) int {
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	root := flags.String("root", "/", "Root of the host filesystem to check")
+	output := flags.String("output", "table", "Output format, table or json")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	findings := preflight.NewChecker(*root).Run()
+
+	switch *output {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(findings); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to encode findings: %v\n", err)
+			return 1
+		}
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "CHECK\tSTATUS\tMESSAGE")
+		for _, finding := range findings {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", finding.Check, finding.Status, finding.Message)
+		}
+		w.Flush()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", *output)
+		return 2
+	}
+
+	if preflight.HasFailures(findings) {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/introspection"
+	log "github.com/jonkeyguan/vfio-device-plugin/pkg/log"
+)
+
+// maxSignalVerbosity caps the verbosity reachable by repeatedly sending SIGUSR1
+const maxSignalVerbosity = 10
+
+type logLevelStatus struct {
+	Verbosity int    `json:"verbosity"`
+	Level     string `json:"level"`
+}
+
+func currentLogLevel() logLevelStatus {
+	return logLevelStatus{
+		Verbosity: log.Verbosity(),
+		Level:     log.LogLevelNames[log.Level()],
+	}
+}
+
+// logLevelHandler reports the current log settings on GET and changes them on POST
+// with the optional "verbosity" and "level" form values
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if value := r.PostForm.Get("verbosity"); value != "" {
+			verbosity, err := strconv.Atoi(value)
+			if err == nil {
+				err = log.SetVerbosity(verbosity)
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid verbosity %q: %v", value, err), http.StatusBadRequest)
+				return
+			}
+		}
+		if value := r.PostForm.Get("level"); value != "" {
+			level, err := log.ParseLogLevel(value)
+			if err == nil {
+				err = log.SetLevel(level)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		log.DefaultLogger().Infof("Log settings changed through the introspection API: %+v", currentLogLevel())
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentLogLevel())
+}
+
+// handleLogLevelSignals raises the verbosity by one on SIGUSR1 and restores the
+// startup verbosity on SIGUSR2, until stop is closed
+func handleLogLevelSignals(stop <-chan struct{}) {
+	logger := log.DefaultLogger()
+	startupVerbosity := log.Verbosity()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(sigs)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case sig := <-sigs:
+			verbosity := startupVerbosity
+			if sig == syscall.SIGUSR1 {
+				verbosity = log.Verbosity() + 1
+				if verbosity > maxSignalVerbosity {
+					verbosity = maxSignalVerbosity
+				}
+			}
+			log.SetVerbosity(verbosity)
+			logger.Infof("Received %s, log verbosity set to %d", sig, verbosity)
+		}
+	}
+}
+
+// runLogLevel prints or changes the log settings of the running device plugin
+func runLogLevel(args []string) int {
+	flags := flag.NewFlagSet("loglevel", flag.ContinueOnError)
+	socket := flags.String("socket", *introspectionSocket, "Unix socket of the introspection API")
+	verbosity := flags.Int("verbosity", -1, "Verbosity to set, unchanged when negative")
+	level := flags.String("level", "", "Log level to set: info, warning, error or fatal. Unchanged when empty")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var status logLevelStatus
+	var err error
+	if *verbosity < 0 && *level == "" {
+		err = introspection.Get(*socket, introspection.LogLevelPath, &status)
+	} else {
+		values := url.Values{}
+		if *verbosity >= 0 {
+			values.Set("verbosity", strconv.Itoa(*verbosity))
+		}
+		if *level != "" {
+			values.Set("level", *level)
+		}
+		err = introspection.Post(*socket, introspection.LogLevelPath, values, &status)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to access log settings through %s: %v\n", *socket, err)
+		return 1
+	}
+
+	fmt.Printf("verbosity: %d\nlevel: %s\n", status.Verbosity, status.Level)
+	return 0
+}
@@ -1,35 +1,186 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+	"time"
 
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+
+	k8scli "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/audit"
 	config "github.com/jonkeyguan/vfio-device-plugin/pkg/config"
 	device_manager "github.com/jonkeyguan/vfio-device-plugin/pkg/device-manager"
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/introspection"
 	log "github.com/jonkeyguan/vfio-device-plugin/pkg/log"
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/metrics"
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/preflight"
 )
 
 const (
 	DeviceAccessPermissions = "rwm"
+	NodeNameEnvVar          = "NODE_NAME"
+	PodNameEnvVar           = "POD_NAME"
+	PodNamespaceEnvVar      = "POD_NAMESPACE"
+)
+
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
+
+var (
+	configFile          = flag.String("config", config.ConfigFilePath, "Path of the resource configuration file")
+	metricsAddress      = flag.String("metrics-address", "", "Address to serve the Prometheus metrics endpoint on, e.g. :9100. Disabled when empty")
+	healthProbeAddress  = flag.String("health-probe-address", "", "Address to serve the /healthz and /readyz probes on, e.g. :8081. Disabled when empty")
+	shutdownTimeout     = flag.Duration("shutdown-timeout", 5*time.Second, "How long each device plugin may take to deregister and stop its gRPC server on shutdown")
+	introspectionSocket = flag.String("introspection-socket", introspection.SocketPath, "Unix socket to serve the introspection API on. Disabled when empty")
+	logFormat           = flag.String("log-format", log.FormatJSON, "Log output format, json or logfmt")
+	auditLogPath        = flag.String("audit-log", "", "Path of the allocation audit log, e.g. /var/log/vfio-device-plugin/audit.log. Disabled when empty")
+	auditLogMaxSize     = flag.Int64("audit-log-max-size", audit.DefaultMaxSize, "Size in bytes at which the allocation audit log is rotated, 0 disables rotation")
+	auditLogMaxBackups  = flag.Int("audit-log-max-backups", audit.DefaultMaxBackups, "Number of rotated allocation audit logs to keep")
+	stateDir            = flag.String("state-dir", "", "Directory the plugin keeps its state in across restarts, e.g. /var/lib/vfio-device-plugin. Release actions are not resumed after a restart when empty")
+	cordonFile          = flag.String("cordon-file", "", "Path of the file listing the cordoned PCI addresses and iommu groups, one per line, e.g. /var/lib/vfio-device-plugin/cordoned. Disabled when empty")
+	socketPrefix        = flag.String("socket-prefix", device_manager.DefaultSocketPrefix, "Prefix of the device plugin socket names. Stale sockets carrying it are removed at startup, so it must differ from the prefix of other device plugins on the node")
 )
 
 func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if err := applyLogFlags(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if flag.NArg() == 0 {
+		runPlugin()
+		return
+	}
+
+	switch flag.Arg(0) {
+	case "status":
+		os.Exit(runStatus(flag.Args()[1:]))
+	case "discover":
+		os.Exit(runDiscover(flag.Args()[1:]))
+	case "doctor":
+		os.Exit(runDoctor(flag.Args()[1:]))
+	case "loglevel":
+		os.Exit(runLogLevel(flag.Args()[1:]))
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s [flags] [command]
+
+Without a command the device plugin is run.
+
+Commands:
+  status    print the state of the running device plugin
+  discover  report which configured devices would be advertised, without serving them
+  doctor    check that the host is set up for VFIO device assignment
+  loglevel  print or change the log settings of the running device plugin
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+// runPlugin runs the device controller until SIGINT or SIGTERM
+func runPlugin() {
 	stop := make(chan struct{})
 	done := make(chan struct{})
 
 	logger := log.DefaultLogger()
 
-	resourceConfig, err := config.NewResourceConfig()
+	preflight.LogFindings(preflight.NewChecker("/").Run())
+
+	resourceConfig, err := config.NewResourceConfigFromFile(*configFile)
 	if err != nil {
 		logger.Reason(err).Error("Failed to create resource config")
 		return
 	}
 
-	deviceController := device_manager.NewDeviceController(DeviceAccessPermissions, resourceConfig)
+	nodeName := os.Getenv(NodeNameEnvVar)
+	clientset, err := newClientset()
+	if err != nil {
+		logger.Reason(err).Warning("Failed to create kubernetes client, node inventory and events will not be published")
+	}
+
+	var recorder record.EventRecorder
+	if clientset != nil {
+		recorder = device_manager.NewEventRecorder(clientset, nodeName)
+	}
+
+	if err := device_manager.SetSocketPrefix(*socketPrefix); err != nil {
+		logger.Reason(err).Error("Invalid socket prefix")
+		return
+	}
+
+	deviceController := device_manager.NewDeviceController(DeviceAccessPermissions, resourceConfig, clientset, nodeName, recorder)
+	deviceController.SetShutdownTimeout(*shutdownTimeout)
+	deviceController.SetConfigFile(*configFile)
+	deviceController.SetCordonFile(*cordonFile)
+	deviceController.SetStateDir(*stateDir)
+	deviceController.SetPod(os.Getenv(PodNamespaceEnvVar), os.Getenv(PodNameEnvVar))
+
+	if *auditLogPath != "" {
+		auditLog, err := audit.Open(*auditLogPath, *auditLogMaxSize, *auditLogMaxBackups)
+		if err != nil {
+			logger.Reason(err).Error("Failed to open the allocation audit log")
+			return
+		}
+		deviceController.SetAuditLog(auditLog)
+	}
 
 	go deviceController.Run(stop, done)
 
+	// endpoints configured on the same address share a server
+	muxes := map[string]*http.ServeMux{}
+	muxFor := func(address string) *http.ServeMux {
+		if _, exists := muxes[address]; !exists {
+			muxes[address] = http.NewServeMux()
+		}
+		return muxes[address]
+	}
+	if *metricsAddress != "" {
+		muxFor(*metricsAddress).Handle(metrics.MetricsPath, metrics.Handler())
+	}
+	if *healthProbeAddress != "" {
+		mux := muxFor(*healthProbeAddress)
+		mux.HandleFunc(healthzPath, probeHandler(deviceController.Healthy))
+		mux.HandleFunc(readyzPath, probeHandler(deviceController.Ready))
+	}
+	for address, mux := range muxes {
+		go serveHTTP(address, mux)
+	}
+
+	if *introspectionSocket != "" {
+		server := introspection.NewServer(*introspectionSocket)
+		server.HandleJSON(introspection.StatusPath, func() interface{} {
+			return deviceController.Status()
+		})
+		server.HandleFunc(introspection.LogLevelPath, logLevelHandler)
+		go func() {
+			if err := server.Run(stop); err != nil {
+				logger.Reason(err).Error("Introspection API failed")
+			}
+		}()
+	}
+
+	go handleLogLevelSignals(stop)
+
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
@@ -43,3 +194,57 @@ func main() {
 
 	logger.Info("Device Controller exited, program ending")
 }
+
+// applyLogFlags configures the loggers from the -log-format flag and the -v flag, when given
+func applyLogFlags() error {
+	if err := log.SetLogFormat(*logFormat); err != nil {
+		return err
+	}
+
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "v" {
+			return
+		}
+		verbosity, parseErr := strconv.Atoi(f.Value.String())
+		if parseErr != nil {
+			err = fmt.Errorf("invalid verbosity %q: %v", f.Value.String(), parseErr)
+			return
+		}
+		err = log.SetVerbosity(verbosity)
+	})
+	return err
+}
+
+// newClientset creates a core/v1 client from the in-cluster service account
+func newClientset() (k8scli.CoreV1Interface, error) {
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := k8scli.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	return clientset, nil
+}
+
+// serveHTTP serves the plugin's HTTP endpoints, failures are logged but not fatal
+func serveHTTP(address string, handler http.Handler) {
+	logger := log.DefaultLogger()
+	logger.Infof("Serving HTTP endpoints on %s", address)
+	if err := http.ListenAndServe(address, handler); err != nil {
+		logger.Reason(err).Errorf("HTTP server on %s failed", address)
+	}
+}
+
+// probeHandler reports 200 when check passes and 503 with the failure otherwise
+func probeHandler(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProbeHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "passing", expectedStatus: http.StatusOK, expectedBody: "ok"},
+		{
+			name:           "failing",
+			err:            errors.New("device plugin for example.com/gpu is not registered with kubelet"),
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedBody:   "device plugin for example.com/gpu is not registered with kubelet\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			probeHandler(func() error { return test.err })(recorder, httptest.NewRequest(http.MethodGet, readyzPath, nil))
+			if recorder.Code != test.expectedStatus || recorder.Body.String() != test.expectedBody {
+				t.Errorf("expected %d %q, got %d %q", test.expectedStatus, test.expectedBody, recorder.Code, recorder.Body.String())
+			}
+		})
+	}
+
+	// the check runs on every request
+	var err error
+	handler := probeHandler(func() error { return err })
+	for _, failing := range []bool{false, true, false} {
+		err = nil
+		if failing {
+			err = errors.New("failing")
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodGet, healthzPath, nil))
+		if failed := recorder.Code == http.StatusServiceUnavailable; failed != failing || (failing && !strings.Contains(recorder.Body.String(), "failing")) {
+			t.Errorf("expected the probe to follow the check, got %d %q", recorder.Code, recorder.Body.String())
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	device_manager "github.com/jonkeyguan/vfio-device-plugin/pkg/device-manager"
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/introspection"
+)
+
+// runStatus prints the state of the running device plugin, read from its introspection API
+func runStatus(args []string) int {
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	socket := flags.String("socket", *introspectionSocket, "Unix socket of the introspection API")
+	output := flags.String("output", "table", "Output format, table or json")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var status device_manager.ControllerStatus
+	if err := introspection.Get(*socket, introspection.StatusPath, &status); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to get status from %s: %v\n", *socket, err)
+		return 1
+	}
+
+	switch *output {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(status); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to encode status: %v\n", err)
+			return 1
+		}
+	case "table":
+		printStatusTable(os.Stdout, status)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", *output)
+		return 2
+	}
+	return 0
+}
+
+func printStatusTable(out io.Writer, status device_manager.ControllerStatus) {
+	if status.NodeName != "" {
+		fmt.Fprintf(out, "Node: %s\n", status.NodeName)
+	}
+	if status.DiscoveryError != "" {
+		fmt.Fprintf(out, "Discovery error: %s\n", status.DiscoveryError)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "\nRESOURCE\tSTATE\tSINCE\tREGISTERED\tREGISTRATION TIME\tATTEMPTS\tFAILURES\tLAST ERROR\tSOCKET")
+	for _, resource := range status.Resources {
+		plugin := resource.Plugin
+		if plugin == nil {
+			plugin = &device_manager.PluginStatus{}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\t%d\t%d\t%s\t%s\n",
+			resource.Name, valueOrDash(plugin.State), formatTime(plugin.StateSince), plugin.Initialized, formatTime(plugin.RegistrationTime),
+			plugin.Attempts, plugin.ConsecutiveFailures, valueOrDash(plugin.LastError), valueOrDash(plugin.SocketPath))
+	}
+
+	fmt.Fprintln(w, "\nRESOURCE\tDEVICE\tBUS\tADDRESS\tID\tDRIVER\tNUMA\tHEALTH\tREASON\tRESERVED BY")
+	for _, resource := range status.Resources {
+		for _, dev := range resource.Devices {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+				resource.Name, dev.ID, dev.Bus, dev.Address, dev.PCIID, dev.Driver, dev.NUMANode, dev.Health, valueOrDash(dev.Reason), valueOrDash(dev.ReservedBy))
+		}
+	}
+	w.Flush()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,161 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxSize    = 100 * 1024 * 1024
+	DefaultMaxBackups = 5
+)
+
+// Record describes one Allocate or PreStartContainer call handled by a device plugin
+type Record struct {
+	Time         time.Time         `json:"time"`
+	Node         string            `json:"node,omitempty"`
+	Resource     string            `json:"resource"`
+	Method       string            `json:"method"`
+	DeviceIDs    []string          `json:"deviceIds"`
+	PCIAddresses []string          `json:"pciAddresses,omitempty"`
+	Envs         map[string]string `json:"envs,omitempty"`
+	Namespace    string            `json:"namespace,omitempty"`
+	Pod          string            `json:"pod,omitempty"`
+	Container    string            `json:"container,omitempty"`
+}
+
+// Log appends records as JSON lines to a file. The file is rotated once it would grow
+// past maxSize, keeping maxBackups rotated files named <path>.1 (the newest) to <path>.<maxBackups>.
+type Log struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	lock       sync.Mutex
+}
+
+// Open opens or creates the audit log at path, a maxSize of 0 disables rotation
+func Open(path string, maxSize int64, maxBackups int) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %v", err)
+	}
+	l := &Log{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat audit log: %v", err)
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// Write appends record and syncs it to disk before returning
+func (l *Log) Write(record Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit record: %v", err)
+	}
+	line = append(line, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file == nil {
+		return fmt.Errorf("audit log %s is closed", l.path)
+	}
+	// a failed rotation keeps appending to the current file, the record is not lost
+	var rotateErr error
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		rotateErr = l.rotate()
+		if l.file == nil {
+			return rotateErr
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write audit record: %v", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync audit log: %v", err)
+	}
+	if rotateErr != nil {
+		return fmt.Errorf("audit record written without rotating the audit log: %v", rotateErr)
+	}
+	return nil
+}
+
+// rotate shifts the backups by one, dropping the oldest, and starts a new file. The
+// current file is reopened when the backups can't be shifted.
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log for rotation: %v", err)
+	}
+	l.file = nil
+
+	rotateErr := l.shiftBackups()
+	if err := l.open(); err != nil {
+		return err
+	}
+	return rotateErr
+}
+
+// shiftBackups moves the file and its backups to the next backup, it stops at the first
+// failure so that no backup is overwritten
+func (l *Log) shiftBackups() error {
+	if l.maxBackups == 0 {
+		if err := os.Remove(l.path); err != nil {
+			return fmt.Errorf("failed to rotate audit log: %v", err)
+		}
+		return nil
+	}
+	for i := l.maxBackups - 1; i > 0; i-- {
+		// backups are missing until the log was rotated maxBackups times
+		if err := os.Rename(l.backupPath(i), l.backupPath(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to rotate audit log backup %s: %v", l.backupPath(i), err)
+		}
+	}
+	if err := os.Rename(l.path, l.backupPath(1)); err != nil {
+		return fmt.Errorf("failed to rotate audit log: %v", err)
+	}
+	return nil
+}
+
+func (l *Log) backupPath(index int) string {
+	return fmt.Sprintf("%s.%d", l.path, index)
+}
+
+func (l *Log) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,169 @@
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readRecords returns the resources of the records of an audit log file, nil when it is missing
+func readRecords(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resources []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var record Record
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("failed to parse audit record %q: %v", line, err)
+		}
+		resources = append(resources, record.Resource)
+	}
+	return resources
+}
+
+// recordSize is the size of the records written by the tests, which only differ by the resource digit
+func recordSize(t *testing.T) int64 {
+	line, err := json.Marshal(Record{Resource: "example.com/gpu0", Method: "Allocate"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int64(len(line)) + 1
+}
+
+func writeRecords(t *testing.T, l *Log, count int) {
+	for i := 0; i < count; i++ {
+		if err := l.Write(Record{Resource: "example.com/gpu" + string(rune('0'+i)), Method: "Allocate"}); err != nil {
+			t.Fatalf("failed to write record %d: %v", i, err)
+		}
+	}
+}
+
+func TestRotate(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxBackups int
+		// expected lists the records of the file and of its backups, newest first
+		expected [][]string
+	}{
+		{
+			name:       "no backups",
+			maxBackups: 0,
+			expected:   [][]string{{"example.com/gpu4"}, nil},
+		},
+		{
+			name:       "one backup",
+			maxBackups: 1,
+			expected:   [][]string{{"example.com/gpu4"}, {"example.com/gpu3"}, nil},
+		},
+		{
+			name:       "several backups",
+			maxBackups: 3,
+			expected:   [][]string{{"example.com/gpu4"}, {"example.com/gpu3"}, {"example.com/gpu2"}, {"example.com/gpu1"}, nil},
+		},
+		{
+			name:       "backups not all used yet",
+			maxBackups: 8,
+			expected:   [][]string{{"example.com/gpu4"}, {"example.com/gpu3"}, {"example.com/gpu2"}, {"example.com/gpu1"}, {"example.com/gpu0"}, nil},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit", "audit.log")
+			// every file holds a single record
+			l, err := Open(path, recordSize(t)+1, test.maxBackups)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			writeRecords(t, l, 5)
+
+			for i, expected := range test.expected {
+				file := path
+				if i > 0 {
+					file = l.backupPath(i)
+				}
+				if records := readRecords(t, file); strings.Join(records, ",") != strings.Join(expected, ",") {
+					t.Errorf("expected %s to hold %v, got %v", filepath.Base(file), expected, records)
+				}
+			}
+		})
+	}
+}
+
+func TestRotateAtMaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	// two records fit, the third one rotates the log
+	l, err := Open(path, 2*recordSize(t), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRecords(t, l, 3)
+	l.Close()
+
+	if records := readRecords(t, path+".1"); len(records) != 2 {
+		t.Errorf("expected the backup to hold 2 records, got %v", records)
+	}
+	// the size of an existing file counts on reopening
+	l, err = Open(path, 2*recordSize(t), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	writeRecords(t, l, 2)
+	if records := readRecords(t, path+".1"); strings.Join(records, ",") != "example.com/gpu2,example.com/gpu0" {
+		t.Errorf("expected the backup to hold the records of the reopened file, got %v", records)
+	}
+	if records := readRecords(t, path); strings.Join(records, ",") != "example.com/gpu1" {
+		t.Errorf("unexpected records %v", records)
+	}
+}
+
+func TestRotateBackupFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(path, recordSize(t)+1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	writeRecords(t, l, 2)
+	// the oldest backup can't be replaced
+	if err := os.MkdirAll(filepath.Join(l.backupPath(2), "busy"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	err = l.Write(Record{Resource: "example.com/gpu2", Method: "Allocate"})
+	if err == nil || !strings.Contains(err.Error(), l.backupPath(1)) {
+		t.Fatalf("expected the failed backup rotation to be reported, got %v", err)
+	}
+	// no backup is overwritten and the record is kept
+	if records := readRecords(t, l.backupPath(1)); strings.Join(records, ",") != "example.com/gpu0" {
+		t.Errorf("expected the backup to be kept, got %v", records)
+	}
+	if records := readRecords(t, path); strings.Join(records, ",") != "example.com/gpu1,example.com/gpu2" {
+		t.Errorf("expected the record to be appended to the current file, got %v", records)
+	}
+}
+
+func TestWriteClosed(t *testing.T) {
+	l, err := Open(filepath.Join(t.TempDir(), "audit.log"), DefaultMaxSize, DefaultMaxBackups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Write(Record{Resource: "example.com/gpu0"}); err == nil {
+		t.Error("expected writing to a closed audit log to fail")
+	}
+	if err := l.Close(); err != nil {
+		t.Errorf("expected closing twice to succeed, got %v", err)
+	}
+}
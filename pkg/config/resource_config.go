@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -16,31 +17,174 @@ const (
 	// ConfigFilePath = "/root/config.yaml"
 )
 
+// Buses VFIO devices of a resource can be discovered on
+const (
+	BusPCI      = "pci"
+	BusPlatform = "platform"
+	BusAP       = "ap"
+	BusCCW      = "ccw"
+)
+
+const (
+	// DefaultDeviceNodeCount matches the default maximum number of pods per node
+	DefaultDeviceNodeCount = 110
+
+	// HealthCheckExists reports a device node unhealthy while its path does not exist
+	HealthCheckExists = "exists"
+	// HealthCheckOpen additionally reports it unhealthy while it can't be opened
+	HealthCheckOpen = "open"
+	// HealthCheckNone always reports a device node healthy
+	HealthCheckNone = "none"
+)
+
+// Built-in health checkers of PCI devices, more may be registered by the device manager
+const (
+	// HealthCheckerConfigSpace reports a device unhealthy once its config space reads all ones,
+	// which happens when it fell off the bus
+	HealthCheckerConfigSpace = "configSpace"
+	// HealthCheckerAER reports a device unhealthy once it logged fatal AER errors
+	HealthCheckerAER = "aer"
+	// HealthCheckerDriver reports a device unhealthy while it isn't bound to its vfio driver
+	HealthCheckerDriver = "driver"
+	// HealthCheckerExec runs a command with the PCI address, the device is unhealthy while it fails
+	HealthCheckerExec = "exec"
+
+	DefaultHealthCheckPeriodSeconds  = 30
+	DefaultHealthCheckTimeoutSeconds = 10
+)
+
+// Actions run on the devices of a resource once a pod released them
+const (
+	// ReleaseActionFLR resets the device through sysfs, which uses a function level reset when
+	// the device supports it
+	ReleaseActionFLR = "flr"
+	// ReleaseActionCommand runs a command with the PCI address, e.g. a vendor scrub tool
+	ReleaseActionCommand = "command"
+
+	DefaultReleaseActionTimeoutSeconds = 60
+)
+
+// Formats of the env vars describing the devices allocated to a container
+const (
+	// EnvFormatList only lists the allocated addresses, comma separated in request order
+	EnvFormatList = "list"
+	// EnvFormatGroups additionally maps every allocated IOMMU group to its addresses as
+	// <group>=<addr>[;<addr>], comma separated in request order
+	EnvFormatGroups = "groups"
+)
+
+// Scopes of a composite topology rule
+const (
+	// TopologyScopeSlot bundles functions of the same PCI slot, e.g. a GPU and its USB-C controller
+	TopologyScopeSlot = "slot"
+	// TopologyScopeSwitch bundles devices behind the same PCIe switch
+	TopologyScopeSwitch = "switch"
+	// TopologyScopeNUMA bundles devices attached to the same NUMA node
+	TopologyScopeNUMA = "numa"
+)
+
+var envPrefixPattern = regexp.MustCompile(`^[A-Z_][A-Z0-9_]*$`)
+
 type ResourceConfig struct {
 	config *Config
 }
 
 // Config structure representing the root of the configuration file
 type Config struct {
-	Resources []Resource `yaml:"resources"` // List of resources
+	Resources   []Resource   `yaml:"resources"`   // List of resources
+	DeviceNodes []DeviceNode `yaml:"deviceNodes"` // List of host device node resources
+	Composites  []Composite  `yaml:"composites"`  // List of resources bundling several PCI devices
+	// List of health checkers run on PCI devices besides the vfio device presence check
+	HealthCheckers []HealthChecker `yaml:"healthCheckers"`
 }
 
 // Resource structure representing each resource in the configuration
 type Resource struct {
 	Name      string   `yaml:"resourceName"` // Name of the resource
-	Addresses []string `yaml:"addresses"`    // List of device addresses for the resource
+	Bus       string   `yaml:"bus"`          // Bus of the devices, one of pci (default), platform, ap or ccw
+	Addresses []string `yaml:"addresses"`    // List of device addresses, an address may be shared by several resources
+	// Action run on a device released by a pod, it isn't allocated again until the action succeeds
+	ReleaseAction *ReleaseAction `yaml:"releaseAction"`
+	// Devices stay bound to their host driver until a container using them starts, they are
+	// bound to vfio-pci then and back to their host driver once released
+	LazyBinding bool `yaml:"lazyBinding"`
+	// Delays between two starts of the device plugin after it failed, the last one repeats
+	BackoffSeconds []int `yaml:"backoffSeconds"`
+	// Env vars describing the allocated devices to the container
+	Env *Env `yaml:"env"`
+}
+
+// Env structure representing the env vars describing the allocated devices
+type Env struct {
+	Prefix string `yaml:"prefix"` // Prefix of the env var names, the default of the bus when unset, e.g. PCI_RESOURCE
+	Format string `yaml:"format"` // One of list or groups (default)
+}
+
+// ReleaseAction structure representing the action cleaning a device up between two pods
+type ReleaseAction struct {
+	Type           string   `yaml:"type"`           // One of flr or command
+	Command        []string `yaml:"command"`        // Command of the command action, the PCI address is appended
+	TimeoutSeconds int      `yaml:"timeoutSeconds"` // Timeout of the action, DefaultReleaseActionTimeoutSeconds when unset
+}
+
+// DeviceNode structure representing a host device node, such as /dev/kvm, shared by
+// Count virtual devices of the resource
+type DeviceNode struct {
+	Name        string `yaml:"resourceName"` // Name of the resource
+	Path        string `yaml:"path"`         // Path of the device node on the host
+	Count       int    `yaml:"count"`        // Number of virtual devices advertised, DefaultDeviceNodeCount when unset
+	Permissions string `yaml:"permissions"`  // cgroup permissions of the device node, any of "rwm"
+	HealthCheck string `yaml:"healthCheck"`  // One of exists (default), open or none
+	// Delays between two starts of the device plugin after it failed, the last one repeats
+	BackoffSeconds []int `yaml:"backoffSeconds"`
+}
+
+// Composite structure representing a resource whose devices are bundles of PCI devices,
+// each advertised as one device. Bundles are either listed or built by a topology rule.
+type Composite struct {
+	Name     string        `yaml:"resourceName"` // Name of the resource
+	Bundles  [][]string    `yaml:"bundles"`      // Device addresses of every bundle
+	Topology *TopologyRule `yaml:"topology"`     // Rule building the bundles from the host devices
+	// Action run on every device of a released bundle, it isn't allocated again until the action succeeds
+	ReleaseAction *ReleaseAction `yaml:"releaseAction"`
+	// Delays between two starts of the device plugin after it failed, the last one repeats
+	BackoffSeconds []int `yaml:"backoffSeconds"`
+	// Env vars describing the allocated devices to the container
+	Env *Env `yaml:"env"`
+}
+
+// TopologyRule bundles one device of each member vendor:device ID found within the same scope
+type TopologyRule struct {
+	Members []string `yaml:"members"` // vendor:device IDs of the bundled devices, the first one is the primary device
+	Scope   string   `yaml:"scope"`   // One of slot, switch or numa
+}
+
+// HealthChecker structure representing a health checker applied to the devices of the
+// listed PCI IDs or resources, to every PCI device when neither is listed
+type HealthChecker struct {
+	Type           string   `yaml:"type"`           // One of configSpace, aer, driver, exec or a registered checker
+	PCIIDs         []string `yaml:"pciIds"`         // vendor:device IDs of the checked devices
+	Resources      []string `yaml:"resources"`      // Resources whose devices are checked
+	Command        []string `yaml:"command"`        // Command of the exec checker, the PCI address is appended
+	PeriodSeconds  int      `yaml:"periodSeconds"`  // Interval between checks, DefaultHealthCheckPeriodSeconds when unset
+	TimeoutSeconds int      `yaml:"timeoutSeconds"` // Timeout of a check, DefaultHealthCheckTimeoutSeconds when unset
 }
 
 func NewResourceConfig() (*ResourceConfig, error) {
+	return NewResourceConfigFromFile(ConfigFilePath)
+}
+
+// NewResourceConfigFromFile loads the resource configuration from filePath
+func NewResourceConfigFromFile(filePath string) (*ResourceConfig, error) {
 	logger := log.DefaultLogger()
-	config, err := readConfig(ConfigFilePath)
+	config, err := readConfig(filePath)
 
 	if err != nil {
 		logger.Reason(err).Error("Error reading config file")
 		return nil, err
 	}
 
-	logger.Infof("Config file loaded successfully: %s", ConfigFilePath)
+	logger.Infof("Config file loaded successfully: %s", filePath)
 	logger.Infof("Resources: %v", config.Resources)
 
 	resourceConfig := &ResourceConfig{
@@ -54,6 +198,39 @@ func (c *ResourceConfig) GetResources() []Resource {
 	return c.config.Resources
 }
 
+func (c *ResourceConfig) GetDeviceNodes() []DeviceNode {
+	return c.config.DeviceNodes
+}
+
+func (c *ResourceConfig) GetComposites() []Composite {
+	return c.config.Composites
+}
+
+func (c *ResourceConfig) GetHealthCheckers() []HealthChecker {
+	return c.config.HealthCheckers
+}
+
+// GetBackoffSeconds returns the restart backoff configured for a resource, nil when it
+// uses the default one
+func (c *ResourceConfig) GetBackoffSeconds(resourceName string) []int {
+	for _, resource := range c.config.Resources {
+		if resource.Name == resourceName {
+			return resource.BackoffSeconds
+		}
+	}
+	for _, node := range c.config.DeviceNodes {
+		if node.Name == resourceName {
+			return node.BackoffSeconds
+		}
+	}
+	for _, composite := range c.config.Composites {
+		if composite.Name == resourceName {
+			return composite.BackoffSeconds
+		}
+	}
+	return nil
+}
+
 // readConfig function to read and parse the YAML configuration file
 func readConfig(filePath string) (*Config, error) {
 	// Read the YAML file
@@ -73,6 +250,16 @@ func readConfig(filePath string) (*Config, error) {
 
 	// Process each resource's addresses to expand ranges into actual device addresses
 	for i, resource := range config.Resources {
+		switch resource.Bus {
+		case "":
+			config.Resources[i].Bus = BusPCI
+		case BusPCI:
+		case BusPlatform, BusAP, BusCCW:
+			// platform device names and mediated device UUIDs have no function ranges
+			continue
+		default:
+			return nil, fmt.Errorf("unknown bus %q of resource %s", resource.Bus, resource.Name)
+		}
 		var expandedAddresses []string
 		for _, address := range resource.Addresses {
 			expandedAddresses = append(expandedAddresses, parseDeviceAddress(address)...)
@@ -81,9 +268,232 @@ func readConfig(filePath string) (*Config, error) {
 		config.Resources[i].Addresses = expandedAddresses
 	}
 
+	if err := validateDeviceNodes(&config); err != nil {
+		return nil, err
+	}
+	if err := validateComposites(&config); err != nil {
+		return nil, err
+	}
+	if err := validateHealthCheckers(&config); err != nil {
+		return nil, err
+	}
+	for _, resource := range config.Resources {
+		if err := validateReleaseAction(resource.ReleaseAction, resource.Name); err != nil {
+			return nil, err
+		}
+		if resource.ReleaseAction != nil && resource.ReleaseAction.Type == ReleaseActionFLR && resource.Bus != BusPCI {
+			return nil, fmt.Errorf("release action flr of resource %s is only supported on the pci bus", resource.Name)
+		}
+		if resource.LazyBinding && resource.Bus != BusPCI {
+			return nil, fmt.Errorf("lazy binding of resource %s is only supported on the pci bus", resource.Name)
+		}
+		if err := validateBackoff(resource.BackoffSeconds, resource.Name); err != nil {
+			return nil, err
+		}
+		if err := validateEnv(resource.Env, resource.Name); err != nil {
+			return nil, err
+		}
+	}
+	for _, node := range config.DeviceNodes {
+		if err := validateBackoff(node.BackoffSeconds, node.Name); err != nil {
+			return nil, err
+		}
+	}
+	for i := range config.Composites {
+		if err := validateReleaseAction(config.Composites[i].ReleaseAction, config.Composites[i].Name); err != nil {
+			return nil, err
+		}
+		if err := validateBackoff(config.Composites[i].BackoffSeconds, config.Composites[i].Name); err != nil {
+			return nil, err
+		}
+		if err := validateEnv(config.Composites[i].Env, config.Composites[i].Name); err != nil {
+			return nil, err
+		}
+	}
+
 	return &config, nil
 }
 
+// validateDeviceNodes checks the device node resources and fills in their defaults
+func validateDeviceNodes(config *Config) error {
+	names := make(map[string]struct{})
+	for _, resource := range config.Resources {
+		names[resource.Name] = struct{}{}
+	}
+
+	for i := range config.DeviceNodes {
+		node := &config.DeviceNodes[i]
+		if node.Name == "" {
+			return fmt.Errorf("device node %s has no resourceName", node.Path)
+		}
+		if _, exists := names[node.Name]; exists {
+			return fmt.Errorf("resource %s is configured more than once", node.Name)
+		}
+		names[node.Name] = struct{}{}
+
+		if !filepath.IsAbs(node.Path) {
+			return fmt.Errorf("device node path %q of resource %s is not absolute", node.Path, node.Name)
+		}
+		if node.Count < 0 {
+			return fmt.Errorf("device node count of resource %s must not be negative", node.Name)
+		}
+		if node.Count == 0 {
+			node.Count = DefaultDeviceNodeCount
+		}
+		if strings.Trim(node.Permissions, "rwm") != "" {
+			return fmt.Errorf("device node permissions %q of resource %s may only contain r, w and m", node.Permissions, node.Name)
+		}
+		switch node.HealthCheck {
+		case "":
+			node.HealthCheck = HealthCheckExists
+		case HealthCheckExists, HealthCheckOpen, HealthCheckNone:
+		default:
+			return fmt.Errorf("unknown health check %q of resource %s", node.HealthCheck, node.Name)
+		}
+	}
+	return nil
+}
+
+// validateComposites checks the composite resources and expands the address ranges of their bundles
+func validateComposites(config *Config) error {
+	names := make(map[string]struct{})
+	claimed := make(map[string]string)
+	for _, resource := range config.Resources {
+		names[resource.Name] = struct{}{}
+		for _, address := range resource.Addresses {
+			claimed[address] = resource.Name
+		}
+	}
+	for _, node := range config.DeviceNodes {
+		names[node.Name] = struct{}{}
+	}
+
+	for i := range config.Composites {
+		composite := &config.Composites[i]
+		if composite.Name == "" {
+			return fmt.Errorf("composite resource has no resourceName")
+		}
+		if _, exists := names[composite.Name]; exists {
+			return fmt.Errorf("resource %s is configured more than once", composite.Name)
+		}
+		names[composite.Name] = struct{}{}
+
+		if (len(composite.Bundles) == 0) == (composite.Topology == nil) {
+			return fmt.Errorf("composite resource %s needs either bundles or a topology rule", composite.Name)
+		}
+
+		for j, bundle := range composite.Bundles {
+			var expandedAddresses []string
+			for _, address := range bundle {
+				expandedAddresses = append(expandedAddresses, parseDeviceAddress(address)...)
+			}
+			if len(expandedAddresses) == 0 {
+				return fmt.Errorf("bundle %d of composite resource %s is empty", j, composite.Name)
+			}
+			for _, address := range expandedAddresses {
+				if owner, exists := claimed[address]; exists {
+					return fmt.Errorf("address %s of composite resource %s is already used by %s", address, composite.Name, owner)
+				}
+				claimed[address] = composite.Name
+			}
+			composite.Bundles[j] = expandedAddresses
+		}
+
+		if rule := composite.Topology; rule != nil {
+			if len(rule.Members) < 2 {
+				return fmt.Errorf("topology rule of composite resource %s needs at least two members", composite.Name)
+			}
+			for k, member := range rule.Members {
+				rule.Members[k] = strings.ToLower(member)
+			}
+			switch rule.Scope {
+			case TopologyScopeSlot, TopologyScopeSwitch, TopologyScopeNUMA:
+			default:
+				return fmt.Errorf("unknown topology scope %q of composite resource %s", rule.Scope, composite.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// validateHealthCheckers checks the health checkers and fills in their defaults. The
+// type isn't checked here since checkers may be registered by the device manager.
+func validateHealthCheckers(config *Config) error {
+	for i := range config.HealthCheckers {
+		checker := &config.HealthCheckers[i]
+		if checker.Type == "" {
+			return fmt.Errorf("health checker %d has no type", i)
+		}
+		if checker.Type == HealthCheckerExec && len(checker.Command) == 0 {
+			return fmt.Errorf("exec health checker %d has no command", i)
+		}
+		for j, pciID := range checker.PCIIDs {
+			checker.PCIIDs[j] = strings.ToLower(pciID)
+		}
+		if checker.PeriodSeconds < 0 || checker.TimeoutSeconds < 0 {
+			return fmt.Errorf("period and timeout of health checker %d must not be negative", i)
+		}
+		if checker.PeriodSeconds == 0 {
+			checker.PeriodSeconds = DefaultHealthCheckPeriodSeconds
+		}
+		if checker.TimeoutSeconds == 0 {
+			checker.TimeoutSeconds = DefaultHealthCheckTimeoutSeconds
+		}
+	}
+	return nil
+}
+
+// validateReleaseAction checks the release action of a resource and fills in its defaults
+func validateReleaseAction(action *ReleaseAction, resourceName string) error {
+	if action == nil {
+		return nil
+	}
+	switch action.Type {
+	case ReleaseActionFLR:
+	case ReleaseActionCommand:
+		if len(action.Command) == 0 {
+			return fmt.Errorf("release action of resource %s has no command", resourceName)
+		}
+	default:
+		return fmt.Errorf("unknown release action %q of resource %s", action.Type, resourceName)
+	}
+	if action.TimeoutSeconds < 0 {
+		return fmt.Errorf("release action timeout of resource %s must not be negative", resourceName)
+	}
+	if action.TimeoutSeconds == 0 {
+		action.TimeoutSeconds = DefaultReleaseActionTimeoutSeconds
+	}
+	return nil
+}
+
+// validateBackoff checks the restart backoff of a resource
+func validateBackoff(backoffSeconds []int, resourceName string) error {
+	for _, seconds := range backoffSeconds {
+		if seconds <= 0 {
+			return fmt.Errorf("backoff delays of resource %s must be positive", resourceName)
+		}
+	}
+	return nil
+}
+
+// validateEnv checks the env vars of a resource and fills in their defaults
+func validateEnv(env *Env, resourceName string) error {
+	if env == nil {
+		return nil
+	}
+	if env.Prefix != "" && !envPrefixPattern.MatchString(env.Prefix) {
+		return fmt.Errorf("env prefix %q of resource %s must be upper case letters, digits and underscores, not starting with a digit", env.Prefix, resourceName)
+	}
+	switch env.Format {
+	case "":
+		env.Format = EnvFormatGroups
+	case EnvFormatList, EnvFormatGroups:
+	default:
+		return fmt.Errorf("unknown env format %q of resource %s", env.Format, resourceName)
+	}
+	return nil
+}
+
 // parseDeviceAddress function to parse a device address like "0000:86:00.0#0-1,3,4" into multiple addresses
 func parseDeviceAddress(device string) []string {
 	log := log.DefaultLogger()
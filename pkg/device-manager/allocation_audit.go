@@ -0,0 +1,137 @@
+package device_manager
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/audit"
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/log"
+)
+
+// auditQueueSize bounds the records waiting to be enriched and written. When the queue
+// is full records are written right away without the pod and container.
+const auditQueueSize = 1000
+
+// allocationAuditor writes the audit records of the device plugins. Records are enriched
+// with the pod and container from the PodResources API in the background so that
+// allocations are not slowed down. kubelet only reports a device once the allocation
+// completed, so Allocate records are usually enriched less often than PreStartContainer ones.
+type allocationAuditor struct {
+	auditLog *audit.Log
+	nodeName string
+	records  chan audit.Record
+	done     chan struct{}
+	closed   bool
+	lock     sync.Mutex
+}
+
+func newAllocationAuditor(auditLog *audit.Log, nodeName string) *allocationAuditor {
+	return &allocationAuditor{
+		auditLog: auditLog,
+		nodeName: nodeName,
+		records:  make(chan audit.Record, auditQueueSize),
+		done:     make(chan struct{}),
+	}
+}
+
+// record queues an audit record, it is safe to call on a nil auditor
+func (a *allocationAuditor) record(resourceName string, method string, deviceIDs []string, pciAddresses []string, envs map[string]string) {
+	if a == nil {
+		return
+	}
+	record := audit.Record{
+		Time:         time.Now().UTC(),
+		Node:         a.nodeName,
+		Resource:     resourceName,
+		Method:       method,
+		DeviceIDs:    deviceIDs,
+		PCIAddresses: pciAddresses,
+		Envs:         envs,
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.closed {
+		a.write(record)
+		return
+	}
+	select {
+	case a.records <- record:
+	default:
+		log.DefaultLogger().Resource(resourceName).Warning("audit queue is full, writing the record without pod details")
+		a.write(record)
+	}
+}
+
+// run enriches and writes the queued records until stop is called
+func (a *allocationAuditor) run() {
+	defer close(a.done)
+
+	_, err := os.Stat(podResourcesSocket)
+	podResourcesAvailable := err == nil
+	for record := range a.records {
+		if podResourcesAvailable {
+			a.enrich(&record)
+		}
+		a.write(record)
+	}
+}
+
+// stop writes the queued records and closes the audit log
+func (a *allocationAuditor) stop() {
+	a.lock.Lock()
+	a.closed = true
+	close(a.records)
+	a.lock.Unlock()
+
+	<-a.done
+	if err := a.auditLog.Close(); err != nil {
+		log.DefaultLogger().Reason(err).Error("failed to close the audit log")
+	}
+}
+
+func (a *allocationAuditor) write(record audit.Record) {
+	if err := a.auditLog.Write(record); err != nil {
+		log.DefaultLogger().Resource(record.Resource).Reason(err).Errorf("failed to write audit record for devices %v", record.DeviceIDs)
+	}
+}
+
+// enrich fills in the pod and container the devices of record are assigned to
+func (a *allocationAuditor) enrich(record *audit.Record) {
+	if len(record.DeviceIDs) == 0 {
+		return
+	}
+	resp, err := listPodResources(podResourcesSocket)
+	if err != nil {
+		log.DefaultLogger().Resource(record.Resource).Reason(err).Warning("failed to list pod resources for the audit record")
+		return
+	}
+	pod, container := findDeviceOwner(resp, record.Resource, record.DeviceIDs[0])
+	if pod != nil {
+		record.Namespace = pod.GetNamespace()
+		record.Pod = pod.GetName()
+		record.Container = container.GetName()
+	}
+}
+
+// findDeviceOwner returns the pod and container a device of resourceName is assigned to
+func findDeviceOwner(resp *podresourcesapi.ListPodResourcesResponse, resourceName string, devID string) (*podresourcesapi.PodResources, *podresourcesapi.ContainerResources) {
+	for _, pod := range resp.GetPodResources() {
+		for _, container := range pod.GetContainers() {
+			for _, dev := range container.GetDevices() {
+				if dev.GetResourceName() != resourceName {
+					continue
+				}
+				for _, id := range dev.GetDeviceIds() {
+					if id == devID {
+						return pod, container
+					}
+				}
+			}
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,116 @@
+package device_manager
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/audit"
+)
+
+// newTestAuditor returns an auditor writing to an audit log of a temp directory and its path
+func newTestAuditor(t *testing.T) (*allocationAuditor, string) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := audit.Open(path, audit.DefaultMaxSize, audit.DefaultMaxBackups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newAllocationAuditor(auditLog, "node1"), path
+}
+
+func readAuditRecords(t *testing.T, path string) []audit.Record {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []audit.Record
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		var record audit.Record
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("failed to parse audit record %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestAllocationAuditorEnrich(t *testing.T) {
+	podResources := servePodResources(t)
+	podResources.setPods(podWithDevices("default", "vm-1", "compute", "example.com/gpu", "12"))
+	a, path := newTestAuditor(t)
+	go a.run()
+
+	a.record("example.com/gpu", "PreStartContainer", []string{"12"}, nil, nil)
+	// the device is assigned through another resource
+	a.record("example.com/nic", "PreStartContainer", []string{"12"}, nil, nil)
+	a.record("example.com/gpu", "Allocate", []string{"13"}, []string{"0000:02:00.0"}, map[string]string{"PCI_RESOURCE_EXAMPLE_COM_GPU": "0000:02:00.0"})
+	a.record("example.com/gpu", "PreStartContainer", nil, nil, nil)
+	a.stop()
+
+	records := readAuditRecords(t, path)
+	if len(records) != 4 {
+		t.Fatalf("expected 4 records, got %+v", records)
+	}
+	owners := make([]string, 0, len(records))
+	for _, record := range records {
+		if record.Node != "node1" {
+			t.Errorf("expected the record to name the node, got %+v", record)
+		}
+		owners = append(owners, record.Namespace+"/"+record.Pod+"/"+record.Container)
+	}
+	expected := []string{"default/vm-1/compute", "//", "//", "//"}
+	if strings.Join(owners, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected the owners %v, got %v", expected, owners)
+	}
+	if records[2].Method != "Allocate" || records[2].PCIAddresses[0] != "0000:02:00.0" || records[2].Envs["PCI_RESOURCE_EXAMPLE_COM_GPU"] != "0000:02:00.0" {
+		t.Errorf("unexpected allocation record %+v", records[2])
+	}
+}
+
+func TestAllocationAuditorWithoutPodResources(t *testing.T) {
+	withoutPodResources(t)
+	a, path := newTestAuditor(t)
+	go a.run()
+
+	a.record("example.com/gpu", "PreStartContainer", []string{"12"}, nil, nil)
+	a.stop()
+
+	records := readAuditRecords(t, path)
+	if len(records) != 1 || records[0].Resource != "example.com/gpu" || records[0].Pod != "" {
+		t.Errorf("expected the record to be written without its pod, got %+v", records)
+	}
+}
+
+func TestAllocationAuditorStop(t *testing.T) {
+	withoutPodResources(t)
+	a, path := newTestAuditor(t)
+
+	// nothing enriches the records yet, once the queue is full they are written right away
+	for i := 0; i <= auditQueueSize; i++ {
+		a.record("example.com/gpu", "Allocate", []string{"12"}, nil, nil)
+	}
+	if records := readAuditRecords(t, path); len(records) != 1 {
+		t.Fatalf("expected the record overflowing the queue to be written, got %d records", len(records))
+	}
+
+	// the queued records are written before the audit log is closed
+	go a.run()
+	a.stop()
+	if records := readAuditRecords(t, path); len(records) != auditQueueSize+1 {
+		t.Errorf("expected %d records, got %d", auditQueueSize+1, len(records))
+	}
+	// records of calls completing after the stop are dropped with an error, the auditor doesn't panic
+	a.record("example.com/gpu", "PreStartContainer", []string{"12"}, nil, nil)
+	if records := readAuditRecords(t, path); len(records) != auditQueueSize+1 {
+		t.Errorf("expected no record after the stop, got %d records", len(records))
+	}
+
+	var nilAuditor *allocationAuditor
+	nilAuditor.record("example.com/gpu", "Allocate", []string{"12"}, nil, nil)
+}
@@ -0,0 +1,114 @@
+package device_manager
+
+import (
+	"fmt"
+	"strings"
+
+	config "github.com/jonkeyguan/vfio-device-plugin/pkg/config"
+)
+
+const (
+	platformBasePath = "/sys/bus/platform/devices"
+	// vfio-ap and vfio-ccw devices are mediated devices created on the AP matrix
+	// device and on CCW subchannels respectively
+	mdevBasePath = "/sys/bus/mdev/devices"
+)
+
+// deviceBus describes how the VFIO devices of a bus are laid out in sysfs.
+// Devices of every bus are assigned by IOMMU group through /dev/vfio.
+type deviceBus struct {
+	name string
+	// basePath holds one entry per device, named after its address
+	basePath string
+	// vfioDrivers are the drivers which make a device usable through vfio
+	vfioDrivers []string
+	// envPrefix prefixes the env var listing the allocated addresses
+	envPrefix string
+	// hasNUMA is set when the devices report a numa_node
+	hasNUMA bool
+	// identify returns the ID a device is reported with, e.g. the vendor:device ID of PCI devices
+	identify func(basePath string, address string) (string, error)
+}
+
+var deviceBuses = map[string]*deviceBus{
+	config.BusPCI: {
+		name:        config.BusPCI,
+		basePath:    pciBasePath,
+		vfioDrivers: []string{"vfio-pci"},
+		envPrefix:   PCIResourcePrefix,
+		hasNUMA:     true,
+		identify: func(basePath string, address string) (string, error) {
+			return Handler.GetDevicePCIID(basePath, address)
+		},
+	},
+	config.BusPlatform: {
+		name:        config.BusPlatform,
+		basePath:    platformBasePath,
+		vfioDrivers: []string{"vfio-platform"},
+		envPrefix:   "PLATFORM_RESOURCE",
+		identify:    identifyPlatformDevice,
+	},
+	config.BusAP: {
+		name:        config.BusAP,
+		basePath:    mdevBasePath,
+		vfioDrivers: []string{"vfio_ap_mdev", "vfio_mdev"},
+		envPrefix:   "AP_RESOURCE",
+		identify:    identifyMdevOfType("vfio_ap-"),
+	},
+	config.BusCCW: {
+		name:        config.BusCCW,
+		basePath:    mdevBasePath,
+		vfioDrivers: []string{"vfio_ccw_mdev", "vfio_mdev"},
+		envPrefix:   "CCW_RESOURCE",
+		identify:    identifyMdevOfType("vfio_ccw-"),
+	},
+}
+
+// busFor returns the bus of a configured resource, PCI when unset
+func busFor(name string) (*deviceBus, error) {
+	bus, exists := deviceBuses[busName(name)]
+	if !exists {
+		return nil, fmt.Errorf("unknown bus %q", name)
+	}
+	return bus, nil
+}
+
+// busName returns the bus of a device, devices discovered without a bus are PCI devices
+func busName(name string) string {
+	if name == "" {
+		return config.BusPCI
+	}
+	return name
+}
+
+func (b *deviceBus) isVfioDriver(driver string) bool {
+	for _, vfioDriver := range b.vfioDrivers {
+		if driver == vfioDriver {
+			return true
+		}
+	}
+	return false
+}
+
+// identifyPlatformDevice reports device tree devices by their first compatible string
+// and ACPI devices by their modalias
+func identifyPlatformDevice(basePath string, address string) (string, error) {
+	if compatible, err := Handler.GetDeviceUeventValue(basePath, address, "OF_COMPATIBLE_0"); err == nil {
+		return compatible, nil
+	}
+	return Handler.GetDeviceUeventValue(basePath, address, "MODALIAS")
+}
+
+// identifyMdevOfType reports mediated devices by their type, rejecting types of other buses
+func identifyMdevOfType(typePrefix string) func(string, string) (string, error) {
+	return func(basePath string, address string) (string, error) {
+		mdevType, err := Handler.GetDeviceMdevType(basePath, address)
+		if err != nil {
+			return "", err
+		}
+		if !strings.HasPrefix(mdevType, typePrefix) {
+			return "", fmt.Errorf("mediated device type %s is not a %s* type", mdevType, typePrefix)
+		}
+		return mdevType, nil
+	}
+}
@@ -0,0 +1,345 @@
+package device_manager
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	config "github.com/jonkeyguan/vfio-device-plugin/pkg/config"
+)
+
+// fakeSysfs is a sysfs tree holding the devices of the non PCI buses, read through the
+// sysfs handler
+type fakeSysfs struct {
+	root string
+}
+
+// sysfsDevice is a device of a fake sysfs tree
+type sysfsDevice struct {
+	bus      string
+	address  string
+	driver   string
+	group    string
+	uevent   string
+	mdevType string
+}
+
+// useFakeSysfs points the buses and the iommu groups to a fake sysfs tree read by the
+// sysfs handler
+func useFakeSysfs(t *testing.T) *fakeSysfs {
+	sysfs := &fakeSysfs{root: t.TempDir()}
+	useDeviceHandler(t, &DeviceUtilsHandler{})
+	for name, bus := range deviceBuses {
+		previous := bus.basePath
+		bus.basePath = sysfs.devicesPath(name)
+		t.Cleanup(func() { bus.basePath = previous })
+	}
+	previous := iommuGroupsBasePath
+	iommuGroupsBasePath = filepath.Join(sysfs.root, "kernel", "iommu_groups")
+	t.Cleanup(func() { iommuGroupsBasePath = previous })
+	return sysfs
+}
+
+// devicesPath returns where the devices of a bus are, mediated devices are on the mdev bus
+func (s *fakeSysfs) devicesPath(bus string) string {
+	if bus == config.BusAP || bus == config.BusCCW {
+		bus = "mdev"
+	}
+	return filepath.Join(s.root, "bus", bus, "devices")
+}
+
+func (s *fakeSysfs) addDevice(t *testing.T, dev sysfsDevice) {
+	devicePath := filepath.Join(s.devicesPath(dev.bus), dev.address)
+	if err := os.MkdirAll(devicePath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := func(target string, name string) {
+		if err := os.MkdirAll(target, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, filepath.Join(devicePath, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dev.driver != "" {
+		link(filepath.Join(s.root, "bus", dev.bus, "drivers", dev.driver), "driver")
+	}
+	if dev.mdevType != "" {
+		link(filepath.Join(s.root, "devices", "mdev_supported_types", dev.mdevType), "mdev_type")
+	}
+	if dev.group != "" {
+		link(filepath.Join(iommuGroupsBasePath, dev.group), "iommu_group")
+		groupDevices := filepath.Join(iommuGroupsBasePath, dev.group, "devices")
+		if err := os.MkdirAll(groupDevices, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(devicePath, filepath.Join(groupDevices, dev.address)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dev.uevent != "" {
+		if err := os.WriteFile(filepath.Join(devicePath, "uevent"), []byte(dev.uevent), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBusFor(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{name: "", expected: config.BusPCI},
+		{name: config.BusPCI, expected: config.BusPCI},
+		{name: config.BusPlatform, expected: config.BusPlatform},
+		{name: config.BusAP, expected: config.BusAP},
+		{name: config.BusCCW, expected: config.BusCCW},
+		{name: "usb"},
+	}
+	for _, test := range tests {
+		bus, err := busFor(test.name)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("expected bus %q to be unknown, got %s", test.name, bus.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for bus %q: %v", test.name, err)
+			continue
+		}
+		if bus.name != test.expected {
+			t.Errorf("expected bus %q to be %s, got %s", test.name, test.expected, bus.name)
+		}
+	}
+}
+
+func TestIdentifyPlatformDevice(t *testing.T) {
+	tests := []struct {
+		name     string
+		uevent   string
+		expected string
+	}{
+		{
+			name:     "device tree device",
+			uevent:   "DRIVER=vfio-platform\nOF_NAME=ethernet\nOF_COMPATIBLE_0=calxeda,hb-xgmac\nOF_COMPATIBLE_N=1\nMODALIAS=of:NethernetT(null)Ccalxeda,hb-xgmac\n",
+			expected: "calxeda,hb-xgmac",
+		},
+		{
+			name:     "acpi device",
+			uevent:   "DRIVER=vfio-platform\nMODALIAS=acpi:AMDI8001:\n",
+			expected: "acpi:AMDI8001:",
+		},
+		{
+			name:   "unidentified device",
+			uevent: "DRIVER=vfio-platform\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sysfs := useFakeSysfs(t)
+			sysfs.addDevice(t, sysfsDevice{bus: config.BusPlatform, address: "fff51000.ethernet", uevent: test.uevent})
+
+			id, err := identifyPlatformDevice(sysfs.devicesPath(config.BusPlatform), "fff51000.ethernet")
+			if test.expected == "" {
+				if err == nil {
+					t.Errorf("expected the device not to be identified, got %s", id)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if id != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, id)
+			}
+		})
+	}
+}
+
+func TestIdentifyMdevOfType(t *testing.T) {
+	tests := []struct {
+		name     string
+		bus      string
+		mdevType string
+		valid    bool
+	}{
+		{name: "ap queue", bus: config.BusAP, mdevType: "vfio_ap-passthrough", valid: true},
+		{name: "ccw subchannel", bus: config.BusCCW, mdevType: "vfio_ccw-io", valid: true},
+		{name: "ccw subchannel on the ap bus", bus: config.BusAP, mdevType: "vfio_ccw-io"},
+		{name: "vgpu on the ccw bus", bus: config.BusCCW, mdevType: "nvidia-63"},
+		{name: "no mediated device type", bus: config.BusAP},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sysfs := useFakeSysfs(t)
+			const uuid = "669d9b23-fe1b-4ecb-be08-a2fabca99b71"
+			sysfs.addDevice(t, sysfsDevice{bus: test.bus, address: uuid, mdevType: test.mdevType})
+
+			bus, err := busFor(test.bus)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id, err := bus.identify(bus.basePath, uuid)
+			if !test.valid {
+				if err == nil {
+					t.Errorf("expected the device to be rejected, got %s", id)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if id != test.mdevType {
+				t.Errorf("expected %s, got %s", test.mdevType, id)
+			}
+		})
+	}
+}
+
+func TestProbeConfiguredDeviceOtherBuses(t *testing.T) {
+	const uuid = "669d9b23-fe1b-4ecb-be08-a2fabca99b71"
+	tests := []struct {
+		name    string
+		dev     sysfsDevice
+		id      string
+		reason  string
+		members []sysfsDevice
+	}{
+		{
+			name: "platform device",
+			dev:  sysfsDevice{bus: config.BusPlatform, address: "fff51000.ethernet", driver: "vfio-platform", group: "3", uevent: "OF_COMPATIBLE_0=calxeda,hb-xgmac\n"},
+			id:   "calxeda,hb-xgmac",
+		},
+		{
+			name:   "platform device bound to its host driver",
+			dev:    sysfsDevice{bus: config.BusPlatform, address: "fff51000.ethernet", driver: "calxedaxgmac", group: "3", uevent: "OF_COMPATIBLE_0=calxeda,hb-xgmac\n"},
+			reason: DeviceNotVfioBoundReason,
+		},
+		{
+			name: "ap queue",
+			dev:  sysfsDevice{bus: config.BusAP, address: uuid, driver: "vfio_ap_mdev", group: "0", mdevType: "vfio_ap-passthrough"},
+			id:   "vfio_ap-passthrough",
+		},
+		{
+			name: "ccw subchannel bound to the generic mdev driver",
+			dev:  sysfsDevice{bus: config.BusCCW, address: uuid, driver: "vfio_mdev", group: "1", mdevType: "vfio_ccw-io"},
+			id:   "vfio_ccw-io",
+		},
+		{
+			name:   "ccw subchannel bound to the driver of the ap bus",
+			dev:    sysfsDevice{bus: config.BusCCW, address: uuid, driver: "vfio_ap_mdev", group: "1", mdevType: "vfio_ccw-io"},
+			reason: DeviceNotVfioBoundReason,
+		},
+		{
+			name:   "mediated device of another bus",
+			dev:    sysfsDevice{bus: config.BusAP, address: uuid, driver: "vfio_mdev", group: "0", mdevType: "vfio_ccw-io"},
+			reason: DeviceDiscoveryFailedReason,
+		},
+		{
+			name:   "device without iommu group",
+			dev:    sysfsDevice{bus: config.BusAP, address: uuid, driver: "vfio_ap_mdev", mdevType: "vfio_ap-passthrough"},
+			reason: DeviceDiscoveryFailedReason,
+		},
+		{
+			name:    "platform device sharing its group with a device bound to its host driver",
+			dev:     sysfsDevice{bus: config.BusPlatform, address: "fff51000.ethernet", driver: "vfio-platform", group: "3", uevent: "OF_COMPATIBLE_0=calxeda,hb-xgmac\n"},
+			members: []sysfsDevice{{bus: config.BusPlatform, address: "fff50000.ethernet", driver: "calxedaxgmac", group: "3"}},
+			reason:  IOMMUGroupUnviableReason,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sysfs := useFakeSysfs(t)
+			sysfs.addDevice(t, test.dev)
+			for _, member := range test.members {
+				sysfs.addDevice(t, member)
+			}
+			// devices of these buses have no numa node, whatever sysfs reports
+			if err := os.WriteFile(filepath.Join(sysfs.devicesPath(test.dev.bus), test.dev.address, "numa_node"), []byte("1\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			bus, err := busFor(test.dev.bus)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dev, reason, err := probeConfiguredDevice(bus, test.dev.address)
+			if reason != test.reason {
+				t.Fatalf("expected reason %q, got %q: %v", test.reason, reason, err)
+			}
+			if dev.bus != test.dev.bus || dev.pciAddress != test.dev.address || dev.numaNode != -1 {
+				t.Errorf("unexpected device %+v", dev)
+			}
+			if test.reason != "" {
+				if err == nil {
+					t.Error("expected an error along with the reason")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if dev.pciID != test.id || dev.driver != test.dev.driver || dev.iommuGroup != test.dev.group {
+				t.Errorf("unexpected device %+v", dev)
+			}
+		})
+	}
+}
+
+const otherBusesConfig = `
+resources:
+- resourceName: example.com/xgmac
+  bus: platform
+  addresses:
+  - fff51000.ethernet
+- resourceName: example.com/crypto
+  bus: ap
+  addresses:
+  - 669d9b23-fe1b-4ecb-be08-a2fabca99b71
+- resourceName: example.com/dasd
+  bus: ccw
+  addresses:
+  - 0d5e7d4c-1a14-44c7-8fb2-3e03c1b5a3a4
+  - 7e2e6a5f-5d3b-4a57-a0b1-66c0b1b9e6e2
+`
+
+func TestDiscoverOtherBuses(t *testing.T) {
+	sysfs := useFakeSysfs(t)
+	for _, dev := range []sysfsDevice{
+		{bus: config.BusPlatform, address: "fff51000.ethernet", driver: "vfio-platform", group: "3", uevent: "OF_COMPATIBLE_0=calxeda,hb-xgmac\n"},
+		{bus: config.BusAP, address: "669d9b23-fe1b-4ecb-be08-a2fabca99b71", driver: "vfio_ap_mdev", group: "0", mdevType: "vfio_ap-passthrough"},
+		{bus: config.BusCCW, address: "0d5e7d4c-1a14-44c7-8fb2-3e03c1b5a3a4", driver: "vfio_ccw_mdev", group: "1", mdevType: "vfio_ccw-io"},
+		// an ap queue configured as a ccw subchannel
+		{bus: config.BusCCW, address: "7e2e6a5f-5d3b-4a57-a0b1-66c0b1b9e6e2", driver: "vfio_ap_mdev", group: "2", mdevType: "vfio_ap-passthrough"},
+	} {
+		sysfs.addDevice(t, dev)
+	}
+
+	c := NewDeviceController("rw", newTestConfig(t, otherBusesConfig), nil, "", nil)
+	devices, rejected, err := c.discoverConfiguredVfioDevices()
+	if err == nil {
+		t.Error("expected the misconfigured device to fail the discovery")
+	}
+
+	var discovered []string
+	for resourceName, devs := range devices {
+		for _, dev := range devs {
+			discovered = append(discovered, resourceName+" "+dev.bus+" "+dev.pciAddress+" "+dev.pciID+" group "+dev.iommuGroup)
+		}
+	}
+	sort.Strings(discovered)
+	expected := []string{
+		"example.com/crypto ap 669d9b23-fe1b-4ecb-be08-a2fabca99b71 vfio_ap-passthrough group 0",
+		"example.com/dasd ccw 0d5e7d4c-1a14-44c7-8fb2-3e03c1b5a3a4 vfio_ccw-io group 1",
+		"example.com/xgmac platform fff51000.ethernet calxeda,hb-xgmac group 3",
+	}
+	if strings.Join(discovered, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected devices:\n%s\nexpected:\n%s", strings.Join(discovered, "\n"), strings.Join(expected, "\n"))
+	}
+	if len(rejected) != 1 || rejected[0].Resource != "example.com/dasd" || rejected[0].Address != "7e2e6a5f-5d3b-4a57-a0b1-66c0b1b9e6e2" || rejected[0].Reason != DeviceDiscoveryFailedReason {
+		t.Errorf("unexpected rejected devices %+v", rejected)
+	}
+}
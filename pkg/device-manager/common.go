@@ -24,6 +24,7 @@ package device_manager
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -33,8 +34,11 @@ import (
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/jonkeyguan/vfio-device-plugin/pkg/log"
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/preflight"
 
 	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
@@ -44,19 +48,32 @@ type DeviceHandler interface {
 	GetDeviceDriver(basepath string, pciAddress string) (string, error)
 	GetDeviceNumaNode(basepath string, pciAddress string) (numaNode int)
 	GetDevicePCIID(basepath string, pciAddress string) (string, error)
+	GetIOMMUGroupDevices(basepath string, iommuGroup string) ([]string, error)
+	GetDeviceUeventValue(basepath string, address string, key string) (string, error)
+	GetDeviceMdevType(basepath string, address string) (string, error)
+	GetDeviceSysfsPath(basepath string, address string) (string, error)
+	ReadDeviceAttribute(basepath string, address string, attribute string) ([]byte, error)
+	ResetDevice(basepath string, address string) error
+	SetDeviceDriver(basepath string, address string, driver string) error
 }
 
 type DeviceUtilsHandler struct{}
 
 var Handler DeviceHandler
 
+// writeSysfsAttribute writes a sysfs attribute, the kernel acts on the write before it returns
+var writeSysfsAttribute = func(path string, data []byte) error {
+	// #nosec No risk for path injection. Writing static path of sysfs data
+	return os.WriteFile(path, data, 0200)
+}
+
 // getDeviceIOMMUGroup gets devices iommu_group
 // e.g. /sys/bus/pci/devices/0000\:65\:00.0/iommu_group -> ../../../../../kernel/iommu_groups/45
 func (h *DeviceUtilsHandler) GetDeviceIOMMUGroup(basepath string, pciAddress string) (string, error) {
 	iommuLink := filepath.Join(basepath, pciAddress, "iommu_group")
 	iommuPath, err := os.Readlink(iommuLink)
 	if err != nil {
-		log.DefaultLogger().Reason(err).Errorf("failed to read iommu_group link %s for device %s", iommuLink, pciAddress)
+		log.DefaultLogger().PCIAddress(pciAddress).Reason(err).Errorf("failed to read iommu_group link %s for device %s", iommuLink, pciAddress)
 		return "", err
 	}
 	_, iommuGroup := filepath.Split(iommuPath)
@@ -68,7 +85,7 @@ func (h *DeviceUtilsHandler) GetDeviceDriver(basepath string, pciAddress string)
 	driverLink := filepath.Join(basepath, pciAddress, "driver")
 	driverPath, err := os.Readlink(driverLink)
 	if err != nil {
-		log.DefaultLogger().Reason(err).Errorf("failed to read driver link %s for device %s", driverLink, pciAddress)
+		log.DefaultLogger().PCIAddress(pciAddress).Reason(err).Errorf("failed to read driver link %s for device %s", driverLink, pciAddress)
 		return "", err
 	}
 	_, driver := filepath.Split(driverPath)
@@ -81,21 +98,30 @@ func (h *DeviceUtilsHandler) GetDeviceNumaNode(basepath string, pciAddress strin
 	// #nosec No risk for path injection. Reading static path of NUMA node info
 	numaNodeStr, err := os.ReadFile(numaNodePath)
 	if err != nil {
-		log.DefaultLogger().Reason(err).Errorf("failed to read numa_node %s for device %s", numaNodePath, pciAddress)
+		log.DefaultLogger().PCIAddress(pciAddress).Reason(err).Errorf("failed to read numa_node %s for device %s", numaNodePath, pciAddress)
 		return
 	}
 	numaNodeStr = bytes.TrimSpace(numaNodeStr)
 	numaNode, err = strconv.Atoi(string(numaNodeStr))
 	if err != nil {
-		log.DefaultLogger().Reason(err).Errorf("failed to convert numa node value %v of device %s", numaNodeStr, pciAddress)
+		log.DefaultLogger().PCIAddress(pciAddress).Reason(err).Errorf("failed to convert numa node value %v of device %s", numaNodeStr, pciAddress)
 		return
 	}
 	return
 }
 
 func (h *DeviceUtilsHandler) GetDevicePCIID(basepath string, pciAddress string) (string, error) {
-	// #nosec No risk for path injection. Reading static path of PCI data
-	file, err := os.Open(filepath.Join(basepath, pciAddress, "uevent"))
+	pciID, err := h.GetDeviceUeventValue(basepath, pciAddress, "PCI_ID")
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(pciID), nil
+}
+
+// GetDeviceUeventValue reads the value of key from the uevent file of a device
+func (h *DeviceUtilsHandler) GetDeviceUeventValue(basepath string, address string, key string) (string, error) {
+	// #nosec No risk for path injection. Reading static path of sysfs data
+	file, err := os.Open(filepath.Join(basepath, address, "uevent"))
 	if err != nil {
 		return "", err
 	}
@@ -103,14 +129,139 @@ func (h *DeviceUtilsHandler) GetDevicePCIID(basepath string, pciAddress string)
 
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "PCI_ID") {
-			equal := strings.Index(line, "=")
-			value := strings.TrimSpace(line[equal+1:])
-			return strings.ToLower(value), nil
+		name, value, found := strings.Cut(scanner.Text(), "=")
+		if found && name == key {
+			return strings.TrimSpace(value), nil
 		}
 	}
-	return "", fmt.Errorf("no pci_id is found")
+	return "", fmt.Errorf("no %s is found", strings.ToLower(key))
+}
+
+// GetDeviceMdevType gets the type of a mediated device
+// e.g. /sys/bus/mdev/devices/<uuid>/mdev_type -> ../../matrix/mdev_supported_types/vfio_ap-passthrough
+func (h *DeviceUtilsHandler) GetDeviceMdevType(basepath string, address string) (string, error) {
+	typePath, err := os.Readlink(filepath.Join(basepath, address, "mdev_type"))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(typePath), nil
+}
+
+// GetIOMMUGroupDevices lists the addresses of all devices sharing an iommu group
+// e.g. /sys/kernel/iommu_groups/45/devices/0000:65:00.0
+func (h *DeviceUtilsHandler) GetIOMMUGroupDevices(basepath string, iommuGroup string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(basepath, iommuGroup, "devices"))
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		addresses = append(addresses, entry.Name())
+	}
+	return addresses, nil
+}
+
+// GetDeviceSysfsPath resolves the device link to its location in the device hierarchy
+// e.g. /sys/bus/pci/devices/0000:3b:00.0 -> /sys/devices/pci0000:3a/0000:3a:00.0/0000:3b:00.0
+func (h *DeviceUtilsHandler) GetDeviceSysfsPath(basepath string, address string) (string, error) {
+	return filepath.EvalSymlinks(filepath.Join(basepath, address))
+}
+
+// ResetDevice resets a PCI device through sysfs, the kernel picks the reset method,
+// a function level reset when the device supports it
+func (h *DeviceUtilsHandler) ResetDevice(basepath string, address string) error {
+	return writeSysfsAttribute(filepath.Join(basepath, address, "reset"), []byte("1"))
+}
+
+// SetDeviceDriver rebinds a PCI device to driver through its driver_override. The override
+// is kept for vfio drivers so that a rescan doesn't hand the device back to its host driver.
+// An empty driver leaves the device unbound with its override cleared.
+func (h *DeviceUtilsHandler) SetDeviceDriver(basepath string, address string, driver string) error {
+	devicePath := filepath.Join(basepath, address)
+	clearOverride := func() error {
+		// an empty override is written as a newline
+		if err := writeSysfsAttribute(filepath.Join(devicePath, "driver_override"), []byte("\n")); err != nil {
+			return fmt.Errorf("failed to clear the driver override of device %s: %v", address, err)
+		}
+		return nil
+	}
+	if _, err := os.Lstat(filepath.Join(devicePath, "driver")); err == nil {
+		if err := writeSysfsAttribute(filepath.Join(devicePath, "driver", "unbind"), []byte(address)); err != nil {
+			return fmt.Errorf("failed to unbind device %s: %v", address, err)
+		}
+	}
+	if driver == "" {
+		if err := clearOverride(); err != nil {
+			return err
+		}
+		if current, err := boundDriver(devicePath); err != nil || current != "" {
+			return fmt.Errorf("device %s is still bound to %s: %v", address, current, err)
+		}
+		return nil
+	}
+	if err := writeSysfsAttribute(filepath.Join(devicePath, "driver_override"), []byte(driver)); err != nil {
+		return fmt.Errorf("failed to set the driver override of device %s: %v", address, err)
+	}
+	if err := writeSysfsAttribute(filepath.Join(filepath.Dir(basepath), "drivers_probe"), []byte(address)); err != nil {
+		return fmt.Errorf("failed to probe device %s: %v", address, err)
+	}
+	if !strings.HasPrefix(driver, "vfio") {
+		if err := clearOverride(); err != nil {
+			return err
+		}
+	}
+
+	current, err := h.GetDeviceDriver(basepath, address)
+	if err != nil {
+		return fmt.Errorf("device %s is not bound to %s: %v", address, driver, err)
+	}
+	if current != driver {
+		return fmt.Errorf("device %s is bound to %s instead of %s", address, current, driver)
+	}
+	return nil
+}
+
+// ReadDeviceAttribute reads a sysfs attribute of a device, e.g. config or aer_dev_fatal
+func (h *DeviceUtilsHandler) ReadDeviceAttribute(basepath string, address string, attribute string) ([]byte, error) {
+	// #nosec No risk for path injection. Reading static path of sysfs data
+	return os.ReadFile(filepath.Join(basepath, address, attribute))
+}
+
+// checkIOMMUGroupViable verifies that every device of an iommu group is either unbound
+// or bound to a driver which vfio accepts, otherwise the group can't be used by a guest
+func checkIOMMUGroupViable(iommuGroup string) error {
+	addresses, err := Handler.GetIOMMUGroupDevices(iommuGroupsBasePath, iommuGroup)
+	if err != nil {
+		return fmt.Errorf("failed to list devices of iommu group %s: %v", iommuGroup, err)
+	}
+	// the group links to its devices whatever their bus
+	groupDevicesPath := filepath.Join(iommuGroupsBasePath, iommuGroup, "devices")
+	for _, address := range addresses {
+		driver, err := boundDriver(filepath.Join(groupDevicesPath, address))
+		if err != nil {
+			return fmt.Errorf("failed to read the driver of device %s: %v", address, err)
+		}
+		if driver == "" {
+			continue
+		}
+		if _, allowed := preflight.VfioViableDrivers[driver]; !allowed {
+			return fmt.Errorf("device %s of iommu group %s is bound to %s", address, iommuGroup, driver)
+		}
+	}
+	return nil
+}
+
+// boundDriver returns the driver a device is bound to, empty when it is unbound, which is
+// the usual case of the other devices of an iommu group and not worth logging
+func boundDriver(devicePath string) (string, error) {
+	driverPath, err := os.Readlink(filepath.Join(devicePath, "driver"))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(driverPath), nil
 }
 
 func initHandler() {
@@ -147,7 +298,12 @@ func gRPCConnect(socketPath string, timeout time.Duration) (*grpc.ClientConn, er
 }
 
 func SocketPath(deviceName string) string {
-	return filepath.Join(v1beta1.DevicePluginPath, fmt.Sprintf("kubevirt-%s.sock", deviceName))
+	return filepath.Join(devicePluginPath, socketPrefix+deviceName+".sock")
+}
+
+// errShuttingDown is returned to kubelet for allocations received during shutdown
+func errShuttingDown(resourceName string) error {
+	return status.Errorf(codes.Unavailable, "%s device plugin is shutting down", resourceName)
 }
 
 func IsChanClosed(ch <-chan struct{}) bool {
@@ -181,4 +337,5 @@ func formatVFIODeviceSpecs(devID string) []*v1beta1.DeviceSpec {
 type deviceHealth struct {
 	DevId  string
 	Health string
+	Reason string
 }
@@ -0,0 +1,172 @@
+package device_manager
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeKernel acts on the sysfs attribute writes to a tree of PCI devices below root, as the
+// kernel does for the devices in root/devices and the drivers in root/drivers
+type fakeKernel struct {
+	root string
+	// drivers are the loaded drivers, probing a device binds it to its override if loaded
+	drivers map[string]bool
+	// writes are the attribute writes in order, e.g. nvidia/unbind="0000:01:00.0"
+	writes []string
+}
+
+func useFakeKernel(t *testing.T, drivers ...string) *fakeKernel {
+	k := &fakeKernel{root: t.TempDir(), drivers: make(map[string]bool)}
+	for _, driver := range drivers {
+		k.drivers[driver] = true
+	}
+	previous := writeSysfsAttribute
+	writeSysfsAttribute = k.write
+	t.Cleanup(func() { writeSysfsAttribute = previous })
+	return k
+}
+
+func (k *fakeKernel) basePath() string {
+	return filepath.Join(k.root, "devices")
+}
+
+func (k *fakeKernel) write(path string, data []byte) error {
+	name := filepath.Base(path)
+	switch name {
+	case "unbind":
+		driverLink := filepath.Dir(path)
+		driverPath, err := os.Readlink(driverLink)
+		if err != nil {
+			return err
+		}
+		name = filepath.Base(driverPath) + "/unbind"
+		if err := os.Remove(driverLink); err != nil {
+			return err
+		}
+	case "drivers_probe":
+		devicePath := filepath.Join(k.basePath(), string(data))
+		override, err := os.ReadFile(filepath.Join(devicePath, "driver_override"))
+		if err != nil {
+			return err
+		}
+		driver := strings.TrimSpace(string(override))
+		if _, err := os.Lstat(filepath.Join(devicePath, "driver")); err != nil && k.drivers[driver] {
+			if err := os.Symlink(filepath.Join("..", "..", "drivers", driver), filepath.Join(devicePath, "driver")); err != nil {
+				return err
+			}
+		}
+	default:
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return err
+		}
+	}
+	k.writes = append(k.writes, fmt.Sprintf("%s=%q", name, data))
+	return nil
+}
+
+func TestSetDeviceDriver(t *testing.T) {
+	const address = "0000:01:00.0"
+	tests := []struct {
+		name     string
+		bound    string
+		override string
+		driver   string
+		loaded   []string
+		writes   []string
+		// expectedOverride is the driver_override left on the device
+		expectedOverride string
+		expectedErr      string
+	}{
+		{
+			name:             "bind to vfio-pci",
+			bound:            "nvidia",
+			driver:           "vfio-pci",
+			loaded:           []string{"nvidia", "vfio-pci"},
+			writes:           []string{`nvidia/unbind="0000:01:00.0"`, `driver_override="vfio-pci"`, `drivers_probe="0000:01:00.0"`},
+			expectedOverride: "vfio-pci",
+		},
+		{
+			name:             "bind an unbound device to vfio-pci",
+			driver:           "vfio-pci",
+			loaded:           []string{"vfio-pci"},
+			writes:           []string{`driver_override="vfio-pci"`, `drivers_probe="0000:01:00.0"`},
+			expectedOverride: "vfio-pci",
+		},
+		{
+			name:     "restore the host driver",
+			bound:    "vfio-pci",
+			override: "vfio-pci",
+			driver:   "nvidia",
+			loaded:   []string{"nvidia", "vfio-pci"},
+			writes: []string{`vfio-pci/unbind="0000:01:00.0"`, `driver_override="nvidia"`, `drivers_probe="0000:01:00.0"`,
+				`driver_override="\n"`},
+			expectedOverride: "\n",
+		},
+		{
+			name:             "leave the device unbound",
+			bound:            "vfio-pci",
+			override:         "vfio-pci",
+			driver:           "",
+			loaded:           []string{"vfio-pci"},
+			writes:           []string{`vfio-pci/unbind="0000:01:00.0"`, `driver_override="\n"`},
+			expectedOverride: "\n",
+		},
+		{
+			name:             "vfio-pci not loaded",
+			bound:            "nvidia",
+			driver:           "vfio-pci",
+			loaded:           []string{"nvidia"},
+			writes:           []string{`nvidia/unbind="0000:01:00.0"`, `driver_override="vfio-pci"`, `drivers_probe="0000:01:00.0"`},
+			expectedOverride: "vfio-pci",
+			expectedErr:      "device 0000:01:00.0 is not bound to vfio-pci",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			k := useFakeKernel(t, test.loaded...)
+			devicePath := filepath.Join(k.basePath(), address)
+			writeSysfsDevice(t, devicePath, test.bound)
+			if err := os.WriteFile(filepath.Join(devicePath, "driver_override"), []byte(test.override+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			handler := &DeviceUtilsHandler{}
+			err := handler.SetDeviceDriver(k.basePath(), address, test.driver)
+			if test.expectedErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.expectedErr != "" && (err == nil || !strings.HasPrefix(err.Error(), test.expectedErr)) {
+				t.Fatalf("expected error %q, got %v", test.expectedErr, err)
+			}
+			if strings.Join(k.writes, " ") != strings.Join(test.writes, " ") {
+				t.Errorf("expected writes %v, got %v", test.writes, k.writes)
+			}
+			override, _ := os.ReadFile(filepath.Join(devicePath, "driver_override"))
+			if string(override) != test.expectedOverride {
+				t.Errorf("expected driver_override %q, got %q", test.expectedOverride, override)
+			}
+			if test.expectedErr != "" {
+				return
+			}
+			if driver, _ := boundDriver(devicePath); driver != test.driver {
+				t.Errorf("expected the device to be bound to %q, got %q", test.driver, driver)
+			}
+		})
+	}
+}
+
+func TestResetDevice(t *testing.T) {
+	k := useFakeKernel(t)
+	writeSysfsDevice(t, filepath.Join(k.basePath(), "0000:01:00.0"), "vfio-pci")
+
+	handler := &DeviceUtilsHandler{}
+	if err := handler.ResetDevice(k.basePath(), "0000:01:00.0"); err != nil {
+		t.Fatalf("failed to reset the device: %v", err)
+	}
+	if len(k.writes) != 1 || k.writes[0] != `reset="1"` {
+		t.Errorf("expected a single reset write, got %v", k.writes)
+	}
+}
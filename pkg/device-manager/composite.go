@@ -0,0 +1,397 @@
+package device_manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	config "github.com/jonkeyguan/vfio-device-plugin/pkg/config"
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/log"
+)
+
+// CompositeResourcePrefix prefixes the env var describing the allocated bundles as JSON
+const CompositeResourcePrefix = "COMPOSITE_RESOURCE"
+
+// compositeBundle is the description of an allocated bundle passed to the container
+type compositeBundle struct {
+	ID      string            `json:"id"`
+	Devices []compositeMember `json:"devices"`
+}
+
+type compositeMember struct {
+	Address    string `json:"address"`
+	PCIID      string `json:"pciId"`
+	IOMMUGroup string `json:"iommuGroup"`
+	NUMANode   int    `json:"numaNode"`
+	LocalCPUs  string `json:"localCpus,omitempty"`
+}
+
+func newCompositeBundle(devID string, members []*PCIDevice) compositeBundle {
+	bundle := compositeBundle{ID: devID}
+	for _, member := range members {
+		bundle.Devices = append(bundle.Devices, compositeMember{
+			Address:    member.pciAddress,
+			PCIID:      member.pciID,
+			IOMMUGroup: member.iommuGroup,
+			NUMANode:   member.numaNode,
+			LocalCPUs:  member.localCPUs,
+		})
+	}
+	return bundle
+}
+
+func formatCompositeBundles(bundles []compositeBundle) string {
+	if bundles == nil {
+		bundles = []compositeBundle{}
+	}
+	// encoding plain strings can't fail
+	data, _ := json.Marshal(bundles)
+	return string(data)
+}
+
+// bundleID identifies a bundle by the iommu groups of its devices, e.g. 45-46
+func bundleID(bundle []*PCIDevice) string {
+	return strings.Join(bundleGroups(bundle), "-")
+}
+
+// bundleGroups returns the distinct iommu groups of a bundle in device order
+func bundleGroups(bundle []*PCIDevice) []string {
+	var groups []string
+	seen := make(map[string]struct{})
+	for _, member := range bundle {
+		if _, exists := seen[member.iommuGroup]; exists {
+			continue
+		}
+		seen[member.iommuGroup] = struct{}{}
+		groups = append(groups, member.iommuGroup)
+	}
+	return groups
+}
+
+// claimBundleGroups records the iommu groups of a bundle in usedGroups. An iommu group can
+// only be handed to a single guest, so it fails when another bundle claimed one of them.
+func claimBundleGroups(bundle []*PCIDevice, usedGroups map[string]struct{}) error {
+	groups := bundleGroups(bundle)
+	for _, group := range groups {
+		if _, used := usedGroups[group]; used {
+			return fmt.Errorf("bundle %s shares iommu group %s with another bundle", bundleID(bundle), group)
+		}
+	}
+	for _, group := range groups {
+		usedGroups[group] = struct{}{}
+	}
+	return nil
+}
+
+// discoverComposites returns the bundles of every composite resource keyed by resource name,
+// the devices of the rejected bundles and an error if any listed bundle fails during discovery
+func (c *DeviceController) discoverComposites() (map[string][][]*PCIDevice, []DiscoveryResult, error) {
+	initHandler()
+
+	logger := log.DefaultLogger()
+	bus, _ := busFor(config.BusPCI)
+
+	// devices of plain resources and listed bundles are never picked by a topology rule, nor
+	// the other devices of their iommu groups since a group is handed to a guest as a whole
+	claimed := make(map[string]struct{})
+	claimedGroups := make(map[string]struct{})
+	claim := func(basePath string, address string) {
+		claimed[address] = struct{}{}
+		if group, err := Handler.GetDeviceIOMMUGroup(basePath, address); err == nil {
+			claimedGroups[group] = struct{}{}
+		}
+	}
+	resourceBuses := c.buildResourceBusMap()
+	for address, resourceNames := range c.buildConfiguredDeviceMap() {
+		for _, resourceName := range resourceNames {
+			basePath := pciBasePath
+			if resourceBus, err := busFor(resourceBuses[resourceName]); err == nil {
+				basePath = resourceBus.basePath
+			}
+			claim(basePath, address)
+		}
+	}
+	for _, composite := range c.config().GetComposites() {
+		for _, bundle := range composite.Bundles {
+			for _, address := range bundle {
+				claim(bus.basePath, address)
+			}
+		}
+	}
+
+	compositeBundles := make(map[string][][]*PCIDevice)
+	var rejected []DiscoveryResult
+	var hadErrors bool
+	for _, composite := range c.config().GetComposites() {
+		if composite.Topology != nil {
+			bundles := buildTopologyBundles(bus, composite.Topology, claimed, claimedGroups)
+			logger.Resource(composite.Name).Infof("Topology rule of composite resource %s built %d bundles", composite.Name, len(bundles))
+			compositeBundles[composite.Name] = bundles
+			continue
+		}
+
+		usedGroups := make(map[string]struct{})
+		for _, addresses := range composite.Bundles {
+			bundle, bundleRejected, err := probeBundle(composite.Name, bus, addresses)
+			if err != nil {
+				logger.Resource(composite.Name).Reason(err).Errorf("failed to discover bundle %v of resource %s", addresses, composite.Name)
+				c.discoveryFailed(composite.Name, DeviceDiscoveryFailedReason, "bundle %v of resource %s: %v", addresses, composite.Name, err)
+				rejected = append(rejected, bundleRejected...)
+				hadErrors = true
+				continue
+			}
+			if err := claimBundleGroups(bundle, usedGroups); err != nil {
+				logger.Resource(composite.Name).Warningf("skipping bundle %v of resource %s: %v", addresses, composite.Name, err)
+				for _, pcidev := range bundle {
+					rejected = append(rejected, rejectedDevice(composite.Name, pcidev, IOMMUGroupUnviableReason, err))
+				}
+				continue
+			}
+			compositeBundles[composite.Name] = append(compositeBundles[composite.Name], bundle)
+		}
+	}
+
+	if hadErrors {
+		return compositeBundles, rejected, fmt.Errorf("some bundles failed during discovery, check logs for details")
+	}
+	return compositeBundles, rejected, nil
+}
+
+// probeBundle probes every device of a listed bundle, the bundle is rejected if any device
+// is. Every device of a rejected bundle is reported, along with the first error.
+func probeBundle(resourceName string, bus *deviceBus, addresses []string) ([]*PCIDevice, []DiscoveryResult, error) {
+	var bundle []*PCIDevice
+	var bundleErr error
+	var failed []DiscoveryResult
+	for _, address := range addresses {
+		pcidev, reason, err := probeConfiguredDevice(bus, address)
+		bundle = append(bundle, pcidev)
+		if err != nil {
+			failed = append(failed, rejectedDevice(resourceName, pcidev, reason, err))
+			if bundleErr == nil {
+				bundleErr = fmt.Errorf("device %s: %v", address, err)
+			}
+		}
+	}
+	if bundleErr == nil {
+		return bundle, nil, nil
+	}
+
+	var rejected []DiscoveryResult
+	for _, pcidev := range bundle {
+		result := rejectedDevice(resourceName, pcidev, DeviceDiscoveryFailedReason, fmt.Errorf("bundle rejected, %v", bundleErr))
+		for _, failure := range failed {
+			if failure.Address == pcidev.pciAddress {
+				result = failure
+			}
+		}
+		rejected = append(rejected, result)
+	}
+	return nil, rejected, bundleErr
+}
+
+// buildTopologyBundles bundles one unclaimed vfio device of each member ID found within the
+// same scope. Devices are picked in address order and claimed as they are bundled, along
+// with their iommu groups: the devices of a group may only end up in the same bundle.
+func buildTopologyBundles(bus *deviceBus, rule *config.TopologyRule, claimed map[string]struct{}, claimedGroups map[string]struct{}) [][]*PCIDevice {
+	logger := log.DefaultLogger()
+
+	memberIDs := make(map[string]struct{})
+	for _, member := range rule.Members {
+		memberIDs[member] = struct{}{}
+	}
+
+	entries, err := os.ReadDir(bus.basePath)
+	if err != nil {
+		logger.Reason(err).Errorf("failed to list %s devices", bus.name)
+		return nil
+	}
+
+	// candidates maps every scope to the candidate devices of each member ID
+	candidates := make(map[string]map[string][]*PCIDevice)
+	for _, entry := range entries {
+		address := entry.Name()
+		if _, isClaimed := claimed[address]; isClaimed {
+			continue
+		}
+		pciID, err := Handler.GetDevicePCIID(bus.basePath, address)
+		if err != nil {
+			continue
+		}
+		if _, isMember := memberIDs[pciID]; !isMember {
+			continue
+		}
+		pcidev, _, err := probeConfiguredDevice(bus, address)
+		if err != nil {
+			logger.V(2).Infof("skipping device %s for topology bundles: %v", address, err)
+			continue
+		}
+		if _, isClaimed := claimedGroups[pcidev.iommuGroup]; isClaimed {
+			logger.V(2).Infof("skipping device %s for topology bundles: iommu group %s is claimed by another resource", address, pcidev.iommuGroup)
+			continue
+		}
+		scope, err := topologyScope(bus, pcidev, rule.Scope)
+		if err != nil {
+			logger.V(2).Infof("skipping device %s for topology bundles: %v", address, err)
+			continue
+		}
+		if candidates[scope] == nil {
+			candidates[scope] = make(map[string][]*PCIDevice)
+		}
+		candidates[scope][pciID] = append(candidates[scope][pciID], pcidev)
+	}
+
+	scopes := make([]string, 0, len(candidates))
+	for scope := range candidates {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+
+	var bundles [][]*PCIDevice
+	for _, scope := range scopes {
+		devices := candidates[scope]
+		for _, pciDevices := range devices {
+			sort.Slice(pciDevices, func(i, j int) bool {
+				return pciDevices[i].pciAddress < pciDevices[j].pciAddress
+			})
+		}
+		for {
+			var bundle []*PCIDevice
+			for _, member := range rule.Members {
+				// devices whose group went to a previous bundle are dropped
+				for len(devices[member]) > 0 {
+					if _, isClaimed := claimedGroups[devices[member][0].iommuGroup]; !isClaimed {
+						break
+					}
+					devices[member] = devices[member][1:]
+				}
+				if len(devices[member]) == 0 {
+					bundle = nil
+					break
+				}
+				bundle = append(bundle, devices[member][0])
+				devices[member] = devices[member][1:]
+			}
+			if bundle == nil {
+				break
+			}
+			for _, pcidev := range bundle {
+				claimed[pcidev.pciAddress] = struct{}{}
+				claimedGroups[pcidev.iommuGroup] = struct{}{}
+			}
+			bundles = append(bundles, bundle)
+		}
+	}
+	return bundles
+}
+
+// topologyScope returns the key shared by the devices which may be bundled together
+func topologyScope(bus *deviceBus, pcidev *PCIDevice, scope string) (string, error) {
+	switch scope {
+	case config.TopologyScopeSlot:
+		// domain:bus:device, without the function
+		dot := strings.LastIndex(pcidev.pciAddress, ".")
+		if dot < 0 {
+			return "", fmt.Errorf("address %s has no function", pcidev.pciAddress)
+		}
+		return pcidev.pciAddress[:dot], nil
+	case config.TopologyScopeNUMA:
+		if pcidev.numaNode < 0 {
+			return "", fmt.Errorf("NUMA node is unknown")
+		}
+		return strconv.Itoa(pcidev.numaNode), nil
+	case config.TopologyScopeSwitch:
+		return switchScope(bus, pcidev)
+	default:
+		return "", fmt.Errorf("unknown topology scope %q", scope)
+	}
+}
+
+// PCI Express port types, from the capabilities register of the PCI Express capability
+const (
+	pcieTypeRootPort       = 0x4
+	pcieTypeUpstreamPort   = 0x5
+	pcieTypeDownstreamPort = 0x6
+	pcieTypePCIBridge      = 0x7
+)
+
+var pciAddressPattern = regexp.MustCompile(`^[0-9a-f]{4}:[0-9a-f]{2}:[0-9a-f]{2}\.[0-7]$`)
+
+// switchScope returns the upstream port of the PCIe switch a device sits behind. The
+// bridges between the device and the switch downstream port are walked up, a device
+// attached to a root port or to the root complex isn't behind a switch.
+func switchScope(bus *deviceBus, pcidev *PCIDevice) (string, error) {
+	if busName(bus.name) != config.BusPCI {
+		return "", fmt.Errorf("%s devices don't sit behind a PCIe switch", bus.name)
+	}
+	sysfsPath, err := Handler.GetDeviceSysfsPath(bus.basePath, pcidev.pciAddress)
+	if err != nil {
+		return "", err
+	}
+	for port := filepath.Dir(sysfsPath); pciAddressPattern.MatchString(filepath.Base(port)); port = filepath.Dir(port) {
+		portType, err := pciePortType(bus.basePath, filepath.Base(port))
+		if err != nil {
+			return "", err
+		}
+		switch portType {
+		case pcieTypeDownstreamPort:
+			return filepath.Dir(port), nil
+		case pcieTypeRootPort, pcieTypeUpstreamPort:
+			return "", fmt.Errorf("device %s is attached to port %s, not to a PCIe switch", pcidev.pciAddress, filepath.Base(port))
+		}
+		// conventional PCI and PCIe to PCI bridges below the switch
+	}
+	return "", fmt.Errorf("device %s is not behind a PCIe switch", pcidev.pciAddress)
+}
+
+// pciePortType reads the port type of a PCI bridge from its PCI Express capability,
+// a conventional PCI bridge has none and reports -1
+func pciePortType(basePath string, address string) (int, error) {
+	data, err := Handler.ReadDeviceAttribute(basePath, address, "config")
+	if err != nil {
+		return -1, fmt.Errorf("failed to read the config space of %s: %v", address, err)
+	}
+	if len(data) < 0x40 || data[0x06]&0x10 == 0 {
+		// no capabilities list
+		return -1, nil
+	}
+	// the list is bounded in case the config space is corrupted
+	offset := int(data[0x34] & 0xfc)
+	for i := 0; i < 48 && offset >= 0x40 && offset+4 <= len(data); i++ {
+		if data[offset] == 0x10 {
+			return int(data[offset+2]>>4) & 0xf, nil
+		}
+		offset = int(data[offset+1] & 0xfc)
+	}
+	return -1, nil
+}
+
+func (c *DeviceController) buildCompositePlugins(compositeBundles map[string][][]*PCIDevice) []Device {
+	var devices []Device
+	releaseActions := make(map[string]*config.ReleaseAction)
+	envs := make(map[string]*config.Env)
+	for _, composite := range c.config().GetComposites() {
+		releaseActions[composite.Name] = composite.ReleaseAction
+		envs[composite.Name] = composite.Env
+	}
+	for compositeName, bundles := range compositeBundles {
+		log.DefaultLogger().Resource(compositeName).Infof("Discovered %d bundles on the node for the resource: %s", len(bundles), compositeName)
+		plugin := NewCompositeDevicePlugin(bundles, compositeName)
+		plugin.shutdownTimeout = c.shutdownTimeout
+		plugin.auditor = c.auditor
+		plugin.healthCheckers = healthCheckersFor(c.checkerRules(), compositeName, plugin.deviceMembers)
+		plugin.releaseAction = releaseActions[compositeName]
+		plugin.setEnv(envs[compositeName])
+		resourceName := compositeName
+		plugin.onHealthChange = func(devID string, health string, reason string) {
+			c.setDeviceHealth(resourceName, devID, health, reason)
+		}
+		devices = append(devices, plugin)
+	}
+	return devices
+}
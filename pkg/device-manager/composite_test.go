@@ -0,0 +1,200 @@
+package device_manager
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	config "github.com/jonkeyguan/vfio-device-plugin/pkg/config"
+)
+
+// bridgeConfig returns the config space of a PCI bridge, with a PCI Express capability of
+// portType behind a power management one, or without capabilities when portType is negative
+func bridgeConfig(portType int) []byte {
+	data := make([]byte, 256)
+	if portType < 0 {
+		return data[:64]
+	}
+	data[0x06] = 0x10
+	data[0x34] = 0x40
+	data[0x40] = 0x01
+	data[0x41] = 0x50
+	data[0x50] = 0x10
+	data[0x52] = byte(portType << 4)
+	return data
+}
+
+func TestSwitchScope(t *testing.T) {
+	const (
+		rootComplex = "/sys/devices/pci0000:00"
+		rootPort    = rootComplex + "/0000:00:01.0"
+		upstream    = rootPort + "/0000:01:00.0"
+	)
+	handler := &fakeDeviceHandler{devices: map[string]*fakeDevice{
+		"0000:00:01.0": {config: bridgeConfig(pcieTypeRootPort), sysfsPath: rootPort},
+		"0000:01:00.0": {config: bridgeConfig(pcieTypeUpstreamPort), sysfsPath: upstream},
+		"0000:02:00.0": {config: bridgeConfig(pcieTypeDownstreamPort), sysfsPath: upstream + "/0000:02:00.0"},
+		"0000:02:01.0": {config: bridgeConfig(pcieTypeDownstreamPort), sysfsPath: upstream + "/0000:02:01.0"},
+		"0000:04:00.0": {config: bridgeConfig(pcieTypePCIBridge), sysfsPath: upstream + "/0000:02:01.0/0000:04:00.0"},
+		"0000:05:00.0": {config: bridgeConfig(-1), sysfsPath: upstream + "/0000:02:01.0/0000:04:00.0/0000:05:00.0"},
+		"0000:00:02.0": {config: bridgeConfig(pcieTypeRootPort), sysfsPath: rootComplex + "/0000:00:02.0"},
+
+		"0000:03:00.0": {sysfsPath: upstream + "/0000:02:00.0/0000:03:00.0"},
+		"0000:06:00.0": {sysfsPath: upstream + "/0000:02:01.0/0000:04:00.0/0000:05:00.0/0000:06:00.0"},
+		"0000:07:00.0": {sysfsPath: rootComplex + "/0000:00:02.0/0000:07:00.0"},
+		"0000:00:1f.0": {sysfsPath: rootComplex + "/0000:00:1f.0"},
+	}}
+	useDeviceHandler(t, handler)
+
+	tests := []struct {
+		name        string
+		address     string
+		expected    string
+		expectedErr string
+	}{
+		{
+			name:     "behind a switch downstream port",
+			address:  "0000:03:00.0",
+			expected: upstream,
+		},
+		{
+			name:     "behind bridges below a switch downstream port",
+			address:  "0000:06:00.0",
+			expected: upstream,
+		},
+		{
+			name:        "attached to a root port",
+			address:     "0000:07:00.0",
+			expectedErr: "device 0000:07:00.0 is attached to port 0000:00:02.0, not to a PCIe switch",
+		},
+		{
+			name:        "integrated in the root complex",
+			address:     "0000:00:1f.0",
+			expectedErr: "device 0000:00:1f.0 is not behind a PCIe switch",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pcidev := &PCIDevice{pciAddress: test.address, numaNode: -1}
+			scope, err := topologyScope(deviceBuses[config.BusPCI], pcidev, config.TopologyScopeSwitch)
+			if test.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+					t.Fatalf("expected error %q, got scope %q and error %v", test.expectedErr, scope, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if scope != test.expected {
+				t.Errorf("expected scope %s, got %s", test.expected, scope)
+			}
+		})
+	}
+}
+
+// usePCIBus lists the devices of the fake handler in the PCI bus directory for the test
+func usePCIBus(t *testing.T, handler *fakeDeviceHandler) {
+	bus := deviceBuses[config.BusPCI]
+	dir := t.TempDir()
+	for address := range handler.devices {
+		if err := os.Mkdir(filepath.Join(dir, address), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	previous := bus.basePath
+	bus.basePath = dir
+	t.Cleanup(func() { bus.basePath = previous })
+}
+
+func TestTopologyBundlesSkipClaimedGroups(t *testing.T) {
+	nics := map[string]*fakeDevice{
+		"0000:03:00.0": {pciID: "15b3:101d", driver: vfioPCIDriver, iommuGroup: "14"},
+		"0000:03:00.1": {pciID: "15b3:101d", driver: vfioPCIDriver, iommuGroup: "14"},
+		"0000:04:00.0": {pciID: "15b3:101d", driver: vfioPCIDriver, iommuGroup: "15"},
+		"0000:06:00.0": {pciID: "10de:20b0", driver: vfioPCIDriver, iommuGroup: "18"},
+		"0000:07:00.0": {pciID: "10de:20b0", driver: vfioPCIDriver, iommuGroup: "19"},
+	}
+	tests := []struct {
+		name     string
+		config   string
+		devices  map[string]*fakeDevice
+		expected []string
+	}{
+		{
+			name: "group of a device advertised by a plain resource",
+			config: `
+resources:
+- resourceName: example.com/gpu
+  addresses: [0000:01:00.0]
+composites:
+- resourceName: example.com/functions
+  topology:
+    members: [10de:10f8, 10de:1ad8]
+    scope: slot
+`,
+			devices: map[string]*fakeDevice{
+				"0000:01:00.0": {pciID: "10de:1eb8", driver: vfioPCIDriver, iommuGroup: "12"},
+				"0000:01:00.1": {pciID: "10de:10f8", driver: vfioPCIDriver, iommuGroup: "12"},
+				"0000:01:00.2": {pciID: "10de:1ad8", driver: vfioPCIDriver, iommuGroup: "16"},
+				"0000:02:00.1": {pciID: "10de:10f8", driver: vfioPCIDriver, iommuGroup: "13"},
+				"0000:02:00.2": {pciID: "10de:1ad8", driver: vfioPCIDriver, iommuGroup: "17"},
+			},
+			expected: []string{"13-17"},
+		},
+		{
+			name: "group of a listed bundle",
+			config: `
+composites:
+- resourceName: example.com/listed
+  bundles:
+  - [0000:03:00.0]
+- resourceName: example.com/nic
+  topology:
+    members: [15b3:101d, 10de:20b0]
+    scope: numa
+`,
+			devices:  nics,
+			expected: []string{"15-18"},
+		},
+		{
+			name: "group of a previous bundle",
+			config: `
+composites:
+- resourceName: example.com/nic
+  topology:
+    members: [15b3:101d, 10de:20b0]
+    scope: numa
+`,
+			devices:  nics,
+			expected: []string{"14-18", "15-19"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := &fakeDeviceHandler{devices: test.devices}
+			useDeviceHandler(t, handler)
+			useIOMMUGroups(t, handler)
+			usePCIBus(t, handler)
+
+			c := NewDeviceController("rw", newTestConfig(t, test.config), nil, "", nil)
+			compositeBundles, _, err := c.discoverComposites()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var bundles []string
+			for _, composite := range c.config().GetComposites() {
+				if composite.Topology == nil {
+					continue
+				}
+				for _, bundle := range compositeBundles[composite.Name] {
+					bundles = append(bundles, bundleID(bundle))
+				}
+			}
+			if strings.Join(bundles, ",") != strings.Join(test.expected, ",") {
+				t.Errorf("expected bundles %v, got %v", test.expected, bundles)
+			}
+		})
+	}
+}
@@ -2,18 +2,63 @@ package device_manager
 
 import (
 	"math"
+	"sync"
 	"time"
 
 	"github.com/jonkeyguan/vfio-device-plugin/pkg/log"
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/metrics"
 )
 
 var defaultBackoffTime = []time.Duration{1 * time.Second, 2 * time.Second, 5 * time.Second, 10 * time.Second}
 
+// Lifecycle states of a controlled device plugin
+const (
+	// PluginStateStarting is the start of the gRPC server of the plugin
+	PluginStateStarting = "starting"
+	// PluginStateRegistering is the registration of the plugin with kubelet
+	PluginStateRegistering = "registering"
+	// PluginStateServing is a plugin registered with kubelet and serving it
+	PluginStateServing = "serving"
+	// PluginStateBackoff is a plugin which exited and waits to be started again
+	PluginStateBackoff = "backoff"
+	// PluginStateStopped is a plugin which isn't running
+	PluginStateStopped = "stopped"
+)
+
+var pluginStates = []string{PluginStateStarting, PluginStateRegistering, PluginStateServing, PluginStateBackoff, PluginStateStopped}
+
+// errorHistorySize is the number of start errors kept per device plugin
+const errorHistorySize = 10
+
+type pluginError struct {
+	time time.Time
+	err  error
+}
+
 type controlledDevice struct {
 	devicePlugin Device
 	started      bool
 	stopChan     chan struct{}
+	doneChan     chan struct{}
 	backoff      []time.Duration
+	// stopTimeout bounds how long Stop waits for the device plugin to shut down
+	stopTimeout time.Duration
+	// consecutiveFailures counts the failed starts since the last clean exit of the plugin
+	consecutiveFailures int
+	attempts            int
+	lastError           error
+	lastErrorTime       time.Time
+	// errors are the last errorHistorySize start errors, the oldest first
+	errors []pluginError
+	// state is the lifecycle state of the plugin since stateSince, stateDurations
+	// accumulates the time spent in the states left
+	state          string
+	stateSince     time.Time
+	stateDurations map[string]time.Duration
+	// onTransition, when set, is called every time the plugin changes state, err is the
+	// failure which made it back off
+	onTransition func(state string, err error)
+	lock         sync.Mutex
 }
 
 func (c *controlledDevice) Start() {
@@ -22,10 +67,11 @@ func (c *controlledDevice) Start() {
 	}
 
 	stop := make(chan struct{})
+	done := make(chan struct{})
 
-	logger := log.DefaultLogger()
 	dev := c.devicePlugin
 	deviceName := dev.GetDeviceName()
+	logger := log.DefaultLogger().Resource(deviceName)
 	logger.Infof("Starting a device plugin for device: %s", deviceName)
 	retries := 0
 
@@ -34,15 +80,37 @@ func (c *controlledDevice) Start() {
 		backoff = defaultBackoffTime
 	}
 
+	dev.setStateObserver(func(state string) {
+		c.setState(state, nil)
+	})
+
+	// a previous run which outlived its Stop still uses the device plugin
+	previous := c.doneChan
+
 	go func() {
+		defer close(done)
+		if previous != nil {
+			<-previous
+			if IsChanClosed(stop) {
+				return
+			}
+		}
+		defer c.setState(PluginStateStopped, nil)
 		for {
+			c.setState(PluginStateStarting, nil)
+			metrics.IncRegistrationAttempts(deviceName)
 			err := dev.Start(stop)
+			c.recordStartResult(err)
 			if err != nil {
+				metrics.IncRegistrationFailures(deviceName)
 				logger.Reason(err).Errorf("Error starting %s device plugin", deviceName)
 				retries = int(math.Min(float64(retries+1), float64(len(backoff)-1)))
 			} else {
 				retries = 0
 			}
+			if !IsChanClosed(stop) {
+				c.setState(PluginStateBackoff, err)
+			}
 
 			select {
 			case <-stop:
@@ -56,19 +124,85 @@ func (c *controlledDevice) Start() {
 	}()
 
 	c.stopChan = stop
+	c.doneChan = done
 	c.started = true
 }
 
+// Stop signals the device plugin to stop and waits, at most stopTimeout, for its shutdown to complete
 func (c *controlledDevice) Stop() {
 	if !c.started {
 		return
 	}
 	close(c.stopChan)
 
+	timeout := c.stopTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout + connectionTimeout
+	}
 	c.stopChan = nil
 	c.started = false
+	select {
+	case <-c.doneChan:
+		c.doneChan = nil
+	case <-time.After(timeout):
+		// doneChan is kept, the next start waits for this run to end
+		log.DefaultLogger().Resource(c.GetName()).Warningf("timed out after %s waiting for the %s device plugin to stop", timeout, c.GetName())
+	}
 }
 
 func (c *controlledDevice) GetName() string {
 	return c.devicePlugin.GetDeviceName()
 }
+
+func (c *controlledDevice) GetConsecutiveFailures() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.consecutiveFailures
+}
+
+func (c *controlledDevice) recordStartResult(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.attempts++
+	if err != nil {
+		c.consecutiveFailures++
+		c.lastError = err
+		c.lastErrorTime = time.Now()
+		c.errors = append(c.errors, pluginError{time: c.lastErrorTime, err: err})
+		if len(c.errors) > errorHistorySize {
+			c.errors = c.errors[len(c.errors)-errorHistorySize:]
+		}
+	} else {
+		c.consecutiveFailures = 0
+	}
+}
+
+// setState moves the plugin to a lifecycle state, accounting the time spent in the previous one
+func (c *controlledDevice) setState(state string, err error) {
+	name := c.GetName()
+	c.lock.Lock()
+	previous := c.state
+	if previous == state {
+		c.lock.Unlock()
+		return
+	}
+	now := time.Now()
+	if previous != "" {
+		elapsed := now.Sub(c.stateSince)
+		if c.stateDurations == nil {
+			c.stateDurations = make(map[string]time.Duration)
+		}
+		c.stateDurations[previous] += elapsed
+		metrics.AddPluginStateSeconds(name, previous, elapsed.Seconds())
+	}
+	c.state = state
+	c.stateSince = now
+	onTransition := c.onTransition
+	c.lock.Unlock()
+
+	metrics.SetPluginState(name, state, pluginStates)
+	log.DefaultLogger().Resource(name).V(3).Infof("%s device plugin is %s", name, state)
+	if onTransition != nil {
+		onTransition(state, err)
+	}
+}
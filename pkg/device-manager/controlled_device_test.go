@@ -0,0 +1,229 @@
+package device_manager
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestControlledDeviceStop(t *testing.T) {
+	plugin := newFakePlugin("example.com/gpu", func(stop <-chan struct{}) error {
+		<-stop
+		return nil
+	})
+	var states []string
+	c := &controlledDevice{
+		devicePlugin: plugin,
+		stopTimeout:  time.Second,
+		onTransition: func(state string, _ error) { states = append(states, state) },
+	}
+	c.Start()
+
+	started := time.Now()
+	c.Stop()
+	if elapsed := time.Since(started); elapsed > c.stopTimeout {
+		t.Errorf("expected the plugin to stop right away, it took %s", elapsed)
+	}
+	expected := []string{PluginStateStarting, PluginStateStopped}
+	if len(states) != len(expected) || states[0] != expected[0] || states[1] != expected[1] {
+		t.Errorf("expected states %v, got %v", expected, states)
+	}
+}
+
+func TestControlledDeviceStopTimeout(t *testing.T) {
+	// the plugin ignores stop until it is released
+	release := make(chan struct{})
+	plugin := newFakePlugin("example.com/gpu", func(stop <-chan struct{}) error {
+		<-release
+		return nil
+	})
+	c := &controlledDevice{
+		devicePlugin: plugin,
+		backoff:      []time.Duration{10 * time.Millisecond},
+		stopTimeout:  100 * time.Millisecond,
+	}
+	c.Start()
+
+	started := time.Now()
+	c.Stop()
+	if elapsed := time.Since(started); elapsed < c.stopTimeout || elapsed > time.Second {
+		t.Errorf("expected Stop to give up after %s, it took %s", c.stopTimeout, elapsed)
+	}
+
+	// the restarted plugin waits for the run which outlived Stop
+	c.Start()
+	time.Sleep(50 * time.Millisecond)
+	if starts := atomic.LoadInt32(&plugin.starts); starts != 1 {
+		t.Errorf("expected the plugin not to be restarted while it runs, got %d starts", starts)
+	}
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&plugin.starts) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the plugin wasn't restarted once its previous run ended")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Stop()
+	if atomic.LoadInt32(&plugin.overlapped) != 0 {
+		t.Error("expected the runs of the plugin not to overlap")
+	}
+}
+
+// transitionRecorder records the transitions of a controlled device plugin
+type transitionRecorder struct {
+	lock        sync.Mutex
+	transitions []string
+}
+
+func (r *transitionRecorder) record(state string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err != nil {
+		state += ": " + err.Error()
+	}
+	r.transitions = append(r.transitions, state)
+}
+
+func (r *transitionRecorder) get() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string{}, r.transitions...)
+}
+
+func TestControlledDeviceLifecycle(t *testing.T) {
+	serving := make(chan struct{})
+	var plugin *fakePlugin
+	plugin = newFakePlugin("example.com/gpu", func(stop <-chan struct{}) error {
+		if atomic.LoadInt32(&plugin.starts) == 1 {
+			return fmt.Errorf("kubelet is not running")
+		}
+		plugin.notifyState(PluginStateRegistering)
+		plugin.notifyState(PluginStateServing)
+		close(serving)
+		<-stop
+		return nil
+	})
+	recorder := &transitionRecorder{}
+	c := &controlledDevice{
+		devicePlugin: plugin,
+		backoff:      []time.Duration{time.Millisecond},
+		stopTimeout:  time.Second,
+		onTransition: recorder.record,
+	}
+	c.Start()
+	<-serving
+	if status := c.status(); status.State != PluginStateServing || status.Attempts != 1 || status.ConsecutiveFailures != 1 || status.LastError != "kubelet is not running" {
+		t.Errorf("unexpected status %+v", status)
+	}
+	c.Stop()
+
+	expected := []string{
+		PluginStateStarting,
+		PluginStateBackoff + ": kubelet is not running",
+		PluginStateStarting,
+		PluginStateRegistering,
+		PluginStateServing,
+		PluginStateStopped,
+	}
+	if transitions := recorder.get(); strings.Join(transitions, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected transitions %v, got %v", expected, transitions)
+	}
+	// the clean exit resets the failures, the last error is kept
+	if status := c.status(); status.Started || status.State != PluginStateStopped || status.Attempts != 2 || status.ConsecutiveFailures != 0 || status.LastError != "kubelet is not running" {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestControlledDeviceErrorHistory(t *testing.T) {
+	const failures = errorHistorySize + 3
+	var plugin *fakePlugin
+	plugin = newFakePlugin("example.com/gpu", func(stop <-chan struct{}) error {
+		if starts := atomic.LoadInt32(&plugin.starts); starts <= failures {
+			return fmt.Errorf("failure %d", starts)
+		}
+		<-stop
+		return nil
+	})
+	c := &controlledDevice{
+		devicePlugin: plugin,
+		backoff:      []time.Duration{time.Millisecond},
+		stopTimeout:  time.Second,
+	}
+	c.Start()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&plugin.starts) <= failures {
+		if time.Now().After(deadline) {
+			t.Fatal("the plugin wasn't restarted after its failures")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Stop()
+
+	status := c.status()
+	if len(status.Errors) != errorHistorySize {
+		t.Fatalf("expected the last %d errors to be kept, got %d", errorHistorySize, len(status.Errors))
+	}
+	// the oldest errors are dropped first
+	for i, pluginErr := range status.Errors {
+		if expected := fmt.Sprintf("failure %d", failures-errorHistorySize+i+1); pluginErr.Message != expected {
+			t.Errorf("expected error %d to be %q, got %q", i, expected, pluginErr.Message)
+		}
+		if i > 0 && pluginErr.Time.Before(status.Errors[i-1].Time) {
+			t.Errorf("expected the errors to be ordered by time, got %v", status.Errors)
+		}
+	}
+	if status.LastError != fmt.Sprintf("failure %d", failures) || !status.LastErrorTime.Equal(status.Errors[errorHistorySize-1].Time) {
+		t.Errorf("expected the last error to be the newest of the history, got %+v", status)
+	}
+	if status.Attempts != failures+1 || status.ConsecutiveFailures != 0 {
+		t.Errorf("expected %d attempts and no consecutive failure, got %+v", failures+1, status)
+	}
+}
+
+func TestControlledDeviceStateDurations(t *testing.T) {
+	recorder := &transitionRecorder{}
+	c := &controlledDevice{
+		devicePlugin: newFakePlugin("example.com/gpu", nil),
+		onTransition: recorder.record,
+	}
+	if status := c.status(); status.State != "" || status.SecondsInState != nil {
+		t.Errorf("expected no state before the first start, got %+v", status)
+	}
+
+	c.setState(PluginStateStarting, nil)
+	time.Sleep(20 * time.Millisecond)
+	c.setState(PluginStateServing, nil)
+	time.Sleep(20 * time.Millisecond)
+	// staying in a state is not a transition
+	c.setState(PluginStateServing, nil)
+	time.Sleep(20 * time.Millisecond)
+	c.setState(PluginStateStarting, nil)
+	time.Sleep(20 * time.Millisecond)
+
+	c.lock.Lock()
+	durations := make(map[string]time.Duration)
+	for state, duration := range c.stateDurations {
+		durations[state] = duration
+	}
+	c.lock.Unlock()
+	if len(durations) != 2 || durations[PluginStateStarting] < 20*time.Millisecond || durations[PluginStateServing] < 40*time.Millisecond {
+		t.Errorf("unexpected durations of the states left %v", durations)
+	}
+	// the current state counts up to now
+	status := c.status()
+	if status.SecondsInState[PluginStateStarting] < 0.04 || status.SecondsInState[PluginStateServing] != durations[PluginStateServing].Seconds() {
+		t.Errorf("unexpected seconds in state %v", status.SecondsInState)
+	}
+	if time.Since(status.StateSince) < 20*time.Millisecond {
+		t.Errorf("expected the state to be entered before the sleep, got %s", status.StateSince)
+	}
+
+	expected := []string{PluginStateStarting, PluginStateServing, PluginStateStarting}
+	if transitions := recorder.get(); strings.Join(transitions, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected transitions %v, got %v", expected, transitions)
+	}
+}
@@ -0,0 +1,147 @@
+package device_manager
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/log"
+)
+
+const (
+	// NodeCordonAnnotation lists the cordoned PCI addresses and iommu groups of the node,
+	// comma separated, e.g. 0000:3b:00.0,45
+	NodeCordonAnnotation = NodeLabelPrefix + "cordoned"
+	cordonPollInterval   = 30 * time.Second
+
+	// health reasons of devices cordoned or uncordoned by an administrator
+	cordonedReason   = "cordoned"
+	uncordonedReason = "uncordoned"
+)
+
+// cordonSources holds the last cordon list read from each source. A source which can't be
+// read keeps its previous list so that devices are not uncordoned by a transient error.
+type cordonSources struct {
+	file       map[string]struct{}
+	annotation map[string]struct{}
+}
+
+// SetCordonFile sets the local state file listing the cordoned PCI addresses and iommu groups
+func (c *DeviceController) SetCordonFile(path string) {
+	c.cordonFile = path
+}
+
+// readCordonFile reads one PCI address or iommu group per line, empty lines and lines
+// starting with # are ignored. A missing file cordons nothing.
+func readCordonFile(path string) (map[string]struct{}, error) {
+	entries := make(map[string]struct{})
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// parseCordonAnnotation parses the comma separated value of NodeCordonAnnotation
+func parseCordonAnnotation(value string) map[string]struct{} {
+	entries := make(map[string]struct{})
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry != "" {
+			entries[entry] = struct{}{}
+		}
+	}
+	return entries
+}
+
+// refreshCordons reads every cordon source and returns the union of their entries
+func (c *DeviceController) refreshCordons() map[string]struct{} {
+	logger := log.DefaultLogger()
+
+	if c.cordonFile != "" {
+		entries, err := readCordonFile(c.cordonFile)
+		if err != nil {
+			logger.Reason(err).Errorf("failed to read the cordon file %s, keeping the previous cordons", c.cordonFile)
+		} else {
+			c.cordons.file = entries
+		}
+	}
+
+	if c.clientset != nil && c.nodeName != "" {
+		node, err := c.clientset.Nodes().Get(context.Background(), c.nodeName, metav1.GetOptions{})
+		if err != nil {
+			logger.Reason(err).Errorf("failed to get node %s for the cordon annotation, keeping the previous cordons", c.nodeName)
+		} else {
+			c.cordons.annotation = parseCordonAnnotation(node.Annotations[NodeCordonAnnotation])
+		}
+	}
+
+	entries := make(map[string]struct{})
+	for entry := range c.cordons.file {
+		entries[entry] = struct{}{}
+	}
+	for entry := range c.cordons.annotation {
+		entries[entry] = struct{}{}
+	}
+	return entries
+}
+
+// applyCordons cordons the devices of every plugin listed by the cordon sources
+func (c *DeviceController) applyCordons(plugins []*PCIDevicePlugin) {
+	c.cordonMutex.Lock()
+	defer c.cordonMutex.Unlock()
+	entries := c.refreshCordons()
+	for _, plugin := range plugins {
+		plugin.cordon(entries)
+	}
+}
+
+// watchCordons applies the cordon sources to the started plugins periodically until stop is closed
+func (c *DeviceController) watchCordons(stop <-chan struct{}) {
+	ticker := time.NewTicker(cordonPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			c.applyCordons(c.pciPlugins())
+		}
+	}
+}
+
+// cordon cordons every device with a member whose PCI address or iommu group is listed
+func (dpi *PCIDevicePlugin) cordon(entries map[string]struct{}) {
+	cordoned := make(map[string]struct{})
+	for devID, members := range dpi.deviceMembers {
+		for _, member := range members {
+			_, addressListed := entries[member.pciAddress]
+			_, groupListed := entries[member.iommuGroup]
+			if addressListed || groupListed {
+				cordoned[devID] = struct{}{}
+				break
+			}
+		}
+	}
+	dpi.setCordoned(cordoned)
+}
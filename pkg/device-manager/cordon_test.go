@@ -0,0 +1,151 @@
+package device_manager
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	k8sv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func sortedEntries(entries map[string]struct{}) string {
+	var sorted []string
+	for entry := range entries {
+		sorted = append(sorted, entry)
+	}
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+func TestReadCordonFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cordoned")
+
+	entries, err := readCordonFile(path)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("expected a missing file to cordon nothing, got %v: %v", entries, err)
+	}
+
+	content := "# taken out for repair\n0000:3B:00.0\n\n  45  \n#46\n0000:5e:00.1 \n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = readCordonFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sorted := sortedEntries(entries); sorted != "0000:3b:00.0,0000:5e:00.1,45" {
+		t.Errorf("unexpected entries %s", sorted)
+	}
+
+	if _, err := readCordonFile(dir); err == nil {
+		t.Error("expected a file which can't be read to fail")
+	}
+}
+
+func TestParseCordonAnnotation(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{value: "", expected: ""},
+		{value: "45", expected: "45"},
+		{value: "0000:3b:00.0,45", expected: "0000:3b:00.0,45"},
+		{value: " 0000:3B:00.0 , 45 ,", expected: "0000:3b:00.0,45"},
+		{value: ",,", expected: ""},
+	}
+	for _, test := range tests {
+		if sorted := sortedEntries(parseCordonAnnotation(test.value)); sorted != test.expected {
+			t.Errorf("expected %q to be parsed as %q, got %q", test.value, test.expected, sorted)
+		}
+	}
+}
+
+func TestApplyCordons(t *testing.T) {
+	plugin := NewPCIDevicePlugin([]*PCIDevice{
+		{pciAddress: "0000:01:00.0", pciID: "10de:1eb8", iommuGroup: "12"},
+		{pciAddress: "0000:01:00.1", pciID: "10de:10f8", iommuGroup: "12"},
+		{pciAddress: "0000:02:00.0", pciID: "10de:1eb8", iommuGroup: "13"},
+		{pciAddress: "0000:03:00.0", pciID: "10de:1eb8", iommuGroup: "14"},
+	}, "example.com/gpu")
+	var changes []string
+	plugin.onHealthChange = func(devID string, health string, reason string) {
+		changes = append(changes, devID+" "+health+" "+reason)
+	}
+	stop := make(chan struct{})
+	plugin.stop = stop
+	responses := make(chan []*pluginapi.Device, 10)
+	stream := &fakeListAndWatchServer{send: func(response *pluginapi.ListAndWatchResponse) error {
+		var devices []*pluginapi.Device
+		for _, dev := range response.Devices {
+			devices = append(devices, &pluginapi.Device{ID: dev.ID, Health: dev.Health})
+		}
+		responses <- devices
+		return nil
+	}}
+	returned := listAndWatch(t, plugin.DevicePluginBase, stream)
+	next := func() []*pluginapi.Device {
+		select {
+		case devices := <-responses:
+			return devices
+		case <-time.After(5 * time.Second):
+			t.Fatal("ListAndWatch didn't send the devices")
+			return nil
+		}
+	}
+	expectDevices(t, map[string]string{"12": pluginapi.Healthy, "13": pluginapi.Healthy, "14": pluginapi.Healthy}, next())
+
+	// the file lists a member of group 12, the annotation lists group 13
+	cordonFile := filepath.Join(t.TempDir(), "cordoned")
+	if err := os.WriteFile(cordonFile, []byte("0000:01:00.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	nodes := &fakeNodes{node: k8sv1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:        "node1",
+		Annotations: map[string]string{NodeCordonAnnotation: "13"},
+	}}}
+	c := NewDeviceController("rw", nil, &fakeCoreV1{nodes: nodes}, "node1", nil)
+	c.SetCordonFile(cordonFile)
+	c.applyCordons([]*PCIDevicePlugin{plugin})
+	expectDevices(t, map[string]string{"12": pluginapi.Unhealthy, "13": pluginapi.Unhealthy, "14": pluginapi.Healthy}, next())
+	sort.Strings(changes)
+	if strings.Join(changes, ",") != "12 Unhealthy cordoned,13 Unhealthy cordoned" {
+		t.Errorf("unexpected health changes %v", changes)
+	}
+
+	// a source which can't be read keeps its previous cordons
+	changes = nil
+	nodes.err = fmt.Errorf("connection refused")
+	if err := os.Remove(cordonFile); err != nil {
+		t.Fatal(err)
+	}
+	c.applyCordons([]*PCIDevicePlugin{plugin})
+	expectDevices(t, map[string]string{"12": pluginapi.Healthy, "13": pluginapi.Unhealthy, "14": pluginapi.Healthy}, next())
+	if strings.Join(changes, ",") != "12 Healthy uncordoned" {
+		t.Errorf("unexpected health changes %v", changes)
+	}
+
+	changes = nil
+	nodes.err = nil
+	nodes.node.Annotations = nil
+	c.applyCordons([]*PCIDevicePlugin{plugin})
+	expectDevices(t, map[string]string{"12": pluginapi.Healthy, "13": pluginapi.Healthy, "14": pluginapi.Healthy}, next())
+	if strings.Join(changes, ",") != "13 Healthy uncordoned" {
+		t.Errorf("unexpected health changes %v", changes)
+	}
+	// nothing changed, nothing is sent
+	c.applyCordons([]*PCIDevicePlugin{plugin})
+
+	close(stop)
+	<-returned
+	expectDevices(t, map[string]string{}, next())
+	if len(responses) != 0 {
+		t.Errorf("expected no list to be sent without a change, got %d", len(responses))
+	}
+}
@@ -0,0 +1,116 @@
+package device_manager
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/log"
+)
+
+// nodeBasePath lists the NUMA nodes and their CPUs
+var nodeBasePath = "/sys/devices/system/node"
+
+const (
+	// suffixes of the env vars listing the local CPUs and NUMA node of every allocated device
+	localCPUsEnvSuffix = "_LOCAL_CPUS"
+	numaNodeEnvSuffix  = "_NUMA_NODE"
+)
+
+// readLocalCPUs reads the CPUs close to a device, e.g. 0-15,32-47
+func readLocalCPUs(basePath string, address string) string {
+	data, err := Handler.ReadDeviceAttribute(basePath, address, "local_cpulist")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// parseCPUList parses a kernel cpulist such as 0-3,8,10-11
+func parseCPUList(cpuList string) (map[int]struct{}, error) {
+	cpus := make(map[int]struct{})
+	for _, part := range strings.Split(strings.TrimSpace(cpuList), ",") {
+		if part == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpulist %q: %v", cpuList, err)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil {
+				return nil, fmt.Errorf("invalid cpulist %q: %v", cpuList, err)
+			}
+			if end < start {
+				return nil, fmt.Errorf("invalid cpulist %q: range %s ends before it starts", cpuList, part)
+			}
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			cpus[cpu] = struct{}{}
+		}
+	}
+	return cpus, nil
+}
+
+// numaNodeOfCPUs returns the NUMA node holding all of cpuList, -1 when the CPUs span
+// several nodes or the nodes can't be read
+func numaNodeOfCPUs(cpuList string) int {
+	logger := log.DefaultLogger()
+	cpus, err := parseCPUList(cpuList)
+	if err != nil || len(cpus) == 0 {
+		return -1
+	}
+
+	nodePaths, err := filepath.Glob(filepath.Join(nodeBasePath, "node[0-9]*"))
+	if err != nil {
+		return -1
+	}
+	var nodes []int
+	for _, nodePath := range nodePaths {
+		node, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(nodePath), "node"))
+		if err != nil {
+			continue
+		}
+		// #nosec No risk for path injection. Reading static path of sysfs data
+		data, err := os.ReadFile(filepath.Join(nodePath, "cpulist"))
+		if err != nil {
+			logger.Reason(err).Warningf("failed to read the CPUs of NUMA node %d", node)
+			continue
+		}
+		nodeCPUs, err := parseCPUList(string(data))
+		if err != nil {
+			continue
+		}
+		for cpu := range cpus {
+			if _, onNode := nodeCPUs[cpu]; onNode {
+				nodes = append(nodes, node)
+				break
+			}
+		}
+	}
+	if len(nodes) != 1 {
+		return -1
+	}
+	return nodes[0]
+}
+
+// formatDeviceValues formats per device values as <address>=<value> separated by semicolons,
+// since cpulists contain commas. Devices without a value are left out.
+func formatDeviceValues(values map[string]string) string {
+	addresses := make([]string, 0, len(values))
+	for address := range values {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	var pairs []string
+	for _, address := range addresses {
+		pairs = append(pairs, address+"="+values[address])
+	}
+	return strings.Join(pairs, ";")
+}
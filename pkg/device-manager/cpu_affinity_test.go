@@ -0,0 +1,164 @@
+package device_manager
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestParseCPUList(t *testing.T) {
+	tests := []struct {
+		name     string
+		cpuList  string
+		expected []int
+		invalid  bool
+	}{
+		{name: "single CPU", cpuList: "3", expected: []int{3}},
+		{name: "range", cpuList: "0-3", expected: []int{0, 1, 2, 3}},
+		{name: "ranges and CPUs", cpuList: "0-1,8,10-11", expected: []int{0, 1, 8, 10, 11}},
+		{name: "trailing newline", cpuList: "4-5\n", expected: []int{4, 5}},
+		{name: "overlapping ranges", cpuList: "0-2,1-3", expected: []int{0, 1, 2, 3}},
+		{name: "empty", cpuList: ""},
+		{name: "empty entries", cpuList: "1,,2,", expected: []int{1, 2}},
+		{name: "not a number", cpuList: "a", invalid: true},
+		{name: "open range", cpuList: "0-", invalid: true},
+		{name: "negative CPU", cpuList: "-1", invalid: true},
+		{name: "reversed range", cpuList: "3-1", invalid: true},
+		{name: "bad range end", cpuList: "0-3,4-x", invalid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cpus, err := parseCPUList(test.cpuList)
+			if test.invalid {
+				if err == nil {
+					t.Errorf("expected %q to be refused, got %v", test.cpuList, cpus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var parsed []int
+			for cpu := range cpus {
+				parsed = append(parsed, cpu)
+			}
+			sort.Ints(parsed)
+			if len(parsed) != len(test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, parsed)
+			}
+			for i := range parsed {
+				if parsed[i] != test.expected[i] {
+					t.Fatalf("expected %v, got %v", test.expected, parsed)
+				}
+			}
+		})
+	}
+}
+
+// useNUMANodes builds a node tree holding the CPUs of every node and points the device manager to it
+func useNUMANodes(t *testing.T, nodes map[string]string) {
+	root := t.TempDir()
+	for node, cpuList := range nodes {
+		nodePath := filepath.Join(root, node)
+		if err := os.Mkdir(nodePath, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(nodePath, "cpulist"), []byte(cpuList+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	previous := nodeBasePath
+	nodeBasePath = root
+	t.Cleanup(func() { nodeBasePath = previous })
+}
+
+func TestNUMANodeOfCPUs(t *testing.T) {
+	useNUMANodes(t, map[string]string{
+		"node0": "0-3,8-11",
+		"node1": "4-7,12-15",
+		// a memory only node has no CPUs
+		"node2": "",
+	})
+	tests := []struct {
+		cpuList  string
+		expected int
+	}{
+		{cpuList: "0-3", expected: 0},
+		{cpuList: "8,10", expected: 0},
+		{cpuList: "4-7,12-15", expected: 1},
+		{cpuList: "2-5", expected: -1},
+		{cpuList: "16", expected: -1},
+		{cpuList: "", expected: -1},
+		{cpuList: "0-x", expected: -1},
+	}
+	for _, test := range tests {
+		if node := numaNodeOfCPUs(test.cpuList); node != test.expected {
+			t.Errorf("expected CPUs %q to be on node %d, got %d", test.cpuList, test.expected, node)
+		}
+	}
+}
+
+func TestFormatDeviceValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   map[string]string
+		expected string
+	}{
+		{name: "no devices", values: map[string]string{}, expected: ""},
+		{name: "single device", values: map[string]string{"0000:01:00.0": "0-3,8-11"}, expected: "0000:01:00.0=0-3,8-11"},
+		{
+			name:     "sorted by address",
+			values:   map[string]string{"0000:02:00.0": "1", "0000:01:00.1": "0", "0000:01:00.0": "0"},
+			expected: "0000:01:00.0=0;0000:01:00.1=0;0000:02:00.0=1",
+		},
+	}
+	for _, test := range tests {
+		if formatted := formatDeviceValues(test.values); formatted != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, formatted)
+		}
+	}
+}
+
+func TestPCIDevicePluginCPUAffinity(t *testing.T) {
+	dpi := NewPCIDevicePlugin([]*PCIDevice{
+		{pciAddress: "0000:01:00.0", iommuGroup: "11", numaNode: 0, localCPUs: "0-3,8-11"},
+		// the audio function reports no topology
+		{pciAddress: "0000:02:00.0", iommuGroup: "12", numaNode: 1, localCPUs: "4-7,12-15"},
+		{pciAddress: "0000:02:00.1", iommuGroup: "12", numaNode: -1},
+		{pciAddress: "0000:03:00.0", iommuGroup: "13", numaNode: -1},
+	}, "example.com/gpu")
+	request := &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+		{DevicesIDs: []string{"11"}},
+		{DevicesIDs: []string{"12", "13"}},
+		{DevicesIDs: []string{"13"}},
+	}}
+	response, err := dpi.Allocate(context.Background(), request)
+	if err != nil {
+		t.Fatalf("failed to allocate the devices: %v", err)
+	}
+
+	const localCPUsEnv = "PCI_RESOURCE_EXAMPLE_COM_GPU_LOCAL_CPUS"
+	const numaNodeEnv = "PCI_RESOURCE_EXAMPLE_COM_GPU_NUMA_NODE"
+	expected := []map[string]string{
+		{localCPUsEnv: "0000:01:00.0=0-3,8-11", numaNodeEnv: "0000:01:00.0=0"},
+		{localCPUsEnv: "0000:02:00.0=4-7,12-15", numaNodeEnv: "0000:02:00.0=1"},
+		// devices without topology set neither
+		{},
+	}
+	if len(response.ContainerResponses) != len(expected) {
+		t.Fatalf("expected %d container responses, got %d", len(expected), len(response.ContainerResponses))
+	}
+	for i, containerResponse := range response.ContainerResponses {
+		for _, name := range []string{localCPUsEnv, numaNodeEnv} {
+			value, set := containerResponse.Envs[name]
+			expectedValue, expectedSet := expected[i][name]
+			if set != expectedSet || value != expectedValue {
+				t.Errorf("container %d: expected %s=%q, got %q", i, name, expectedValue, value)
+			}
+		}
+	}
+}
@@ -6,31 +6,113 @@ import (
 	"time"
 
 	k8scli "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/audit"
 	config "github.com/jonkeyguan/vfio-device-plugin/pkg/config"
 	log "github.com/jonkeyguan/vfio-device-plugin/pkg/log"
 )
 
+// unhealthyFailureThreshold is the number of consecutive device plugin failures
+// after which the controller reports itself unhealthy
+const unhealthyFailureThreshold = 5
+
 type DeviceController struct {
-	startedPlugins      map[string]controlledDevice
+	startedPlugins      map[string]*controlledDevice
 	startedPluginsMutex sync.Mutex
 	permissions         string
 	backoff             []time.Duration
+	shutdownTimeout     time.Duration
 	resourceConfig      *config.ResourceConfig
 	stop                chan struct{}
 	clientset           k8scli.CoreV1Interface
+	nodeName            string
+	recorder            record.EventRecorder
+	discoveryErr        error
+	discoveredDevices   map[string][]*PCIDevice
+	// discoveredBundles are the bundles of the composite resources
+	discoveredBundles map[string][][]*PCIDevice
+	deviceHealth      map[string]map[string]deviceHealth
+	inventoryMutex    sync.Mutex
+	inventoryChanged  chan struct{}
+	auditLog          *audit.Log
+	auditor           *allocationAuditor
+	// sharedDevices maps the devices offered by several resources to their plugins
+	sharedDevices map[string][]*PCIDevicePlugin
+	reservations  map[string]deviceReservation
+	// podResourcesErr tells why the PodResources API couldn't be listed, the shared devices
+	// are withheld meanwhile. withheldReported is set once the withheld devices were reported.
+	podResourcesErr  error
+	withheldReported bool
+	sharingMutex     sync.Mutex
+	cordonFile       string
+	cordons          cordonSources
+	// healthCheckerRules are the configured health checkers of PCI devices, guarded by configMutex
+	healthCheckerRules []*healthCheckerRule
+	stateDir           string
+	// releasePlugins are the plugins of the resources with a release action, the devices
+	// allocated at the last poll and the devices whose release action is running
+	releasePlugins map[string]*PCIDevicePlugin
+	lastAllocated  map[string]map[string]struct{}
+	releasing      map[string]map[string]struct{}
+	releaseStop    <-chan struct{}
+	releaseRetry   time.Duration
+	releaseMutex   sync.Mutex
+	// driverJournal holds the devices of lazy binding resources switched to vfio-pci
+	driverJournal map[string]*driverJournalEntry
+	driverMutex   sync.Mutex
+	// takingOver is set while the plugins start alongside the previous instance, which
+	// retires once they are registered. legacyPredecessor is set when that instance is a
+	// release which predates the handover socket and serves the legacy sockets.
+	takingOver        bool
+	legacyPredecessor bool
+	// podNamespace and podName identify the pod of this instance
+	podNamespace string
+	podName      string
+	// retired is set once a new instance took the resources over, the plugins aren't reconciled anymore
+	retired bool
+	// queue holds the pending reconcile of the plugins, triggers are the inputs enqueuing it
+	queue    workqueue.TypedRateLimitingInterface[string]
+	triggers []reconcileTrigger
+	// fingerprints identify the devices and configuration of every started plugin
+	fingerprints map[string]string
+	// synced is closed once the plugins were reconciled with a successful discovery
+	synced      chan struct{}
+	configFile  string
+	configMutex sync.RWMutex
+	cordonMutex sync.Mutex
 }
 
 func NewDeviceController(
 	permissions string,
 	resourceConfig *config.ResourceConfig,
+	clientset k8scli.CoreV1Interface,
+	nodeName string,
+	recorder record.EventRecorder,
 ) *DeviceController {
 
 	controller := &DeviceController{
-		startedPlugins: map[string]controlledDevice{},
-		permissions:    permissions,
-		backoff:        defaultBackoffTime,
-		resourceConfig: resourceConfig,
+		startedPlugins:    map[string]*controlledDevice{},
+		permissions:       permissions,
+		backoff:           defaultBackoffTime,
+		shutdownTimeout:   defaultShutdownTimeout,
+		releaseRetry:      releaseRetryInterval,
+		resourceConfig:    resourceConfig,
+		clientset:         clientset,
+		nodeName:          nodeName,
+		recorder:          recorder,
+		discoveredDevices: map[string][]*PCIDevice{},
+		discoveredBundles: map[string][][]*PCIDevice{},
+		deviceHealth:      map[string]map[string]deviceHealth{},
+		inventoryChanged:  make(chan struct{}, 1),
+		sharedDevices:     map[string][]*PCIDevicePlugin{},
+		reservations:      map[string]deviceReservation{},
+		releasing:         map[string]map[string]struct{}{},
+		driverJournal:     map[string]*driverJournalEntry{},
+		triggers:          []reconcileTrigger{resync, watchKubelet, watchUevents},
+		fingerprints:      map[string]string{},
+		synced:            make(chan struct{}),
 	}
 
 	return controller
@@ -41,143 +123,335 @@ func (c *DeviceController) Run(stop chan struct{}, done chan<- struct{}) error {
 
 	defer close(done)
 
-	var (
-		discoverConfiguredVfioDevices map[string][]*PCIDevice
-		discoverErr                   error
-		retryInterval                 = 30 * time.Second
-	)
-
-	for {
-		discoverConfiguredVfioDevices, discoverErr = c.discoverConfiguredVfioDevices()
-		if discoverErr != nil {
-			logger.Reason(discoverErr).Errorf("failed to discover configured VFIO devices, will retry in %s", retryInterval)
-			select {
-			case <-stop:
-				logger.Info("Received stop signal before successful discovery")
-				return fmt.Errorf("device discovery interrupted")
-			case <-time.After(retryInterval):
-				continue
-			}
+	// the controller stops on the stop signal, or once a new instance took its resources over
+	runStop := make(chan struct{})
+	retired := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+		case <-retired:
 		}
-		break
+		close(runStop)
+	}()
+
+	publisherDone := make(chan struct{})
+	go func() {
+		defer close(publisherDone)
+		c.publishNodeInventoryUntil(runStop, discoveryRetryInterval)
+	}()
+	defer func() { <-publisherDone }()
+
+	// sockets left behind by a previous run are removed before any plugin starts
+	sweepStaleSockets()
+	// the state is loaded once the previous instance retired and stopped changing it
+	predecessor := c.connectPredecessor()
+	// a release which predates the handover socket is taken over without retiring it
+	legacyPredecessor := predecessor == nil && c.legacyPredecessorServes()
+	takingOver := predecessor != nil || legacyPredecessor
+	c.startedPluginsMutex.Lock()
+	c.takingOver = takingOver
+	c.legacyPredecessor = legacyPredecessor
+	c.startedPluginsMutex.Unlock()
+	if predecessor == nil {
+		c.loadReleaseState()
+		c.loadDriverJournal()
+	}
+	podResourcesDone := make(chan struct{})
+	go func() {
+		defer close(podResourcesDone)
+		c.watchPodResources(runStop)
+	}()
+	defer func() { <-podResourcesDone }()
+
+	if c.auditLog != nil {
+		c.auditor = newAllocationAuditor(c.auditLog, c.nodeName)
+		go c.auditor.run()
+		// deferred before stopAllDevices so that it runs after it and the last allocations are written
+		defer c.auditor.stop()
 	}
+	defer c.stopAllDevices()
 
-	devicePlugins := c.buildDevicePlugins(discoverConfiguredVfioDevices)
+	// the plugins are converged to the configuration and the discovered devices by a single
+	// worker, every input only enqueues a reconcile
+	c.queue = newReconcileQueue()
+	reconcilerDone := make(chan struct{})
+	go func() {
+		defer close(reconcilerDone)
+		c.runReconciler(runStop)
+	}()
+	defer func() { <-reconcilerDone }()
+	defer c.queue.ShutDown()
 
-	// start all device plugins
-	func() {
-		c.startedPluginsMutex.Lock()
-		defer c.startedPluginsMutex.Unlock()
-		for _, dev := range devicePlugins {
-			logger.Infof("Starting device plugin for %s", dev.GetDeviceName())
-			c.startDevice(dev.GetDeviceName(), dev)
+	triggersDone := make(chan struct{})
+	go func() {
+		defer close(triggersDone)
+		var wg sync.WaitGroup
+		for _, trigger := range c.triggers {
+			wg.Add(1)
+			go func(trigger reconcileTrigger) {
+				defer wg.Done()
+				trigger(runStop, c.enqueue)
+			}(trigger)
 		}
+		wg.Wait()
+	}()
+	defer func() { <-triggersDone }()
+	c.enqueue("controller started")
+
+	cordonsDone := make(chan struct{})
+	go func() {
+		defer close(cordonsDone)
+		c.watchCordons(runStop)
 	}()
+	defer func() { <-cordonsDone }()
 	logger.Info("Starting device plugin controller")
 
-	// keep running until stop
-	<-stop
-
-	// stop all device plugins
-	func() {
-		c.startedPluginsMutex.Lock()
-		defer c.startedPluginsMutex.Unlock()
-		for name := range c.startedPlugins {
-			c.stopDevice(name)
+	if takingOver {
+		select {
+		case <-c.synced:
+			c.takeOver(predecessor, runStop)
+			if predecessor != nil {
+				c.loadReleaseState()
+				c.loadDriverJournal()
+			}
+			c.resumeReleases(c.pciPlugins(), runStop)
+			c.finishTakeOver(runStop)
+		case <-runStop:
+			if predecessor != nil {
+				predecessor.Close()
+			}
+		}
+	}
+	handoverDone := make(chan struct{})
+	go func() {
+		defer close(handoverDone)
+		if c.stateDir != "" {
+			c.serveHandover(runStop, retired)
 		}
 	}()
-	logger.Info("Shutting down device plugin controller")
+	defer func() { <-handoverDone }()
+
+	// keep running until stop
+	<-runStop
+
+	if IsChanClosed(retired) {
+		logger.Info("Device plugin controller retired, the new instance serves the devices")
+	} else {
+		logger.Info("Shutting down device plugin controller")
+	}
 	return nil
 }
 
+// stopAllDevices stops all device plugins, in parallel so that the shutdown timeout applies once
+func (c *DeviceController) stopAllDevices() {
+	c.startedPluginsMutex.Lock()
+	defer c.startedPluginsMutex.Unlock()
+	var wg sync.WaitGroup
+	for _, dev := range c.startedPlugins {
+		wg.Add(1)
+		go func(dev *controlledDevice) {
+			defer wg.Done()
+			dev.Stop()
+		}(dev)
+	}
+	wg.Wait()
+	c.startedPlugins = map[string]*controlledDevice{}
+	log.DefaultLogger().Info("Device plugin controller stopped")
+}
+
+// SetShutdownTimeout sets how long each device plugin may take to shut down in order
+func (c *DeviceController) SetShutdownTimeout(timeout time.Duration) {
+	c.shutdownTimeout = timeout
+}
+
+// SetAuditLog enables the allocation audit log, it is closed when Run returns
+func (c *DeviceController) SetAuditLog(auditLog *audit.Log) {
+	c.auditLog = auditLog
+}
+
+// publishNodeInventoryUntil publishes the node inventory and condition whenever they change,
+// retrying failed updates after retryInterval
+func (c *DeviceController) publishNodeInventoryUntil(stop <-chan struct{}, retryInterval time.Duration) {
+	logger := log.DefaultLogger()
+	if c.clientset == nil || c.nodeName == "" {
+		logger.Warning("No kubernetes client or node name configured, node inventory will not be published")
+		return
+	}
+
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case <-c.inventoryChanged:
+		case <-retry:
+		}
+		retry = nil
+		if err := c.publishNodeInventory(); err != nil {
+			logger.Reason(err).Errorf("failed to publish node inventory, will retry in %s", retryInterval)
+			retry = time.After(retryInterval)
+		}
+	}
+}
+
 func (c *DeviceController) buildDevicePlugins(pciDeviceMap map[string][]*PCIDevice) []Device {
 	var devices []Device
+	resourceBuses := c.buildResourceBusMap()
+	releaseActions := make(map[string]*config.ReleaseAction)
+	lazyResources := make(map[string]bool)
+	envs := make(map[string]*config.Env)
+	for _, resource := range c.config().GetResources() {
+		releaseActions[resource.Name] = resource.ReleaseAction
+		lazyResources[resource.Name] = resource.LazyBinding
+		envs[resource.Name] = resource.Env
+	}
 	for pciResourceName, pciDevices := range pciDeviceMap {
 		log.DefaultLogger().Infof("Discovered PCIs %d devices on the node for the resource: %s", len(pciDevices), pciResourceName)
-		devices = append(devices, NewPCIDevicePlugin(pciDevices, pciResourceName))
+		plugin := NewPCIDevicePlugin(pciDevices, pciResourceName)
+		if bus, err := busFor(resourceBuses[pciResourceName]); err == nil {
+			plugin.envPrefix = bus.envPrefix
+		}
+		plugin.setEnv(envs[pciResourceName])
+		plugin.shutdownTimeout = c.shutdownTimeout
+		plugin.auditor = c.auditor
+		plugin.healthCheckers = healthCheckersFor(c.checkerRules(), pciResourceName, plugin.deviceMembers)
+		plugin.releaseAction = releaseActions[pciResourceName]
+		if lazyResources[pciResourceName] {
+			if c.stateDir == "" {
+				log.DefaultLogger().Resource(pciResourceName).Warning("devices are bound lazily without a state directory, a crash mid-switch won't be recovered")
+			}
+			bindPlugin := plugin
+			plugin.bindDevices = func(devIDs []string) error {
+				return c.bindDevices(bindPlugin, devIDs)
+			}
+		}
+		resourceName := pciResourceName
+		plugin.onHealthChange = func(devID string, health string, reason string) {
+			c.setDeviceHealth(resourceName, devID, health, reason)
+		}
+		// only the devices shared with another resource are reserved
+		plugin.onAllocate = func(devIDs []string) error {
+			return c.reserveDevices(resourceName, devIDs)
+		}
+		devices = append(devices, plugin)
 	}
 	return devices
 }
 
-// discoverConfiguredVfioDevices returns a map of resourceName to a slice of PCIDevice
-// and an error if any device fails during discovery (error details are logged)
-func (c *DeviceController) discoverConfiguredVfioDevices() (map[string][]*PCIDevice, error) {
+func (c *DeviceController) buildDeviceNodePlugins() []Device {
+	var devices []Device
+	for _, deviceNode := range c.config().GetDeviceNodes() {
+		log.DefaultLogger().Resource(deviceNode.Name).Infof("Advertising %d devices of %s for the resource: %s", deviceNode.Count, deviceNode.Path, deviceNode.Name)
+		plugin := NewGenericDevicePlugin(deviceNode, c.permissions)
+		plugin.shutdownTimeout = c.shutdownTimeout
+		plugin.auditor = c.auditor
+		devices = append(devices, plugin)
+	}
+	return devices
+}
+
+// discoverConfiguredVfioDevices returns a map of resourceName to a slice of PCIDevice,
+// the devices which were rejected and an error if any device fails during discovery
+func (c *DeviceController) discoverConfiguredVfioDevices() (map[string][]*PCIDevice, []DiscoveryResult, error) {
 	initHandler()
 
 	logger := log.DefaultLogger()
 	configuredDeviceMap := c.buildConfiguredDeviceMap()
+	resourceBuses := c.buildResourceBusMap()
+	lazyResources := make(map[string]bool)
+	for _, resource := range c.config().GetResources() {
+		lazyResources[resource.Name] = resource.LazyBinding
+	}
 
 	pciDeviceMap := make(map[string][]*PCIDevice)
-	var hadErrors bool
-
-	for pciAddress, resourceName := range configuredDeviceMap {
-		pciID, err := Handler.GetDevicePCIID(pciBasePath, pciAddress)
-		if err != nil {
-			logger.Reason(err).Errorf("failed to get vendor:device ID for device: %s", pciAddress)
-			hadErrors = true
-			continue
-		}
-
-		driver, err := Handler.GetDeviceDriver(pciBasePath, pciAddress)
-		if err != nil {
-			logger.Reason(err).Errorf("failed to get driver for device: %s", pciAddress)
-			hadErrors = true
-			continue
-		}
-		if driver != "vfio-pci" {
-			logger.Errorf("device %s is not bound to vfio-pci (actual driver: %s)", pciAddress, driver)
-			hadErrors = true
-			continue
-		}
-
-		iommuGroup, err := Handler.GetDeviceIOMMUGroup(pciBasePath, pciAddress)
-		if err != nil {
-			logger.Reason(err).Errorf("failed to get IOMMU group for device: %s", pciAddress)
-			hadErrors = true
-			continue
-		}
+	var rejected []DiscoveryResult
 
-		numaNode := Handler.GetDeviceNumaNode(pciBasePath, pciAddress)
+	for pciAddress, resourceNames := range configuredDeviceMap {
+		// a device shared by several resources is probed once for each of them, since
+		// the resources may be on different buses
+		for _, resourceName := range resourceNames {
+			bus, err := busFor(resourceBuses[resourceName])
+			if err != nil {
+				logger.Resource(resourceName).Reason(err).Errorf("failed to discover device %s of resource %s", pciAddress, resourceName)
+				c.discoveryFailed(resourceName, DeviceDiscoveryFailedReason, "device %s of resource %s: %v", pciAddress, resourceName, err)
+				rejected = append(rejected, rejectedDevice(resourceName, &PCIDevice{bus: resourceBuses[resourceName], pciAddress: pciAddress, numaNode: -1}, DeviceDiscoveryFailedReason, err))
+				continue
+			}
+			probe := probeConfiguredDevice
+			if lazyResources[resourceName] {
+				probe = probeLazyDevice
+			}
+			pcidev, reason, err := probe(bus, pciAddress)
+			if err != nil {
+				logger.Resource(resourceName).PCIAddress(pciAddress).Reason(err).Errorf("failed to discover device %s of resource %s", pciAddress, resourceName)
+				c.discoveryFailed(resourceName, reason, "device %s of resource %s: %v", pciAddress, resourceName, err)
+				rejected = append(rejected, rejectedDevice(resourceName, pcidev, reason, err))
+				continue
+			}
 
-		pcidev := &PCIDevice{
-			pciID:      pciID,
-			pciAddress: pciAddress,
-			iommuGroup: iommuGroup,
-			driver:     driver,
-			numaNode:   numaNode,
+			pciDeviceMap[resourceName] = append(pciDeviceMap[resourceName], pcidev)
+			logger.Resource(resourceName).PCIAddress(pciAddress).IOMMUGroup(pcidev.iommuGroup).Infof("Discovered configured device %s with resource name %s", pciAddress, resourceName)
 		}
-
-		pciDeviceMap[resourceName] = append(pciDeviceMap[resourceName], pcidev)
-		logger.Infof("Discovered configured device %s with resource name %s", pciAddress, resourceName)
 	}
 
-	if hadErrors {
-		return pciDeviceMap, fmt.Errorf("some devices failed during discovery, check logs for details")
+	if len(rejected) > 0 {
+		return pciDeviceMap, rejected, fmt.Errorf("some devices failed during discovery, check logs for details")
 	}
-	return pciDeviceMap, nil
+	return pciDeviceMap, nil, nil
 }
 
-func (c *DeviceController) buildConfiguredDeviceMap() map[string]string {
-	resources := c.resourceConfig.GetResources()
-	devicesMap := make(map[string]string)
+// buildConfiguredDeviceMap returns the resources every configured address is offered by
+func (c *DeviceController) buildConfiguredDeviceMap() map[string][]string {
+	resources := c.config().GetResources()
+	devicesMap := make(map[string][]string)
 	for _, resource := range resources {
 		for _, address := range resource.Addresses {
-			devicesMap[address] = resource.Name
+			devicesMap[address] = append(devicesMap[address], resource.Name)
 		}
 	}
 	return devicesMap
 }
 
+// buildResourceBusMap returns the bus of every configured resource
+func (c *DeviceController) buildResourceBusMap() map[string]string {
+	buses := make(map[string]string)
+	for _, resource := range c.config().GetResources() {
+		buses[resource.Name] = resource.Bus
+	}
+	return buses
+}
+
 func (c *DeviceController) startDevice(resourceName string, dev Device) {
 	c.stopDevice(resourceName)
-	controlledDev := controlledDevice{
+	if c.takingOver {
+		dev.setTakingOver(true, c.legacyPredecessor)
+	}
+	controlledDev := &controlledDevice{
 		devicePlugin: dev,
-		backoff:      c.backoff,
+		backoff:      c.pluginBackoff(resourceName),
+		// leave room for a registration in flight to time out before the shutdown starts
+		stopTimeout: c.shutdownTimeout + connectionTimeout,
+		onTransition: func(state string, err error) {
+			c.recordPluginEvent(resourceName, state, err)
+		},
 	}
 	controlledDev.Start()
 	c.startedPlugins[resourceName] = controlledDev
 }
 
+// pluginBackoff returns the restart backoff configured for the device plugin of a resource
+func (c *DeviceController) pluginBackoff(resourceName string) []time.Duration {
+	backoffSeconds := c.config().GetBackoffSeconds(resourceName)
+	if len(backoffSeconds) == 0 {
+		return c.backoff
+	}
+	backoff := make([]time.Duration, 0, len(backoffSeconds))
+	for _, seconds := range backoffSeconds {
+		backoff = append(backoff, time.Duration(seconds)*time.Second)
+	}
+	return backoff
+}
+
 func (c *DeviceController) stopDevice(resourceName string) {
 	dev, exists := c.startedPlugins[resourceName]
 	if exists {
@@ -185,3 +459,57 @@ func (c *DeviceController) stopDevice(resourceName string) {
 		delete(c.startedPlugins, resourceName)
 	}
 }
+
+// Ready returns an error unless the device plugin of every configured resource
+// is serving and registered with kubelet
+func (c *DeviceController) Ready() error {
+	c.startedPluginsMutex.Lock()
+	takingOver := c.takingOver
+	c.startedPluginsMutex.Unlock()
+	if takingOver {
+		return fmt.Errorf("the resources are being taken over from the previous instance")
+	}
+	return c.pluginsRegistered()
+}
+
+// pluginsRegistered returns an error unless the device plugin of every configured resource
+// is serving and registered with kubelet
+func (c *DeviceController) pluginsRegistered() error {
+	c.startedPluginsMutex.Lock()
+	defer c.startedPluginsMutex.Unlock()
+
+	var resourceNames []string
+	for _, resource := range c.config().GetResources() {
+		resourceNames = append(resourceNames, resource.Name)
+	}
+	for _, deviceNode := range c.config().GetDeviceNodes() {
+		resourceNames = append(resourceNames, deviceNode.Name)
+	}
+	for _, composite := range c.config().GetComposites() {
+		resourceNames = append(resourceNames, composite.Name)
+	}
+
+	for _, resourceName := range resourceNames {
+		dev, exists := c.startedPlugins[resourceName]
+		if !exists {
+			return fmt.Errorf("device plugin for %s is not started", resourceName)
+		}
+		if !dev.devicePlugin.GetInitialized() {
+			return fmt.Errorf("device plugin for %s is not registered with kubelet", resourceName)
+		}
+	}
+	return nil
+}
+
+// Healthy returns an error if the device plugin of any resource keeps failing to serve
+func (c *DeviceController) Healthy() error {
+	c.startedPluginsMutex.Lock()
+	defer c.startedPluginsMutex.Unlock()
+
+	for name, dev := range c.startedPlugins {
+		if failures := dev.GetConsecutiveFailures(); failures >= unhealthyFailureThreshold {
+			return fmt.Errorf("device plugin for %s failed %d times in a row", name, failures)
+		}
+	}
+	return nil
+}
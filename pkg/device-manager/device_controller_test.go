@@ -0,0 +1,80 @@
+package device_manager
+
+import (
+	"strings"
+	"testing"
+)
+
+const readinessTestConfig = `
+resources:
+- resourceName: example.com/gpu
+  addresses:
+  - 0000:01:00.0
+deviceNodes:
+- resourceName: example.com/kvm
+  path: /dev/kvm
+composites:
+- resourceName: example.com/pair
+  bundles:
+  - [0000:02:00.0, 0000:03:00.0]
+`
+
+// startedFakePlugin records a started plugin of a resource, registered with kubelet or not
+func startedFakePlugin(c *DeviceController, resourceName string, registered bool) *controlledDevice {
+	plugin := newFakePlugin(resourceName, nil)
+	plugin.setInitialized(registered)
+	dev := &controlledDevice{devicePlugin: plugin}
+	c.startedPlugins[resourceName] = dev
+	return dev
+}
+
+func TestReady(t *testing.T) {
+	c := NewDeviceController("rw", newTestConfig(t, readinessTestConfig), nil, "node1", nil)
+	expectNotReady := func(reason string) {
+		t.Helper()
+		if err := c.Ready(); err == nil || !strings.Contains(err.Error(), reason) {
+			t.Errorf("expected the controller not to be ready as %s, got %v", reason, err)
+		}
+	}
+
+	expectNotReady("example.com/gpu is not started")
+	// every kind of resource is waited for
+	startedFakePlugin(c, "example.com/gpu", true)
+	expectNotReady("example.com/kvm is not started")
+	startedFakePlugin(c, "example.com/kvm", true)
+	expectNotReady("example.com/pair is not started")
+	pair := startedFakePlugin(c, "example.com/pair", false)
+	expectNotReady("example.com/pair is not registered with kubelet")
+
+	pair.devicePlugin.(*fakePlugin).setInitialized(true)
+	if err := c.Ready(); err != nil {
+		t.Errorf("expected the controller to be ready, got %v", err)
+	}
+	// plugins of resources which aren't configured anymore don't count
+	startedFakePlugin(c, "example.com/removed", false)
+	if err := c.Ready(); err != nil {
+		t.Errorf("expected the controller to be ready, got %v", err)
+	}
+
+	c.takingOver = true
+	expectNotReady("being taken over")
+}
+
+func TestHealthy(t *testing.T) {
+	c := NewDeviceController("rw", newTestConfig(t, readinessTestConfig), nil, "node1", nil)
+	if err := c.Healthy(); err != nil {
+		t.Errorf("expected the controller to be healthy without plugins, got %v", err)
+	}
+
+	gpu := startedFakePlugin(c, "example.com/gpu", false)
+	startedFakePlugin(c, "example.com/kvm", true)
+	// a plugin which isn't registered yet is healthy until it keeps failing
+	gpu.consecutiveFailures = unhealthyFailureThreshold - 1
+	if err := c.Healthy(); err != nil {
+		t.Errorf("expected the controller to be healthy, got %v", err)
+	}
+	gpu.consecutiveFailures = unhealthyFailureThreshold
+	if err := c.Healthy(); err == nil || !strings.Contains(err.Error(), "example.com/gpu failed 5 times in a row") {
+		t.Errorf("expected the failing plugin to be reported, got %v", err)
+	}
+}
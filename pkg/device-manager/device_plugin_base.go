@@ -23,6 +23,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"path"
 	"path/filepath"
@@ -32,7 +33,9 @@ import (
 	"github.com/fsnotify/fsnotify"
 	"google.golang.org/grpc"
 
+	config "github.com/jonkeyguan/vfio-device-plugin/pkg/config"
 	"github.com/jonkeyguan/vfio-device-plugin/pkg/log"
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/metrics"
 
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
@@ -51,6 +54,38 @@ type DevicePluginBase struct {
 	devicePath   string
 	deviceRoot   string
 	deviceName   string
+	registeredAt time.Time
+	// shutdownTimeout bounds how long an orderly shutdown may take before the server is forced down
+	shutdownTimeout time.Duration
+	shuttingDown    bool
+	streaming       bool
+	// onHealthChange, when set, is called every time a device changes health
+	onHealthChange func(devID string, health string, reason string)
+	// auditor, when set, records every allocation
+	auditor *allocationAuditor
+	// permissions are the cgroup permissions of devicePath in the container
+	permissions string
+	// healthCheckMode is one of the config.HealthCheck modes, empty means exists
+	healthCheckMode string
+	// unavailable holds the reasons, keyed by their source, of the devices which can't be
+	// allocated, e.g. they are taken through another resource sharing them. They are
+	// advertised unhealthy whatever their actual health.
+	unavailable map[string]map[string]string
+	// cordoned holds the devices taken out of service by an administrator, they are
+	// advertised unhealthy until they are uncordoned
+	cordoned map[string]struct{}
+	// refresh asks ListAndWatch to send the device list again
+	refresh chan struct{}
+	// takingOver lets the plugin start while the previous instance of this plugin still
+	// serves the resource, which retires once the plugin is registered. legacyPredecessor
+	// lets it serve alongside the legacy socket of a release which predates the handover.
+	takingOver        bool
+	legacyPredecessor bool
+	// retiring stops the plugin without deregistering its devices, the plugin which took
+	// over from it serves them
+	retiring bool
+	// onStateChange, when set, is called as the plugin registers and starts serving
+	onStateChange func(state string)
 }
 
 func (dpi *DevicePluginBase) GetDeviceName() string {
@@ -58,18 +93,37 @@ func (dpi *DevicePluginBase) GetDeviceName() string {
 }
 
 func (dpi *DevicePluginBase) ListAndWatch(_ *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
-	s.Send(&pluginapi.ListAndWatchResponse{Devices: dpi.devs})
+	dpi.setStreaming(true)
+	defer dpi.setStreaming(false)
+
+	s.Send(&pluginapi.ListAndWatchResponse{Devices: dpi.advertisedDevices()})
 
 	done := false
 	for {
 		select {
 		case devHealth := <-dpi.health:
+			var changed []string
+			dpi.lock.Lock()
 			for _, dev := range dpi.devs {
-				if devHealth.DevId == dev.ID {
+				// an empty device ID applies to every device
+				if (devHealth.DevId == "" || devHealth.DevId == dev.ID) && dev.Health != devHealth.Health {
 					dev.Health = devHealth.Health
+					// the health of a cordoned device is reported once it is uncordoned
+					if _, cordoned := dpi.cordoned[dev.ID]; !cordoned {
+						changed = append(changed, dev.ID)
+					}
+				}
+			}
+			onHealthChange := dpi.onHealthChange
+			dpi.lock.Unlock()
+			if onHealthChange != nil {
+				for _, devID := range changed {
+					onHealthChange(devID, devHealth.Health, devHealth.Reason)
 				}
 			}
-			s.Send(&pluginapi.ListAndWatchResponse{Devices: dpi.devs})
+			s.Send(&pluginapi.ListAndWatchResponse{Devices: dpi.advertisedDevices()})
+		case <-dpi.refresh:
+			s.Send(&pluginapi.ListAndWatchResponse{Devices: dpi.advertisedDevices()})
 		case <-dpi.stop:
 			done = true
 		case <-dpi.done:
@@ -79,16 +133,20 @@ func (dpi *DevicePluginBase) ListAndWatch(_ *pluginapi.Empty, s pluginapi.Device
 			break
 		}
 	}
-	emptyList := []*pluginapi.Device{}
-	if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: emptyList}); err != nil {
-		log.DefaultLogger().Reason(err).Infof("%s device plugin failed to deregister", dpi.resourceName)
+	if !dpi.isRetiring() {
+		emptyList := []*pluginapi.Device{}
+		if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: emptyList}); err != nil {
+			log.DefaultLogger().Resource(dpi.resourceName).Reason(err).Infof("%s device plugin failed to deregister", dpi.resourceName)
+		}
+	}
+	if !IsChanClosed(dpi.deregistered) {
+		close(dpi.deregistered)
 	}
-	close(dpi.deregistered)
 	return nil
 }
 
 func (dpi *DevicePluginBase) healthCheck() error {
-	logger := log.DefaultLogger()
+	logger := log.DefaultLogger().Resource(dpi.resourceName)
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return fmt.Errorf("failed to creating a fsnotify watcher: %v", err)
@@ -97,26 +155,19 @@ func (dpi *DevicePluginBase) healthCheck() error {
 
 	// This way we don't have to mount /dev from the node
 	devicePath := filepath.Join(dpi.deviceRoot, dpi.devicePath)
+	checkDevice := dpi.healthCheckMode != config.HealthCheckNone
 
-	// Start watching the files before we check for their existence to avoid races
-	dirName := filepath.Dir(devicePath)
-
-	if err = watcher.Add(dirName); err != nil {
-		return fmt.Errorf("failed to add the device root path to the watcher: %v", err)
-	}
-
-	if _, err = os.Stat(devicePath); err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
+	if checkDevice {
+		// Start watching the files before we check for their existence to avoid races
+		if err = watcher.Add(filepath.Dir(devicePath)); err != nil {
+			return fmt.Errorf("failed to add the device root path to the watcher: %v", err)
+		}
+		if _, err = os.Stat(devicePath); err != nil && !errors.Is(err, os.ErrNotExist) {
 			return fmt.Errorf("could not stat the device: %v", err)
 		}
-		logger.Warningf("device '%s' is not present, the device plugin can't expose it.", dpi.devicePath)
-		dpi.health <- deviceHealth{Health: pluginapi.Unhealthy}
 	}
-	logger.Infof("device '%s' is present.", dpi.devicePath)
 
-	dirName = filepath.Dir(dpi.socketPath)
-
-	if err = watcher.Add(dirName); err != nil {
+	if err = watcher.Add(filepath.Dir(dpi.socketPath)); err != nil {
 		return fmt.Errorf("failed to add the device-plugin kubelet path to the watcher: %v", err)
 	}
 
@@ -124,23 +175,46 @@ func (dpi *DevicePluginBase) healthCheck() error {
 		return fmt.Errorf("failed to stat the device-plugin socket: %v", err)
 	}
 
+	// devices are advertised healthy until a probe says otherwise
+	current := deviceHealth{Health: pluginapi.Healthy}
+	probe := func() {
+		if !checkDevice {
+			return
+		}
+		health := dpi.probeDevice(devicePath)
+		if health == current {
+			return
+		}
+		if health.Health == pluginapi.Healthy {
+			logger.Infof("device '%s' is present.", dpi.devicePath)
+		} else {
+			logger.Warningf("device '%s' is unhealthy, the device plugin can't expose it: %s", dpi.devicePath, health.Reason)
+		}
+		current = health
+		dpi.sendHealth(health)
+	}
+	probe()
+
+	// opening the device can start failing without any file system event
+	var ticker <-chan time.Time
+	if dpi.healthCheckMode == config.HealthCheckOpen {
+		openTicker := time.NewTicker(openProbeInterval)
+		defer openTicker.Stop()
+		ticker = openTicker.C
+	}
+
 	for {
 		select {
 		case <-dpi.stop:
 			return nil
 		case err := <-watcher.Errors:
 			logger.Reason(err).Errorf("error watching devices and device plugin directory")
+		case <-ticker:
+			probe()
 		case event := <-watcher.Events:
 			logger.V(4).Infof("health Event: %v", event)
 			if event.Name == devicePath {
-				// Health in this case is if the device path actually exists
-				if event.Op == fsnotify.Create {
-					logger.Infof("monitored device %s appeared", dpi.deviceName)
-					dpi.health <- deviceHealth{Health: pluginapi.Healthy}
-				} else if (event.Op == fsnotify.Remove) || (event.Op == fsnotify.Rename) {
-					logger.Infof("monitored device %s disappeared", dpi.deviceName)
-					dpi.health <- deviceHealth{Health: pluginapi.Unhealthy}
-				}
+				probe()
 			} else if event.Name == dpi.socketPath && event.Op == fsnotify.Remove {
 				logger.Infof("device socket file for device %s was removed, kubelet probably restarted.", dpi.deviceName)
 				return nil
@@ -149,7 +223,36 @@ func (dpi *DevicePluginBase) healthCheck() error {
 	}
 }
 
-func (dpi *DevicePluginBase) PreStartContainer(_ context.Context, _ *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+// sendHealth hands a health update to ListAndWatch, it gives up once the plugin is stopped
+// as ListAndWatch doesn't read updates anymore
+func (dpi *DevicePluginBase) sendHealth(health deviceHealth) bool {
+	select {
+	case dpi.health <- health:
+		return true
+	case <-dpi.stop:
+		return false
+	}
+}
+
+// probeDevice checks the device node according to the health check mode, an empty
+// device ID applies the result to every device of the plugin
+func (dpi *DevicePluginBase) probeDevice(devicePath string) deviceHealth {
+	if _, err := os.Stat(devicePath); err != nil {
+		return deviceHealth{Health: pluginapi.Unhealthy, Reason: "device is not present"}
+	}
+	if dpi.healthCheckMode == config.HealthCheckOpen {
+		file, err := os.OpenFile(devicePath, os.O_RDWR, 0)
+		if err != nil {
+			return deviceHealth{Health: pluginapi.Unhealthy, Reason: fmt.Sprintf("device can't be opened: %v", err)}
+		}
+		file.Close()
+	}
+	return deviceHealth{Health: pluginapi.Healthy}
+}
+
+func (dpi *DevicePluginBase) PreStartContainer(_ context.Context, r *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	defer metrics.ObserveRPC(dpi.resourceName, "PreStartContainer", time.Now())
+	dpi.auditor.record(dpi.resourceName, "PreStartContainer", r.DevicesIDs, nil, nil)
 	res := &pluginapi.PreStartContainerResponse{}
 	return res, nil
 }
@@ -162,36 +265,144 @@ func (dpi *DevicePluginBase) GetDevicePluginOptions(_ context.Context, _ *plugin
 }
 
 func (dpi *DevicePluginBase) Allocate(ctx context.Context, r *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	defer metrics.ObserveRPC(dpi.resourceName, "Allocate", time.Now())
+	if dpi.isShuttingDown() {
+		return nil, errShuttingDown(dpi.resourceName)
+	}
 	log.DefaultLogger().Infof("Generic Allocate: resourceName: %s", dpi.deviceName)
 	log.DefaultLogger().Infof("Generic Allocate: request: %v", r.ContainerRequests)
 	response := pluginapi.AllocateResponse{}
-	containerResponse := new(pluginapi.ContainerAllocateResponse)
-
-	dev := new(pluginapi.DeviceSpec)
-	dev.HostPath = dpi.devicePath
-	dev.ContainerPath = dpi.devicePath
-	containerResponse.Devices = []*pluginapi.DeviceSpec{dev}
 
-	response.ContainerResponses = []*pluginapi.ContainerAllocateResponse{containerResponse}
+	// every virtual device maps onto the same device node
+	for _, request := range r.ContainerRequests {
+		containerResponse := new(pluginapi.ContainerAllocateResponse)
+		dev := new(pluginapi.DeviceSpec)
+		dev.HostPath = dpi.devicePath
+		dev.ContainerPath = dpi.devicePath
+		dev.Permissions = dpi.permissions
+		containerResponse.Devices = []*pluginapi.DeviceSpec{dev}
+
+		response.ContainerResponses = append(response.ContainerResponses, containerResponse)
+		dpi.auditor.record(dpi.resourceName, "Allocate", request.DevicesIDs, nil, nil)
+	}
 
 	return &response, nil
 }
 
+// serve runs a serving cycle of the plugin until stop is closed or serving fails: it
+// listens on its socket, registers with kubelet and runs healthCheck. server implements
+// the device specific calls, e.g. Allocate.
+func (dpi *DevicePluginBase) serve(stop <-chan struct{}, server pluginapi.DevicePluginServer, healthCheck func() error) (err error) {
+	logger := log.DefaultLogger().Resource(dpi.resourceName)
+	dpi.stop = stop
+	dpi.resetForStart()
+
+	err = dpi.selectSocket()
+	if err != nil {
+		return err
+	}
+
+	err = dpi.cleanup()
+	if err != nil {
+		return err
+	}
+
+	sock, err := net.Listen("unix", dpi.socketPath)
+	if err != nil {
+		return fmt.Errorf("error creating GRPC server socket: %v", err)
+	}
+
+	dpi.server = grpc.NewServer([]grpc.ServerOption{}...)
+	defer dpi.stopDevicePlugin()
+
+	pluginapi.RegisterDevicePluginServer(dpi.server, server)
+
+	errChan := make(chan error, 2)
+
+	go func() {
+		errChan <- dpi.server.Serve(sock)
+	}()
+
+	err = waitForGRPCServer(dpi.socketPath, connectionTimeout)
+	if err != nil {
+		return fmt.Errorf("error starting the GRPC server: %v", err)
+	}
+
+	dpi.notifyState(PluginStateRegistering)
+	err = dpi.register()
+	if err != nil {
+		return fmt.Errorf("error registering with device plugin manager: %v", err)
+	}
+
+	go func() {
+		errChan <- healthCheck()
+	}()
+
+	dpi.setInitialized(true)
+	dpi.notifyState(PluginStateServing)
+	logger.Infof("%s device plugin started", dpi.resourceName)
+	err = <-errChan
+
+	return err
+}
+
+// resetForStart prepares the plugin for a new serving cycle, the channels of a previous
+// cycle are closed by its shutdown and can't be reused
+func (dpi *DevicePluginBase) resetForStart() {
+	dpi.done = make(chan struct{})
+	dpi.deregistered = make(chan struct{})
+	dpi.lock.Lock()
+	dpi.shuttingDown = false
+	dpi.lock.Unlock()
+}
+
+// stopDevicePlugin shuts the plugin down in order, all phases sharing shutdownTimeout:
+// new allocations are refused, kubelet is sent an empty device list, the gRPC server
+// is stopped gracefully and the socket is removed last
 func (dpi *DevicePluginBase) stopDevicePlugin() error {
-	defer func() {
-		if !IsChanClosed(dpi.done) {
-			close(dpi.done)
+	logger := log.DefaultLogger().Resource(dpi.resourceName)
+	timeout := dpi.shutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	logger.Infof("%s device plugin shutting down: refusing new allocations", dpi.resourceName)
+	dpi.setShuttingDown()
+
+	if dpi.isRetiring() {
+		logger.Infof("%s device plugin shutting down: retiring, the devices stay registered", dpi.resourceName)
+	} else {
+		logger.Infof("%s device plugin shutting down: deregistering devices", dpi.resourceName)
+	}
+	streaming := dpi.isStreaming()
+	if !IsChanClosed(dpi.done) {
+		close(dpi.done)
+	}
+	if streaming {
+		select {
+		case <-dpi.deregistered:
+		case <-time.After(time.Until(deadline)):
+			logger.Warningf("%s device plugin shutting down: timed out after %s sending the empty device list", dpi.resourceName, timeout)
 		}
+	}
+
+	logger.Infof("%s device plugin shutting down: stopping the gRPC server", dpi.resourceName)
+	stopped := make(chan struct{})
+	go func() {
+		dpi.server.GracefulStop()
+		close(stopped)
 	}()
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
 	select {
-	case <-dpi.deregistered:
-	case <-ticker.C:
+	case <-stopped:
+	case <-time.After(time.Until(deadline)):
+		logger.Warningf("%s device plugin shutting down: timed out after %s waiting for in-flight calls, forcing the gRPC server down", dpi.resourceName, timeout)
+		dpi.server.Stop()
+		<-stopped
 	}
 
-	dpi.server.Stop()
 	dpi.setInitialized(false)
+	logger.Infof("%s device plugin shutting down: removing socket %s", dpi.resourceName, dpi.socketPath)
 	return dpi.cleanup()
 }
 
@@ -211,11 +422,207 @@ func (dpi *DevicePluginBase) GetInitialized() bool {
 func (dpi *DevicePluginBase) setInitialized(initialized bool) {
 	dpi.lock.Lock()
 	dpi.initialized = initialized
+	if initialized {
+		dpi.registeredAt = time.Now()
+	}
+	dpi.lock.Unlock()
+}
+
+func (dpi *DevicePluginBase) setShuttingDown() {
+	dpi.lock.Lock()
+	dpi.shuttingDown = true
+	dpi.lock.Unlock()
+}
+
+func (dpi *DevicePluginBase) isShuttingDown() bool {
+	dpi.lock.Lock()
+	defer dpi.lock.Unlock()
+	return dpi.shuttingDown
+}
+
+func (dpi *DevicePluginBase) setStreaming(streaming bool) {
+	dpi.lock.Lock()
+	dpi.streaming = streaming
 	dpi.lock.Unlock()
 }
 
+func (dpi *DevicePluginBase) isStreaming() bool {
+	dpi.lock.Lock()
+	defer dpi.lock.Unlock()
+	return dpi.streaming
+}
+
+// advertisedDevices returns the devices with the unavailable ones reported unhealthy
+func (dpi *DevicePluginBase) advertisedDevices() []*pluginapi.Device {
+	dpi.lock.Lock()
+	defer dpi.lock.Unlock()
+	if len(dpi.unavailable) == 0 && len(dpi.cordoned) == 0 {
+		return dpi.devs
+	}
+
+	devs := make([]*pluginapi.Device, 0, len(dpi.devs))
+	for _, dev := range dpi.devs {
+		_, unavailable := dpi.unavailable[dev.ID]
+		_, cordoned := dpi.cordoned[dev.ID]
+		if (unavailable || cordoned) && dev.Health == pluginapi.Healthy {
+			advertised := *dev
+			advertised.Health = pluginapi.Unhealthy
+			dev = &advertised
+		}
+		devs = append(devs, dev)
+	}
+	return devs
+}
+
+// setUnavailable marks a device unavailable for a reason, e.g. it is allocated through
+// another resource. An empty reason clears the reason, the device is available again once
+// it has none left.
+func (dpi *DevicePluginBase) setUnavailable(devID string, source string, reason string) {
+	dpi.lock.Lock()
+	current, exists := dpi.unavailable[devID][source]
+	switch {
+	case reason == "" && exists:
+		delete(dpi.unavailable[devID], source)
+		if len(dpi.unavailable[devID]) == 0 {
+			delete(dpi.unavailable, devID)
+		}
+	case reason != "" && current != reason:
+		if dpi.unavailable == nil {
+			dpi.unavailable = make(map[string]map[string]string)
+		}
+		if dpi.unavailable[devID] == nil {
+			dpi.unavailable[devID] = make(map[string]string)
+		}
+		dpi.unavailable[devID][source] = reason
+	default:
+		dpi.lock.Unlock()
+		return
+	}
+	dpi.lock.Unlock()
+
+	dpi.requestRefresh()
+}
+
+// setCordoned replaces the cordoned devices. Newly cordoned devices are reported unhealthy,
+// uncordoned devices are reported with their actual health.
+func (dpi *DevicePluginBase) setCordoned(devIDs map[string]struct{}) {
+	logger := log.DefaultLogger().Resource(dpi.resourceName)
+	var cordoned []string
+	uncordoned := make(map[string]string)
+	dpi.lock.Lock()
+	for devID := range devIDs {
+		if _, exists := dpi.cordoned[devID]; !exists {
+			cordoned = append(cordoned, devID)
+		}
+	}
+	for _, dev := range dpi.devs {
+		if _, exists := dpi.cordoned[dev.ID]; !exists {
+			continue
+		}
+		if _, exists := devIDs[dev.ID]; !exists {
+			uncordoned[dev.ID] = dev.Health
+		}
+	}
+	dpi.cordoned = devIDs
+	dpi.lock.Unlock()
+
+	if len(cordoned) == 0 && len(uncordoned) == 0 {
+		return
+	}
+	for _, devID := range cordoned {
+		logger.DevID(devID).Infof("device %s is cordoned", devID)
+		if dpi.onHealthChange != nil {
+			dpi.onHealthChange(devID, pluginapi.Unhealthy, cordonedReason)
+		}
+	}
+	for devID, health := range uncordoned {
+		logger.DevID(devID).Infof("device %s is uncordoned", devID)
+		if dpi.onHealthChange != nil {
+			dpi.onHealthChange(devID, health, uncordonedReason)
+		}
+	}
+	dpi.requestRefresh()
+}
+
+func (dpi *DevicePluginBase) isCordoned(devID string) bool {
+	dpi.lock.Lock()
+	defer dpi.lock.Unlock()
+	_, cordoned := dpi.cordoned[devID]
+	return cordoned
+}
+
+func (dpi *DevicePluginBase) GetSocketPath() string {
+	dpi.lock.Lock()
+	defer dpi.lock.Unlock()
+	return dpi.socketPath
+}
+
+// requestRefresh asks ListAndWatch to send the device list again
+func (dpi *DevicePluginBase) requestRefresh() {
+	select {
+	case dpi.refresh <- struct{}{}:
+	default:
+	}
+}
+
+func (dpi *DevicePluginBase) setTakingOver(takingOver bool, legacyPredecessor bool) {
+	dpi.lock.Lock()
+	defer dpi.lock.Unlock()
+	dpi.takingOver = takingOver
+	dpi.legacyPredecessor = takingOver && legacyPredecessor
+}
+
+func (dpi *DevicePluginBase) isTakingOver() bool {
+	dpi.lock.Lock()
+	defer dpi.lock.Unlock()
+	return dpi.takingOver
+}
+
+// isTakingOverLegacy reports whether the plugin takes over from a release serving the legacy socket
+func (dpi *DevicePluginBase) isTakingOverLegacy() bool {
+	dpi.lock.Lock()
+	defer dpi.lock.Unlock()
+	return dpi.legacyPredecessor
+}
+
+// retire makes the next shutdown of the plugin leave its devices registered
+func (dpi *DevicePluginBase) retire() {
+	dpi.lock.Lock()
+	defer dpi.lock.Unlock()
+	dpi.retiring = true
+}
+
+func (dpi *DevicePluginBase) isRetiring() bool {
+	dpi.lock.Lock()
+	defer dpi.lock.Unlock()
+	return dpi.retiring
+}
+
+func (dpi *DevicePluginBase) setStateObserver(observer func(state string)) {
+	dpi.lock.Lock()
+	defer dpi.lock.Unlock()
+	dpi.onStateChange = observer
+}
+
+// notifyState reports a lifecycle state reached by the plugin within Start
+func (dpi *DevicePluginBase) notifyState(state string) {
+	dpi.lock.Lock()
+	observer := dpi.onStateChange
+	dpi.lock.Unlock()
+	if observer != nil {
+		observer(state)
+	}
+}
+
+// GetRegistrationTime returns when the plugin last registered with kubelet
+func (dpi *DevicePluginBase) GetRegistrationTime() time.Time {
+	dpi.lock.Lock()
+	defer dpi.lock.Unlock()
+	return dpi.registeredAt
+}
+
 func (dpi *DevicePluginBase) register() error {
-	conn, err := gRPCConnect(pluginapi.KubeletSocket, connectionTimeout)
+	conn, err := gRPCConnect(kubeletSocketPath(), connectionTimeout)
 	if err != nil {
 		return err
 	}
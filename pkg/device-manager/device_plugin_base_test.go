@@ -0,0 +1,258 @@
+package device_manager
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	config "github.com/jonkeyguan/vfio-device-plugin/pkg/config"
+)
+
+// fakeListAndWatchServer hands every list sent by ListAndWatch to send
+type fakeListAndWatchServer struct {
+	grpc.ServerStream
+	send func(*pluginapi.ListAndWatchResponse) error
+}
+
+func (s *fakeListAndWatchServer) Send(response *pluginapi.ListAndWatchResponse) error {
+	return s.send(response)
+}
+
+// servedNullPlugin returns a plugin of /dev/null serving service on a socket of a temp directory
+func servedNullPlugin(t *testing.T, service func(*GenericDevicePlugin) pluginapi.DevicePluginServer) *GenericDevicePlugin {
+	dpi := NewGenericDevicePlugin(config.DeviceNode{Name: "example.com/null", Path: "/dev/null", Count: 2, HealthCheck: config.HealthCheckNone}, "rw")
+	dpi.socketPath = filepath.Join(t.TempDir(), "null.sock")
+	dpi.shutdownTimeout = 200 * time.Millisecond
+	dpi.stop = make(chan struct{})
+
+	listener, err := net.Listen("unix", dpi.socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dpi.server = grpc.NewServer()
+	pluginapi.RegisterDevicePluginServer(dpi.server, service(dpi))
+	go dpi.server.Serve(listener)
+	dpi.setInitialized(true)
+	t.Cleanup(dpi.server.Stop)
+	return dpi
+}
+
+func servePlugin(dpi *GenericDevicePlugin) pluginapi.DevicePluginServer {
+	return dpi
+}
+
+// listAndWatch runs ListAndWatch of dpi against stream and waits until it streams
+func listAndWatch(t *testing.T, dpi *DevicePluginBase, stream *fakeListAndWatchServer) <-chan struct{} {
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+		dpi.ListAndWatch(&pluginapi.Empty{}, stream)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for !dpi.isStreaming() {
+		if time.Now().After(deadline) {
+			t.Fatal("ListAndWatch didn't start streaming")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return returned
+}
+
+func TestStopDevicePluginPhases(t *testing.T) {
+	dpi := servedNullPlugin(t, servePlugin)
+
+	var lock sync.Mutex
+	var phases []string
+	record := func(phase string) {
+		lock.Lock()
+		defer lock.Unlock()
+		phases = append(phases, phase)
+	}
+	stream := &fakeListAndWatchServer{send: func(response *pluginapi.ListAndWatchResponse) error {
+		if len(response.Devices) > 0 {
+			record("listed")
+			return nil
+		}
+		// kubelet gets the empty list from a server refusing allocations and still serving its socket
+		request := &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"null-0"}}}}
+		if _, err := dpi.Allocate(context.Background(), request); status.Code(err) == codes.Unavailable {
+			record("allocations refused")
+		}
+		if _, err := os.Stat(dpi.socketPath); err == nil {
+			record("deregistered")
+		}
+		return nil
+	}}
+	returned := listAndWatch(t, dpi.DevicePluginBase, stream)
+
+	if err := dpi.stopDevicePlugin(); err != nil {
+		t.Fatalf("failed to stop the device plugin: %v", err)
+	}
+	record("stopped")
+	<-returned
+
+	expected := []string{"listed", "allocations refused", "deregistered", "stopped"}
+	if len(phases) != len(expected) {
+		t.Fatalf("expected phases %v, got %v", expected, phases)
+	}
+	for i := range expected {
+		if phases[i] != expected[i] {
+			t.Fatalf("expected phases %v, got %v", expected, phases)
+		}
+	}
+	if _, err := os.Stat(dpi.socketPath); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed, got %v", err)
+	}
+	if dpi.GetInitialized() {
+		t.Error("expected the plugin not to be initialized once stopped")
+	}
+}
+
+func TestStopDevicePluginDeregistrationTimeout(t *testing.T) {
+	dpi := servedNullPlugin(t, servePlugin)
+
+	// kubelet never reads the empty list
+	release := make(chan struct{})
+	defer close(release)
+	stream := &fakeListAndWatchServer{send: func(response *pluginapi.ListAndWatchResponse) error {
+		if len(response.Devices) == 0 {
+			<-release
+		}
+		return nil
+	}}
+	listAndWatch(t, dpi.DevicePluginBase, stream)
+
+	started := time.Now()
+	if err := dpi.stopDevicePlugin(); err != nil {
+		t.Fatalf("failed to stop the device plugin: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed < dpi.shutdownTimeout || elapsed > 2*time.Second {
+		t.Errorf("expected the shutdown to give up after %s, it took %s", dpi.shutdownTimeout, elapsed)
+	}
+	if _, err := os.Stat(dpi.socketPath); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed, got %v", err)
+	}
+}
+
+// blockingPlugin holds every PreStartContainer call until its context is done
+type blockingPlugin struct {
+	*GenericDevicePlugin
+	called chan struct{}
+}
+
+func (p *blockingPlugin) PreStartContainer(ctx context.Context, _ *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	close(p.called)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestStopDevicePluginForcesInFlightCalls(t *testing.T) {
+	called := make(chan struct{})
+	dpi := servedNullPlugin(t, func(dpi *GenericDevicePlugin) pluginapi.DevicePluginServer {
+		return &blockingPlugin{GenericDevicePlugin: dpi, called: called}
+	})
+
+	conn, err := gRPCConnect(dpi.socketPath, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go pluginapi.NewDevicePluginClient(conn).PreStartContainer(context.Background(), &pluginapi.PreStartContainerRequest{})
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("the call didn't reach the device plugin")
+	}
+
+	started := time.Now()
+	if err := dpi.stopDevicePlugin(); err != nil {
+		t.Fatalf("failed to stop the device plugin: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed < dpi.shutdownTimeout || elapsed > 2*time.Second {
+		t.Errorf("expected the gRPC server to be forced down after %s, it took %s", dpi.shutdownTimeout, elapsed)
+	}
+	if _, err := os.Stat(dpi.socketPath); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed, got %v", err)
+	}
+}
+
+func TestListAndWatchHealthUpdates(t *testing.T) {
+	dpi := servedNullPlugin(t, servePlugin)
+
+	var lock sync.Mutex
+	changes := make(map[string]string)
+	dpi.onHealthChange = func(devID string, health string, reason string) {
+		lock.Lock()
+		defer lock.Unlock()
+		changes[devID] = health + " " + reason
+	}
+	stream := &fakeListAndWatchServer{send: func(*pluginapi.ListAndWatchResponse) error { return nil }}
+	returned := listAndWatch(t, dpi.DevicePluginBase, stream)
+
+	// the device is cordoned and uncordoned while its health changes
+	cordoned := make(chan struct{})
+	go func() {
+		defer close(cordoned)
+		for i := 0; i < 100; i++ {
+			dpi.setCordoned(map[string]struct{}{"null-0": {}})
+			dpi.setCordoned(map[string]struct{}{})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		dpi.health <- deviceHealth{DevId: "null-0", Health: pluginapi.Unhealthy, Reason: "gone"}
+		dpi.health <- deviceHealth{DevId: "null-0", Health: pluginapi.Healthy, Reason: "back"}
+	}
+	<-cordoned
+	dpi.health <- deviceHealth{DevId: "null-0", Health: pluginapi.Unhealthy, Reason: "gone"}
+
+	if err := dpi.stopDevicePlugin(); err != nil {
+		t.Fatalf("failed to stop the device plugin: %v", err)
+	}
+	<-returned
+
+	lock.Lock()
+	defer lock.Unlock()
+	if changes["null-0"] != pluginapi.Unhealthy+" gone" {
+		t.Errorf("expected null-0 to be reported unhealthy, got %q", changes["null-0"])
+	}
+	if _, reported := changes["null-1"]; reported {
+		t.Errorf("expected the health of null-1 not to change, got %q", changes["null-1"])
+	}
+}
+
+func TestHealthCheckStopsWithoutListAndWatch(t *testing.T) {
+	dpi := servedNullPlugin(t, servePlugin)
+	stop := make(chan struct{})
+	dpi.stop = stop
+	// the device is missing, the health check reports it unhealthy right away
+	dpi.deviceRoot = t.TempDir()
+	dpi.healthCheckMode = config.HealthCheckExists
+	if err := os.Mkdir(filepath.Join(dpi.deviceRoot, "dev"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	returned := make(chan error)
+	go func() {
+		returned <- dpi.healthCheck()
+	}()
+	// kubelet never called ListAndWatch, nothing reads the health update
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the health check didn't stop")
+	}
+}
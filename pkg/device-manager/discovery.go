@@ -0,0 +1,179 @@
+package device_manager
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DiscoveryResult describes what discovery found for one configured device address or device node
+type DiscoveryResult struct {
+	Resource   string `json:"resource"`
+	Bus        string `json:"bus"`
+	Address    string `json:"address"`
+	PCIID      string `json:"pciId,omitempty"`
+	Driver     string `json:"driver,omitempty"`
+	IOMMUGroup string `json:"iommuGroup,omitempty"`
+	NUMANode   int    `json:"numaNode"`
+	LocalCPUs  string `json:"localCpus,omitempty"`
+	// Count is the number of devices advertised for a device node
+	Count      int    `json:"count,omitempty"`
+	Advertised bool   `json:"advertised"`
+	Reason     string `json:"reason,omitempty"`
+	Message    string `json:"message,omitempty"`
+}
+
+// probeConfiguredDevice reads the sysfs attributes of a configured device of bus and checks
+// that it can be handed to a guest. When the device is rejected, the returned PCIDevice holds
+// whatever could be read, along with the event reason and the error explaining why.
+func probeConfiguredDevice(bus *deviceBus, pciAddress string) (*PCIDevice, string, error) {
+	pcidev := &PCIDevice{
+		bus:        bus.name,
+		pciAddress: pciAddress,
+		numaNode:   -1,
+	}
+
+	pciID, err := bus.identify(bus.basePath, pciAddress)
+	if err != nil {
+		return pcidev, DeviceDiscoveryFailedReason, fmt.Errorf("failed to identify %s device: %v", bus.name, err)
+	}
+	pcidev.pciID = pciID
+	if bus.hasNUMA {
+		pcidev.numaNode = Handler.GetDeviceNumaNode(bus.basePath, pciAddress)
+		pcidev.localCPUs = readLocalCPUs(bus.basePath, pciAddress)
+		// firmware without proximity information reports -1, the local CPUs still tell the node
+		if pcidev.numaNode < 0 && pcidev.localCPUs != "" {
+			pcidev.numaNode = numaNodeOfCPUs(pcidev.localCPUs)
+		}
+	}
+
+	driver, err := Handler.GetDeviceDriver(bus.basePath, pciAddress)
+	if err != nil {
+		return pcidev, DeviceNotVfioBoundReason, fmt.Errorf("not bound to any driver: %v", err)
+	}
+	pcidev.driver = driver
+
+	// the group is read before rejecting devices bound to another driver so that it can be reported
+	iommuGroup, iommuErr := Handler.GetDeviceIOMMUGroup(bus.basePath, pciAddress)
+	pcidev.iommuGroup = iommuGroup
+
+	if !bus.isVfioDriver(driver) {
+		return pcidev, DeviceNotVfioBoundReason, fmt.Errorf("bound to %s instead of %s", driver, strings.Join(bus.vfioDrivers, " or "))
+	}
+	if iommuErr != nil {
+		return pcidev, DeviceDiscoveryFailedReason, fmt.Errorf("failed to get IOMMU group: %v", iommuErr)
+	}
+
+	if err := checkIOMMUGroupViable(iommuGroup); err != nil {
+		return pcidev, IOMMUGroupUnviableReason, fmt.Errorf("IOMMU group %s is not viable: %v", iommuGroup, err)
+	}
+
+	return pcidev, "", nil
+}
+
+// probeLazyDevice probes a device of a lazy binding resource, which may be bound to its host
+// driver. The iommu group viability is only checked once the device is bound to vfio-pci.
+func probeLazyDevice(bus *deviceBus, pciAddress string) (*PCIDevice, string, error) {
+	pcidev, reason, err := probeConfiguredDevice(bus, pciAddress)
+	if reason == IOMMUGroupUnviableReason || (reason == DeviceNotVfioBoundReason && pcidev.driver != "" && pcidev.iommuGroup != "") {
+		if !bus.isVfioDriver(pcidev.driver) {
+			pcidev.hostDriver = pcidev.driver
+		}
+		return pcidev, "", nil
+	}
+	return pcidev, reason, err
+}
+
+// discovery is the outcome of probing the configured devices and bundles
+type discovery struct {
+	pciDeviceMap     map[string][]*PCIDevice
+	compositeBundles map[string][][]*PCIDevice
+	// rejected are the configured devices which can't be advertised
+	rejected []DiscoveryResult
+}
+
+// discover probes the configured devices and bundles and records the outcome, the error
+// tells that some configured device or bundle failed
+func (c *DeviceController) discover() (*discovery, error) {
+	pciDeviceMap, rejected, discoverErr := c.discoverConfiguredVfioDevices()
+	compositeBundles, compositeRejected, compositeErr := c.discoverComposites()
+	if discoverErr == nil {
+		discoverErr = compositeErr
+	}
+	c.setDiscoveryError(discoverErr)
+	return &discovery{
+		pciDeviceMap:     pciDeviceMap,
+		compositeBundles: compositeBundles,
+		rejected:         append(rejected, compositeRejected...),
+	}, discoverErr
+}
+
+func newDiscoveryResult(resourceName string, pcidev *PCIDevice) DiscoveryResult {
+	return DiscoveryResult{
+		Resource:   resourceName,
+		Bus:        busName(pcidev.bus),
+		Address:    pcidev.pciAddress,
+		PCIID:      pcidev.pciID,
+		Driver:     pcidev.driver,
+		IOMMUGroup: pcidev.iommuGroup,
+		NUMANode:   pcidev.numaNode,
+		LocalCPUs:  pcidev.localCPUs,
+	}
+}
+
+// rejectedDevice reports a device which discovery rejected with the event reason and the error
+func rejectedDevice(resourceName string, pcidev *PCIDevice, reason string, err error) DiscoveryResult {
+	result := newDiscoveryResult(resourceName, pcidev)
+	result.Reason = reason
+	result.Message = err.Error()
+	return result
+}
+
+// DiscoveryReport runs the discovery of the controller and builds its device plugins
+// without starting any, and reports per device whether it would be advertised or why not
+func (c *DeviceController) DiscoveryReport() []DiscoveryResult {
+	found, discoverErr := c.discover()
+	results := found.rejected
+
+	var plugins []Device
+	plugins = append(plugins, c.buildDevicePlugins(found.pciDeviceMap)...)
+	plugins = append(plugins, c.buildCompositePlugins(found.compositeBundles)...)
+	for _, plugin := range plugins {
+		dpi, isPCI := plugin.(*PCIDevicePlugin)
+		if !isPCI {
+			continue
+		}
+		for _, members := range dpi.deviceMembers {
+			for _, member := range members {
+				result := newDiscoveryResult(dpi.resourceName, member)
+				if discoverErr != nil {
+					// the vfio plugins only start once every configured device is discovered
+					result.Reason = DeviceDiscoveryFailedReason
+					result.Message = "held back until every configured device is discovered"
+				} else {
+					result.Advertised = true
+				}
+				results = append(results, result)
+			}
+		}
+	}
+	for _, plugin := range c.buildDeviceNodePlugins() {
+		if dpi, isGeneric := plugin.(*GenericDevicePlugin); isGeneric {
+			results = append(results, DiscoveryResult{
+				Resource:   dpi.resourceName,
+				Address:    dpi.devicePath,
+				NUMANode:   -1,
+				Count:      len(dpi.devs),
+				Advertised: true,
+			})
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Resource != results[j].Resource {
+			return results[i].Resource < results[j].Resource
+		}
+		return results[i].Address < results[j].Address
+	})
+	return results
+}
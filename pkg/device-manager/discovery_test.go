@@ -0,0 +1,87 @@
+package device_manager
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const discoveryReportConfig = `
+resources:
+- resourceName: example.com/gpu
+  addresses:
+  - 0000:01:00.0
+  - 0000:02:00.0
+deviceNodes:
+- resourceName: example.com/kvm
+  path: /dev/kvm
+  count: 3
+composites:
+- resourceName: example.com/bundle
+  bundles:
+  - [0000:05:00.0, 0000:06:00.0]
+`
+
+func formatDiscoveryResults(results []DiscoveryResult) string {
+	var lines []string
+	for _, result := range results {
+		line := fmt.Sprintf("%s %s advertised=%t", result.Resource, result.Address, result.Advertised)
+		if result.Count > 0 {
+			line += fmt.Sprintf(" count=%d", result.Count)
+		}
+		if result.Reason != "" {
+			line += " " + result.Reason
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestDiscoveryReport(t *testing.T) {
+	tests := []struct {
+		name     string
+		driver   string
+		expected []string
+	}{
+		{
+			name:   "every device discovered",
+			driver: "vfio-pci",
+			expected: []string{
+				"example.com/bundle 0000:05:00.0 advertised=true",
+				"example.com/bundle 0000:06:00.0 advertised=true",
+				"example.com/gpu 0000:01:00.0 advertised=true",
+				"example.com/gpu 0000:02:00.0 advertised=true",
+				"example.com/kvm /dev/kvm advertised=true count=3",
+			},
+		},
+		{
+			name:   "a device bound to its host driver holds the others back",
+			driver: "nvidia",
+			expected: []string{
+				"example.com/bundle 0000:05:00.0 advertised=false DeviceDiscoveryFailed",
+				"example.com/bundle 0000:06:00.0 advertised=false DeviceDiscoveryFailed",
+				"example.com/gpu 0000:01:00.0 advertised=false DeviceDiscoveryFailed",
+				"example.com/gpu 0000:02:00.0 advertised=false DeviceNotVfioBound",
+				"example.com/kvm /dev/kvm advertised=true count=3",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := &fakeDeviceHandler{devices: map[string]*fakeDevice{
+				"0000:01:00.0": {pciID: "10de:1eb8", driver: "vfio-pci", iommuGroup: "11"},
+				"0000:02:00.0": {pciID: "10de:1eb8", driver: test.driver, iommuGroup: "12"},
+				"0000:05:00.0": {pciID: "10de:20b0", driver: "vfio-pci", iommuGroup: "15"},
+				"0000:06:00.0": {pciID: "15b3:101d", driver: "vfio-pci", iommuGroup: "16"},
+			}}
+			useDeviceHandler(t, handler)
+			useIOMMUGroups(t, handler)
+
+			c := NewDeviceController("rw", newTestConfig(t, discoveryReportConfig), nil, "", nil)
+			report := formatDiscoveryResults(c.DiscoveryReport())
+			if report != strings.Join(test.expected, "\n") {
+				t.Errorf("unexpected report:\n%s\nexpected:\n%s", report, strings.Join(test.expected, "\n"))
+			}
+		})
+	}
+}
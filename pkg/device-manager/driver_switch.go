@@ -0,0 +1,228 @@
+package device_manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/log"
+)
+
+const (
+	driverJournalFile = "drivers.json"
+	vfioPCIDriver     = "vfio-pci"
+	// vfioDeviceTimeout bounds the wait for the vfio device of a group bound to vfio-pci
+	vfioDeviceTimeout = 5 * time.Second
+
+	// states of a journaled device, a device found binding or restoring after a restart
+	// was interrupted mid-switch
+	driverStateBinding   = "binding"
+	driverStateBound     = "bound"
+	driverStateRestoring = "restoring"
+)
+
+// driverJournalEntry records a device of a lazy binding resource which left its host driver
+type driverJournalEntry struct {
+	Resource string `json:"resource"`
+	DeviceID string `json:"deviceId"`
+	// HostDrivers maps the address of every member to the driver it is restored to
+	HostDrivers map[string]string `json:"hostDrivers"`
+	State       string            `json:"state"`
+	Since       time.Time         `json:"since"`
+}
+
+func driverJournalKey(resourceName string, devID string) string {
+	return resourceName + "/" + devID
+}
+
+// loadDriverJournal restores the devices switched to vfio-pci by a previous run
+func (c *DeviceController) loadDriverJournal() {
+	if c.stateDir == "" {
+		return
+	}
+	data, err := os.ReadFile(filepath.Join(c.stateDir, driverJournalFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	} else if err != nil {
+		log.DefaultLogger().Reason(err).Error("failed to read the driver journal")
+		return
+	}
+	var entries []*driverJournalEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		log.DefaultLogger().Reason(err).Error("failed to parse the driver journal")
+		return
+	}
+
+	c.driverMutex.Lock()
+	defer c.driverMutex.Unlock()
+	for _, entry := range entries {
+		c.driverJournal[driverJournalKey(entry.Resource, entry.DeviceID)] = entry
+	}
+}
+
+// saveDriverJournal must be called with driverMutex held
+func (c *DeviceController) saveDriverJournal() {
+	if c.stateDir == "" {
+		return
+	}
+	entries := make([]*driverJournalEntry, 0, len(c.driverJournal))
+	for _, entry := range c.driverJournal {
+		entries = append(entries, entry)
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		log.DefaultLogger().Reason(err).Error("failed to marshal the driver journal")
+		return
+	}
+	if err := writeFileAtomic(filepath.Join(c.stateDir, driverJournalFile), data); err != nil {
+		log.DefaultLogger().Reason(err).Error("failed to save the driver journal")
+	}
+}
+
+// bindDevices binds the devices of a lazy binding resource to vfio-pci and waits for their
+// vfio devices. A device which fails is restored to its host driver.
+func (c *DeviceController) bindDevices(plugin *PCIDevicePlugin, devIDs []string) error {
+	c.driverMutex.Lock()
+	defer c.driverMutex.Unlock()
+
+	for _, devID := range devIDs {
+		members, exists := plugin.deviceMembers[devID]
+		if !exists {
+			continue
+		}
+		key := driverJournalKey(plugin.resourceName, devID)
+		entry, journaled := c.driverJournal[key]
+		if journaled && entry.State == driverStateBound {
+			continue
+		}
+		if !journaled {
+			entry = &driverJournalEntry{
+				Resource:    plugin.resourceName,
+				DeviceID:    devID,
+				HostDrivers: make(map[string]string),
+			}
+			for _, member := range members {
+				driver, err := Handler.GetDeviceDriver(pciBasePath, member.pciAddress)
+				if err != nil {
+					// devices found unbound are restored to the driver they were discovered with
+					driver = member.hostDriver
+				}
+				if driver == vfioPCIDriver {
+					driver = member.hostDriver
+				}
+				entry.HostDrivers[member.pciAddress] = driver
+			}
+			c.driverJournal[key] = entry
+		}
+		entry.State = driverStateBinding
+		entry.Since = time.Now()
+		c.saveDriverJournal()
+
+		if err := bindToVfio(members); err != nil {
+			if restoreErr := c.restoreEntry(entry); restoreErr != nil {
+				log.DefaultLogger().Resource(plugin.resourceName).DevID(devID).Reason(restoreErr).Error("failed to restore the host driver")
+			}
+			return fmt.Errorf("device %s: %v", devID, err)
+		}
+		entry.State = driverStateBound
+		c.saveDriverJournal()
+		log.DefaultLogger().Resource(plugin.resourceName).DevID(devID).Infof("Bound device %s to %s", devID, vfioPCIDriver)
+	}
+	return nil
+}
+
+// bindToVfio binds members to vfio-pci and checks that their iommu groups can be used
+func bindToVfio(members []*PCIDevice) error {
+	for _, member := range members {
+		driver, err := Handler.GetDeviceDriver(pciBasePath, member.pciAddress)
+		if err == nil && driver == vfioPCIDriver {
+			continue
+		}
+		if err := Handler.SetDeviceDriver(pciBasePath, member.pciAddress, vfioPCIDriver); err != nil {
+			return err
+		}
+	}
+	for _, group := range bundleGroups(members) {
+		if err := waitForVfioDevice(group); err != nil {
+			return err
+		}
+		if err := checkIOMMUGroupViable(group); err != nil {
+			return fmt.Errorf("IOMMU group %s is not viable: %v", group, err)
+		}
+	}
+	return nil
+}
+
+func waitForVfioDevice(group string) error {
+	vfioDevice := filepath.Join(vfioDevicePath, group)
+	deadline := time.Now().Add(vfioDeviceTimeout)
+	for {
+		if _, err := os.Stat(vfioDevice); err == nil {
+			return nil
+		} else if time.Now().After(deadline) {
+			return fmt.Errorf("vfio device %s didn't appear: %v", vfioDevice, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// restoreDrivers returns a released device of a lazy binding resource to its host driver
+func (c *DeviceController) restoreDrivers(resourceName string, devID string) error {
+	c.driverMutex.Lock()
+	defer c.driverMutex.Unlock()
+
+	entry, journaled := c.driverJournal[driverJournalKey(resourceName, devID)]
+	if !journaled {
+		return nil
+	}
+	if err := c.restoreEntry(entry); err != nil {
+		return err
+	}
+	log.DefaultLogger().Resource(resourceName).DevID(devID).Infof("Restored device %s to its host driver", devID)
+	return nil
+}
+
+// restoreEntry binds the members of a journaled device back to their host driver and drops
+// the entry. It must be called with driverMutex held.
+func (c *DeviceController) restoreEntry(entry *driverJournalEntry) error {
+	entry.State = driverStateRestoring
+	c.saveDriverJournal()
+	for address, driver := range entry.HostDrivers {
+		// a device found unbound is still unbound from vfio-pci and its override cleared,
+		// the override would hand it back to vfio-pci on the next probe
+		if driver != "" {
+			if current, err := Handler.GetDeviceDriver(pciBasePath, address); err == nil && current == driver {
+				continue
+			}
+		}
+		if err := Handler.SetDeviceDriver(pciBasePath, address, driver); err != nil {
+			return err
+		}
+	}
+	delete(c.driverJournal, driverJournalKey(entry.Resource, entry.DeviceID))
+	c.saveDriverJournal()
+	return nil
+}
+
+// staleDriverEntries returns the journaled devices which aren't allocated anymore: their
+// switch was interrupted, or they were bound for a container which never showed up in the
+// PodResources API
+func (c *DeviceController) staleDriverEntries(allocated map[string]map[string]struct{}) []*driverJournalEntry {
+	c.driverMutex.Lock()
+	defer c.driverMutex.Unlock()
+
+	var stale []*driverJournalEntry
+	for _, entry := range c.driverJournal {
+		if _, isAllocated := allocated[entry.Resource][entry.DeviceID]; isAllocated {
+			continue
+		}
+		if entry.State == driverStateBound && time.Since(entry.Since) < reservationGracePeriod {
+			continue
+		}
+		stale = append(stale, entry)
+	}
+	return stale
+}
@@ -0,0 +1,35 @@
+package device_manager
+
+import (
+	"testing"
+)
+
+func TestRestoreEntry(t *testing.T) {
+	handler := &fakeDeviceHandler{devices: map[string]*fakeDevice{
+		"0000:01:00.0": {pciID: "10de:1eb8", driver: vfioPCIDriver, iommuGroup: "12"},
+		"0000:01:00.1": {pciID: "10de:10f8", driver: vfioPCIDriver, iommuGroup: "12"},
+	}}
+	useDeviceHandler(t, handler)
+
+	c := &DeviceController{driverJournal: map[string]*driverJournalEntry{}}
+	entry := &driverJournalEntry{
+		Resource: "example.com/gpu",
+		DeviceID: "12",
+		// the audio function was found unbound
+		HostDrivers: map[string]string{"0000:01:00.0": "nvidia", "0000:01:00.1": ""},
+		State:       driverStateBound,
+	}
+	c.driverJournal[driverJournalKey(entry.Resource, entry.DeviceID)] = entry
+
+	if err := c.restoreEntry(entry); err != nil {
+		t.Fatalf("failed to restore the host drivers: %v", err)
+	}
+	for address, expected := range entry.HostDrivers {
+		if driver := handler.devices[address].driver; driver != expected {
+			t.Errorf("expected %s to be bound to %q, got %q", address, expected, driver)
+		}
+	}
+	if len(c.driverJournal) != 0 {
+		t.Errorf("expected the journal entry to be dropped, got %v", c.driverJournal)
+	}
+}
@@ -21,13 +21,22 @@ package device_manager
 
 import (
 	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
 	"time"
 
+	config "github.com/jonkeyguan/vfio-device-plugin/pkg/config"
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/util"
+
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
 const (
-	connectionTimeout = 5 * time.Second
+	connectionTimeout      = 5 * time.Second
+	defaultShutdownTimeout = 5 * time.Second
+	// openProbeInterval is how often the open health check tries to open the device node
+	openProbeInterval = 10 * time.Second
 )
 
 type Device interface {
@@ -37,4 +46,59 @@ type Device interface {
 	Allocate(context.Context, *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error)
 	GetDeviceName() string
 	GetInitialized() bool
+	GetSocketPath() string
+	GetRegistrationTime() time.Time
+	requestRefresh()
+	setTakingOver(takingOver bool, legacyPredecessor bool)
+	retire()
+	setStateObserver(observer func(state string))
+}
+
+// GenericDevicePlugin advertises a host device node, such as /dev/kvm, as a number
+// of virtual devices which all map onto the same node
+type GenericDevicePlugin struct {
+	*DevicePluginBase
+}
+
+func NewGenericDevicePlugin(deviceNode config.DeviceNode, defaultPermissions string) *GenericDevicePlugin {
+	serverSock := SocketPath(socketName(deviceNode.Name))
+	permissions := deviceNode.Permissions
+	if permissions == "" {
+		permissions = defaultPermissions
+	}
+
+	dpi := &GenericDevicePlugin{
+		DevicePluginBase: &DevicePluginBase{
+			devs:            []*pluginapi.Device{},
+			initialized:     false,
+			lock:            &sync.Mutex{},
+			socketPath:      serverSock,
+			devicePath:      deviceNode.Path,
+			deviceName:      filepath.Base(deviceNode.Path),
+			resourceName:    deviceNode.Name,
+			deviceRoot:      util.HostRootMount,
+			health:          make(chan deviceHealth),
+			done:            make(chan struct{}),
+			deregistered:    make(chan struct{}),
+			refresh:         make(chan struct{}, 1),
+			permissions:     permissions,
+			healthCheckMode: deviceNode.HealthCheck,
+		},
+	}
+	for i := 0; i < deviceNode.Count; i++ {
+		dpi.devs = append(dpi.devs, &pluginapi.Device{
+			ID:     fmt.Sprintf("%s-%d", dpi.deviceName, i),
+			Health: pluginapi.Healthy,
+		})
+	}
+	return dpi
+}
+
+func (dpi *GenericDevicePlugin) Start(stop <-chan struct{}) error {
+	return dpi.serve(stop, dpi, dpi.healthCheck)
+}
+
+func (dpi *GenericDevicePlugin) GetPreferredAllocation(
+	_ context.Context, _ *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	return nil, nil
 }
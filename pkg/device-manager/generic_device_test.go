@@ -0,0 +1,234 @@
+package device_manager
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	config "github.com/jonkeyguan/vfio-device-plugin/pkg/config"
+)
+
+// fakeKubelet hands every registration to registered
+type fakeKubelet struct {
+	registered chan *pluginapi.RegisterRequest
+}
+
+func (k *fakeKubelet) Register(_ context.Context, request *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
+	k.registered <- request
+	return &pluginapi.Empty{}, nil
+}
+
+// serveKubelet serves the registration socket of kubelet in the device plugin directory
+func serveKubelet(t *testing.T) *fakeKubelet {
+	listener, err := net.Listen("unix", kubeletSocketPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	kubelet := &fakeKubelet{registered: make(chan *pluginapi.RegisterRequest, 1)}
+	server := grpc.NewServer()
+	pluginapi.RegisterRegistrationServer(server, kubelet)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return kubelet
+}
+
+func expectDevices(t *testing.T, expected map[string]string, devices []*pluginapi.Device) {
+	t.Helper()
+	health := make(map[string]string)
+	for _, dev := range devices {
+		health[dev.ID] = dev.Health
+	}
+	if len(health) != len(expected) {
+		t.Fatalf("expected devices %v, got %v", expected, health)
+	}
+	for devID, devHealth := range expected {
+		if health[devID] != devHealth {
+			t.Fatalf("expected devices %v, got %v", expected, health)
+		}
+	}
+}
+
+func TestGenericDevicePluginServes(t *testing.T) {
+	useDevicePluginPath(t)
+	kubelet := serveKubelet(t)
+	dpi := NewGenericDevicePlugin(config.DeviceNode{Name: "example.com/null", Path: "/dev/null", Count: 2, HealthCheck: config.HealthCheckNone}, "rw")
+	dpi.shutdownTimeout = 200 * time.Millisecond
+
+	stop := make(chan struct{})
+	returned := make(chan error)
+	go func() {
+		returned <- dpi.Start(stop)
+	}()
+	select {
+	case request := <-kubelet.registered:
+		if request.ResourceName != "example.com/null" || request.Endpoint != filepath.Base(dpi.GetSocketPath()) {
+			t.Errorf("unexpected registration %+v", request)
+		}
+	case err := <-returned:
+		t.Fatalf("the device plugin didn't register: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the device plugin didn't register")
+	}
+
+	conn, err := gRPCConnect(dpi.GetSocketPath(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := pluginapi.NewDevicePluginClient(conn)
+	stream, err := client.ListAndWatch(context.Background(), &pluginapi.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDevices(t, map[string]string{"null-0": pluginapi.Healthy, "null-1": pluginapi.Healthy}, response.Devices)
+
+	request := &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"null-0"}}}}
+	allocated, err := client.Allocate(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocated.ContainerResponses) != 1 || len(allocated.ContainerResponses[0].Devices) != 1 || allocated.ContainerResponses[0].Devices[0].HostPath != "/dev/null" {
+		t.Errorf("unexpected allocation %+v", allocated)
+	}
+
+	close(stop)
+	// the devices are deregistered before the plugin stops
+	response, err = stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDevices(t, map[string]string{}, response.Devices)
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the device plugin didn't stop")
+	}
+	if _, err := os.Stat(dpi.GetSocketPath()); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed, got %v", err)
+	}
+}
+
+func TestGenericDevicePluginAllocate(t *testing.T) {
+	tests := []struct {
+		name        string
+		permissions string
+		containers  [][]string
+		expected    string
+	}{
+		{name: "default permissions", containers: [][]string{{"kvm-0"}}, expected: "rw"},
+		{name: "node permissions", permissions: "r", containers: [][]string{{"kvm-0", "kvm-1"}}, expected: "r"},
+		{name: "several containers", containers: [][]string{{"kvm-0"}, {"kvm-1", "kvm-2"}}, expected: "rw"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := config.DeviceNode{Name: "example.com/kvm", Path: "/dev/kvm", Count: 3, Permissions: test.permissions}
+			dpi := NewGenericDevicePlugin(node, "rw")
+			request := &pluginapi.AllocateRequest{}
+			for _, devIDs := range test.containers {
+				request.ContainerRequests = append(request.ContainerRequests, &pluginapi.ContainerAllocateRequest{DevicesIDs: devIDs})
+			}
+
+			response, err := dpi.Allocate(context.Background(), request)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(response.ContainerResponses) != len(test.containers) {
+				t.Fatalf("expected %d container responses, got %d", len(test.containers), len(response.ContainerResponses))
+			}
+			// every virtual device maps onto the same node, once per container
+			for _, containerResponse := range response.ContainerResponses {
+				if len(containerResponse.Devices) != 1 {
+					t.Fatalf("expected a single device spec, got %v", containerResponse.Devices)
+				}
+				spec := containerResponse.Devices[0]
+				if spec.HostPath != "/dev/kvm" || spec.ContainerPath != "/dev/kvm" || spec.Permissions != test.expected {
+					t.Errorf("unexpected device spec %+v", spec)
+				}
+				if len(containerResponse.Envs) != 0 || len(containerResponse.Mounts) != 0 {
+					t.Errorf("unexpected envs %v and mounts %v", containerResponse.Envs, containerResponse.Mounts)
+				}
+			}
+
+			dpi.setShuttingDown()
+			if _, err := dpi.Allocate(context.Background(), request); status.Code(err) != codes.Unavailable {
+				t.Errorf("expected allocations to be refused while shutting down, got %v", err)
+			}
+		})
+	}
+}
+
+func TestGenericDevicePluginListAndWatchDeviceNode(t *testing.T) {
+	dpi := servedNullPlugin(t, servePlugin)
+	stop := make(chan struct{})
+	dpi.stop = stop
+	dpi.deviceRoot = t.TempDir()
+	dpi.healthCheckMode = config.HealthCheckExists
+	devicePath := filepath.Join(dpi.deviceRoot, dpi.devicePath)
+	if err := os.MkdirAll(filepath.Dir(devicePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(devicePath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	responses := make(chan []*pluginapi.Device, 10)
+	// the devices are copied as kubelet gets them marshalled
+	stream := &fakeListAndWatchServer{send: func(response *pluginapi.ListAndWatchResponse) error {
+		var devices []*pluginapi.Device
+		for _, dev := range response.Devices {
+			devices = append(devices, &pluginapi.Device{ID: dev.ID, Health: dev.Health})
+		}
+		responses <- devices
+		return nil
+	}}
+	returned := listAndWatch(t, dpi.DevicePluginBase, stream)
+	checked := make(chan error)
+	go func() {
+		checked <- dpi.healthCheck()
+	}()
+	next := func() []*pluginapi.Device {
+		select {
+		case devices := <-responses:
+			return devices
+		case <-time.After(5 * time.Second):
+			t.Fatal("ListAndWatch didn't send the devices")
+			return nil
+		}
+	}
+
+	expectDevices(t, map[string]string{"null-0": pluginapi.Healthy, "null-1": pluginapi.Healthy}, next())
+	// every virtual device goes with the node
+	if err := os.Remove(devicePath); err != nil {
+		t.Fatal(err)
+	}
+	expectDevices(t, map[string]string{"null-0": pluginapi.Unhealthy, "null-1": pluginapi.Unhealthy}, next())
+	if err := os.WriteFile(devicePath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectDevices(t, map[string]string{"null-0": pluginapi.Healthy, "null-1": pluginapi.Healthy}, next())
+	// a cordoned device is withheld whatever its health
+	dpi.setCordoned(map[string]struct{}{"null-1": {}})
+	expectDevices(t, map[string]string{"null-0": pluginapi.Healthy, "null-1": pluginapi.Unhealthy}, next())
+
+	close(stop)
+	<-returned
+	expectDevices(t, map[string]string{}, next())
+	if err := <-checked; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
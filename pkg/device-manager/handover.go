@@ -0,0 +1,259 @@
+package device_manager
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	k8sv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/log"
+)
+
+const (
+	// handoverSocketFile is served in the state directory by the running instance, a new
+	// instance connecting to it takes the resources over before the running one retires
+	handoverSocketFile = "handover.sock"
+	// handoverRegistrationTimeout bounds how long a new instance waits for its plugins to
+	// register before it retires the previous one anyway
+	handoverRegistrationTimeout = 2 * time.Minute
+	// handoverSettleDelay is how long after the previous instance retired the device lists
+	// are sent again, kubelet may process the end of its streams after our registration
+	handoverSettleDelay = 5 * time.Second
+
+	handoverRetire  = "retire"
+	handoverRetired = "retired"
+)
+
+// SetPod names the pod this instance runs in, a release which predates the handover socket
+// is only taken over when another pod of its DaemonSet runs on the node
+func (c *DeviceController) SetPod(namespace, name string) {
+	c.podNamespace = namespace
+	c.podName = name
+}
+
+// connectPredecessor connects to the handover socket of the instance this one replaces,
+// nil when no instance runs
+func (c *DeviceController) connectPredecessor() net.Conn {
+	if c.stateDir == "" {
+		return nil
+	}
+	conn, err := net.DialTimeout("unix", filepath.Join(c.stateDir, handoverSocketFile), socketProbeTimeout)
+	if err != nil {
+		return nil
+	}
+	log.DefaultLogger().Info("Found a running instance, taking its resources over")
+	return conn
+}
+
+// legacyPredecessorServes reports whether a release which predates the handover socket
+// serves any configured resource, on the legacy socket of the resource. KubeVirt's device
+// plugins serve sockets of the same name, so a live legacy socket only counts once another
+// pod of the DaemonSet of this instance is found running on the node.
+func (c *DeviceController) legacyPredecessorServes() bool {
+	logger := log.DefaultLogger()
+	resourceConfig := c.config()
+	var resourceNames []string
+	for _, resource := range resourceConfig.GetResources() {
+		resourceNames = append(resourceNames, resource.Name)
+	}
+	for _, deviceNode := range resourceConfig.GetDeviceNodes() {
+		resourceNames = append(resourceNames, deviceNode.Name)
+	}
+	for _, composite := range resourceConfig.GetComposites() {
+		resourceNames = append(resourceNames, composite.Name)
+	}
+	for _, resourceName := range resourceNames {
+		socketPath := legacySocketPath(resourceName)
+		if !socketIsLive(socketPath) {
+			continue
+		}
+		previous, err := c.previousPod()
+		if err != nil {
+			logger.Reason(err).Warningf("%s is served on %s by a process which isn't a previous release of this plugin", resourceName, socketPath)
+			return false
+		}
+		logger.Infof("Found the previous release %s serving %s on %s, taking its resources over", previous, resourceName, socketPath)
+		return true
+	}
+	return false
+}
+
+// previousPod returns the name of another running pod of the DaemonSet of this instance on
+// its node, which an update is replacing
+func (c *DeviceController) previousPod() (string, error) {
+	if c.clientset == nil || c.podName == "" {
+		return "", fmt.Errorf("the pod of this instance is unknown")
+	}
+	pods := c.clientset.Pods(c.podNamespace)
+	pod, err := pods.Get(context.Background(), c.podName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get pod %s/%s: %v", c.podNamespace, c.podName, err)
+	}
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return "", fmt.Errorf("pod %s/%s has no controller", c.podNamespace, c.podName)
+	}
+	siblings, err := pods.List(context.Background(), metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", pod.Spec.NodeName).String(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to list the pods of node %s: %v", pod.Spec.NodeName, err)
+	}
+	for i := range siblings.Items {
+		sibling := &siblings.Items[i]
+		if sibling.UID == pod.UID || sibling.Spec.NodeName != pod.Spec.NodeName || sibling.Status.Phase != k8sv1.PodRunning {
+			continue
+		}
+		if siblingOwner := metav1.GetControllerOf(sibling); siblingOwner != nil && siblingOwner.UID == owner.UID {
+			return sibling.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no other pod of %s %s runs on node %s", owner.Kind, owner.Name, pod.Spec.NodeName)
+}
+
+// takeOver waits for the plugins to register alongside the previous instance, then asks it
+// to retire without deregistering its devices, so that the capacity advertised to kubelet
+// never drops during an upgrade. finishTakeOver must be called afterwards.
+// A release which predates the handover socket has no predecessor connection and can't be
+// asked to retire: kubelet drops its plugins as ours register, and the rollout stops it once
+// this instance is ready.
+func (c *DeviceController) takeOver(predecessor net.Conn, stop <-chan struct{}) {
+	logger := log.DefaultLogger()
+	if predecessor != nil {
+		defer predecessor.Close()
+	}
+
+	deadline := time.Now().Add(handoverRegistrationTimeout)
+	for {
+		err := c.pluginsRegistered()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			logger.Reason(err).Warningf("not every device plugin registered after %s, retiring the previous instance anyway", handoverRegistrationTimeout)
+			break
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+
+	if predecessor == nil {
+		logger.Info("The previous release can't retire, kubelet serves its resources from the new plugins")
+		return
+	}
+
+	// the previous instance stops every plugin before it answers
+	if err := predecessor.SetDeadline(time.Now().Add(2 * (c.shutdownTimeout + connectionTimeout))); err != nil {
+		logger.Reason(err).Warning("failed to set the handover deadline")
+	}
+	if _, err := fmt.Fprintln(predecessor, handoverRetire); err != nil {
+		logger.Reason(err).Warning("failed to ask the previous instance to retire")
+		return
+	}
+	reply, err := bufio.NewReader(predecessor).ReadString('\n')
+	if err != nil || strings.TrimSpace(reply) != handoverRetired {
+		logger.Reason(err).Warningf("the previous instance didn't confirm its retirement: %q", strings.TrimSpace(reply))
+		return
+	}
+	logger.Info("The previous instance retired, its resources are taken over")
+}
+
+// finishTakeOver lets the plugins refuse resources served by other processes again and
+// sends their device lists, right away and once kubelet dropped the previous instance
+func (c *DeviceController) finishTakeOver(stop <-chan struct{}) {
+	refresh := func() {
+		c.startedPluginsMutex.Lock()
+		defer c.startedPluginsMutex.Unlock()
+		c.takingOver = false
+		c.legacyPredecessor = false
+		for _, dev := range c.startedPlugins {
+			dev.devicePlugin.setTakingOver(false, false)
+			dev.devicePlugin.requestRefresh()
+		}
+	}
+	refresh()
+	go func() {
+		select {
+		case <-stop:
+		case <-time.After(handoverSettleDelay):
+			refresh()
+		}
+	}()
+}
+
+// serveHandover waits for the next instance to connect to the handover socket and retires
+// this one once it asks to. retired is closed after the plugins stopped.
+func (c *DeviceController) serveHandover(stop <-chan struct{}, retired chan<- struct{}) {
+	logger := log.DefaultLogger()
+	socketPath := filepath.Join(c.stateDir, handoverSocketFile)
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		logger.Reason(err).Errorf("failed to remove the stale handover socket %s", socketPath)
+		return
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		logger.Reason(err).Errorf("failed to serve the handover socket %s, upgrades will deregister the devices", socketPath)
+		return
+	}
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-stop:
+		case <-closed:
+		}
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !IsChanClosed(stop) {
+				logger.Reason(err).Error("failed to accept a handover connection")
+			}
+			return
+		}
+		request, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || strings.TrimSpace(request) != handoverRetire {
+			// the next instance connects first and asks once its plugins are registered,
+			// a connection closed before that is a start which failed
+			conn.Close()
+			continue
+		}
+
+		// the socket is removed before the next instance serves it in turn
+		listener.Close()
+		logger.Info("A new instance took the resources over, retiring")
+		c.retire()
+		if _, err := fmt.Fprintln(conn, handoverRetired); err != nil {
+			logger.Reason(err).Warning("failed to confirm the retirement to the new instance")
+		}
+		conn.Close()
+		close(retired)
+		return
+	}
+}
+
+// retire stops every plugin without deregistering its devices
+func (c *DeviceController) retire() {
+	func() {
+		c.startedPluginsMutex.Lock()
+		defer c.startedPluginsMutex.Unlock()
+		c.retired = true
+		for _, dev := range c.startedPlugins {
+			dev.devicePlugin.retire()
+		}
+	}()
+	c.stopAllDevices()
+}
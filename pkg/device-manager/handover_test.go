@@ -0,0 +1,168 @@
+package device_manager
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	k8sv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	k8scli "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// fakeCoreV1 serves the pods of fakePods and the nodes of fakeNodes, the other clients are left nil
+type fakeCoreV1 struct {
+	k8scli.CoreV1Interface
+	pods  *fakePods
+	nodes *fakeNodes
+}
+
+func (c *fakeCoreV1) Pods(string) k8scli.PodInterface {
+	return c.pods
+}
+
+func (c *fakeCoreV1) Nodes() k8scli.NodeInterface {
+	return c.nodes
+}
+
+type fakePods struct {
+	k8scli.PodInterface
+	pods []k8sv1.Pod
+}
+
+func (p *fakePods) Get(_ context.Context, name string, _ metav1.GetOptions) (*k8sv1.Pod, error) {
+	for i := range p.pods {
+		if p.pods[i].Name == name {
+			return &p.pods[i], nil
+		}
+	}
+	return nil, fmt.Errorf("pod %s not found", name)
+}
+
+func (p *fakePods) List(context.Context, metav1.ListOptions) (*k8sv1.PodList, error) {
+	return &k8sv1.PodList{Items: p.pods}, nil
+}
+
+// fakeNodes serves a single node, or fails with err when it is set
+type fakeNodes struct {
+	k8scli.NodeInterface
+	node k8sv1.Node
+	err  error
+}
+
+func (n *fakeNodes) Get(_ context.Context, name string, _ metav1.GetOptions) (*k8sv1.Node, error) {
+	if n.err != nil {
+		return nil, n.err
+	}
+	if n.node.Name != name {
+		return nil, fmt.Errorf("node %s not found", name)
+	}
+	return n.node.DeepCopy(), nil
+}
+
+// daemonSetPod returns a pod of node owned by the DaemonSet of uid owner
+func daemonSetPod(name string, node string, owner types.UID, phase k8sv1.PodPhase) k8sv1.Pod {
+	controller := true
+	return k8sv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			UID:             types.UID(name),
+			OwnerReferences: []metav1.OwnerReference{{Kind: "DaemonSet", Name: string(owner), UID: owner, Controller: &controller}},
+		},
+		Spec:   k8sv1.PodSpec{NodeName: node},
+		Status: k8sv1.PodStatus{Phase: phase},
+	}
+}
+
+func TestPreviousPod(t *testing.T) {
+	self := daemonSetPod("vfio-device-plugin-new", "node1", "vfio-device-plugin", k8sv1.PodRunning)
+	tests := []struct {
+		name        string
+		pods        []k8sv1.Pod
+		expected    string
+		expectedErr string
+	}{
+		{
+			name:     "previous pod of the DaemonSet",
+			pods:     []k8sv1.Pod{self, daemonSetPod("vfio-device-plugin-old", "node1", "vfio-device-plugin", k8sv1.PodRunning)},
+			expected: "vfio-device-plugin-old",
+		},
+		{
+			name:        "KubeVirt serving the same resource",
+			pods:        []k8sv1.Pod{self, daemonSetPod("virt-handler-abcde", "node1", "virt-handler", k8sv1.PodRunning)},
+			expectedErr: "no other pod of DaemonSet vfio-device-plugin runs on node node1",
+		},
+		{
+			name:        "pod of the DaemonSet on another node",
+			pods:        []k8sv1.Pod{self, daemonSetPod("vfio-device-plugin-other", "node2", "vfio-device-plugin", k8sv1.PodRunning)},
+			expectedErr: "no other pod of DaemonSet vfio-device-plugin runs on node node1",
+		},
+		{
+			name:        "previous pod which already stopped",
+			pods:        []k8sv1.Pod{self, daemonSetPod("vfio-device-plugin-old", "node1", "vfio-device-plugin", k8sv1.PodSucceeded)},
+			expectedErr: "no other pod of DaemonSet vfio-device-plugin runs on node node1",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := NewDeviceController("rw", nil, &fakeCoreV1{pods: &fakePods{pods: test.pods}}, "node1", nil)
+			c.SetPod("vfio-device-plugin", self.Name)
+			previous, err := c.previousPod()
+			if test.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+					t.Fatalf("expected error %q, got pod %q and error %v", test.expectedErr, previous, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if previous != test.expected {
+				t.Errorf("expected the previous pod %s, got %s", test.expected, previous)
+			}
+		})
+	}
+
+	c := NewDeviceController("rw", nil, nil, "node1", nil)
+	if _, err := c.previousPod(); err == nil {
+		t.Error("expected no previous pod to be found without a kubernetes client")
+	}
+}
+
+func TestSelectSocketLegacy(t *testing.T) {
+	useDevicePluginPath(t)
+	// a release which predates the handover or KubeVirt serves the resource
+	serveSocket(t, legacySocketPath("example.com/gpu"))
+
+	tests := []struct {
+		name              string
+		takingOver        bool
+		legacyPredecessor bool
+		expectedErr       bool
+	}{
+		{name: "not taking over", expectedErr: true},
+		{name: "taking over from an instance serving the handover socket", takingOver: true, expectedErr: true},
+		{name: "taking over from a previous release", takingOver: true, legacyPredecessor: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dpi := newPCIDevicePlugin(map[string][]*PCIDevice{}, "example.com/gpu")
+			dpi.setTakingOver(test.takingOver, test.legacyPredecessor)
+			err := dpi.selectSocket()
+			if test.expectedErr {
+				if err == nil {
+					t.Fatalf("expected the legacy socket to be refused, got socket %s", dpi.socketPath)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if dpi.socketPath != SocketPath(socketName("example.com/gpu")) {
+				t.Errorf("expected the plugin to serve on its primary socket, got %s", dpi.socketPath)
+			}
+		})
+	}
+}
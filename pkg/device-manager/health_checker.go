@@ -0,0 +1,279 @@
+package device_manager
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	config "github.com/jonkeyguan/vfio-device-plugin/pkg/config"
+)
+
+// maxExecOutput bounds the output of a failed exec check kept in the health reason
+const maxExecOutput = 256
+
+// HealthChecker checks the health of a device beyond the presence of its vfio device,
+// the returned error describes why the device is unhealthy
+type HealthChecker interface {
+	Check(ctx context.Context, device *PCIDevice) error
+}
+
+// HealthCheckerFactory creates a health checker from its configuration
+type HealthCheckerFactory func(checker config.HealthChecker) (HealthChecker, error)
+
+var healthCheckerFactories = map[string]HealthCheckerFactory{
+	config.HealthCheckerConfigSpace: func(config.HealthChecker) (HealthChecker, error) {
+		return configSpaceChecker{}, nil
+	},
+	config.HealthCheckerAER: func(config.HealthChecker) (HealthChecker, error) {
+		return &aerChecker{baselines: make(map[string]int)}, nil
+	},
+	config.HealthCheckerDriver: func(config.HealthChecker) (HealthChecker, error) {
+		return driverChecker{}, nil
+	},
+	config.HealthCheckerExec: func(checker config.HealthChecker) (HealthChecker, error) {
+		return execChecker{command: checker.Command}, nil
+	},
+}
+
+// RegisterHealthChecker makes a health checker type available to the configuration,
+// it must be called before the device controller runs
+func RegisterHealthChecker(checkerType string, factory HealthCheckerFactory) {
+	healthCheckerFactories[checkerType] = factory
+}
+
+// Address returns the address of the device on its bus
+func (d *PCIDevice) Address() string {
+	return d.pciAddress
+}
+
+// ID returns the ID the device is reported with, the vendor:device ID of PCI devices
+func (d *PCIDevice) ID() string {
+	return d.pciID
+}
+
+// Bus returns the bus the device was discovered on
+func (d *PCIDevice) Bus() string {
+	return busName(d.bus)
+}
+
+// healthCheckerRule is a configured health checker and the devices it applies to
+type healthCheckerRule struct {
+	checkerType string
+	checker     HealthChecker
+	pciIDs      map[string]struct{}
+	resources   map[string]struct{}
+	period      time.Duration
+	timeout     time.Duration
+}
+
+// buildHealthCheckerRules creates the configured health checkers
+func buildHealthCheckerRules(checkers []config.HealthChecker) ([]*healthCheckerRule, error) {
+	var rules []*healthCheckerRule
+	for _, checkerConfig := range checkers {
+		factory, exists := healthCheckerFactories[checkerConfig.Type]
+		if !exists {
+			return nil, fmt.Errorf("unknown health checker type %q", checkerConfig.Type)
+		}
+		checker, err := factory(checkerConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the %s health checker: %v", checkerConfig.Type, err)
+		}
+		rule := &healthCheckerRule{
+			checkerType: checkerConfig.Type,
+			checker:     checker,
+			pciIDs:      make(map[string]struct{}),
+			resources:   make(map[string]struct{}),
+			period:      time.Duration(checkerConfig.PeriodSeconds) * time.Second,
+			timeout:     time.Duration(checkerConfig.TimeoutSeconds) * time.Second,
+		}
+		for _, pciID := range checkerConfig.PCIIDs {
+			rule.pciIDs[pciID] = struct{}{}
+		}
+		for _, resourceName := range checkerConfig.Resources {
+			rule.resources[resourceName] = struct{}{}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// appliesTo reports whether the rule checks a device of resourceName, a rule listing
+// neither PCI IDs nor resources checks every device
+func (r *healthCheckerRule) appliesTo(resourceName string, device *PCIDevice) bool {
+	if len(r.pciIDs) == 0 && len(r.resources) == 0 {
+		return true
+	}
+	_, idListed := r.pciIDs[device.pciID]
+	_, resourceListed := r.resources[resourceName]
+	return idListed || resourceListed
+}
+
+// healthCheckersFor returns the rules checking each device of a plugin keyed by address
+func healthCheckersFor(rules []*healthCheckerRule, resourceName string, deviceMembers map[string][]*PCIDevice) map[string][]*healthCheckerRule {
+	checkers := make(map[string][]*healthCheckerRule)
+	for _, members := range deviceMembers {
+		for _, member := range members {
+			for _, rule := range rules {
+				if rule.appliesTo(resourceName, member) {
+					checkers[member.pciAddress] = append(checkers[member.pciAddress], rule)
+				}
+			}
+		}
+	}
+	return checkers
+}
+
+// healthCheckResult is the outcome of a health checker on a device, an empty reason means healthy
+type healthCheckResult struct {
+	address string
+	rule    *healthCheckerRule
+	reason  string
+}
+
+// runHealthChecker checks devices every period of rule until done is closed. The first
+// result of every device is always sent, later ones only when they change.
+func runHealthChecker(rule *healthCheckerRule, devices []*PCIDevice, results chan<- healthCheckResult, done <-chan struct{}) {
+	reported := make(map[string]string)
+	ticker := time.NewTicker(rule.period)
+	defer ticker.Stop()
+	for {
+		for _, device := range devices {
+			ctx, cancel := context.WithTimeout(context.Background(), rule.timeout)
+			err := rule.checker.Check(ctx, device)
+			cancel()
+
+			reason := ""
+			if err != nil {
+				reason = fmt.Sprintf("%s check failed: %v", rule.checkerType, err)
+			}
+			if last, checked := reported[device.pciAddress]; checked && last == reason {
+				continue
+			}
+			reported[device.pciAddress] = reason
+			select {
+			case results <- healthCheckResult{address: device.pciAddress, rule: rule, reason: reason}:
+			case <-done:
+				return
+			}
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// configSpaceChecker detects PCI devices which fell off the bus, their config space reads all ones
+type configSpaceChecker struct{}
+
+func (configSpaceChecker) Check(_ context.Context, device *PCIDevice) error {
+	if busName(device.bus) != config.BusPCI {
+		return nil
+	}
+	data, err := Handler.ReadDeviceAttribute(pciBasePath, device.pciAddress, "config")
+	if err != nil {
+		return fmt.Errorf("failed to read the config space: %v", err)
+	}
+	if len(data) < 2 {
+		return fmt.Errorf("config space is truncated")
+	}
+	if data[0] == 0xff && data[1] == 0xff {
+		return fmt.Errorf("vendor ID reads 0xffff, the device fell off the bus")
+	}
+	return nil
+}
+
+// aerChecker reports PCI devices which logged fatal AER errors since the checker started.
+// Devices without AER reporting are healthy.
+type aerChecker struct {
+	baselines map[string]int
+	lock      sync.Mutex
+}
+
+func (c *aerChecker) Check(_ context.Context, device *PCIDevice) error {
+	if busName(device.bus) != config.BusPCI {
+		return nil
+	}
+	data, err := Handler.ReadDeviceAttribute(pciBasePath, device.pciAddress, "aer_dev_fatal")
+	if err != nil {
+		return nil
+	}
+	fatal, err := parseAERTotal(data, "TOTAL_ERR_FATAL")
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	baseline, exists := c.baselines[device.pciAddress]
+	if !exists {
+		c.baselines[device.pciAddress] = fatal
+		return nil
+	}
+	if fatal > baseline {
+		return fmt.Errorf("%d fatal AER errors were logged", fatal-baseline)
+	}
+	return nil
+}
+
+// parseAERTotal reads a counter of an aer_dev_* file, which lists "<name> <count>" lines
+func parseAERTotal(data []byte, name string) (int, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == name {
+			return strconv.Atoi(fields[1])
+		}
+	}
+	return 0, fmt.Errorf("no %s counter is found", name)
+}
+
+// driverChecker reports devices which aren't bound to a vfio driver of their bus anymore
+type driverChecker struct{}
+
+func (driverChecker) Check(_ context.Context, device *PCIDevice) error {
+	bus, err := busFor(device.bus)
+	if err != nil {
+		return err
+	}
+	driver, err := Handler.GetDeviceDriver(bus.basePath, device.pciAddress)
+	if err != nil {
+		return fmt.Errorf("device is not bound to a driver")
+	}
+	// lazily bound devices go back to their host driver while unallocated
+	if !bus.isVfioDriver(driver) && driver != device.hostDriver {
+		return fmt.Errorf("device is bound to %s instead of a vfio driver", driver)
+	}
+	return nil
+}
+
+// execChecker runs a command with the device address appended, the device is unhealthy
+// while the command fails
+type execChecker struct {
+	command []string
+}
+
+func (c execChecker) Check(ctx context.Context, device *PCIDevice) error {
+	args := append(append([]string{}, c.command[1:]...), device.pciAddress)
+	// #nosec the command comes from the plugin configuration
+	output, err := exec.CommandContext(ctx, c.command[0], args...).CombinedOutput()
+	if err != nil {
+		message := strings.TrimSpace(string(output))
+		if len(message) > maxExecOutput {
+			message = message[:maxExecOutput]
+		}
+		if message == "" {
+			return fmt.Errorf("%s: %v", c.command[0], err)
+		}
+		return fmt.Errorf("%s: %v: %s", c.command[0], err, message)
+	}
+	return nil
+}
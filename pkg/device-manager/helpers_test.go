@@ -0,0 +1,294 @@
+package device_manager
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"google.golang.org/grpc"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+
+	config "github.com/jonkeyguan/vfio-device-plugin/pkg/config"
+)
+
+// fakeDevice holds the sysfs attributes served by fakeDeviceHandler for one device
+type fakeDevice struct {
+	pciID      string
+	driver     string
+	iommuGroup string
+	numaNode   int
+	// sysfsPath is the location of the device in the device hierarchy
+	sysfsPath string
+	// config is the config space of the device
+	config []byte
+}
+
+// fakeDeviceHandler serves devices from memory instead of sysfs, the methods it doesn't
+// override read the real paths they are given
+type fakeDeviceHandler struct {
+	DeviceUtilsHandler
+	devices map[string]*fakeDevice
+	// reset, when set, resets a device instead of succeeding right away
+	reset func(address string) error
+}
+
+func (h *fakeDeviceHandler) device(address string) (*fakeDevice, error) {
+	dev, exists := h.devices[address]
+	if !exists {
+		return nil, os.ErrNotExist
+	}
+	return dev, nil
+}
+
+func (h *fakeDeviceHandler) GetDevicePCIID(_ string, address string) (string, error) {
+	dev, err := h.device(address)
+	if err != nil {
+		return "", err
+	}
+	return dev.pciID, nil
+}
+
+func (h *fakeDeviceHandler) GetDeviceDriver(_ string, address string) (string, error) {
+	dev, err := h.device(address)
+	if err != nil {
+		return "", err
+	}
+	if dev.driver == "" {
+		return "", os.ErrNotExist
+	}
+	return dev.driver, nil
+}
+
+func (h *fakeDeviceHandler) GetDeviceIOMMUGroup(_ string, address string) (string, error) {
+	dev, err := h.device(address)
+	if err != nil {
+		return "", err
+	}
+	return dev.iommuGroup, nil
+}
+
+func (h *fakeDeviceHandler) GetDeviceNumaNode(_ string, address string) int {
+	dev, err := h.device(address)
+	if err != nil {
+		return -1
+	}
+	return dev.numaNode
+}
+
+func (h *fakeDeviceHandler) GetIOMMUGroupDevices(_ string, iommuGroup string) ([]string, error) {
+	var addresses []string
+	for address, dev := range h.devices {
+		if dev.iommuGroup == iommuGroup {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses, nil
+}
+
+func (h *fakeDeviceHandler) GetDeviceSysfsPath(_ string, address string) (string, error) {
+	dev, err := h.device(address)
+	if err != nil {
+		return "", err
+	}
+	return dev.sysfsPath, nil
+}
+
+func (h *fakeDeviceHandler) ReadDeviceAttribute(_ string, address string, attribute string) ([]byte, error) {
+	dev, err := h.device(address)
+	if err != nil {
+		return nil, err
+	}
+	if attribute != "config" || dev.config == nil {
+		return nil, os.ErrNotExist
+	}
+	return dev.config, nil
+}
+
+// useDeviceHandler replaces the device handler for the duration of the test
+func useDeviceHandler(t *testing.T, handler DeviceHandler) {
+	previous := Handler
+	Handler = handler
+	t.Cleanup(func() { Handler = previous })
+}
+
+// useIOMMUGroups builds an iommu_groups tree holding the devices of the fake handler,
+// linked to their driver, and points the device manager to it
+func useIOMMUGroups(t *testing.T, handler *fakeDeviceHandler) {
+	root := t.TempDir()
+	for address, dev := range handler.devices {
+		devicePath := filepath.Join(root, dev.iommuGroup, "devices", address)
+		writeSysfsDevice(t, devicePath, dev.driver)
+	}
+	previous := iommuGroupsBasePath
+	iommuGroupsBasePath = root
+	t.Cleanup(func() { iommuGroupsBasePath = previous })
+}
+
+// writeSysfsDevice creates a device directory, linked to driver unless it is empty
+func writeSysfsDevice(t *testing.T, devicePath string, driver string) {
+	if err := os.MkdirAll(devicePath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if driver == "" {
+		return
+	}
+	if err := os.Symlink(filepath.Join("..", "..", "drivers", driver), filepath.Join(devicePath, "driver")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestConfig loads a resource configuration from its yaml
+func newTestConfig(t *testing.T, yaml string) *config.ResourceConfig {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	resourceConfig, err := config.NewResourceConfigFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resourceConfig
+}
+
+// fakePlugin is a device plugin whose Start runs start instead of serving kubelet
+type fakePlugin struct {
+	*DevicePluginBase
+	start func(stop <-chan struct{}) error
+	// starts counts the calls of Start, running the calls which haven't returned yet
+	starts  int32
+	running int32
+	// overlapped is set when Start is called while a previous call is still running
+	overlapped int32
+}
+
+func newFakePlugin(resourceName string, start func(stop <-chan struct{}) error) *fakePlugin {
+	return &fakePlugin{
+		DevicePluginBase: &DevicePluginBase{
+			resourceName: resourceName,
+			lock:         &sync.Mutex{},
+		},
+		start: start,
+	}
+}
+
+func (p *fakePlugin) Start(stop <-chan struct{}) error {
+	atomic.AddInt32(&p.starts, 1)
+	if atomic.AddInt32(&p.running, 1) > 1 {
+		atomic.StoreInt32(&p.overlapped, 1)
+	}
+	defer atomic.AddInt32(&p.running, -1)
+	return p.start(stop)
+}
+
+func (h *fakeDeviceHandler) ResetDevice(_ string, address string) error {
+	if _, err := h.device(address); err != nil {
+		return err
+	}
+	if h.reset != nil {
+		return h.reset(address)
+	}
+	return nil
+}
+
+func (h *fakeDeviceHandler) SetDeviceDriver(_ string, address string, driver string) error {
+	dev, err := h.device(address)
+	if err != nil {
+		return err
+	}
+	dev.driver = driver
+	return nil
+}
+
+// useDevicePluginPath makes the plugins serve their sockets in a temp directory for the test,
+// named shortly since socket paths are limited to 108 bytes
+func useDevicePluginPath(t *testing.T) string {
+	dir, err := os.MkdirTemp("", "dp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := devicePluginPath
+	devicePluginPath = dir
+	t.Cleanup(func() {
+		devicePluginPath = previous
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+// serveSocket makes another process appear to serve socketPath until the test ends
+func serveSocket(t *testing.T, socketPath string) {
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+}
+
+// fakePodResources serves the pods of the PodResources API from memory
+type fakePodResources struct {
+	podresourcesapi.UnimplementedPodResourcesListerServer
+	lock sync.Mutex
+	pods []*podresourcesapi.PodResources
+}
+
+func (f *fakePodResources) List(context.Context, *podresourcesapi.ListPodResourcesRequest) (*podresourcesapi.ListPodResourcesResponse, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return &podresourcesapi.ListPodResourcesResponse{PodResources: f.pods}, nil
+}
+
+// setPods replaces the served pods
+func (f *fakePodResources) setPods(pods ...*podresourcesapi.PodResources) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.pods = pods
+}
+
+// podWithDevices returns a pod whose single container is assigned devIDs of resourceName
+func podWithDevices(namespace string, name string, container string, resourceName string, devIDs ...string) *podresourcesapi.PodResources {
+	return &podresourcesapi.PodResources{
+		Namespace: namespace,
+		Name:      name,
+		Containers: []*podresourcesapi.ContainerResources{{
+			Name:    container,
+			Devices: []*podresourcesapi.ContainerDevices{{ResourceName: resourceName, DeviceIds: devIDs}},
+		}},
+	}
+}
+
+// servePodResources serves the PodResources API of kubelet in a temp directory for the test
+func servePodResources(t *testing.T) *fakePodResources {
+	dir, err := os.MkdirTemp("", "pr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socketPath := filepath.Join(dir, "kubelet.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	podResources := &fakePodResources{}
+	server := grpc.NewServer()
+	podresourcesapi.RegisterPodResourcesListerServer(server, podResources)
+	go server.Serve(listener)
+
+	previous := podResourcesSocket
+	podResourcesSocket = socketPath
+	t.Cleanup(func() {
+		podResourcesSocket = previous
+		server.Stop()
+		os.RemoveAll(dir)
+	})
+	return podResources
+}
+
+// withoutPodResources makes the PodResources API unavailable for the test
+func withoutPodResources(t *testing.T) {
+	previous := podResourcesSocket
+	podResourcesSocket = filepath.Join(t.TempDir(), "kubelet.sock")
+	t.Cleanup(func() { podResourcesSocket = previous })
+}
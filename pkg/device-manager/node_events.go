@@ -0,0 +1,179 @@
+package device_manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	k8sv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	k8scli "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/log"
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/metrics"
+)
+
+const (
+	// Event reasons emitted against the node
+	DeviceDiscoveryFailedReason = "DeviceDiscoveryFailed"
+	DeviceNotVfioBoundReason    = "DeviceNotVfioBound"
+	IOMMUGroupUnviableReason    = "IOMMUGroupUnviable"
+	DeviceUnhealthyReason       = "DeviceUnhealthy"
+	DeviceHealthyReason         = "DeviceHealthy"
+	DeviceReleaseFailedReason   = "DeviceReleaseFailed"
+	DevicePluginFailedReason    = "DevicePluginFailed"
+	DevicePluginServingReason   = "DevicePluginServing"
+	SharedDevicesWithheldReason = "SharedDevicesWithheld"
+
+	// VFIODevicesReadyCondition is the node condition maintained by the plugin
+	VFIODevicesReadyCondition k8sv1.NodeConditionType = "VFIODevicesReady"
+
+	devicesReadyReason     = "DevicesReady"
+	discoveryFailedReason  = "DiscoveryFailed"
+	devicesUnhealthyReason = "DevicesUnhealthy"
+	sharedWithheldReason   = "SharedDevicesWithheld"
+)
+
+// NewEventRecorder creates a recorder which publishes events through the given client
+func NewEventRecorder(clientset k8scli.CoreV1Interface, nodeName string) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&k8scli.EventSinkImpl{Interface: clientset.Events(k8sv1.NamespaceDefault)})
+	return broadcaster.NewRecorder(scheme.Scheme, k8sv1.EventSource{Component: "vfio-device-plugin", Host: nodeName})
+}
+
+// nodeReference returns the object events are recorded against, the same way kubelet does
+func (c *DeviceController) nodeReference() *k8sv1.ObjectReference {
+	return &k8sv1.ObjectReference{
+		Kind: "Node",
+		Name: c.nodeName,
+		UID:  types.UID(c.nodeName),
+	}
+}
+
+func (c *DeviceController) recordNodeEvent(eventType string, reason string, messageFmt string, args ...interface{}) {
+	if c.recorder == nil || c.nodeName == "" {
+		return
+	}
+	c.recorder.Eventf(c.nodeReference(), eventType, reason, messageFmt, args...)
+}
+
+// discoveryFailed reports a device which failed discovery through an event and the discovery error metric
+func (c *DeviceController) discoveryFailed(resourceName string, reason string, messageFmt string, args ...interface{}) {
+	metrics.IncDiscoveryErrors(resourceName, reason)
+	c.recordNodeEvent(k8sv1.EventTypeWarning, reason, messageFmt, args...)
+}
+
+// recordHealthEvent emits an event for a device health transition
+func (c *DeviceController) recordHealthEvent(resourceName string, devID string, health string, reason string) {
+	if health == pluginapi.Healthy {
+		c.recordNodeEvent(k8sv1.EventTypeNormal, DeviceHealthyReason,
+			"device with iommu group %s of resource %s is healthy", devID, resourceName)
+	} else {
+		c.recordNodeEvent(k8sv1.EventTypeWarning, DeviceUnhealthyReason,
+			"device with iommu group %s of resource %s is unhealthy: %s", devID, resourceName, reason)
+	}
+}
+
+// recordPluginEvent emits an event when a device plugin failed or started serving
+func (c *DeviceController) recordPluginEvent(resourceName string, state string, err error) {
+	switch {
+	case state == PluginStateBackoff && err != nil:
+		c.recordNodeEvent(k8sv1.EventTypeWarning, DevicePluginFailedReason,
+			"device plugin of resource %s failed, it is restarted after a backoff: %v", resourceName, err)
+	case state == PluginStateServing:
+		c.recordNodeEvent(k8sv1.EventTypeNormal, DevicePluginServingReason,
+			"device plugin of resource %s is registered with kubelet", resourceName)
+	}
+}
+
+// setDiscoveryError records the outcome of the last device discovery
+func (c *DeviceController) setDiscoveryError(err error) {
+	c.inventoryMutex.Lock()
+	c.discoveryErr = err
+	c.inventoryMutex.Unlock()
+
+	c.notifyInventoryChanged()
+}
+
+// buildDevicesReadyCondition computes the VFIODevicesReady condition from the
+// outcome of the last discovery and the current health of all devices
+func (c *DeviceController) buildDevicesReadyCondition() k8sv1.NodeCondition {
+	withheld := c.sharedDevicesWithheld()
+
+	c.inventoryMutex.Lock()
+	defer c.inventoryMutex.Unlock()
+
+	condition := k8sv1.NodeCondition{
+		Type:    VFIODevicesReadyCondition,
+		Status:  k8sv1.ConditionTrue,
+		Reason:  devicesReadyReason,
+		Message: "all configured VFIO devices are discovered and healthy",
+	}
+
+	if c.discoveryErr != nil {
+		condition.Status = k8sv1.ConditionFalse
+		condition.Reason = discoveryFailedReason
+		condition.Message = c.discoveryErr.Error()
+		return condition
+	}
+	if withheld != nil {
+		condition.Status = k8sv1.ConditionFalse
+		condition.Reason = sharedWithheldReason
+		condition.Message = withheld.Error()
+		return condition
+	}
+
+	var unhealthy []string
+	for resourceName, devices := range c.deviceHealth {
+		for devID, health := range devices {
+			// cordoned devices are out of service on purpose
+			if health.Health != pluginapi.Healthy && health.Reason != cordonedReason {
+				unhealthy = append(unhealthy, fmt.Sprintf("%s/%s", resourceName, devID))
+			}
+		}
+	}
+	if len(unhealthy) > 0 {
+		sort.Strings(unhealthy)
+		condition.Status = k8sv1.ConditionFalse
+		condition.Reason = devicesUnhealthyReason
+		condition.Message = fmt.Sprintf("unhealthy devices: %s", strings.Join(unhealthy, ", "))
+	}
+	return condition
+}
+
+// publishNodeCondition patches the VFIODevicesReady condition into the node status,
+// keeping the last transition time when the status did not change
+func (c *DeviceController) publishNodeCondition(node *k8sv1.Node) error {
+	condition := c.buildDevicesReadyCondition()
+	now := metav1.NewTime(time.Now())
+	condition.LastHeartbeatTime = now
+	condition.LastTransitionTime = now
+	for _, existing := range node.Status.Conditions {
+		if existing.Type == condition.Type && existing.Status == condition.Status {
+			condition.LastTransitionTime = existing.LastTransitionTime
+		}
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []k8sv1.NodeCondition{condition},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal node condition patch: %v", err)
+	}
+
+	_, err = c.clientset.Nodes().PatchStatus(context.Background(), c.nodeName, patch)
+	if err != nil {
+		return fmt.Errorf("failed to patch status of node %s: %v", c.nodeName, err)
+	}
+	log.DefaultLogger().V(4).Infof("published %s condition %s on node %s", condition.Type, condition.Status, c.nodeName)
+	return nil
+}
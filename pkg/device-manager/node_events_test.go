@@ -0,0 +1,119 @@
+package device_manager
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	k8sv1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const discoveryTestConfig = `
+resources:
+- resourceName: example.com/gpu
+  addresses:
+  - 0000:01:00.0
+  - 0000:02:00.0
+  - 0000:03:00.0
+`
+
+func drainEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			sort.Strings(events)
+			return events
+		}
+	}
+}
+
+func TestDiscoveryFailureEventsAndCondition(t *testing.T) {
+	handler := &fakeDeviceHandler{devices: map[string]*fakeDevice{
+		// bound to its host driver
+		"0000:01:00.0": {pciID: "10de:1eb8", driver: "nvidia", iommuGroup: "11"},
+		// shares its group with a device bound to a driver vfio doesn't accept
+		"0000:02:00.0": {pciID: "10de:1eb8", driver: "vfio-pci", iommuGroup: "12"},
+		"0000:02:00.1": {pciID: "10de:10f8", driver: "snd_hda_intel", iommuGroup: "12"},
+		// shares its group with an unbound device, which is viable
+		"0000:03:00.0": {pciID: "10de:1eb8", driver: "vfio-pci", iommuGroup: "13"},
+		"0000:03:00.1": {pciID: "10de:10f8", iommuGroup: "13"},
+	}}
+	useDeviceHandler(t, handler)
+	useIOMMUGroups(t, handler)
+
+	recorder := record.NewFakeRecorder(10)
+	c := NewDeviceController("rw", newTestConfig(t, discoveryTestConfig), nil, "node1", recorder)
+	_, pciDeviceMap, err := c.desiredPlugins()
+	if err == nil {
+		t.Fatalf("expected the discovery to fail, discovered %v", pciDeviceMap)
+	}
+
+	events := drainEvents(recorder)
+	expected := []string{
+		"Warning DeviceNotVfioBound device 0000:01:00.0 of resource example.com/gpu: bound to nvidia instead of vfio-pci",
+		"Warning IOMMUGroupUnviable device 0000:02:00.0 of resource example.com/gpu: IOMMU group 12 is not viable: device 0000:02:00.1 of iommu group 12 is bound to snd_hda_intel",
+	}
+	if strings.Join(events, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected events:\n%s\nexpected:\n%s", strings.Join(events, "\n"), strings.Join(expected, "\n"))
+	}
+
+	condition := c.buildDevicesReadyCondition()
+	if condition.Type != VFIODevicesReadyCondition || condition.Status != k8sv1.ConditionFalse || condition.Reason != discoveryFailedReason {
+		t.Errorf("unexpected condition %+v", condition)
+	}
+}
+
+func TestDiscoverySuccessCondition(t *testing.T) {
+	handler := &fakeDeviceHandler{devices: map[string]*fakeDevice{
+		"0000:01:00.0": {pciID: "10de:1eb8", driver: "vfio-pci", iommuGroup: "11"},
+		"0000:02:00.0": {pciID: "10de:1eb8", driver: "vfio-pci", iommuGroup: "12"},
+		"0000:03:00.0": {pciID: "10de:1eb8", driver: "vfio-pci", iommuGroup: "13"},
+	}}
+	useDeviceHandler(t, handler)
+	useIOMMUGroups(t, handler)
+
+	recorder := record.NewFakeRecorder(10)
+	c := NewDeviceController("rw", newTestConfig(t, discoveryTestConfig), nil, "node1", recorder)
+	if _, _, err := c.desiredPlugins(); err != nil {
+		t.Fatalf("unexpected discovery error: %v", err)
+	}
+	if events := drainEvents(recorder); len(events) != 0 {
+		t.Errorf("unexpected events %v", events)
+	}
+	condition := c.buildDevicesReadyCondition()
+	if condition.Status != k8sv1.ConditionTrue || condition.Reason != devicesReadyReason {
+		t.Errorf("unexpected condition %+v", condition)
+	}
+}
+
+func TestCheckIOMMUGroupViable(t *testing.T) {
+	tests := []struct {
+		name    string
+		drivers map[string]string
+		viable  bool
+	}{
+		{name: "vfio bound", drivers: map[string]string{"0000:01:00.0": "vfio-pci"}, viable: true},
+		{name: "unbound member", drivers: map[string]string{"0000:01:00.0": "vfio-pci", "0000:01:00.1": ""}, viable: true},
+		{name: "pci-stub member", drivers: map[string]string{"0000:01:00.0": "vfio-pci", "0000:01:00.1": "pci-stub"}, viable: true},
+		{name: "host driver member", drivers: map[string]string{"0000:01:00.0": "vfio-pci", "0000:01:00.1": "snd_hda_intel"}, viable: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := &fakeDeviceHandler{devices: map[string]*fakeDevice{}}
+			for address, driver := range test.drivers {
+				handler.devices[address] = &fakeDevice{driver: driver, iommuGroup: "7"}
+			}
+			useDeviceHandler(t, handler)
+			useIOMMUGroups(t, handler)
+
+			err := checkIOMMUGroupViable("7")
+			if (err == nil) != test.viable {
+				t.Errorf("expected viable %t, got %v", test.viable, err)
+			}
+		})
+	}
+}
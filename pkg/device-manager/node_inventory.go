@@ -0,0 +1,265 @@
+package device_manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/log"
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/metrics"
+)
+
+const (
+	// NodeLabelPrefix is the prefix of every node label and annotation owned by the plugin
+	NodeLabelPrefix         = "vfio.resource/"
+	NodeInventoryAnnotation = NodeLabelPrefix + "inventory"
+)
+
+// deviceInventory is the published view of a single discovered device
+type deviceInventory struct {
+	Bus        string `json:"bus"`
+	Address    string `json:"address"`
+	PCIID      string `json:"pciId"`
+	IOMMUGroup string `json:"iommuGroup"`
+	NUMANode   int    `json:"numaNode"`
+	Health     string `json:"health"`
+	Reason     string `json:"reason,omitempty"`
+	// Bundle is the ID of the bundle holding a device of a composite resource
+	Bundle string `json:"bundle,omitempty"`
+}
+
+// setDeviceHealth records the health of a device and schedules a node inventory update
+func (c *DeviceController) setDeviceHealth(resourceName string, devID string, health string, reason string) {
+	c.inventoryMutex.Lock()
+	if c.deviceHealth[resourceName] == nil {
+		c.deviceHealth[resourceName] = make(map[string]deviceHealth)
+	}
+	c.deviceHealth[resourceName][devID] = deviceHealth{DevId: devID, Health: health, Reason: reason}
+	c.updateDeviceMetrics()
+	c.inventoryMutex.Unlock()
+
+	metrics.IncHealthTransitions(resourceName, health)
+	c.recordHealthEvent(resourceName, devID, health, reason)
+	c.notifyInventoryChanged()
+}
+
+// setDiscoveredDevices replaces the set of discovered devices and composite bundles. The
+// devices of restarted resources are reported healthy, the others keep their health.
+func (c *DeviceController) setDiscoveredDevices(pciDeviceMap map[string][]*PCIDevice, compositeBundles map[string][][]*PCIDevice, restarted map[string]struct{}) {
+	c.inventoryMutex.Lock()
+	previous := c.deviceHealth
+	c.discoveredDevices = pciDeviceMap
+	c.discoveredBundles = compositeBundles
+	c.deviceHealth = make(map[string]map[string]deviceHealth)
+	track := func(resourceName string, devID string) {
+		if c.deviceHealth[resourceName] == nil {
+			c.deviceHealth[resourceName] = make(map[string]deviceHealth)
+		}
+		if health, exists := previous[resourceName][devID]; exists {
+			if _, isRestarted := restarted[resourceName]; !isRestarted {
+				c.deviceHealth[resourceName][devID] = health
+				return
+			}
+		}
+		c.deviceHealth[resourceName][devID] = deviceHealth{DevId: devID, Health: pluginapi.Healthy}
+	}
+	for resourceName, pciDevices := range pciDeviceMap {
+		for _, pciDevice := range pciDevices {
+			track(resourceName, pciDevice.iommuGroup)
+		}
+	}
+	for resourceName, bundles := range compositeBundles {
+		for _, bundle := range bundles {
+			track(resourceName, bundleID(bundle))
+		}
+	}
+	metrics.ResetDeviceGauges()
+	c.updateDeviceMetrics()
+	c.inventoryMutex.Unlock()
+
+	c.notifyInventoryChanged()
+}
+
+// updateDeviceMetrics refreshes the advertised and healthy device gauges,
+// the caller must hold inventoryMutex
+func (c *DeviceController) updateDeviceMetrics() {
+	for resourceName, pciDevices := range c.discoveredDevices {
+		healthy := 0
+		for _, health := range c.deviceHealth[resourceName] {
+			if health.Health == pluginapi.Healthy {
+				healthy++
+			}
+		}
+		metrics.SetDevicesAdvertised(resourceName, len(pciDevices))
+		metrics.SetDevicesHealthy(resourceName, healthy)
+	}
+	for resourceName, bundles := range c.discoveredBundles {
+		healthy := 0
+		for _, health := range c.deviceHealth[resourceName] {
+			if health.Health == pluginapi.Healthy {
+				healthy++
+			}
+		}
+		metrics.SetDevicesAdvertised(resourceName, len(bundles))
+		metrics.SetDevicesHealthy(resourceName, healthy)
+	}
+}
+
+func (c *DeviceController) notifyInventoryChanged() {
+	select {
+	case c.inventoryChanged <- struct{}{}:
+	default:
+	}
+}
+
+// buildNodeInventory returns the inventory of every discovered device, keyed by resource
+// name. The devices of a composite resource are listed along with their bundle.
+func (c *DeviceController) buildNodeInventory() map[string][]deviceInventory {
+	c.inventoryMutex.Lock()
+	defer c.inventoryMutex.Unlock()
+
+	inventory := make(map[string][]deviceInventory)
+	newInventory := func(resourceName string, devID string, pciDevice *PCIDevice) deviceInventory {
+		health := c.deviceHealth[resourceName][devID]
+		if health.Health == "" {
+			health.Health = pluginapi.Healthy
+		}
+		return deviceInventory{
+			Bus:        busName(pciDevice.bus),
+			Address:    pciDevice.pciAddress,
+			PCIID:      pciDevice.pciID,
+			IOMMUGroup: pciDevice.iommuGroup,
+			NUMANode:   pciDevice.numaNode,
+			Health:     health.Health,
+			Reason:     health.Reason,
+		}
+	}
+	for resourceName, pciDevices := range c.discoveredDevices {
+		devices := make([]deviceInventory, 0, len(pciDevices))
+		for _, pciDevice := range pciDevices {
+			devices = append(devices, newInventory(resourceName, pciDevice.iommuGroup, pciDevice))
+		}
+		inventory[resourceName] = devices
+	}
+	for resourceName, bundles := range c.discoveredBundles {
+		var devices []deviceInventory
+		for _, bundle := range bundles {
+			for _, member := range bundle {
+				device := newInventory(resourceName, bundleID(bundle), member)
+				device.Bundle = bundleID(bundle)
+				devices = append(devices, device)
+			}
+		}
+		inventory[resourceName] = devices
+	}
+	for _, devices := range inventory {
+		sort.Slice(devices, func(i, j int) bool {
+			return devices[i].Address < devices[j].Address
+		})
+	}
+	return inventory
+}
+
+// nodeInventoryLabels converts an inventory into the node labels published by the plugin:
+// a device count per resource and a presence label per bus and device ID, e.g. the PCI vendor:device ID.
+// A composite resource counts its bundles.
+func nodeInventoryLabels(inventory map[string][]deviceInventory) map[string]string {
+	logger := log.DefaultLogger()
+	labels := make(map[string]string)
+	for resourceName, devices := range inventory {
+		count := len(devices)
+		bundles := make(map[string]struct{})
+		for _, dev := range devices {
+			if dev.Bundle != "" {
+				bundles[dev.Bundle] = struct{}{}
+			}
+		}
+		if len(bundles) > 0 {
+			count = len(bundles)
+		}
+		key := NodeLabelPrefix + sanitizeLabelName(resourceName) + ".count"
+		if errs := validation.IsQualifiedName(key); len(errs) != 0 {
+			logger.Warningf("skipping count label for resource %s: %s", resourceName, strings.Join(errs, ", "))
+		} else {
+			labels[key] = strconv.Itoa(count)
+		}
+
+		for _, dev := range devices {
+			key := NodeLabelPrefix + dev.Bus + "-" + sanitizeLabelName(dev.PCIID)
+			if errs := validation.IsQualifiedName(key); len(errs) != 0 {
+				logger.Warningf("skipping presence label for %s ID %s: %s", dev.Bus, dev.PCIID, strings.Join(errs, ", "))
+				continue
+			}
+			labels[key] = "true"
+		}
+	}
+	return labels
+}
+
+// sanitizeLabelName maps a resource name or PCI ID to a valid label name segment,
+// e.g. "ib.net/ib1" -> "ib.net_ib1" and "15b3:101b" -> "15b3-101b"
+func sanitizeLabelName(name string) string {
+	name = strings.Replace(name, "/", "_", -1)
+	name = strings.Replace(name, ":", "-", -1)
+	name = strings.Replace(name, ",", "_", -1)
+	return name
+}
+
+// publishNodeInventory patches the node with the current device labels, inventory annotation
+// and VFIODevicesReady condition. Labels owned by the plugin which no longer apply are removed.
+func (c *DeviceController) publishNodeInventory() error {
+	if c.clientset == nil || c.nodeName == "" {
+		return nil
+	}
+
+	inventory := c.buildNodeInventory()
+	labels := nodeInventoryLabels(inventory)
+	inventoryJSON, err := json.Marshal(inventory)
+	if err != nil {
+		return fmt.Errorf("failed to marshal node inventory: %v", err)
+	}
+
+	node, err := c.clientset.Nodes().Get(context.Background(), c.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get node %s: %v", c.nodeName, err)
+	}
+
+	patchLabels := make(map[string]interface{})
+	for key := range node.Labels {
+		if strings.HasPrefix(key, NodeLabelPrefix) {
+			if _, exists := labels[key]; !exists {
+				patchLabels[key] = nil
+			}
+		}
+	}
+	for key, value := range labels {
+		patchLabels[key] = value
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": patchLabels,
+			"annotations": map[string]string{
+				NodeInventoryAnnotation: string(inventoryJSON),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal node patch: %v", err)
+	}
+
+	_, err = c.clientset.Nodes().Patch(context.Background(), c.nodeName, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to patch node %s: %v", c.nodeName, err)
+	}
+	log.DefaultLogger().V(4).Infof("published device inventory on node %s", c.nodeName)
+	return c.publishNodeCondition(node)
+}
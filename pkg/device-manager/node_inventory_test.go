@@ -0,0 +1,50 @@
+package device_manager
+
+import (
+	"encoding/json"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestNodeInventoryWithComposites(t *testing.T) {
+	gpu := &PCIDevice{pciAddress: "0000:01:00.0", pciID: "10de:1eb8", iommuGroup: "11", numaNode: 0}
+	bundleGPU := &PCIDevice{pciAddress: "0000:05:00.0", pciID: "10de:20b0", iommuGroup: "15", numaNode: 1}
+	bundleNIC := &PCIDevice{pciAddress: "0000:06:00.0", pciID: "15b3:101d", iommuGroup: "16", numaNode: 1}
+
+	c := NewDeviceController("rw", nil, nil, "", nil)
+	c.setDiscoveredDevices(
+		map[string][]*PCIDevice{"example.com/gpu": {gpu}},
+		map[string][][]*PCIDevice{"example.com/bundle": {{bundleGPU, bundleNIC}}},
+		nil)
+	c.setDeviceHealth("example.com/bundle", "15-16", pluginapi.Unhealthy, "the NIC fell off the bus")
+
+	inventory, err := json.Marshal(c.buildNodeInventory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"example.com/bundle":[` +
+		`{"bus":"pci","address":"0000:05:00.0","pciId":"10de:20b0","iommuGroup":"15","numaNode":1,"health":"Unhealthy","reason":"the NIC fell off the bus","bundle":"15-16"},` +
+		`{"bus":"pci","address":"0000:06:00.0","pciId":"15b3:101d","iommuGroup":"16","numaNode":1,"health":"Unhealthy","reason":"the NIC fell off the bus","bundle":"15-16"}],` +
+		`"example.com/gpu":[{"bus":"pci","address":"0000:01:00.0","pciId":"10de:1eb8","iommuGroup":"11","numaNode":0,"health":"Healthy"}]}`
+	if string(inventory) != expected {
+		t.Errorf("unexpected inventory:\n%s\nexpected:\n%s", inventory, expected)
+	}
+
+	labels := nodeInventoryLabels(c.buildNodeInventory())
+	expectedLabels := map[string]string{
+		"vfio.resource/example.com_bundle.count": "1",
+		"vfio.resource/example.com_gpu.count":    "1",
+		"vfio.resource/pci-10de-1eb8":            "true",
+		"vfio.resource/pci-10de-20b0":            "true",
+		"vfio.resource/pci-15b3-101d":            "true",
+	}
+	if len(labels) != len(expectedLabels) {
+		t.Errorf("expected labels %v, got %v", expectedLabels, labels)
+	}
+	for key, value := range expectedLabels {
+		if labels[key] != value {
+			t.Errorf("expected label %s=%s, got %q", key, value, labels[key])
+		}
+	}
+}
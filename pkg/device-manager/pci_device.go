@@ -23,16 +23,21 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
-	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
+	config "github.com/jonkeyguan/vfio-device-plugin/pkg/config"
 	"github.com/jonkeyguan/vfio-device-plugin/pkg/log"
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/metrics"
 	"github.com/jonkeyguan/vfio-device-plugin/pkg/util"
 
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
@@ -43,74 +48,113 @@ const (
 	vfioMount         = "/dev/vfio/vfio"
 	pciBasePath       = "/sys/bus/pci/devices"
 	PCIResourcePrefix = "PCI_RESOURCE"
+	// iommuGroupsEnvSuffix names the env var mapping the allocated iommu groups to their addresses
+	iommuGroupsEnvSuffix = "_IOMMU_GROUPS"
 )
 
+// iommuGroupsBasePath lists the iommu groups and links to their devices
+var iommuGroupsBasePath = "/sys/kernel/iommu_groups"
+
+// PCIDevice is a VFIO device discovered on any bus, pciID holds the ID reported by
+// the bus, which is the vendor:device ID for PCI devices
 type PCIDevice struct {
+	bus        string
 	pciID      string
 	driver     string
 	pciAddress string
 	iommuGroup string
 	numaNode   int
+	// localCPUs are the CPUs close to the device, as listed by its local_cpulist
+	localCPUs string
+	// hostDriver is the driver a device of a lazy binding resource is bound to while unallocated
+	hostDriver string
 }
 
 type PCIDevicePlugin struct {
 	*DevicePluginBase
-	iommuToPCIMap map[string]string
+	// deviceMembers maps every advertised device ID to its devices, a plain device
+	// is advertised by its iommu group, a composite device bundles several devices
+	deviceMembers map[string][]*PCIDevice
+	// envPrefix prefixes the env var listing the allocated addresses
+	envPrefix string
+	// envFormat is one of the config.EnvFormat formats of the env vars
+	envFormat string
+	// composite is set when the devices are bundles, described by an extra env var
+	composite bool
+	// onAllocate, when set, reserves the devices before they are allocated and
+	// fails the allocation if they are taken through another resource
+	onAllocate func(devIDs []string) error
+	// healthCheckers are the health checkers run on every device address besides the vfio device check
+	healthCheckers map[string][]*healthCheckerRule
+	// releaseAction, when set, cleans a device up once a pod released it
+	releaseAction *config.ReleaseAction
+	// bindDevices, when set, binds the devices to vfio-pci before a container using them starts.
+	// The devices are bound to their host driver again once released.
+	bindDevices func(devIDs []string) error
 }
 
-func (dpi *PCIDevicePlugin) Start(stop <-chan struct{}) (err error) {
-	logger := log.DefaultLogger()
-	dpi.stop = stop
+func (dpi *PCIDevicePlugin) Start(stop <-chan struct{}) error {
+	return dpi.serve(stop, dpi, dpi.healthCheck)
+}
 
-	err = dpi.cleanup()
-	if err != nil {
-		return err
+// setEnv applies the env vars configured for the resource over the defaults of its bus
+func (dpi *PCIDevicePlugin) setEnv(env *config.Env) {
+	if env == nil {
+		return
 	}
-
-	sock, err := net.Listen("unix", dpi.socketPath)
-	if err != nil {
-		return fmt.Errorf("error creating GRPC server socket: %v", err)
+	if env.Prefix != "" {
+		dpi.envPrefix = env.Prefix
 	}
+	dpi.envFormat = env.Format
+}
 
-	dpi.server = grpc.NewServer([]grpc.ServerOption{}...)
-	defer dpi.stopDevicePlugin()
-
-	pluginapi.RegisterDevicePluginServer(dpi.server, dpi)
-
-	errChan := make(chan error, 2)
-
-	go func() {
-		errChan <- dpi.server.Serve(sock)
-	}()
-
-	err = waitForGRPCServer(dpi.socketPath, connectionTimeout)
-	if err != nil {
-		return fmt.Errorf("error starting the GRPC server: %v", err)
+// formatGroupAddresses maps every iommu group to its addresses as <group>=<addr>[;<addr>],
+// comma separated in the given order, which tells a guest which /dev/vfio node holds which device
+func formatGroupAddresses(groups []string, addresses map[string][]string) string {
+	entries := make([]string, 0, len(groups))
+	for _, group := range groups {
+		entries = append(entries, group+"="+strings.Join(addresses[group], ";"))
 	}
+	return strings.Join(entries, ",")
+}
 
-	err = dpi.register()
-	if err != nil {
-		return fmt.Errorf("error registering with device plugin manager: %v", err)
+// NewPCIDevicePlugin advertises every iommu group as a device, the functions sharing a group
+// (e.g. a GPU and its audio function) are its members in the order of their addresses
+func NewPCIDevicePlugin(pciDevices []*PCIDevice, resourceName string) *PCIDevicePlugin {
+	deviceMembers := make(map[string][]*PCIDevice)
+	for _, pciDevice := range pciDevices {
+		deviceMembers[pciDevice.iommuGroup] = append(deviceMembers[pciDevice.iommuGroup], pciDevice)
 	}
+	for _, members := range deviceMembers {
+		sort.Slice(members, func(i, j int) bool {
+			return members[i].pciAddress < members[j].pciAddress
+		})
+	}
+	return newPCIDevicePlugin(deviceMembers, resourceName)
+}
 
-	go func() {
-		errChan <- dpi.healthCheck()
-	}()
-
-	dpi.setInitialized(true)
-	logger.Infof("%s device plugin started", dpi.resourceName)
-	err = <-errChan
-
-	return err
+// NewCompositeDevicePlugin advertises every bundle of devices as a single device
+func NewCompositeDevicePlugin(bundles [][]*PCIDevice, resourceName string) *PCIDevicePlugin {
+	deviceMembers := make(map[string][]*PCIDevice)
+	usedGroups := make(map[string]struct{})
+	for _, bundle := range bundles {
+		if err := claimBundleGroups(bundle, usedGroups); err != nil {
+			log.DefaultLogger().Resource(resourceName).Reason(err).Warningf("skipping bundle %s", bundleID(bundle))
+			continue
+		}
+		deviceMembers[bundleID(bundle)] = bundle
+	}
+	dpi := newPCIDevicePlugin(deviceMembers, resourceName)
+	dpi.composite = true
+	return dpi
 }
 
-func NewPCIDevicePlugin(pciDevices []*PCIDevice, resourceName string) *PCIDevicePlugin {
-	serverSock := SocketPath(strings.Replace(resourceName, "/", "-", -1))
-	iommuToPCIMap := make(map[string]string)
+func newPCIDevicePlugin(deviceMembers map[string][]*PCIDevice, resourceName string) *PCIDevicePlugin {
+	serverSock := SocketPath(socketName(resourceName))
 
 	initHandler()
 
-	devs := constructDPIdevices(pciDevices, iommuToPCIMap)
+	devs := constructDPIdevices(deviceMembers)
 
 	dpi := &PCIDevicePlugin{
 		DevicePluginBase: &DevicePluginBase{
@@ -124,62 +168,173 @@ func NewPCIDevicePlugin(pciDevices []*PCIDevice, resourceName string) *PCIDevice
 			health:       make(chan deviceHealth),
 			done:         make(chan struct{}),
 			deregistered: make(chan struct{}),
+			refresh:      make(chan struct{}, 1),
 		},
-		iommuToPCIMap: iommuToPCIMap,
+		deviceMembers: deviceMembers,
+		envPrefix:     PCIResourcePrefix,
+		envFormat:     config.EnvFormatGroups,
 	}
 	return dpi
 }
 
-func constructDPIdevices(pciDevices []*PCIDevice, iommuToPCIMap map[string]string) (devs []*pluginapi.Device) {
-	for _, pciDevice := range pciDevices {
-		iommuToPCIMap[pciDevice.iommuGroup] = pciDevice.pciAddress
+func constructDPIdevices(deviceMembers map[string][]*PCIDevice) (devs []*pluginapi.Device) {
+	for devID, members := range deviceMembers {
 		dpiDev := &pluginapi.Device{
-			ID:     pciDevice.iommuGroup,
+			ID:     devID,
 			Health: pluginapi.Healthy,
 		}
-		if pciDevice.numaNode >= 0 {
-			numaInfo := &pluginapi.NUMANode{
-				ID: int64(pciDevice.numaNode),
+		// a bundle spanning several NUMA nodes reports all of them
+		numaNodes := make(map[int]struct{})
+		for _, member := range members {
+			if _, exists := numaNodes[member.numaNode]; exists || member.numaNode < 0 {
+				continue
 			}
-			dpiDev.Topology = &pluginapi.TopologyInfo{
-				Nodes: []*pluginapi.NUMANode{numaInfo},
+			numaNodes[member.numaNode] = struct{}{}
+			if dpiDev.Topology == nil {
+				dpiDev.Topology = &pluginapi.TopologyInfo{}
 			}
+			dpiDev.Topology.Nodes = append(dpiDev.Topology.Nodes, &pluginapi.NUMANode{
+				ID: int64(member.numaNode),
+			})
 		}
 		devs = append(devs, dpiDev)
 	}
+	sort.Slice(devs, func(i, j int) bool {
+		return devs[i].ID < devs[j].ID
+	})
 	return
 }
 
+// deviceGroups returns the iommu groups of every advertised device
+func (dpi *PCIDevicePlugin) deviceGroups() map[string][]string {
+	groups := make(map[string][]string)
+	for devID, members := range dpi.deviceMembers {
+		groups[devID] = bundleGroups(members)
+	}
+	return groups
+}
+
 func (dpi *PCIDevicePlugin) Allocate(_ context.Context, r *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
-	resourceNameEnvVar := util.ResourceNameToEnvVar(PCIResourcePrefix, dpi.resourceName)
-	allocatedDevices := []string{}
+	defer metrics.ObserveRPC(dpi.resourceName, "Allocate", time.Now())
+	if dpi.isShuttingDown() {
+		return nil, errShuttingDown(dpi.resourceName)
+	}
+	if dpi.onAllocate != nil {
+		var devIDs []string
+		for _, request := range r.ContainerRequests {
+			devIDs = append(devIDs, request.DevicesIDs...)
+		}
+		if err := dpi.onAllocate(devIDs); err != nil {
+			log.DefaultLogger().Resource(dpi.resourceName).Reason(err).Errorf("refusing to allocate devices %v", devIDs)
+			return nil, status.Errorf(codes.FailedPrecondition, "%v", err)
+		}
+	}
+	resourceNameEnvVar := util.ResourceNameToEnvVar(dpi.envPrefix, dpi.resourceName)
 	resp := new(pluginapi.AllocateResponse)
-	containerResponse := new(pluginapi.ContainerAllocateResponse)
 
 	for _, request := range r.ContainerRequests {
+		allocatedDevices := []string{}
+		containerResponse := new(pluginapi.ContainerAllocateResponse)
 		deviceSpecs := make([]*pluginapi.DeviceSpec, 0)
+		allocatedGroups := make(map[string]struct{})
+		var groupOrder []string
+		groupAddresses := make(map[string][]string)
+		localCPUs := make(map[string]string)
+		numaNodes := make(map[string]string)
+		var bundles []compositeBundle
 		for _, devID := range request.DevicesIDs {
-			// translate device's iommu group to its pci address
-			devPCIAddress, exist := dpi.iommuToPCIMap[devID]
+			// translate the device ID to the pci addresses and iommu groups of its devices
+			members, exist := dpi.deviceMembers[devID]
 			if !exist {
 				continue
 			}
-			allocatedDevices = append(allocatedDevices, devPCIAddress)
-			deviceSpecs = append(deviceSpecs, formatVFIODeviceSpecs(devID)...)
+			for _, member := range members {
+				allocatedDevices = append(allocatedDevices, member.pciAddress)
+				if member.localCPUs != "" {
+					localCPUs[member.pciAddress] = member.localCPUs
+				}
+				if member.numaNode >= 0 {
+					numaNodes[member.pciAddress] = strconv.Itoa(member.numaNode)
+				}
+				if _, allocated := allocatedGroups[member.iommuGroup]; !allocated {
+					allocatedGroups[member.iommuGroup] = struct{}{}
+					groupOrder = append(groupOrder, member.iommuGroup)
+					deviceSpecs = append(deviceSpecs, formatVFIODeviceSpecs(member.iommuGroup)...)
+				}
+				groupAddresses[member.iommuGroup] = append(groupAddresses[member.iommuGroup], member.pciAddress)
+			}
+			bundles = append(bundles, newCompositeBundle(devID, members))
 		}
 		containerResponse.Devices = deviceSpecs
 		envVar := make(map[string]string)
 		envVar[resourceNameEnvVar] = strings.Join(allocatedDevices, ",")
+		if dpi.envFormat == config.EnvFormatGroups {
+			envVar[resourceNameEnvVar+iommuGroupsEnvSuffix] = formatGroupAddresses(groupOrder, groupAddresses)
+		}
+		if len(localCPUs) > 0 {
+			envVar[resourceNameEnvVar+localCPUsEnvSuffix] = formatDeviceValues(localCPUs)
+		}
+		if len(numaNodes) > 0 {
+			envVar[resourceNameEnvVar+numaNodeEnvSuffix] = formatDeviceValues(numaNodes)
+		}
+		if dpi.composite {
+			envVar[util.ResourceNameToEnvVar(CompositeResourcePrefix, dpi.resourceName)] = formatCompositeBundles(bundles)
+		}
 
 		containerResponse.Envs = envVar
 		resp.ContainerResponses = append(resp.ContainerResponses, containerResponse)
+		dpi.auditor.record(dpi.resourceName, "Allocate", request.DevicesIDs, allocatedDevices, envVar)
 	}
 	return resp, nil
 }
 
+// GetDevicePluginOptions asks kubelet for PreStartContainer calls when devices are bound lazily
+func (dpi *PCIDevicePlugin) GetDevicePluginOptions(_ context.Context, _ *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
+	options := &pluginapi.DevicePluginOptions{
+		PreStartRequired: dpi.bindDevices != nil,
+	}
+	return options, nil
+}
+
+func (dpi *PCIDevicePlugin) PreStartContainer(ctx context.Context, r *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	defer metrics.ObserveRPC(dpi.resourceName, "PreStartContainer", time.Now())
+	var pciAddresses []string
+	for _, devID := range r.DevicesIDs {
+		for _, member := range dpi.deviceMembers[devID] {
+			pciAddresses = append(pciAddresses, member.pciAddress)
+		}
+	}
+	if dpi.bindDevices != nil {
+		if err := dpi.bindDevices(r.DevicesIDs); err != nil {
+			log.DefaultLogger().Resource(dpi.resourceName).Reason(err).Errorf("failed to bind devices %v to vfio-pci", r.DevicesIDs)
+			return nil, status.Errorf(codes.Internal, "failed to bind devices %v to vfio-pci: %v", r.DevicesIDs, err)
+		}
+	}
+	dpi.auditor.record(dpi.resourceName, "PreStartContainer", r.DevicesIDs, pciAddresses, nil)
+	return &pluginapi.PreStartContainerResponse{}, nil
+}
+
 func (dpi *PCIDevicePlugin) healthCheck() error {
-	logger := log.DefaultLogger()
-	monitoredDevices := make(map[string]string)
+	logger := log.DefaultLogger().Resource(dpi.resourceName)
+	// monitoredGroups maps the vfio device of every iommu group to the group
+	monitoredGroups := make(map[string]string)
+	deviceGroups := dpi.deviceGroups()
+	groupDevices := make(map[string][]string)
+	for devID, groups := range deviceGroups {
+		for _, group := range groups {
+			groupDevices[group] = append(groupDevices[group], devID)
+		}
+	}
+	missingGroups := make(map[string]struct{})
+	// failedChecks holds the reason of every failing health checker of every device address
+	failedChecks := make(map[string]map[*healthCheckerRule]string)
+	addressDevices := make(map[string][]string)
+	for devID, members := range dpi.deviceMembers {
+		for _, member := range members {
+			addressDevices[member.pciAddress] = append(addressDevices[member.pciAddress], devID)
+		}
+	}
+
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return fmt.Errorf("failed to creating a fsnotify watcher: %v", err)
@@ -203,14 +358,17 @@ func (dpi *PCIDevicePlugin) healthCheck() error {
 		}
 	}
 
-	// probe all devices
-	for _, dev := range dpi.devs {
-		vfioDevice := filepath.Join(devicePath, dev.ID)
+	// probe all devices, the vfio devices of lazily bound devices only exist while they are allocated
+	for group := range groupDevices {
+		if dpi.bindDevices != nil {
+			break
+		}
+		vfioDevice := filepath.Join(devicePath, group)
 		err = watcher.Add(vfioDevice)
 		if err != nil {
 			return fmt.Errorf("failed to add the device %s to the watcher: %v", vfioDevice, err)
 		}
-		monitoredDevices[vfioDevice] = dev.ID
+		monitoredGroups[vfioDevice] = group
 	}
 
 	dirName = filepath.Dir(dpi.socketPath)
@@ -224,28 +382,70 @@ func (dpi *PCIDevicePlugin) healthCheck() error {
 		return fmt.Errorf("failed to stat the device-plugin socket: %v", err)
 	}
 
+	// a device is healthy while the vfio devices of all its iommu groups exist
+	// and the health checkers of all its members pass
+	sendHealth := func(devIDs []string) {
+		for _, devID := range devIDs {
+			health := deviceHealth{DevId: devID, Health: pluginapi.Healthy}
+			for _, devGroup := range deviceGroups[devID] {
+				if _, missing := missingGroups[devGroup]; missing {
+					health.Health = pluginapi.Unhealthy
+					health.Reason = fmt.Sprintf("vfio device %s disappeared", filepath.Join(devicePath, devGroup))
+					break
+				}
+			}
+			for _, member := range dpi.deviceMembers[devID] {
+				if health.Health != pluginapi.Healthy {
+					break
+				}
+				for _, reason := range failedChecks[member.pciAddress] {
+					health.Health = pluginapi.Unhealthy
+					health.Reason = fmt.Sprintf("device %s: %s", member.pciAddress, reason)
+					break
+				}
+			}
+			if !dpi.sendHealth(health) {
+				return
+			}
+		}
+	}
+
+	checkResults := make(chan healthCheckResult)
+	checkersDone := make(chan struct{})
+	defer close(checkersDone)
+	for rule, devices := range dpi.checkedDevices() {
+		go runHealthChecker(rule, devices, checkResults, checkersDone)
+	}
+
 	for {
 		select {
 		case <-dpi.stop:
 			return nil
 		case err := <-watcher.Errors:
 			logger.Reason(err).Errorf("error watching devices and device plugin directory")
+		case result := <-checkResults:
+			if result.reason == "" {
+				delete(failedChecks[result.address], result.rule)
+			} else {
+				logger.PCIAddress(result.address).Warningf("device %s is unhealthy: %s", result.address, result.reason)
+				if failedChecks[result.address] == nil {
+					failedChecks[result.address] = make(map[*healthCheckerRule]string)
+				}
+				failedChecks[result.address][result.rule] = result.reason
+			}
+			sendHealth(addressDevices[result.address])
 		case event := <-watcher.Events:
 			logger.V(4).Infof("health Event: %v", event)
-			if monDevId, exist := monitoredDevices[event.Name]; exist {
+			if group, exist := monitoredGroups[event.Name]; exist {
 				// Health in this case is if the device path actually exists
 				if event.Op == fsnotify.Create {
-					logger.Infof("monitored device %s appeared", dpi.resourceName)
-					dpi.health <- deviceHealth{
-						DevId:  monDevId,
-						Health: pluginapi.Healthy,
-					}
+					logger.IOMMUGroup(group).Infof("monitored device %s appeared", dpi.resourceName)
+					delete(missingGroups, group)
+					sendHealth(groupDevices[group])
 				} else if (event.Op == fsnotify.Remove) || (event.Op == fsnotify.Rename) {
-					logger.Infof("monitored device %s disappeared", dpi.resourceName)
-					dpi.health <- deviceHealth{
-						DevId:  monDevId,
-						Health: pluginapi.Unhealthy,
-					}
+					logger.IOMMUGroup(group).Infof("monitored device %s disappeared", dpi.resourceName)
+					missingGroups[group] = struct{}{}
+					sendHealth(groupDevices[group])
 				}
 			} else if event.Name == dpi.socketPath && event.Op == fsnotify.Remove {
 				logger.Infof("device socket file for device %s was removed, kubelet probably restarted.", dpi.resourceName)
@@ -255,6 +455,24 @@ func (dpi *PCIDevicePlugin) healthCheck() error {
 	}
 }
 
+// checkedDevices returns the devices each health checker of the plugin checks
+func (dpi *PCIDevicePlugin) checkedDevices() map[*healthCheckerRule][]*PCIDevice {
+	checked := make(map[*healthCheckerRule][]*PCIDevice)
+	seen := make(map[string]struct{})
+	for _, members := range dpi.deviceMembers {
+		for _, member := range members {
+			if _, exists := seen[member.pciAddress]; exists {
+				continue
+			}
+			seen[member.pciAddress] = struct{}{}
+			for _, rule := range dpi.healthCheckers[member.pciAddress] {
+				checked[rule] = append(checked[rule], member)
+			}
+		}
+	}
+	return checked
+}
+
 func (dpi *PCIDevicePlugin) GetPreferredAllocation(
 	_ context.Context, _ *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
 	return nil, nil
@@ -0,0 +1,46 @@
+package device_manager
+
+import (
+	"context"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestPCIDevicePluginGroupMembers(t *testing.T) {
+	// the audio function is discovered before the GPU sharing its iommu group
+	audio := &PCIDevice{pciAddress: "0000:01:00.1", pciID: "10de:10f8", iommuGroup: "12", numaNode: -1}
+	gpu := &PCIDevice{pciAddress: "0000:01:00.0", pciID: "10de:1eb8", iommuGroup: "12", numaNode: -1}
+	dpi := NewPCIDevicePlugin([]*PCIDevice{audio, gpu}, "example.com/gpu")
+
+	if len(dpi.devs) != 1 || dpi.devs[0].ID != "12" {
+		t.Fatalf("expected a single device for iommu group 12, got %v", dpi.devs)
+	}
+	request := &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"12"}}}}
+	response, err := dpi.Allocate(context.Background(), request)
+	if err != nil {
+		t.Fatalf("failed to allocate the device: %v", err)
+	}
+	envs := response.ContainerResponses[0].Envs
+	expected := map[string]string{
+		"PCI_RESOURCE_EXAMPLE_COM_GPU":              "0000:01:00.0,0000:01:00.1",
+		"PCI_RESOURCE_EXAMPLE_COM_GPU_IOMMU_GROUPS": "12=0000:01:00.0;0000:01:00.1",
+	}
+	for name, value := range expected {
+		if envs[name] != value {
+			t.Errorf("expected %s=%s, got %q", name, value, envs[name])
+		}
+	}
+}
+
+func TestCompositeDevicePluginSharedGroups(t *testing.T) {
+	gpu := &PCIDevice{pciAddress: "0000:05:00.0", iommuGroup: "15"}
+	nic := &PCIDevice{pciAddress: "0000:06:00.0", iommuGroup: "16"}
+	otherNIC := &PCIDevice{pciAddress: "0000:06:00.1", iommuGroup: "16"}
+	otherGPU := &PCIDevice{pciAddress: "0000:07:00.0", iommuGroup: "17"}
+	dpi := NewCompositeDevicePlugin([][]*PCIDevice{{gpu, nic}, {otherGPU, otherNIC}}, "example.com/bundle")
+
+	if len(dpi.deviceMembers) != 1 || dpi.deviceMembers["15-16"] == nil {
+		t.Errorf("expected the bundle sharing group 16 to be skipped, got bundles %v", dpi.deviceMembers)
+	}
+}
@@ -0,0 +1,101 @@
+package device_manager
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/log"
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/metrics"
+)
+
+const podResourcesPollInterval = 30 * time.Second
+
+// podResourcesSocket serves the PodResources API of kubelet
+var podResourcesSocket = "/var/lib/kubelet/pod-resources/kubelet.sock"
+
+// listPodResources queries the kubelet PodResources API for the devices assigned to every container
+func listPodResources(socketPath string) (*podresourcesapi.ListPodResourcesResponse, error) {
+	conn, err := gRPCConnect(socketPath, connectionTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
+	defer cancel()
+
+	client := podresourcesapi.NewPodResourcesListerClient(conn)
+	return client.List(ctx, &podresourcesapi.ListPodResourcesRequest{})
+}
+
+// allocatedDeviceIDs returns the set of allocated device IDs keyed by resource name
+func allocatedDeviceIDs(resp *podresourcesapi.ListPodResourcesResponse) map[string]map[string]struct{} {
+	allocated := make(map[string]map[string]struct{})
+	for _, pod := range resp.GetPodResources() {
+		for _, container := range pod.GetContainers() {
+			for _, dev := range container.GetDevices() {
+				if allocated[dev.GetResourceName()] == nil {
+					allocated[dev.GetResourceName()] = make(map[string]struct{})
+				}
+				for _, devID := range dev.GetDeviceIds() {
+					allocated[dev.GetResourceName()][devID] = struct{}{}
+				}
+			}
+		}
+	}
+	return allocated
+}
+
+// watchPodResources periodically polls the PodResources API until stop is closed, kubelet
+// may serve it only once it restarted
+func (c *DeviceController) watchPodResources(stop <-chan struct{}) {
+	ticker := time.NewTicker(podResourcesPollInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := os.Stat(podResourcesSocket); err != nil {
+			c.setPodResourcesError(fmt.Errorf("no PodResources API at %s: %v", podResourcesSocket, err))
+		} else {
+			c.pollPodResources()
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pollPodResources lists the allocated devices once and keeps the allocated device metrics,
+// the shared device reservations and the released devices up to date
+func (c *DeviceController) pollPodResources() {
+	resp, err := listPodResources(podResourcesSocket)
+	if err != nil {
+		log.DefaultLogger().Reason(err).Error("failed to list pod resources")
+		c.setPodResourcesError(fmt.Errorf("failed to list pod resources: %v", err))
+		return
+	}
+	c.setPodResourcesError(nil)
+	allocated := allocatedDeviceIDs(resp)
+	for _, resourceName := range c.resourceNames() {
+		metrics.SetDevicesAllocated(resourceName, len(allocated[resourceName]))
+	}
+	c.reconcileReservations(allocated)
+	c.handleReleases(allocated)
+}
+
+// resourceNames returns the names of all discovered resources
+func (c *DeviceController) resourceNames() []string {
+	c.inventoryMutex.Lock()
+	defer c.inventoryMutex.Unlock()
+
+	names := make([]string, 0, len(c.discoveredDevices))
+	for resourceName := range c.discoveredDevices {
+		names = append(names, resourceName)
+	}
+	return names
+}
@@ -0,0 +1,390 @@
+package device_manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/client-go/util/workqueue"
+
+	config "github.com/jonkeyguan/vfio-device-plugin/pkg/config"
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/log"
+)
+
+const (
+	// reconcileKey is the only key of the work queue, every reconcile converges all the plugins
+	reconcileKey = "device-plugins"
+	// resyncInterval is how often the plugins are reconciled without any other input
+	resyncInterval = 5 * time.Minute
+	// discoveryRetryInterval bounds the backoff of a failed reconcile
+	discoveryRetryInterval = 30 * time.Second
+)
+
+// reconcileTrigger is an input of the reconcile loop. It calls enqueue, with the reason,
+// whenever the desired plugins may have changed, until stop is closed.
+type reconcileTrigger func(stop <-chan struct{}, enqueue func(reason string))
+
+// desiredPlugin is a device plugin the controller should run. The fingerprint identifies its
+// devices and configuration, a started plugin is replaced when it changes.
+type desiredPlugin struct {
+	device      Device
+	fingerprint string
+}
+
+func newReconcileQueue() workqueue.TypedRateLimitingInterface[string] {
+	return workqueue.NewTypedRateLimitingQueue[string](
+		workqueue.NewTypedItemExponentialFailureRateLimiter[string](time.Second, discoveryRetryInterval))
+}
+
+func (c *DeviceController) enqueue(reason string) {
+	log.DefaultLogger().V(4).Infof("reconciling the device plugins: %s", reason)
+	c.queue.Add(reconcileKey)
+}
+
+// runReconciler reconciles the plugins every time the queue holds the key, until the queue shuts down.
+// A failed reconcile is retried with an exponential backoff.
+func (c *DeviceController) runReconciler(stop <-chan struct{}) {
+	logger := log.DefaultLogger()
+	for {
+		key, shutdown := c.queue.Get()
+		if shutdown {
+			return
+		}
+		if err := c.reconcile(stop); err != nil {
+			logger.Reason(err).Errorf("failed to reconcile the device plugins, will retry within %s", discoveryRetryInterval)
+			c.queue.AddRateLimited(key)
+		} else {
+			c.queue.Forget(key)
+		}
+		c.queue.Done(key)
+	}
+}
+
+// reconcilePlan is the difference between the started plugins and the desired ones
+type reconcilePlan struct {
+	// stop are the started plugins which aren't desired anymore or whose fingerprint changed
+	stop []string
+	// start are the desired plugins which aren't started, sorted by name
+	start []Device
+	// restarted are the resources whose plugin is stopped or started
+	restarted map[string]struct{}
+	// pciPlugins are the desired PCI and composite plugins, the started ones where they run,
+	// resourcePlugins and newPCIPlugins are the plain resource and the not started ones among them
+	pciPlugins      []*PCIDevicePlugin
+	resourcePlugins []*PCIDevicePlugin
+	newPCIPlugins   []*PCIDevicePlugin
+}
+
+// planReconcile compares the desired plugins to the started ones. When the discovery failed
+// the started PCI plugins are kept as they are. It must be called with startedPluginsMutex held.
+func (c *DeviceController) planReconcile(desired map[string]desiredPlugin, discoverErr error) *reconcilePlan {
+	logger := log.DefaultLogger()
+	if discoverErr != nil {
+		for name, dev := range c.startedPlugins {
+			if _, isPCI := dev.devicePlugin.(*PCIDevicePlugin); isPCI {
+				desired[name] = desiredPlugin{device: dev.devicePlugin, fingerprint: c.fingerprints[name]}
+			}
+		}
+	}
+
+	plan := &reconcilePlan{restarted: make(map[string]struct{})}
+	for name := range c.startedPlugins {
+		plugin, isDesired := desired[name]
+		if isDesired && plugin.fingerprint == c.fingerprints[name] {
+			continue
+		}
+		if isDesired {
+			logger.Resource(name).Infof("Devices or configuration of resource %s changed, restarting its device plugin", name)
+		} else {
+			logger.Resource(name).Infof("Resource %s is not configured or discovered anymore, stopping its device plugin", name)
+		}
+		plan.stop = append(plan.stop, name)
+		plan.restarted[name] = struct{}{}
+	}
+	sort.Strings(plan.stop)
+
+	for name, plugin := range desired {
+		_, restarted := plan.restarted[name]
+		running := false
+		if _, started := c.startedPlugins[name]; started && !restarted {
+			plugin.device = c.startedPlugins[name].devicePlugin
+			running = true
+		} else {
+			plan.start = append(plan.start, plugin.device)
+			plan.restarted[name] = struct{}{}
+		}
+		if pciPlugin, isPCI := plugin.device.(*PCIDevicePlugin); isPCI {
+			plan.pciPlugins = append(plan.pciPlugins, pciPlugin)
+			if !pciPlugin.composite {
+				plan.resourcePlugins = append(plan.resourcePlugins, pciPlugin)
+			}
+			if !running {
+				plan.newPCIPlugins = append(plan.newPCIPlugins, pciPlugin)
+			}
+		}
+	}
+	sort.Slice(plan.start, func(i, j int) bool {
+		return plan.start[i].GetDeviceName() < plan.start[j].GetDeviceName()
+	})
+	return plan
+}
+
+// reconcile converges the started plugins to the desired ones: plugins which aren't desired
+// anymore or whose fingerprint changed are stopped, missing plugins are started. When the
+// discovery fails the PCI plugins are left as they are and the error is returned to retry.
+// The plan is made under startedPluginsMutex, stopping plugins and resuming releases may
+// take a while and run without it so that the probes aren't blocked meanwhile.
+func (c *DeviceController) reconcile(stop <-chan struct{}) error {
+	logger := log.DefaultLogger()
+	desired, found, discoverErr := c.desiredPlugins()
+
+	c.startedPluginsMutex.Lock()
+	if c.retired {
+		c.startedPluginsMutex.Unlock()
+		return nil
+	}
+	plan := c.planReconcile(desired, discoverErr)
+	stopping := make([]*controlledDevice, 0, len(plan.stop))
+	for _, name := range plan.stop {
+		stopping = append(stopping, c.startedPlugins[name])
+		delete(c.startedPlugins, name)
+		delete(c.fingerprints, name)
+	}
+	takingOver := c.takingOver
+	c.startedPluginsMutex.Unlock()
+
+	for _, dev := range stopping {
+		dev.Stop()
+	}
+
+	if discoverErr == nil {
+		c.setDiscoveredDevices(found.pciDeviceMap, found.compositeBundles, plan.restarted)
+	}
+	c.setSharedDevices(plan.resourcePlugins)
+	// cordons are applied before the plugins start so that cordoned devices are never advertised healthy
+	c.applyCordons(plan.newPCIPlugins)
+	// devices released while the plugin was down are cleaned up before they are advertised,
+	// while taking over they are once the previous instance retired
+	if !takingOver {
+		c.resumeReleases(plan.pciPlugins, stop)
+	}
+
+	c.startedPluginsMutex.Lock()
+	// a new instance may have taken the resources over meanwhile
+	if !c.retired {
+		for _, dev := range plan.start {
+			logger.Infof("Starting device plugin for %s", dev.GetDeviceName())
+			c.startDevice(dev.GetDeviceName(), dev)
+			c.fingerprints[dev.GetDeviceName()] = desired[dev.GetDeviceName()].fingerprint
+		}
+	}
+	c.startedPluginsMutex.Unlock()
+
+	if discoverErr != nil {
+		return discoverErr
+	}
+	if !IsChanClosed(c.synced) {
+		close(c.synced)
+	}
+	return nil
+}
+
+// desiredPlugins builds the plugins of the current configuration and discovered devices.
+// The device node plugins are returned even when the discovery of PCI devices fails.
+func (c *DeviceController) desiredPlugins() (map[string]desiredPlugin, *discovery, error) {
+	logger := log.DefaultLogger()
+	resourceConfig := c.config()
+
+	healthCheckerRules, err := buildHealthCheckerRules(resourceConfig.GetHealthCheckers())
+	if err != nil {
+		logger.Reason(err).Error("invalid health checker configuration, only the vfio devices are checked")
+	}
+	c.configMutex.Lock()
+	c.healthCheckerRules = healthCheckerRules
+	c.configMutex.Unlock()
+
+	specs := make(map[string]interface{})
+	for _, resource := range resourceConfig.GetResources() {
+		specs[resource.Name] = resource
+	}
+	for _, deviceNode := range resourceConfig.GetDeviceNodes() {
+		specs[deviceNode.Name] = deviceNode
+	}
+	for _, composite := range resourceConfig.GetComposites() {
+		specs[composite.Name] = composite
+	}
+	desired := make(map[string]desiredPlugin)
+	add := func(dev Device) {
+		desired[dev.GetDeviceName()] = desiredPlugin{
+			device:      dev,
+			fingerprint: pluginFingerprint(dev, specs[dev.GetDeviceName()], resourceConfig.GetHealthCheckers()),
+		}
+	}
+
+	// device node resources don't depend on the discovery of PCI devices
+	for _, dev := range c.buildDeviceNodePlugins() {
+		add(dev)
+	}
+
+	found, discoverErr := c.discover()
+	if discoverErr != nil {
+		return desired, nil, fmt.Errorf("failed to discover configured VFIO devices: %v", discoverErr)
+	}
+
+	for _, dev := range c.buildDevicePlugins(found.pciDeviceMap) {
+		add(dev)
+	}
+	for _, dev := range c.buildCompositePlugins(found.compositeBundles) {
+		add(dev)
+	}
+	return desired, found, nil
+}
+
+// pluginFingerprint identifies the devices a plugin advertises and the configuration it was
+// built from. The drivers of the devices are left out, lazily bound devices switch drivers.
+func pluginFingerprint(dev Device, spec interface{}, healthCheckers []config.HealthChecker) string {
+	var devices []string
+	switch plugin := dev.(type) {
+	case *PCIDevicePlugin:
+		for devID, members := range plugin.deviceMembers {
+			var addresses []string
+			for _, member := range members {
+				addresses = append(addresses, fmt.Sprintf("%s@%d", member.pciAddress, member.numaNode))
+			}
+			sort.Strings(addresses)
+			devices = append(devices, devID+"="+strings.Join(addresses, ","))
+		}
+	case *GenericDevicePlugin:
+		devices = append(devices, fmt.Sprintf("%s=%d", plugin.devicePath, len(plugin.devs)))
+	}
+	sort.Strings(devices)
+
+	// the configuration structures only hold plain values, they always marshal
+	specJSON, _ := json.Marshal(spec)
+	checkersJSON, _ := json.Marshal(healthCheckers)
+	return strings.Join(devices, ";") + "|" + string(specJSON) + "|" + string(checkersJSON)
+}
+
+// pciPlugins returns the started PCI and composite plugins
+func (c *DeviceController) pciPlugins() []*PCIDevicePlugin {
+	c.startedPluginsMutex.Lock()
+	defer c.startedPluginsMutex.Unlock()
+	var plugins []*PCIDevicePlugin
+	for _, dev := range c.startedPlugins {
+		if plugin, isPCI := dev.devicePlugin.(*PCIDevicePlugin); isPCI {
+			plugins = append(plugins, plugin)
+		}
+	}
+	return plugins
+}
+
+// SetConfigFile makes the controller reload the resource configuration whenever path changes
+func (c *DeviceController) SetConfigFile(path string) {
+	c.configFile = path
+	c.triggers = append(c.triggers, c.watchConfig)
+}
+
+func (c *DeviceController) config() *config.ResourceConfig {
+	c.configMutex.RLock()
+	defer c.configMutex.RUnlock()
+	return c.resourceConfig
+}
+
+// checkerRules returns the health checkers built from the configuration
+func (c *DeviceController) checkerRules() []*healthCheckerRule {
+	c.configMutex.RLock()
+	defer c.configMutex.RUnlock()
+	return c.healthCheckerRules
+}
+
+// watchConfig reloads the configuration file when it changes. Its directory is watched since
+// ConfigMap volumes replace files through symlinks. An invalid file keeps the previous configuration.
+func (c *DeviceController) watchConfig(stop <-chan struct{}, enqueue func(reason string)) {
+	logger := log.DefaultLogger()
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Reason(err).Error("failed to watch the configuration file, it won't be reloaded")
+		return
+	}
+	defer watcher.Close()
+	if err := watcher.Add(filepath.Dir(c.configFile)); err != nil {
+		logger.Reason(err).Errorf("failed to watch %s, the configuration won't be reloaded", filepath.Dir(c.configFile))
+		return
+	}
+
+	// #nosec the path comes from the command line
+	loaded, _ := os.ReadFile(c.configFile)
+	for {
+		select {
+		case <-stop:
+			return
+		case err := <-watcher.Errors:
+			logger.Reason(err).Error("error watching the configuration file")
+		case <-watcher.Events:
+			// #nosec the path comes from the command line
+			data, err := os.ReadFile(c.configFile)
+			if err != nil || bytes.Equal(data, loaded) {
+				continue
+			}
+			resourceConfig, err := config.NewResourceConfigFromFile(c.configFile)
+			if err != nil {
+				logger.Reason(err).Errorf("failed to reload %s, keeping the previous configuration", c.configFile)
+				loaded = data
+				continue
+			}
+			loaded = data
+			c.configMutex.Lock()
+			c.resourceConfig = resourceConfig
+			c.configMutex.Unlock()
+			logger.Infof("Reloaded the configuration from %s", c.configFile)
+			enqueue("configuration changed")
+		}
+	}
+}
+
+// resync reconciles the plugins periodically, which catches changes no other input reports
+func resync(stop <-chan struct{}, enqueue func(reason string)) {
+	ticker := time.NewTicker(resyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			enqueue("periodic resync")
+		}
+	}
+}
+
+// watchKubelet reconciles the plugins when kubelet restarts, which recreates its socket
+func watchKubelet(stop <-chan struct{}, enqueue func(reason string)) {
+	logger := log.DefaultLogger()
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Reason(err).Error("failed to watch for kubelet restarts")
+		return
+	}
+	defer watcher.Close()
+	if err := watcher.Add(devicePluginPath); err != nil {
+		logger.Reason(err).Errorf("failed to watch %s for kubelet restarts", devicePluginPath)
+		return
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case err := <-watcher.Errors:
+			logger.Reason(err).Error("error watching for kubelet restarts")
+		case event := <-watcher.Events:
+			if event.Name == kubeletSocketPath() && event.Op&fsnotify.Create != 0 {
+				enqueue("kubelet restarted")
+			}
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package device_manager
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPlanReconcile(t *testing.T) {
+	gpu := &PCIDevice{pciAddress: "0000:01:00.0", pciID: "10de:1eb8", iommuGroup: "11"}
+	failing := func(<-chan struct{}) error { return fmt.Errorf("kubelet is not there") }
+
+	tests := []struct {
+		name        string
+		started     map[string]string
+		desired     map[string]string
+		discoverErr error
+		stop        []string
+		start       []string
+		restarted   []string
+	}{
+		{
+			name:      "added resource",
+			started:   map[string]string{"example.com/gpu": "a"},
+			desired:   map[string]string{"example.com/gpu": "a", "example.com/nic": "b"},
+			start:     []string{"example.com/nic"},
+			restarted: []string{"example.com/nic"},
+		},
+		{
+			name:      "removed resource",
+			started:   map[string]string{"example.com/gpu": "a", "example.com/nic": "b"},
+			desired:   map[string]string{"example.com/gpu": "a"},
+			stop:      []string{"example.com/nic"},
+			restarted: []string{"example.com/nic"},
+		},
+		{
+			name:      "changed configuration",
+			started:   map[string]string{"example.com/gpu": "a", "example.com/nic": "b"},
+			desired:   map[string]string{"example.com/gpu": "a", "example.com/nic": "c"},
+			stop:      []string{"example.com/nic"},
+			start:     []string{"example.com/nic"},
+			restarted: []string{"example.com/nic"},
+		},
+		{
+			name:    "plugin in backoff",
+			started: map[string]string{"example.com/failing": "a"},
+			desired: map[string]string{"example.com/failing": "a"},
+		},
+		{
+			name:        "failed discovery",
+			started:     map[string]string{"example.com/pci": "a", "example.com/null": "b"},
+			desired:     map[string]string{},
+			discoverErr: fmt.Errorf("sysfs is not mounted"),
+			stop:        []string{"example.com/null"},
+			restarted:   []string{"example.com/null"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := NewDeviceController("rw", nil, nil, "", nil)
+			for name, fingerprint := range test.started {
+				var dev Device
+				switch name {
+				case "example.com/pci":
+					dev = newPCIDevicePlugin(map[string][]*PCIDevice{gpu.iommuGroup: {gpu}}, name)
+				case "example.com/failing":
+					// the plugin fails to register and waits before its next attempt
+					plugin := newFakePlugin(name, failing)
+					controlled := &controlledDevice{devicePlugin: plugin, backoff: []time.Duration{time.Hour}, stopTimeout: time.Second}
+					controlled.Start()
+					defer controlled.Stop()
+					for controlled.GetConsecutiveFailures() == 0 {
+						time.Sleep(time.Millisecond)
+					}
+					c.startedPlugins[name] = controlled
+					c.fingerprints[name] = fingerprint
+					continue
+				default:
+					dev = newFakePlugin(name, nil)
+				}
+				c.startedPlugins[name] = &controlledDevice{devicePlugin: dev}
+				c.fingerprints[name] = fingerprint
+			}
+			desired := make(map[string]desiredPlugin)
+			for name, fingerprint := range test.desired {
+				desired[name] = desiredPlugin{device: newFakePlugin(name, nil), fingerprint: fingerprint}
+			}
+
+			plan := c.planReconcile(desired, test.discoverErr)
+
+			expectNames(t, "stopped", test.stop, plan.stop)
+			var start []string
+			for _, dev := range plan.start {
+				if dev != desired[dev.GetDeviceName()].device {
+					t.Errorf("expected %s to start the desired plugin", dev.GetDeviceName())
+				}
+				start = append(start, dev.GetDeviceName())
+			}
+			expectNames(t, "started", test.start, start)
+			var restarted []string
+			for name := range plan.restarted {
+				restarted = append(restarted, name)
+			}
+			sort.Strings(restarted)
+			expectNames(t, "restarted", test.restarted, restarted)
+			if failing, exists := c.startedPlugins["example.com/failing"]; exists {
+				if starts := atomic.LoadInt32(&failing.devicePlugin.(*fakePlugin).starts); starts != 1 {
+					t.Errorf("expected the plugin in backoff not to be restarted, got %d starts", starts)
+				}
+			}
+		})
+	}
+}
+
+func expectNames(t *testing.T, what string, expected []string, names []string) {
+	t.Helper()
+	if len(expected) != len(names) {
+		t.Errorf("expected %s plugins %v, got %v", what, expected, names)
+		return
+	}
+	for i := range expected {
+		if expected[i] != names[i] {
+			t.Errorf("expected %s plugins %v, got %v", what, expected, names)
+			return
+		}
+	}
+}
+
+func TestReconcileStopsPluginsWithoutBlockingProbes(t *testing.T) {
+	// the plugin ignores stop until it is released
+	release := make(chan struct{})
+	defer close(release)
+	plugin := newFakePlugin("example.com/gpu", func(<-chan struct{}) error {
+		<-release
+		return nil
+	})
+	stopping := &controlledDevice{devicePlugin: plugin, stopTimeout: time.Second}
+	stopping.Start()
+
+	c := NewDeviceController("rw", newTestConfig(t, "resources: []\n"), nil, "", nil)
+	c.startedPlugins["example.com/gpu"] = stopping
+	c.fingerprints["example.com/gpu"] = "a"
+
+	reconciled := make(chan error)
+	go func() {
+		reconciled <- c.reconcile(make(chan struct{}))
+	}()
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.startedPluginsMutex.Lock()
+		_, started := c.startedPlugins["example.com/gpu"]
+		c.startedPluginsMutex.Unlock()
+		if !started {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the plugin of the removed resource wasn't stopped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	probed := make(chan struct{})
+	go func() {
+		defer close(probed)
+		c.Healthy()
+		c.Ready()
+	}()
+	select {
+	case <-probed:
+	case <-time.After(stopping.stopTimeout / 2):
+		t.Error("the probes waited for the plugin to stop")
+	}
+	if err := <-reconciled; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
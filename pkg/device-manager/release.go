@@ -0,0 +1,299 @@
+package device_manager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	k8sv1 "k8s.io/api/core/v1"
+
+	config "github.com/jonkeyguan/vfio-device-plugin/pkg/config"
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/log"
+)
+
+const (
+	// unavailableReleasing is the source of the unavailability of devices whose release action didn't succeed yet
+	unavailableReleasing = "releasing"
+	releaseStateFile     = "releases.json"
+	releaseRetryInterval = podResourcesPollInterval
+)
+
+// releaseState is persisted in the state directory so that devices released while the
+// plugin was down are cleaned up, and unfinished release actions are retried
+type releaseState struct {
+	// Allocated lists the allocated devices of every resource at the last poll
+	Allocated map[string][]string `json:"allocated"`
+	// Releasing lists the devices of every resource whose release action didn't succeed yet
+	Releasing map[string][]string `json:"releasing"`
+}
+
+// SetStateDir sets the directory the controller keeps its state in across restarts
+func (c *DeviceController) SetStateDir(dir string) {
+	c.stateDir = dir
+}
+
+// loadReleaseState restores the allocated and releasing devices saved by a previous run
+func (c *DeviceController) loadReleaseState() {
+	if c.stateDir == "" {
+		return
+	}
+	data, err := os.ReadFile(filepath.Join(c.stateDir, releaseStateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	} else if err != nil {
+		log.DefaultLogger().Reason(err).Error("failed to read the release state")
+		return
+	}
+	var state releaseState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.DefaultLogger().Reason(err).Error("failed to parse the release state")
+		return
+	}
+
+	c.releaseMutex.Lock()
+	defer c.releaseMutex.Unlock()
+	c.lastAllocated = toDeviceSets(state.Allocated)
+	c.releasing = toDeviceSets(state.Releasing)
+}
+
+// saveReleaseState must be called with releaseMutex held
+func (c *DeviceController) saveReleaseState() {
+	if c.stateDir == "" {
+		return
+	}
+	data, err := json.Marshal(releaseState{
+		Allocated: fromDeviceSets(c.lastAllocated),
+		Releasing: fromDeviceSets(c.releasing),
+	})
+	if err != nil {
+		log.DefaultLogger().Reason(err).Error("failed to marshal the release state")
+		return
+	}
+	if err := writeFileAtomic(filepath.Join(c.stateDir, releaseStateFile), data); err != nil {
+		log.DefaultLogger().Reason(err).Error("failed to save the release state")
+	}
+}
+
+// writeFileAtomic replaces path with data so that readers never see a partial file
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func toDeviceSets(devices map[string][]string) map[string]map[string]struct{} {
+	sets := make(map[string]map[string]struct{})
+	for resourceName, devIDs := range devices {
+		sets[resourceName] = make(map[string]struct{})
+		for _, devID := range devIDs {
+			sets[resourceName][devID] = struct{}{}
+		}
+	}
+	return sets
+}
+
+func fromDeviceSets(sets map[string]map[string]struct{}) map[string][]string {
+	devices := make(map[string][]string)
+	for resourceName, set := range sets {
+		if len(set) == 0 {
+			continue
+		}
+		for devID := range set {
+			devices[resourceName] = append(devices[resourceName], devID)
+		}
+		sort.Strings(devices[resourceName])
+	}
+	return devices
+}
+
+// setReleasePlugins records the plugins of the resources with a release action. The first
+// call resumes the release actions which didn't succeed before the last restart and reports true.
+func (c *DeviceController) setReleasePlugins(plugins []*PCIDevicePlugin, stop <-chan struct{}) bool {
+	c.releaseMutex.Lock()
+	defer c.releaseMutex.Unlock()
+
+	first := c.releasePlugins == nil
+	c.releasePlugins = make(map[string]*PCIDevicePlugin)
+	for _, plugin := range plugins {
+		if plugin.releaseAction != nil || plugin.bindDevices != nil {
+			c.releasePlugins[plugin.resourceName] = plugin
+		}
+	}
+	if !first {
+		return false
+	}
+	c.releaseStop = stop
+
+	pending := c.releasing
+	c.releasing = make(map[string]map[string]struct{})
+	for resourceName, devIDs := range pending {
+		plugin, exists := c.releasePlugins[resourceName]
+		if !exists {
+			continue
+		}
+		for devID := range devIDs {
+			if _, exists := plugin.deviceMembers[devID]; exists {
+				c.startRelease(plugin, devID)
+			}
+		}
+	}
+	c.saveReleaseState()
+	return true
+}
+
+// resumeReleases hands the plugins over to the release handling. The first time, the devices
+// released while no instance watched the pods are cleaned up.
+func (c *DeviceController) resumeReleases(plugins []*PCIDevicePlugin, stop <-chan struct{}) {
+	if !c.setReleasePlugins(plugins, stop) {
+		return
+	}
+	if _, err := os.Stat(podResourcesSocket); err == nil {
+		c.pollPodResources()
+	}
+}
+
+// handleReleases runs the release action of every device allocated at the previous poll
+// and not anymore
+func (c *DeviceController) handleReleases(allocated map[string]map[string]struct{}) {
+	c.releaseMutex.Lock()
+	defer c.releaseMutex.Unlock()
+
+	// the plugins aren't built yet, keep the previous snapshot to compare with once they are
+	if c.releasePlugins == nil {
+		return
+	}
+
+	for resourceName, devIDs := range c.lastAllocated {
+		plugin, exists := c.releasePlugins[resourceName]
+		if !exists {
+			continue
+		}
+		for devID := range devIDs {
+			if _, stillAllocated := allocated[resourceName][devID]; stillAllocated {
+				continue
+			}
+			if _, releasing := c.releasing[resourceName][devID]; releasing {
+				continue
+			}
+			if _, exists := plugin.deviceMembers[devID]; !exists {
+				continue
+			}
+			c.startRelease(plugin, devID)
+		}
+	}
+	c.lastAllocated = allocated
+	c.saveReleaseState()
+
+	for _, entry := range c.staleDriverEntries(allocated) {
+		plugin, exists := c.releasePlugins[entry.Resource]
+		if exists {
+			if _, exists = plugin.deviceMembers[entry.DeviceID]; exists {
+				if _, releasing := c.releasing[entry.Resource][entry.DeviceID]; !releasing {
+					c.startRelease(plugin, entry.DeviceID)
+				}
+				continue
+			}
+		}
+		// the device isn't advertised anymore, it is only returned to its host driver
+		if err := c.restoreDrivers(entry.Resource, entry.DeviceID); err != nil {
+			log.DefaultLogger().Resource(entry.Resource).DevID(entry.DeviceID).Reason(err).Error("failed to restore the host driver")
+		}
+	}
+}
+
+// startRelease makes a device unavailable, in every resource sharing it, until its release
+// action succeeds. It must be called with releaseMutex held.
+func (c *DeviceController) startRelease(plugin *PCIDevicePlugin, devID string) {
+	if c.releasing[plugin.resourceName] == nil {
+		c.releasing[plugin.resourceName] = make(map[string]struct{})
+	}
+	c.releasing[plugin.resourceName][devID] = struct{}{}
+	for _, holder := range c.devicePlugins(plugin, devID) {
+		holder.setUnavailable(devID, unavailableReleasing, fmt.Sprintf("release action of %s is running", plugin.resourceName))
+	}
+	log.DefaultLogger().Resource(plugin.resourceName).DevID(devID).Infof("device %s was released, cleaning it up", devID)
+	go c.release(plugin, devID)
+}
+
+// devicePlugins returns plugin and the other plugins sharing devID
+func (c *DeviceController) devicePlugins(plugin *PCIDevicePlugin, devID string) []*PCIDevicePlugin {
+	c.sharingMutex.Lock()
+	defer c.sharingMutex.Unlock()
+	if shared, exists := c.sharedDevices[devID]; exists {
+		return shared
+	}
+	return []*PCIDevicePlugin{plugin}
+}
+
+// release runs the release action of a device, then returns a lazily bound device to its
+// host driver, until both succeed or the controller stops
+func (c *DeviceController) release(plugin *PCIDevicePlugin, devID string) {
+	logger := log.DefaultLogger().Resource(plugin.resourceName).DevID(devID)
+	for {
+		var err error
+		if plugin.releaseAction != nil {
+			err = runReleaseAction(plugin.releaseAction, plugin.deviceMembers[devID])
+		}
+		if err == nil && plugin.bindDevices != nil {
+			err = c.restoreDrivers(plugin.resourceName, devID)
+		}
+		if err == nil {
+			break
+		}
+		logger.Reason(err).Errorf("failed to clean device %s up, retrying in %s", devID, c.releaseRetry)
+		c.recordNodeEvent(k8sv1.EventTypeWarning, DeviceReleaseFailedReason,
+			"failed to clean device %s of resource %s up: %v", devID, plugin.resourceName, err)
+		select {
+		case <-c.releaseStop:
+			return
+		case <-time.After(c.releaseRetry):
+		}
+	}
+
+	c.releaseMutex.Lock()
+	defer c.releaseMutex.Unlock()
+	delete(c.releasing[plugin.resourceName], devID)
+	c.saveReleaseState()
+	for _, holder := range c.devicePlugins(plugin, devID) {
+		holder.setUnavailable(devID, unavailableReleasing, "")
+	}
+	logger.Infof("device %s is cleaned up", devID)
+}
+
+// runReleaseAction runs action on every member of a released device
+func runReleaseAction(action *config.ReleaseAction, members []*PCIDevice) error {
+	timeout := time.Duration(action.TimeoutSeconds) * time.Second
+	for _, member := range members {
+		switch action.Type {
+		case config.ReleaseActionFLR:
+			if err := Handler.ResetDevice(pciBasePath, member.pciAddress); err != nil {
+				return fmt.Errorf("failed to reset device %s: %v", member.pciAddress, err)
+			}
+		case config.ReleaseActionCommand:
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			args := append(append([]string{}, action.Command[1:]...), member.pciAddress)
+			// #nosec the command comes from the plugin configuration
+			output, err := exec.CommandContext(ctx, action.Command[0], args...).CombinedOutput()
+			cancel()
+			if err != nil {
+				message := strings.TrimSpace(string(output))
+				if len(message) > maxExecOutput {
+					message = message[:maxExecOutput]
+				}
+				return fmt.Errorf("%s %s: %v: %s", action.Command[0], member.pciAddress, err, message)
+			}
+		default:
+			return fmt.Errorf("unknown release action %q", action.Type)
+		}
+	}
+	return nil
+}
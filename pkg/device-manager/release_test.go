@@ -0,0 +1,246 @@
+package device_manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/tools/record"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	config "github.com/jonkeyguan/vfio-device-plugin/pkg/config"
+)
+
+// newReleaseTest returns a controller keeping its state in a temp directory and the plugin
+// of a resource resetting its devices on release, device 12 has two functions
+func newReleaseTest(t *testing.T, reset func(address string) error) (*DeviceController, *PCIDevicePlugin) {
+	handler := &fakeDeviceHandler{
+		devices: map[string]*fakeDevice{
+			"0000:01:00.0": {pciID: "10de:1eb8", driver: vfioPCIDriver, iommuGroup: "12"},
+			"0000:01:00.1": {pciID: "10de:10f8", driver: vfioPCIDriver, iommuGroup: "12"},
+			"0000:02:00.0": {pciID: "10de:1eb8", driver: vfioPCIDriver, iommuGroup: "13"},
+		},
+		reset: reset,
+	}
+	useDeviceHandler(t, handler)
+
+	plugin := NewPCIDevicePlugin([]*PCIDevice{
+		{pciAddress: "0000:01:00.0", pciID: "10de:1eb8", iommuGroup: "12"},
+		{pciAddress: "0000:01:00.1", pciID: "10de:10f8", iommuGroup: "12"},
+		{pciAddress: "0000:02:00.0", pciID: "10de:1eb8", iommuGroup: "13"},
+	}, "example.com/gpu")
+	plugin.releaseAction = &config.ReleaseAction{Type: config.ReleaseActionFLR}
+
+	c := NewDeviceController("rw", nil, nil, "node1", record.NewFakeRecorder(10))
+	c.SetStateDir(t.TempDir())
+	return c, plugin
+}
+
+func readReleaseState(t *testing.T, c *DeviceController) releaseState {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(c.stateDir, releaseStateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state releaseState
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatalf("failed to parse the release state %q: %v", data, err)
+	}
+	return state
+}
+
+// waitForReleases waits until no release action is running anymore
+func waitForReleases(t *testing.T, c *DeviceController) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.releaseMutex.Lock()
+		releasing := fromDeviceSets(c.releasing)
+		c.releaseMutex.Unlock()
+		if len(releasing) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the release actions to complete, still releasing %v", releasing)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// advertisedHealth returns the health a plugin advertises for a device
+func advertisedHealth(plugin *PCIDevicePlugin, devID string) string {
+	for _, dev := range plugin.advertisedDevices() {
+		if dev.ID == devID {
+			return dev.Health
+		}
+	}
+	return ""
+}
+
+func TestReleasePersistedState(t *testing.T) {
+	resetting := make(chan string, 4)
+	proceed := make(chan struct{})
+	c, plugin := newReleaseTest(t, func(address string) error {
+		resetting <- address
+		<-proceed
+		return nil
+	})
+	stop := make(chan struct{})
+	defer close(stop)
+	if !c.setReleasePlugins([]*PCIDevicePlugin{plugin}, stop) {
+		t.Fatal("expected the first call to resume the releases")
+	}
+
+	c.handleReleases(map[string]map[string]struct{}{"example.com/gpu": {"12": {}}})
+	if state := readReleaseState(t, c); !reflect.DeepEqual(state.Allocated, map[string][]string{"example.com/gpu": {"12"}}) || len(state.Releasing) != 0 {
+		t.Fatalf("expected device 12 to be saved as allocated, got %+v", state)
+	}
+
+	// the device is withheld while it is reset
+	c.handleReleases(map[string]map[string]struct{}{})
+	if address := <-resetting; address != "0000:01:00.0" {
+		t.Errorf("expected the first function to be reset first, got %s", address)
+	}
+	if state := readReleaseState(t, c); len(state.Allocated) != 0 || !reflect.DeepEqual(state.Releasing, map[string][]string{"example.com/gpu": {"12"}}) {
+		t.Errorf("expected device 12 to be saved as releasing, got %+v", state)
+	}
+	if health := advertisedHealth(plugin, "12"); health != pluginapi.Unhealthy {
+		t.Errorf("expected the released device to be withheld, got %s", health)
+	}
+	// the next poll doesn't start a second release action
+	c.handleReleases(map[string]map[string]struct{}{})
+
+	close(proceed)
+	if address := <-resetting; address != "0000:01:00.1" {
+		t.Errorf("expected the second function to be reset, got %s", address)
+	}
+	waitForReleases(t, c)
+	if state := readReleaseState(t, c); len(state.Allocated) != 0 || len(state.Releasing) != 0 {
+		t.Errorf("expected no device left to release, got %+v", state)
+	}
+	if health := advertisedHealth(plugin, "12"); health != pluginapi.Healthy {
+		t.Errorf("expected the cleaned up device to be offered again, got %s", health)
+	}
+	if len(resetting) != 0 {
+		t.Errorf("expected every function to be reset once, got another reset of %s", <-resetting)
+	}
+}
+
+func TestReleaseResumeAfterRestart(t *testing.T) {
+	var reset []string
+	resets := make(chan string, 8)
+	c, plugin := newReleaseTest(t, func(address string) error {
+		resets <- address
+		return nil
+	})
+	// the previous run saw device 13 allocated and didn't clean device 12 up yet, the
+	// other entries aren't advertised anymore
+	data, err := json.Marshal(releaseState{
+		Allocated: map[string][]string{"example.com/gpu": {"13"}},
+		Releasing: map[string][]string{"example.com/gpu": {"12", "14"}, "example.com/nic": {"21"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(c.stateDir, releaseStateFile), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// device 13 was released while no instance watched the pods
+	servePodResources(t)
+
+	c.loadReleaseState()
+	stop := make(chan struct{})
+	defer close(stop)
+	c.resumeReleases([]*PCIDevicePlugin{plugin}, stop)
+	waitForReleases(t, c)
+	for len(resets) > 0 {
+		reset = append(reset, <-resets)
+	}
+	sort.Strings(reset)
+	if strings.Join(reset, ",") != "0000:01:00.0,0000:01:00.1,0000:02:00.0" {
+		t.Errorf("expected devices 12 and 13 to be reset, got %v", reset)
+	}
+	if state := readReleaseState(t, c); len(state.Allocated) != 0 || len(state.Releasing) != 0 {
+		t.Errorf("expected the stale entries to be dropped, got %+v", state)
+	}
+
+	// later calls only update the plugins
+	c.resumeReleases([]*PCIDevicePlugin{plugin}, stop)
+	if len(resets) != 0 {
+		t.Errorf("expected no release action to run again, got a reset of %s", <-resets)
+	}
+}
+
+func TestReleaseRetry(t *testing.T) {
+	attempts := make(chan int, 8)
+	var calls int
+	c, plugin := newReleaseTest(t, func(address string) error {
+		if address != "0000:02:00.0" {
+			return nil
+		}
+		calls++
+		attempts <- calls
+		if calls <= 2 {
+			return fmt.Errorf("device is busy")
+		}
+		return nil
+	})
+	recorder := c.recorder.(*record.FakeRecorder)
+	c.releaseRetry = 10 * time.Millisecond
+	stop := make(chan struct{})
+	defer close(stop)
+	c.setReleasePlugins([]*PCIDevicePlugin{plugin}, stop)
+	c.handleReleases(map[string]map[string]struct{}{"example.com/gpu": {"13": {}}})
+
+	c.handleReleases(map[string]map[string]struct{}{})
+	<-attempts
+	if health := advertisedHealth(plugin, "13"); health != pluginapi.Unhealthy {
+		t.Errorf("expected the device to be withheld until its release action succeeds, got %s", health)
+	}
+	waitForReleases(t, c)
+	if count := len(attempts) + 1; count != 3 {
+		t.Errorf("expected 3 attempts, got %d", count)
+	}
+	if health := advertisedHealth(plugin, "13"); health != pluginapi.Healthy {
+		t.Errorf("expected the device to be offered once its release action succeeded, got %s", health)
+	}
+	events := drainEvents(recorder)
+	if len(events) != 2 {
+		t.Fatalf("expected an event for every failed attempt, got %v", events)
+	}
+	for _, event := range events {
+		if !strings.HasPrefix(event, "Warning "+DeviceReleaseFailedReason+" failed to clean device 13 of resource example.com/gpu up: failed to reset device 0000:02:00.0: device is busy") {
+			t.Errorf("unexpected event %s", event)
+		}
+	}
+}
+
+func TestReleaseStop(t *testing.T) {
+	attempts := make(chan struct{}, 8)
+	c, plugin := newReleaseTest(t, func(address string) error {
+		attempts <- struct{}{}
+		return fmt.Errorf("device is busy")
+	})
+	c.releaseRetry = time.Hour
+	stop := make(chan struct{})
+	c.setReleasePlugins([]*PCIDevicePlugin{plugin}, stop)
+	c.handleReleases(map[string]map[string]struct{}{"example.com/gpu": {"13": {}}})
+	c.handleReleases(map[string]map[string]struct{}{})
+	<-attempts
+
+	// the release action is given up on stop and resumed by the next run
+	close(stop)
+	time.Sleep(50 * time.Millisecond)
+	if len(attempts) != 0 {
+		t.Errorf("expected no attempt after the stop, got %d", len(attempts))
+	}
+	if state := readReleaseState(t, c); !reflect.DeepEqual(state.Releasing, map[string][]string{"example.com/gpu": {"13"}}) {
+		t.Errorf("expected device 13 to stay saved as releasing, got %+v", state)
+	}
+}
@@ -0,0 +1,199 @@
+package device_manager
+
+import (
+	"fmt"
+	"time"
+
+	k8sv1 "k8s.io/api/core/v1"
+
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/log"
+)
+
+// reservationGracePeriod is how long a device allocated through one resource stays reserved
+// without kubelet reporting it through the PodResources API, which covers the time
+// between Allocate and kubelet recording the assignment
+const reservationGracePeriod = 2 * podResourcesPollInterval
+
+// unavailableShared is the source of the unavailability of devices allocated through another resource
+const unavailableShared = "shared"
+
+// unavailablePodResources is the source of the unavailability of shared devices while the
+// PodResources API, which tells when they are released, can't be listed
+const unavailablePodResources = "podResources"
+
+// deviceReservation records which of the resources sharing a device allocated it
+type deviceReservation struct {
+	owner string
+	since time.Time
+}
+
+// setSharedDevices records the devices offered by more than one resource. Devices are
+// advertised by iommu group, so resources listing devices of the same group share them.
+func (c *DeviceController) setSharedDevices(plugins []*PCIDevicePlugin) {
+	pools := make(map[string][]*PCIDevicePlugin)
+	for _, plugin := range plugins {
+		for devID := range plugin.deviceMembers {
+			pools[devID] = append(pools[devID], plugin)
+		}
+	}
+
+	c.sharingMutex.Lock()
+	shared := len(c.sharedDevices)
+	// devices which aren't shared anymore are offered again
+	for devID, plugins := range c.sharedDevices {
+		for _, plugin := range plugins {
+			plugin.setUnavailable(devID, unavailablePodResources, "")
+		}
+	}
+	c.sharedDevices = make(map[string][]*PCIDevicePlugin)
+	for devID, plugins := range pools {
+		if len(plugins) > 1 {
+			c.sharedDevices[devID] = plugins
+		}
+	}
+	if len(c.sharedDevices) > 0 && len(c.sharedDevices) != shared {
+		log.DefaultLogger().Infof("%d devices are shared by several resources", len(c.sharedDevices))
+	}
+	report := c.withholdSharedDevices()
+	c.sharingMutex.Unlock()
+	report()
+}
+
+// setPodResourcesError records whether the PodResources API could be listed, nil once it
+// was. The reservations of shared devices are only released by listing it, so the shared
+// devices are withheld from every resource sharing them while it can't be.
+func (c *DeviceController) setPodResourcesError(err error) {
+	logger := log.DefaultLogger()
+	c.sharingMutex.Lock()
+	changed := (err == nil) != (c.podResourcesErr == nil)
+	c.podResourcesErr = err
+	report := c.withholdSharedDevices()
+	c.sharingMutex.Unlock()
+
+	if changed {
+		if err != nil {
+			logger.Reason(err).Warning("PodResources API is not available, allocations are not tracked, release actions don't run and shared devices are withheld")
+		} else {
+			logger.Info("PodResources API is available, allocations are tracked")
+		}
+		c.notifyInventoryChanged()
+	}
+	report()
+}
+
+// withholdSharedDevices makes the shared devices unavailable in every resource while the
+// PodResources API can't be listed, and available again once it can. It returns the report
+// of newly withheld devices, to call once sharingMutex is released. It must be called with
+// sharingMutex held.
+func (c *DeviceController) withholdSharedDevices() func() {
+	reason := ""
+	if c.podResourcesErr != nil {
+		reason = fmt.Sprintf("shared device withheld, the PodResources API tracking its release is unavailable: %v", c.podResourcesErr)
+	}
+	for devID, plugins := range c.sharedDevices {
+		for _, plugin := range plugins {
+			plugin.setUnavailable(devID, unavailablePodResources, reason)
+		}
+	}
+
+	withheld := reason != "" && len(c.sharedDevices) > 0
+	if !withheld || c.withheldReported {
+		c.withheldReported = withheld
+		return func() {}
+	}
+	c.withheldReported = true
+	count, err := len(c.sharedDevices), c.podResourcesErr
+	return func() {
+		c.recordNodeEvent(k8sv1.EventTypeWarning, SharedDevicesWithheldReason,
+			"%d devices shared by several resources are withheld, the PodResources API tracking their release is unavailable: %v", count, err)
+		c.notifyInventoryChanged()
+	}
+}
+
+// sharedDevicesWithheld returns why the shared devices are withheld, nil when they aren't
+func (c *DeviceController) sharedDevicesWithheld() error {
+	c.sharingMutex.Lock()
+	defer c.sharingMutex.Unlock()
+	if c.podResourcesErr == nil || len(c.sharedDevices) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d shared devices are withheld, the PodResources API tracking their release is unavailable: %v", len(c.sharedDevices), c.podResourcesErr)
+}
+
+// reserveDevices reserves the shared devices allocated through resourceName, which makes them
+// unavailable in the other resources. It fails if any is already reserved by another resource.
+func (c *DeviceController) reserveDevices(resourceName string, devIDs []string) error {
+	c.sharingMutex.Lock()
+	defer c.sharingMutex.Unlock()
+
+	for _, devID := range devIDs {
+		if _, shared := c.sharedDevices[devID]; !shared {
+			continue
+		}
+		if reservation, reserved := c.reservations[devID]; reserved && reservation.owner != resourceName {
+			return fmt.Errorf("device %s is allocated through resource %s", devID, reservation.owner)
+		}
+	}
+	for _, devID := range devIDs {
+		if _, shared := c.sharedDevices[devID]; shared {
+			c.reserveDevice(devID, resourceName)
+		}
+	}
+	return nil
+}
+
+// reserveDevice must be called with sharingMutex held
+func (c *DeviceController) reserveDevice(devID string, owner string) {
+	c.reservations[devID] = deviceReservation{owner: owner, since: time.Now()}
+	for _, plugin := range c.sharedDevices[devID] {
+		if plugin.resourceName == owner {
+			plugin.setUnavailable(devID, unavailableShared, "")
+			continue
+		}
+		plugin.setUnavailable(devID, unavailableShared, fmt.Sprintf("allocated through %s", owner))
+	}
+	log.DefaultLogger().Resource(owner).IOMMUGroup(devID).Infof("Reserved shared device %s for resource %s", devID, owner)
+}
+
+// releaseDevice must be called with sharingMutex held
+func (c *DeviceController) releaseDevice(devID string) {
+	owner := c.reservations[devID].owner
+	delete(c.reservations, devID)
+	for _, plugin := range c.sharedDevices[devID] {
+		plugin.setUnavailable(devID, unavailableShared, "")
+	}
+	log.DefaultLogger().Resource(owner).IOMMUGroup(devID).Infof("Released shared device %s from resource %s", devID, owner)
+}
+
+// reconcileReservations matches the reservations with the devices kubelet reports allocated.
+// Devices no longer assigned to any container are released, devices allocated before the
+// plugin started are reserved.
+func (c *DeviceController) reconcileReservations(allocated map[string]map[string]struct{}) {
+	c.sharingMutex.Lock()
+	defer c.sharingMutex.Unlock()
+
+	for devID, plugins := range c.sharedDevices {
+		owner := ""
+		for _, plugin := range plugins {
+			if _, isAllocated := allocated[plugin.resourceName][devID]; isAllocated {
+				owner = plugin.resourceName
+				break
+			}
+		}
+
+		reservation, reserved := c.reservations[devID]
+		switch {
+		case owner != "" && (!reserved || reservation.owner != owner):
+			c.reserveDevice(devID, owner)
+		case owner == "" && reserved && time.Since(reservation.since) > reservationGracePeriod:
+			c.releaseDevice(devID)
+		}
+	}
+}
+
+// reservedBy returns the resource a shared device is reserved by, empty if it isn't
+func (c *DeviceController) reservedBy(devID string) string {
+	c.sharingMutex.Lock()
+	defer c.sharingMutex.Unlock()
+	return c.reservations[devID].owner
+}
@@ -0,0 +1,81 @@
+package device_manager
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	k8sv1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestSharedDevicesWithheldWithoutPodResources(t *testing.T) {
+	gpu := &PCIDevice{pciAddress: "0000:01:00.0", pciID: "10de:1eb8", iommuGroup: "12"}
+	nic := &PCIDevice{pciAddress: "0000:02:00.0", pciID: "8086:1572", iommuGroup: "13"}
+	plugins := []*PCIDevicePlugin{
+		NewPCIDevicePlugin([]*PCIDevice{gpu, nic}, "example.com/gpu"),
+		NewPCIDevicePlugin([]*PCIDevice{gpu}, "example.com/passthrough"),
+	}
+	health := func(plugin *PCIDevicePlugin) map[string]string {
+		health := make(map[string]string)
+		for _, dev := range plugin.advertisedDevices() {
+			health[dev.ID] = dev.Health
+		}
+		return health
+	}
+
+	recorder := record.NewFakeRecorder(10)
+	c := NewDeviceController("rw", nil, nil, "node1", recorder)
+	c.setSharedDevices(plugins)
+	c.setPodResourcesError(fmt.Errorf("no PodResources API at %s", podResourcesSocket))
+	// a later failure is not reported again
+	c.setPodResourcesError(fmt.Errorf("no PodResources API at %s", podResourcesSocket))
+
+	for _, plugin := range plugins {
+		if devHealth := health(plugin)["12"]; devHealth != pluginapi.Unhealthy {
+			t.Errorf("expected the shared device to be withheld from %s, got %s", plugin.GetDeviceName(), devHealth)
+		}
+	}
+	if devHealth := health(plugins[0])["13"]; devHealth != pluginapi.Healthy {
+		t.Errorf("expected the device which isn't shared to be offered, got %s", devHealth)
+	}
+	events := drainEvents(recorder)
+	if len(events) != 1 || !strings.HasPrefix(events[0], "Warning "+SharedDevicesWithheldReason+" 1 devices shared") {
+		t.Errorf("unexpected events %v", events)
+	}
+	condition := c.buildDevicesReadyCondition()
+	if condition.Status != k8sv1.ConditionFalse || condition.Reason != sharedWithheldReason {
+		t.Errorf("unexpected condition %+v", condition)
+	}
+
+	c.setPodResourcesError(nil)
+	for _, plugin := range plugins {
+		if devHealth := health(plugin)["12"]; devHealth != pluginapi.Healthy {
+			t.Errorf("expected the shared device to be offered again by %s, got %s", plugin.GetDeviceName(), devHealth)
+		}
+	}
+	condition = c.buildDevicesReadyCondition()
+	if condition.Status != k8sv1.ConditionTrue || condition.Reason != devicesReadyReason {
+		t.Errorf("unexpected condition %+v", condition)
+	}
+
+	// resources sharing devices while the API is unavailable are withheld right away
+	c.setSharedDevices(nil)
+	c.setPodResourcesError(fmt.Errorf("failed to list pod resources"))
+	if events := drainEvents(recorder); len(events) != 0 {
+		t.Errorf("unexpected events %v without shared devices", events)
+	}
+	c.setSharedDevices(plugins)
+	if devHealth := health(plugins[1])["12"]; devHealth != pluginapi.Unhealthy {
+		t.Errorf("expected the shared device to be withheld, got %s", devHealth)
+	}
+	if events := drainEvents(recorder); len(events) != 1 {
+		t.Errorf("expected the withheld devices to be reported, got %v", events)
+	}
+	// devices which aren't shared anymore are offered again
+	c.setSharedDevices(plugins[:1])
+	if devHealth := health(plugins[0])["12"]; devHealth != pluginapi.Healthy {
+		t.Errorf("expected the device which isn't shared anymore to be offered, got %s", devHealth)
+	}
+}
@@ -0,0 +1,153 @@
+package device_manager
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/log"
+)
+
+// DefaultSocketPrefix namespaces the sockets of this plugin in the kubelet device plugin
+// directory, apart from the kubevirt- sockets of KubeVirt's own device plugins
+const DefaultSocketPrefix = "vfio-device-plugin-"
+
+// legacySocketPrefix named the sockets of the releases which predate the socket prefix and
+// the handover socket, it is the prefix of KubeVirt's device plugins
+const legacySocketPrefix = "kubevirt-"
+
+// socketProbeTimeout bounds the connection attempt telling a live socket from a stale one
+const socketProbeTimeout = time.Second
+
+var socketPrefix = DefaultSocketPrefix
+
+// devicePluginPath is the directory kubelet looks for device plugin sockets in
+var devicePluginPath = pluginapi.DevicePluginPath
+
+// kubeletSocketPath returns the registration socket kubelet serves in devicePluginPath
+func kubeletSocketPath() string {
+	return filepath.Join(devicePluginPath, filepath.Base(pluginapi.KubeletSocket))
+}
+
+// SetSocketPrefix sets the prefix of the socket names of every device plugin, it must be
+// called before the device controller runs
+func SetSocketPrefix(prefix string) error {
+	if prefix == "" {
+		return fmt.Errorf("the socket prefix can't be empty")
+	}
+	if strings.ContainsRune(prefix, filepath.Separator) {
+		return fmt.Errorf("the socket prefix %q can't contain %c", prefix, filepath.Separator)
+	}
+	socketPrefix = prefix
+	return nil
+}
+
+func socketName(resourceName string) string {
+	return strings.Replace(resourceName, "/", "-", -1)
+}
+
+// socketIsLive reports whether a process accepts connections on socketPath
+func socketIsLive(socketPath string) bool {
+	conn, err := net.DialTimeout("unix", socketPath, socketProbeTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// legacySocketPath returns the socket a release which predates the handover socket serves
+// a resource on
+func legacySocketPath(resourceName string) string {
+	return filepath.Join(devicePluginPath, legacySocketPrefix+socketName(resourceName)+".sock")
+}
+
+// otherSocketPaths returns the sockets another instance using the default prefix, a previous
+// release or KubeVirt serve a resource on. Only the exact names are matched, resources whose
+// names end like this one are served on sockets ending the same way.
+func otherSocketPaths(resourceName string) []string {
+	var paths []string
+	for _, prefix := range []string{DefaultSocketPrefix, legacySocketPrefix} {
+		if prefix == socketPrefix {
+			continue
+		}
+		socketPath := filepath.Join(devicePluginPath, prefix+socketName(resourceName)+".sock")
+		paths = append(paths, socketPath)
+		if prefix != legacySocketPrefix {
+			paths = append(paths, slotSocketPath(socketPath))
+		}
+	}
+	return paths
+}
+
+// slotSocketPath returns the second socket slot of a resource, a plugin taking over from
+// its previous instance serves on the slot the previous instance doesn't use
+func slotSocketPath(socketPath string) string {
+	return strings.TrimSuffix(socketPath, ".sock") + ".1.sock"
+}
+
+// selectSocket picks the socket slot the plugin serves on. It fails if a live process
+// already serves the resource, on a slot of this plugin or on the socket of another
+// instance or of KubeVirt, which differ by their prefix only. Taking over from the previous
+// instance, the slot it doesn't serve on is picked instead, and the legacy socket of a
+// previous release identified as such is served alongside until kubelet switches to this plugin.
+func (dpi *DevicePluginBase) selectSocket() error {
+	primary := SocketPath(socketName(dpi.resourceName))
+	slots := []string{primary, slotSocketPath(primary)}
+
+	for _, other := range otherSocketPaths(dpi.resourceName) {
+		if other == legacySocketPath(dpi.resourceName) && dpi.isTakingOverLegacy() {
+			continue
+		}
+		if socketIsLive(other) {
+			return fmt.Errorf("resource %s is already served by another process on %s", dpi.resourceName, other)
+		}
+	}
+
+	var free []string
+	for _, slot := range slots {
+		if socketIsLive(slot) {
+			if !dpi.isTakingOver() {
+				return fmt.Errorf("resource %s is already served by another process on %s", dpi.resourceName, slot)
+			}
+			continue
+		}
+		free = append(free, slot)
+	}
+	if len(free) == 0 {
+		return fmt.Errorf("both socket slots of resource %s are served by other processes", dpi.resourceName)
+	}
+
+	dpi.lock.Lock()
+	defer dpi.lock.Unlock()
+	dpi.socketPath = free[0]
+	return nil
+}
+
+// sweepStaleSockets removes the sockets carrying this plugin's prefix which no process
+// serves anymore, left behind by a crash or by resources renamed or removed since. Live
+// sockets belong to another instance sharing the prefix and are kept.
+func sweepStaleSockets() {
+	logger := log.DefaultLogger()
+	sockets, err := filepath.Glob(filepath.Join(devicePluginPath, socketPrefix+"*.sock"))
+	if err != nil {
+		logger.Reason(err).Warning("failed to list the device plugin sockets")
+		return
+	}
+	for _, socket := range sockets {
+		if socketIsLive(socket) {
+			logger.Warningf("socket %s is served by another process, keeping it", socket)
+			continue
+		}
+		if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+			logger.Reason(err).Warningf("failed to remove stale socket %s", socket)
+			continue
+		}
+		logger.Infof("Removed stale socket %s", socket)
+	}
+}
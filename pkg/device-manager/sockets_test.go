@@ -0,0 +1,72 @@
+package device_manager
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSelectSocket(t *testing.T) {
+	tests := []struct {
+		name         string
+		socketPrefix string
+		live         []string
+		expected     string
+	}{
+		{
+			name:     "no other process",
+			expected: "vfio-device-plugin-vendor-gpu.sock",
+		},
+		{
+			name:     "resources whose names end like this one",
+			live:     []string{"vfio-device-plugin-my-vendor-gpu.sock", "kubevirt-my-vendor-gpu.sock", "vfio-device-plugin-my-vendor-gpu.1.sock"},
+			expected: "vfio-device-plugin-vendor-gpu.sock",
+		},
+		{
+			name: "served by this plugin",
+			live: []string{"vfio-device-plugin-vendor-gpu.sock"},
+		},
+		{
+			name: "served by KubeVirt",
+			live: []string{"kubevirt-vendor-gpu.sock"},
+		},
+		{
+			name:         "served by an instance using the default prefix",
+			socketPrefix: "custom-",
+			live:         []string{"vfio-device-plugin-vendor-gpu.1.sock"},
+		},
+		{
+			name:         "custom prefix",
+			socketPrefix: "custom-",
+			live:         []string{"custom-my-vendor-gpu.sock"},
+			expected:     "custom-vendor-gpu.sock",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := useDevicePluginPath(t)
+			if test.socketPrefix != "" {
+				previous := socketPrefix
+				socketPrefix = test.socketPrefix
+				defer func() { socketPrefix = previous }()
+			}
+			for _, socket := range test.live {
+				serveSocket(t, filepath.Join(dir, socket))
+			}
+
+			dpi := newPCIDevicePlugin(map[string][]*PCIDevice{}, "vendor/gpu")
+			err := dpi.selectSocket()
+			if test.expected == "" {
+				if err == nil {
+					t.Fatalf("expected the resource to be refused, got socket %s", dpi.socketPath)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if dpi.socketPath != filepath.Join(dir, test.expected) {
+				t.Errorf("expected socket %s, got %s", test.expected, dpi.socketPath)
+			}
+		})
+	}
+}
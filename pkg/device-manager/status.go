@@ -0,0 +1,156 @@
+package device_manager
+
+import (
+	"sort"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// ControllerStatus is a read-only snapshot of the controller state served by the introspection API
+type ControllerStatus struct {
+	NodeName       string           `json:"nodeName,omitempty"`
+	DiscoveryError string           `json:"discoveryError,omitempty"`
+	Resources      []ResourceStatus `json:"resources"`
+}
+
+type ResourceStatus struct {
+	Name    string         `json:"name"`
+	Plugin  *PluginStatus  `json:"plugin,omitempty"`
+	Devices []DeviceStatus `json:"devices"`
+}
+
+type PluginStatus struct {
+	Started             bool      `json:"started"`
+	Initialized         bool      `json:"initialized"`
+	SocketPath          string    `json:"socketPath"`
+	RegistrationTime    time.Time `json:"registrationTime,omitempty"`
+	Attempts            int       `json:"attempts"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	LastError           string    `json:"lastError,omitempty"`
+	LastErrorTime       time.Time `json:"lastErrorTime,omitempty"`
+	State               string    `json:"state,omitempty"`
+	StateSince          time.Time `json:"stateSince,omitempty"`
+	// SecondsInState is the time spent in every lifecycle state, the current one included
+	SecondsInState map[string]float64 `json:"secondsInState,omitempty"`
+	// Errors are the last start errors, the oldest first
+	Errors []PluginError `json:"errors,omitempty"`
+}
+
+type PluginError struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+type DeviceStatus struct {
+	ID         string `json:"id"`
+	Bus        string `json:"bus"`
+	Address    string `json:"address"`
+	PCIID      string `json:"pciId"`
+	Driver     string `json:"driver"`
+	IOMMUGroup string `json:"iommuGroup"`
+	NUMANode   int    `json:"numaNode"`
+	LocalCPUs  string `json:"localCpus,omitempty"`
+	Health     string `json:"health"`
+	Reason     string `json:"reason,omitempty"`
+	// ReservedBy is the resource a device shared by several resources is allocated through
+	ReservedBy string `json:"reservedBy,omitempty"`
+}
+
+// Status returns a snapshot of the discovered resources, their devices and device plugins
+func (c *DeviceController) Status() ControllerStatus {
+	status := ControllerStatus{
+		NodeName:  c.nodeName,
+		Resources: []ResourceStatus{},
+	}
+
+	resources := make(map[string]*ResourceStatus)
+	func() {
+		c.inventoryMutex.Lock()
+		defer c.inventoryMutex.Unlock()
+
+		if c.discoveryErr != nil {
+			status.DiscoveryError = c.discoveryErr.Error()
+		}
+		for resourceName, pciDevices := range c.discoveredDevices {
+			resource := &ResourceStatus{Name: resourceName, Devices: []DeviceStatus{}}
+			for _, pciDevice := range pciDevices {
+				health := c.deviceHealth[resourceName][pciDevice.iommuGroup]
+				if health.Health == "" {
+					health.Health = pluginapi.Healthy
+				}
+				resource.Devices = append(resource.Devices, DeviceStatus{
+					ID:         pciDevice.iommuGroup,
+					Bus:        busName(pciDevice.bus),
+					Address:    pciDevice.pciAddress,
+					PCIID:      pciDevice.pciID,
+					Driver:     pciDevice.driver,
+					IOMMUGroup: pciDevice.iommuGroup,
+					NUMANode:   pciDevice.numaNode,
+					LocalCPUs:  pciDevice.localCPUs,
+					Health:     health.Health,
+					Reason:     health.Reason,
+					ReservedBy: c.reservedBy(pciDevice.iommuGroup),
+				})
+			}
+			sort.Slice(resource.Devices, func(i, j int) bool {
+				return resource.Devices[i].Address < resource.Devices[j].Address
+			})
+			resources[resourceName] = resource
+		}
+	}()
+
+	func() {
+		c.startedPluginsMutex.Lock()
+		defer c.startedPluginsMutex.Unlock()
+
+		for resourceName, dev := range c.startedPlugins {
+			resource, exists := resources[resourceName]
+			if !exists {
+				resource = &ResourceStatus{Name: resourceName, Devices: []DeviceStatus{}}
+				resources[resourceName] = resource
+			}
+			resource.Plugin = dev.status()
+		}
+	}()
+
+	for _, resource := range resources {
+		status.Resources = append(status.Resources, *resource)
+	}
+	sort.Slice(status.Resources, func(i, j int) bool {
+		return status.Resources[i].Name < status.Resources[j].Name
+	})
+	return status
+}
+
+// status returns the state of the controlled device plugin
+func (c *controlledDevice) status() *PluginStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	status := &PluginStatus{
+		Started:             c.started,
+		Initialized:         c.devicePlugin.GetInitialized(),
+		SocketPath:          c.devicePlugin.GetSocketPath(),
+		RegistrationTime:    c.devicePlugin.GetRegistrationTime(),
+		Attempts:            c.attempts,
+		ConsecutiveFailures: c.consecutiveFailures,
+		LastErrorTime:       c.lastErrorTime,
+		State:               c.state,
+		StateSince:          c.stateSince,
+	}
+	if c.lastError != nil {
+		status.LastError = c.lastError.Error()
+	}
+	if c.state != "" {
+		status.SecondsInState = make(map[string]float64)
+		for state, duration := range c.stateDurations {
+			status.SecondsInState[state] = duration.Seconds()
+		}
+		status.SecondsInState[c.state] += time.Since(c.stateSince).Seconds()
+	}
+	for _, pluginErr := range c.errors {
+		status.Errors = append(status.Errors, PluginError{Time: pluginErr.time, Message: pluginErr.err.Error()})
+	}
+	return status
+}
@@ -0,0 +1,124 @@
+package device_manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestStatus(t *testing.T) {
+	c := NewDeviceController("rw", nil, nil, "node1", nil)
+	c.discoveryErr = fmt.Errorf("device 0000:04:00.0 of resource example.com/gpu: bound to nvidia instead of vfio-pci")
+	c.discoveredDevices = map[string][]*PCIDevice{
+		"example.com/gpu": {
+			{pciAddress: "0000:02:00.0", pciID: "10de:1eb8", driver: vfioPCIDriver, iommuGroup: "13", numaNode: 1, localCPUs: "4-7"},
+			{pciAddress: "0000:01:00.0", pciID: "10de:1eb8", driver: vfioPCIDriver, iommuGroup: "12", numaNode: -1},
+		},
+		"example.com/nic": {
+			{pciAddress: "0000:03:00.0", pciID: "8086:1572", driver: vfioPCIDriver, iommuGroup: "14", numaNode: 0},
+		},
+	}
+	c.deviceHealth = map[string]map[string]deviceHealth{
+		"example.com/gpu": {"13": {DevId: "13", Health: pluginapi.Unhealthy, Reason: "cordoned"}},
+	}
+	c.reservations["12"] = deviceReservation{owner: "example.com/passthrough", since: time.Now()}
+
+	plugin := newFakePlugin("example.com/gpu", nil)
+	plugin.socketPath = "/var/lib/kubelet/device-plugins/vfio-example.com-gpu.sock"
+	plugin.setInitialized(true)
+	gpu := &controlledDevice{devicePlugin: plugin, started: true}
+	gpu.recordStartResult(fmt.Errorf("kubelet is not running"))
+	gpu.recordStartResult(nil)
+	gpu.setState(PluginStateStarting, nil)
+	gpu.setState(PluginStateServing, nil)
+	c.startedPlugins["example.com/gpu"] = gpu
+	// a device node plugin has no discovered devices
+	c.startedPlugins["example.com/kvm"] = &controlledDevice{devicePlugin: newFakePlugin("example.com/kvm", nil), started: true}
+
+	data, err := json.Marshal(c.Status())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status map[string]interface{}
+	if err := json.Unmarshal(data, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status["nodeName"] != "node1" || status["discoveryError"] != c.discoveryErr.Error() {
+		t.Errorf("unexpected node status %s", data)
+	}
+	resources := status["resources"].([]interface{})
+	if len(resources) != 3 {
+		t.Fatalf("expected 3 resources, got %s", data)
+	}
+	names := make([]string, 0, len(resources))
+	for _, resource := range resources {
+		names = append(names, resource.(map[string]interface{})["name"].(string))
+	}
+	if fmt.Sprint(names) != "[example.com/gpu example.com/kvm example.com/nic]" {
+		t.Errorf("expected the resources sorted by name, got %v", names)
+	}
+
+	gpuStatus := resources[0].(map[string]interface{})
+	devices := gpuStatus["devices"].([]interface{})
+	expectedDevices := []map[string]interface{}{
+		// the devices are sorted by address, a healthy device has no reason
+		{"id": "12", "bus": "pci", "address": "0000:01:00.0", "pciId": "10de:1eb8", "driver": vfioPCIDriver, "iommuGroup": "12", "numaNode": float64(-1), "health": pluginapi.Healthy, "reservedBy": "example.com/passthrough"},
+		{"id": "13", "bus": "pci", "address": "0000:02:00.0", "pciId": "10de:1eb8", "driver": vfioPCIDriver, "iommuGroup": "13", "numaNode": float64(1), "localCpus": "4-7", "health": pluginapi.Unhealthy, "reason": "cordoned"},
+	}
+	if len(devices) != len(expectedDevices) {
+		t.Fatalf("expected %d devices, got %v", len(expectedDevices), devices)
+	}
+	for i, expected := range expectedDevices {
+		device := devices[i].(map[string]interface{})
+		if len(device) != len(expected) {
+			t.Errorf("expected device %v, got %v", expected, device)
+			continue
+		}
+		for key, value := range expected {
+			if device[key] != value {
+				t.Errorf("expected %s of device %d to be %v, got %v", key, i, value, device[key])
+			}
+		}
+	}
+
+	pluginStatus := gpuStatus["plugin"].(map[string]interface{})
+	expectedPlugin := map[string]interface{}{
+		"started":             true,
+		"initialized":         true,
+		"socketPath":          plugin.socketPath,
+		"attempts":            float64(2),
+		"consecutiveFailures": float64(0),
+		"lastError":           "kubelet is not running",
+		"state":               PluginStateServing,
+	}
+	for key, value := range expectedPlugin {
+		if pluginStatus[key] != value {
+			t.Errorf("expected %s of the plugin to be %v, got %v", key, value, pluginStatus[key])
+		}
+	}
+	seconds := pluginStatus["secondsInState"].(map[string]interface{})
+	if _, exists := seconds[PluginStateStarting]; !exists {
+		t.Errorf("expected the time spent starting to be reported, got %v", seconds)
+	}
+	if _, exists := seconds[PluginStateServing]; !exists {
+		t.Errorf("expected the time spent in the current state to be reported, got %v", seconds)
+	}
+	pluginErrors := pluginStatus["errors"].([]interface{})
+	if len(pluginErrors) != 1 || pluginErrors[0].(map[string]interface{})["message"] != "kubelet is not running" {
+		t.Errorf("unexpected errors %v", pluginErrors)
+	}
+
+	kvmStatus := resources[1].(map[string]interface{})
+	if devices := kvmStatus["devices"].([]interface{}); len(devices) != 0 {
+		t.Errorf("expected the device node plugin to list no devices, got %v", devices)
+	}
+	if kvmPlugin := kvmStatus["plugin"].(map[string]interface{}); kvmPlugin["state"] != nil || kvmPlugin["errors"] != nil || kvmPlugin["secondsInState"] != nil {
+		t.Errorf("expected the plugin which didn't start yet to have no state, got %v", kvmPlugin)
+	}
+	if _, exists := resources[2].(map[string]interface{})["plugin"]; exists {
+		t.Errorf("expected the resource without a plugin to have none, got %v", resources[2])
+	}
+}
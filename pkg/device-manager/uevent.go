@@ -0,0 +1,100 @@
+package device_manager
+
+import (
+	"bytes"
+	"syscall"
+	"time"
+
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/log"
+)
+
+const (
+	// ueventSettleDelay groups the burst of uevents of a hotplug or a driver switch into one reconcile
+	ueventSettleDelay = 2 * time.Second
+	// ueventReadTimeout bounds a read of the uevent socket so that stop is noticed
+	ueventReadTimeout = time.Second
+	ueventBufferSize  = 64 * 1024
+)
+
+// ueventSubsystems are the subsystems whose devices the plugin discovers
+var ueventSubsystems = map[string]struct{}{
+	"pci":      {},
+	"vfio":     {},
+	"platform": {},
+	"ap":       {},
+	"ccw":      {},
+}
+
+// watchUevents reconciles the plugins when the kernel reports devices of the discovered
+// subsystems added, removed, bound or unbound
+func watchUevents(stop <-chan struct{}, enqueue func(reason string)) {
+	logger := log.DefaultLogger()
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		logger.Reason(err).Warning("failed to open the uevent socket, hotplugged devices are found by the periodic resync")
+		return
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: 1}); err != nil {
+		logger.Reason(err).Warning("failed to listen to uevents, hotplugged devices are found by the periodic resync")
+		return
+	}
+	timeout := syscall.NsecToTimeval(ueventReadTimeout.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+		logger.Reason(err).Warning("failed to set the uevent read timeout, hotplugged devices are found by the periodic resync")
+		return
+	}
+
+	buf := make([]byte, ueventBufferSize)
+	var settle <-chan time.Time
+	pending := ""
+	for {
+		select {
+		case <-stop:
+			return
+		case <-settle:
+			settle = nil
+			enqueue(pending)
+		default:
+		}
+
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if err != syscall.EAGAIN && err != syscall.EINTR {
+				logger.Reason(err).Error("failed to read a uevent")
+			}
+			continue
+		}
+		action, subsystem, devpath := parseUevent(buf[:n])
+		if _, watched := ueventSubsystems[subsystem]; !watched {
+			continue
+		}
+		switch action {
+		case "add", "remove", "bind", "unbind":
+			logger.V(4).Infof("uevent %s %s", action, devpath)
+			if settle == nil {
+				pending = action + " " + devpath
+				settle = time.After(ueventSettleDelay)
+			}
+		}
+	}
+}
+
+// parseUevent reads a kernel uevent: a header followed by NUL separated KEY=value pairs
+func parseUevent(msg []byte) (action string, subsystem string, devpath string) {
+	for _, field := range bytes.Split(msg, []byte{0}) {
+		key, value, found := bytes.Cut(field, []byte("="))
+		if !found {
+			continue
+		}
+		switch string(key) {
+		case "ACTION":
+			action = string(value)
+		case "SUBSYSTEM":
+			subsystem = string(value)
+		case "DEVPATH":
+			devpath = string(value)
+		}
+	}
+	return action, subsystem, devpath
+}
@@ -0,0 +1,134 @@
+package introspection
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/log"
+)
+
+const (
+	// SocketPath is where the introspection API is served by default
+	SocketPath = "/var/run/vfio-device-plugin/introspection.sock"
+
+	StatusPath   = "/status"
+	LogLevelPath = "/loglevel"
+
+	clientTimeout = 5 * time.Second
+)
+
+// Server serves a local HTTP API over a unix socket
+type Server struct {
+	socketPath string
+	mux        *http.ServeMux
+}
+
+func NewServer(socketPath string) *Server {
+	return &Server{
+		socketPath: socketPath,
+		mux:        http.NewServeMux(),
+	}
+}
+
+// HandleJSON serves the value returned by get as JSON on GET requests to path
+func (s *Server) HandleJSON(path string, get func() interface{}) {
+	s.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(get()); err != nil {
+			log.DefaultLogger().Reason(err).Errorf("failed to encode introspection response for %s", path)
+		}
+	})
+}
+
+// HandleFunc serves path with handler, for endpoints which are not plain JSON reads
+func (s *Server) HandleFunc(path string, handler http.HandlerFunc) {
+	s.mux.HandleFunc(path, handler)
+}
+
+// Run serves the API until stop is closed, the socket is removed on exit
+func (s *Server) Run(stop <-chan struct{}) error {
+	if err := os.MkdirAll(filepath.Dir(s.socketPath), 0755); err != nil {
+		return fmt.Errorf("failed to create introspection socket directory: %v", err)
+	}
+	if err := os.Remove(s.socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove stale introspection socket: %v", err)
+	}
+
+	sock, err := net.Listen("unix", s.socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on introspection socket: %v", err)
+	}
+	// the API is read-only but still exposes node internals, keep it root only
+	if err := os.Chmod(s.socketPath, 0600); err != nil {
+		sock.Close()
+		return fmt.Errorf("failed to restrict introspection socket permissions: %v", err)
+	}
+
+	server := &http.Server{Handler: s.mux}
+	go func() {
+		<-stop
+		server.Close()
+	}()
+
+	log.DefaultLogger().Infof("Serving introspection API on %s", s.socketPath)
+	err = server.Serve(sock)
+	os.Remove(s.socketPath)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Get fetches path from the introspection API at socketPath and decodes the JSON response into out
+func Get(socketPath string, path string, out interface{}) error {
+	// the host is ignored, the connection always goes to the socket
+	resp, err := newClient(socketPath).Get("http://introspection" + path)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(resp, out)
+}
+
+// Post sends the form values to path of the introspection API at socketPath and decodes the JSON response into out
+func Post(socketPath string, path string, values url.Values, out interface{}) error {
+	resp, err := newClient(socketPath).PostForm("http://introspection"+path, values)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(resp, out)
+}
+
+func newClient(socketPath string) *http.Client {
+	return &http.Client{
+		Timeout: clientTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+}
+
+func decodeResponse(resp *http.Response, out interface{}) error {
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("introspection API returned %s: %s", resp.Status, body)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,150 @@
+package introspection
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testStatus struct {
+	NodeName string `json:"nodeName"`
+	Devices  int    `json:"devices"`
+}
+
+// serve runs s on a socket of a temp directory until the test ends and returns the socket path
+func serve(t *testing.T, s *Server) string {
+	// socket paths are limited to 108 bytes
+	dir, err := os.MkdirTemp("", "is")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	s.socketPath = filepath.Join(dir, "run", "introspection.sock")
+
+	stop := make(chan struct{})
+	go s.Run(stop)
+	t.Cleanup(func() { close(stop) })
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(s.socketPath); err == nil {
+			return s.socketPath
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the introspection API wasn't served")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestGet(t *testing.T) {
+	s := NewServer("")
+	var devices int32
+	s.HandleJSON(StatusPath, func() interface{} {
+		return testStatus{NodeName: "node1", Devices: int(atomic.AddInt32(&devices, 1))}
+	})
+	socketPath := serve(t, s)
+
+	// every request gets a new snapshot
+	for expected := 1; expected <= 2; expected++ {
+		var status testStatus
+		if err := Get(socketPath, StatusPath, &status); err != nil {
+			t.Fatalf("failed to get the status: %v", err)
+		}
+		if status.NodeName != "node1" || status.Devices != expected {
+			t.Errorf("unexpected status %+v", status)
+		}
+	}
+
+	var status testStatus
+	if err := Post(socketPath, StatusPath, url.Values{}, &status); err == nil || !strings.Contains(err.Error(), "405") {
+		t.Errorf("expected the status to be read only, got %v", err)
+	}
+	if err := Get(socketPath, "/unknown", &status); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected an unknown path to fail, got %v", err)
+	}
+	if err := Get(filepath.Join(t.TempDir(), "missing.sock"), StatusPath, &status); err == nil {
+		t.Error("expected a missing socket to fail")
+	}
+}
+
+func TestPost(t *testing.T) {
+	s := NewServer("")
+	s.HandleFunc(LogLevelPath, func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.Form.Get("level") == "" {
+			http.Error(w, "missing level", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"level":"` + r.Form.Get("level") + `"}`))
+	})
+	socketPath := serve(t, s)
+
+	var response struct {
+		Level string `json:"level"`
+	}
+	if err := Post(socketPath, LogLevelPath, url.Values{"level": {"warning"}}, &response); err != nil || response.Level != "warning" {
+		t.Errorf("expected the level to be set, got %+v: %v", response, err)
+	}
+	if err := Post(socketPath, LogLevelPath, url.Values{}, &response); err == nil || !strings.Contains(err.Error(), "missing level") {
+		t.Errorf("expected the error of the handler to be returned, got %v", err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	s := NewServer("")
+	s.HandleJSON(StatusPath, func() interface{} { return testStatus{} })
+	// a socket left by a previous run is replaced
+	dir, err := os.MkdirTemp("", "is")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stale := filepath.Join(dir, "introspection.sock")
+	if err := os.WriteFile(stale, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.socketPath = stale
+	stop := make(chan struct{})
+	returned := make(chan error, 1)
+	go func() {
+		returned <- s.Run(stop)
+	}()
+
+	var status testStatus
+	deadline := time.Now().Add(5 * time.Second)
+	for Get(stale, StatusPath, &status) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the introspection API wasn't served on the stale socket path")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	info, err := os.Stat(stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("expected a socket only root can use, got %s", info.Mode())
+	}
+
+	close(stop)
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Errorf("expected a clean exit, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return on stop")
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed on exit, got %v", err)
+	}
+}
@@ -24,12 +24,14 @@ import (
 	goflag "flag"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	klog "github.com/go-kit/kit/log"
@@ -44,6 +46,20 @@ const (
 	logTimestampFormat     = "2006-01-02T15:04:05.000000Z"
 )
 
+// Keys used for the structured fields shared by all device plugin log lines
+const (
+	ResourceKey   = "resource"
+	PCIAddressKey = "pciAddress"
+	IOMMUGroupKey = "iommuGroup"
+	DevIDKey      = "devId"
+)
+
+// Output formats of the loggers
+const (
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
 type LogLevel int32
 
 const (
@@ -74,11 +90,28 @@ type FilteredVerbosityLogger struct {
 type FilteredLogger struct {
 	logger                klog.Logger
 	component             string
-	filterLevel           LogLevel
+	levels                *filterLevels
 	currentLogLevel       LogLevel
-	verbosityLevel        int
 	currentVerbosityLevel int
 	err                   error
+	// handler receives the log lines instead of logger when the FilteredLogger
+	// was built on top of an slog.Handler
+	handler slog.Handler
+}
+
+// filterLevels holds the filter settings of a logger. They are shared by every copy
+// of the logger so that they can be changed at runtime.
+type filterLevels struct {
+	filterLevel    atomic.Int32
+	verbosityLevel atomic.Int32
+}
+
+func (l *filterLevels) filter() LogLevel {
+	return LogLevel(l.filterLevel.Load())
+}
+
+func (l *filterLevels) verbosity() int {
+	return int(l.verbosityLevel.Load())
 }
 
 var Log = DefaultLogger()
@@ -92,6 +125,9 @@ func InitializeLogging(comp string) {
 }
 
 func getDefaultVerbosity() int {
+	if verbosity, set := runtimeVerbosity(); set {
+		return verbosity
+	}
 	if verbosityFlag := flag.Lookup("v"); verbosityFlag != nil {
 		defaultVerbosity, _ := strconv.Atoi(verbosityFlag.Value.String())
 		return defaultVerbosity
@@ -105,17 +141,23 @@ func getDefaultVerbosity() int {
 // Wrap a go-kit logger in a FilteredLogger. Not cached
 func MakeLogger(logger klog.Logger) *FilteredLogger {
 	defaultLogLevel := INFO
+	if level, set := runtimeLogLevel(); set {
+		defaultLogLevel = level
+	}
 
 	defaultVerbosity = getDefaultVerbosity()
 	// This verbosity will be used for info logs without setting a custom verbosity level
 	defaultCurrentVerbosity := 2
 
+	levels := &filterLevels{}
+	levels.filterLevel.Store(int32(defaultLogLevel))
+	levels.verbosityLevel.Store(int32(defaultVerbosity))
+
 	return &FilteredLogger{
 		logger:                logger,
 		component:             defaultComponent,
-		filterLevel:           defaultLogLevel,
+		levels:                levels,
 		currentLogLevel:       defaultLogLevel,
-		verbosityLevel:        defaultVerbosity,
 		currentVerbosityLevel: defaultCurrentVerbosity,
 	}
 }
@@ -133,7 +175,7 @@ func createLogger(component string) {
 	defer lock.Unlock()
 	_, ok := loggers[component]
 	if ok == false {
-		logger := klog.NewJSONLogger(os.Stderr)
+		logger := newFormatLogger(logFormat, os.Stderr)
 		log := MakeLogger(logger)
 		log.component = component
 		loggers[component] = log
@@ -155,12 +197,14 @@ func DefaultLogger() *FilteredLogger {
 // SetIOWriter is meant to be used for testing. "log" and "glog" logs are sent to /dev/nil.
 // KubeVirt related log messages will be sent to this writer
 func (l *FilteredLogger) SetIOWriter(w io.Writer) {
-	l.logger = klog.NewJSONLogger(w)
+	l.logger = newFormatLogger(getLogFormat(), w)
+	l.handler = nil
 	goflag.CommandLine.Set("logtostderr", "false")
 }
 
 func (l *FilteredLogger) SetLogger(logger klog.Logger) *FilteredLogger {
 	l.logger = logger
+	l.handler = nil
 	return l
 }
 
@@ -185,28 +229,44 @@ func (l FilteredLogger) Log(params ...interface{}) error {
 }
 
 func (l FilteredLogger) log(skipFrames int, params ...interface{}) error {
+	if !l.enabled() {
+		return nil
+	}
+	var pcs [1]uintptr
+	runtime.Callers(skipFrames+1, pcs[:])
+	return l.write(time.Now(), pcs[0], params...)
+}
+
+// enabled reports whether a message at the current level and verbosity passes the filter
+func (l FilteredLogger) enabled() bool {
 	// messages should be logged if any of these conditions are met:
 	// The log filtering level is info and verbosity checks match
 	// The log message priority is warning or higher
-	if l.currentLogLevel >= WARNING || (l.filterLevel == INFO &&
-		(l.currentLogLevel == l.filterLevel) &&
-		(l.currentVerbosityLevel <= l.verbosityLevel)) {
-		now := time.Now().UTC()
-		_, fileName, lineNumber, _ := runtime.Caller(skipFrames)
-		logParams := make([]interface{}, 0, 8)
-
-		logParams = append(logParams,
-			"level", LogLevelNames[l.currentLogLevel],
-			"timestamp", now.Format(logTimestampFormat),
-			"pos", fmt.Sprintf("%s:%d", filepath.Base(fileName), lineNumber),
-			"component", l.component,
-		)
-		if l.err != nil {
-			l.logger = klog.With(l.logger, "reason", l.err)
-		}
-		return klog.WithPrefix(l.logger, logParams...).Log(params...)
+	filterLevel := l.levels.filter()
+	return l.currentLogLevel >= WARNING || (filterLevel == INFO &&
+		(l.currentLogLevel == filterLevel) &&
+		(l.currentVerbosityLevel <= l.levels.verbosity()))
+}
+
+// write emits an already filtered message, pc identifies the calling site
+func (l FilteredLogger) write(now time.Time, pc uintptr, params ...interface{}) error {
+	if l.handler != nil {
+		return l.writeSlog(now, pc, params)
 	}
-	return nil
+
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	logParams := make([]interface{}, 0, 8)
+
+	logParams = append(logParams,
+		"level", LogLevelNames[l.currentLogLevel],
+		"timestamp", now.UTC().Format(logTimestampFormat),
+		"pos", fmt.Sprintf("%s:%d", filepath.Base(frame.File), frame.Line),
+		"component", l.component,
+	)
+	if l.err != nil {
+		l.logger = klog.With(l.logger, "reason", l.err)
+	}
+	return klog.WithPrefix(l.logger, logParams...).Log(params...)
 }
 
 func (l FilteredVerbosityLogger) Log(params ...interface{}) error {
@@ -262,18 +322,20 @@ func (l FilteredLogger) Object(obj LoggableObject) *FilteredLogger {
 }
 
 func (l FilteredLogger) With(obj ...interface{}) *FilteredLogger {
-	l.logger = klog.With(l.logger, obj...)
-	return &l
+	return l.with(obj...)
 }
 
 func (l *FilteredLogger) with(obj ...interface{}) *FilteredLogger {
 	l.logger = klog.With(l.logger, obj...)
+	if l.handler != nil {
+		l.handler = l.handler.WithAttrs(argsToAttrs(obj))
+	}
 	return l
 }
 
 func (l *FilteredLogger) SetLogLevel(filterLevel LogLevel) error {
 	if (filterLevel >= INFO) && (filterLevel <= FATAL) {
-		l.filterLevel = filterLevel
+		l.levels.filterLevel.Store(int32(filterLevel))
 		return nil
 	}
 	return fmt.Errorf("Log level %d does not exist", filterLevel)
@@ -281,7 +343,7 @@ func (l *FilteredLogger) SetLogLevel(filterLevel LogLevel) error {
 
 func (l *FilteredLogger) SetVerbosityLevel(level int) error {
 	if level >= 0 {
-		l.verbosityLevel = level
+		l.levels.verbosityLevel.Store(int32(level))
 	} else {
 		return errors.New("Verbosity setting must not be negative")
 	}
@@ -383,7 +445,7 @@ func LogLibvirtLogLine(logger *FilteredLogger, line string) {
 	// by either considering the GA version as unsupported or just don't
 	// send commands which not supported
 	if strings.Contains(msg, "unable to execute QEMU agent command") {
-		if logger.verbosityLevel < 4 {
+		if logger.levels.verbosity() < 4 {
 			return
 		}
 
@@ -0,0 +1,129 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	klog "github.com/go-kit/kit/log"
+)
+
+var (
+	logFormat = FormatJSON
+	// runtime overrides of the filter settings, negative when unset
+	verbosityOverride atomic.Int32
+	levelOverride     atomic.Int32
+)
+
+func init() {
+	verbosityOverride.Store(-1)
+	levelOverride.Store(-1)
+}
+
+func newFormatLogger(format string, w io.Writer) klog.Logger {
+	if format == FormatLogfmt {
+		return klog.NewLogfmtLogger(w)
+	}
+	return klog.NewJSONLogger(w)
+}
+
+func getLogFormat() string {
+	lock.Lock()
+	defer lock.Unlock()
+	return logFormat
+}
+
+// SetLogFormat switches every logger to the json or logfmt output format.
+// It is meant to be called once at startup, before loggers are shared between goroutines.
+func SetLogFormat(format string) error {
+	if format != FormatJSON && format != FormatLogfmt {
+		return fmt.Errorf("Log format %q does not exist", format)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	logFormat = format
+	for _, l := range loggers {
+		l.logger = newFormatLogger(format, os.Stderr)
+	}
+	return nil
+}
+
+func runtimeVerbosity() (int, bool) {
+	level := verbosityOverride.Load()
+	return int(level), level >= 0
+}
+
+func runtimeLogLevel() (LogLevel, bool) {
+	level := levelOverride.Load()
+	return LogLevel(level), level >= 0
+}
+
+// SetVerbosity changes the verbosity of every logger, including the ones created later.
+// It is safe to call while other goroutines are logging.
+func SetVerbosity(level int) error {
+	if level < 0 {
+		return fmt.Errorf("Verbosity setting must not be negative")
+	}
+	verbosityOverride.Store(int32(level))
+
+	lock.Lock()
+	defer lock.Unlock()
+	for _, l := range loggers {
+		l.SetVerbosityLevel(level)
+	}
+	return nil
+}
+
+// SetLevel changes the filter level of every logger, including the ones created later.
+// It is safe to call while other goroutines are logging.
+func SetLevel(level LogLevel) error {
+	if level < INFO || level > FATAL {
+		return fmt.Errorf("Log level %d does not exist", level)
+	}
+	levelOverride.Store(int32(level))
+
+	lock.Lock()
+	defer lock.Unlock()
+	for _, l := range loggers {
+		l.SetLogLevel(level)
+	}
+	return nil
+}
+
+// Verbosity returns the verbosity of the default logger
+func Verbosity() int {
+	return DefaultLogger().levels.verbosity()
+}
+
+// Level returns the filter level of the default logger
+func Level() LogLevel {
+	return DefaultLogger().levels.filter()
+}
+
+// ParseLogLevel converts a level name such as "warning" into a LogLevel
+func ParseLogLevel(name string) (LogLevel, error) {
+	for level, levelName := range LogLevelNames {
+		if levelName == name {
+			return level, nil
+		}
+	}
+	return INFO, fmt.Errorf("Log level %q does not exist", name)
+}
+
+func (l FilteredLogger) Resource(resourceName string) *FilteredLogger {
+	return l.With(ResourceKey, resourceName)
+}
+
+func (l FilteredLogger) PCIAddress(pciAddress string) *FilteredLogger {
+	return l.With(PCIAddressKey, pciAddress)
+}
+
+func (l FilteredLogger) IOMMUGroup(iommuGroup string) *FilteredLogger {
+	return l.With(IOMMUGroupKey, iommuGroup)
+}
+
+func (l FilteredLogger) DevID(devID string) *FilteredLogger {
+	return l.With(DevIDKey, devID)
+}
@@ -0,0 +1,174 @@
+package log
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// restoreRuntimeSettings puts the format, level and verbosity of every logger back once the test ends
+func restoreRuntimeSettings(t *testing.T) {
+	format := getLogFormat()
+	levels := make(map[string][2]int)
+	lock.Lock()
+	for component, l := range loggers {
+		levels[component] = [2]int{int(l.levels.filter()), l.levels.verbosity()}
+	}
+	lock.Unlock()
+	t.Cleanup(func() {
+		verbosityOverride.Store(-1)
+		levelOverride.Store(-1)
+		SetLogFormat(format)
+		lock.Lock()
+		defer lock.Unlock()
+		for component, l := range loggers {
+			if level, existed := levels[component]; existed {
+				l.SetLogLevel(LogLevel(level[0]))
+				l.SetVerbosityLevel(level[1])
+			}
+		}
+	})
+}
+
+func TestSetLevel(t *testing.T) {
+	restoreRuntimeSettings(t)
+	var buf bytes.Buffer
+	logger := Logger("set-level")
+	logger.SetIOWriter(&buf)
+	// copies made before the change share its filter settings
+	resourceLogger := logger.Resource("example.com/gpu")
+
+	if err := SetLevel(WARNING); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resourceLogger.Info("probed")
+	resourceLogger.Warning("unhealthy")
+	if lines := decodeLines(t, &buf); len(lines) != 1 || lines[0]["msg"] != "unhealthy" || lines[0][ResourceKey] != "example.com/gpu" {
+		t.Errorf("expected only the warning to be logged, got %v", lines)
+	}
+	if Level() != WARNING {
+		t.Errorf("expected the default logger to filter at warning, got %s", LogLevelNames[Level()])
+	}
+	// loggers created later filter at the same level
+	if level := Logger("set-level-later").levels.filter(); level != WARNING {
+		t.Errorf("expected a new logger to filter at warning, got %s", LogLevelNames[level])
+	}
+
+	buf.Reset()
+	if err := SetLevel(INFO); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resourceLogger.Info("probed")
+	if lines := decodeLines(t, &buf); len(lines) != 1 || lines[0]["msg"] != "probed" {
+		t.Errorf("expected the info message to be logged, got %v", lines)
+	}
+
+	for _, level := range []LogLevel{INFO - 1, FATAL + 1} {
+		if err := SetLevel(level); err == nil {
+			t.Errorf("expected level %d to be refused", level)
+		}
+	}
+}
+
+func TestSetVerbosity(t *testing.T) {
+	restoreRuntimeSettings(t)
+	var buf bytes.Buffer
+	logger := Logger("set-verbosity")
+	logger.SetIOWriter(&buf)
+	logger.SetVerbosityLevel(2)
+	verboseLogger := logger.V(4)
+
+	verboseLogger.Infof("details of %s", "example.com/gpu")
+	if buf.Len() != 0 {
+		t.Errorf("expected V(4) to be filtered at verbosity 2, got %s", buf.String())
+	}
+
+	if err := SetVerbosity(4); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	verboseLogger.Infof("details of %s", "example.com/gpu")
+	logger.V(5).Info("more details")
+	if lines := decodeLines(t, &buf); len(lines) != 1 || lines[0]["msg"] != "details of example.com/gpu" {
+		t.Errorf("expected only V(4) to be logged at verbosity 4, got %v", lines)
+	}
+	if Verbosity() != 4 {
+		t.Errorf("expected the default logger verbosity to be 4, got %d", Verbosity())
+	}
+	if verbosity := Logger("set-verbosity-later").levels.verbosity(); verbosity != 4 {
+		t.Errorf("expected a new logger to have verbosity 4, got %d", verbosity)
+	}
+
+	if err := SetVerbosity(-1); err == nil {
+		t.Error("expected a negative verbosity to be refused")
+	}
+}
+
+func TestSetLogFormat(t *testing.T) {
+	restoreRuntimeSettings(t)
+	// existing loggers write to stderr in the new format
+	logger := Logger("set-log-format")
+	stderr := os.Stderr
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stderr = writer
+	defer func() { os.Stderr = stderr }()
+
+	if err := SetLogFormat(FormatLogfmt); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	logger.Resource("example.com/gpu").Info("switched")
+	if err := SetLogFormat(FormatJSON); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	logger.Info("switched back")
+	writer.Close()
+	os.Stderr = stderr
+	output, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", output)
+	}
+	if !strings.HasPrefix(lines[0], "level=info ") || !strings.Contains(lines[0], " resource=example.com/gpu ") || !strings.HasSuffix(lines[0], " msg=switched") {
+		t.Errorf("expected a logfmt line, got %s", lines[0])
+	}
+	var buf bytes.Buffer
+	buf.WriteString(lines[1])
+	if decoded := decodeLines(t, &buf); decoded[0]["msg"] != "switched back" {
+		t.Errorf("expected a json line, got %s", lines[1])
+	}
+
+	// writers set later use the current format
+	if err := SetLogFormat(FormatLogfmt); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	buf.Reset()
+	logger.SetIOWriter(&buf)
+	logger.Info("written")
+	if !strings.HasPrefix(buf.String(), "level=info ") {
+		t.Errorf("expected a logfmt line, got %s", buf.String())
+	}
+
+	if err := SetLogFormat("text"); err == nil {
+		t.Error("expected an unknown format to be refused")
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for level, name := range LogLevelNames {
+		parsed, err := ParseLogLevel(name)
+		if err != nil || parsed != level {
+			t.Errorf("expected %s to be parsed as %d, got %d: %v", name, level, parsed, err)
+		}
+	}
+	if _, err := ParseLogLevel("debug"); err == nil {
+		t.Error("expected an unknown level to be refused")
+	}
+}
@@ -0,0 +1,222 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// infoVerbosity is the verbosity of info messages logged without V(), see MakeLogger
+const infoVerbosity = 2
+
+// slogFatalLevel is the slog level FATAL messages are mapped onto, slog has no fatal level
+const slogFatalLevel = slog.LevelError + 4
+
+// toSlogLevel maps a log level and verbosity onto an slog level. Every verbosity step
+// above V(2) lowers the level by 2, so that V(4) is logged at slog.LevelDebug.
+func toSlogLevel(level LogLevel, verbosity int) slog.Level {
+	switch level {
+	case INFO:
+		if verbosity <= infoVerbosity {
+			return slog.LevelInfo
+		}
+		return slog.LevelInfo - slog.Level(2*(verbosity-infoVerbosity))
+	case WARNING:
+		return slog.LevelWarn
+	case ERROR:
+		return slog.LevelError
+	default:
+		return slogFatalLevel
+	}
+}
+
+// fromSlogLevel is the inverse of toSlogLevel, levels between two verbosity steps
+// are rounded up to the higher verbosity
+func fromSlogLevel(level slog.Level) (LogLevel, int) {
+	switch {
+	case level >= slogFatalLevel:
+		return FATAL, infoVerbosity
+	case level >= slog.LevelError:
+		return ERROR, infoVerbosity
+	case level >= slog.LevelWarn:
+		return WARNING, infoVerbosity
+	case level >= slog.LevelInfo:
+		return INFO, infoVerbosity
+	default:
+		return INFO, infoVerbosity + int(slog.LevelInfo-level+1)/2
+	}
+}
+
+// MakeSlogLogger builds a FilteredLogger on top of an slog.Handler. Not cached.
+// Messages are filtered by the FilteredLogger first and then by the handler. The
+// component, Reason(err) and the fields added with Object(obj) or With() are passed
+// to the handler as attributes.
+func MakeSlogLogger(handler slog.Handler) *FilteredLogger {
+	l := MakeLogger(&slogKitLogger{handler: handler})
+	l.handler = handler
+	return l
+}
+
+func (l FilteredLogger) writeSlog(now time.Time, pc uintptr, params []interface{}) error {
+	ctx := context.Background()
+	level := toSlogLevel(l.currentLogLevel, l.currentVerbosityLevel)
+	if !l.handler.Enabled(ctx, level) {
+		return nil
+	}
+
+	msg, args := splitMessage(params)
+	record := slog.NewRecord(now, level, msg, pc)
+	record.AddAttrs(slog.String("component", l.component))
+	if l.err != nil {
+		record.AddAttrs(slog.Any("reason", l.err))
+	}
+	record.Add(args...)
+	return l.handler.Handle(ctx, record)
+}
+
+// slogKitLogger forwards the lines written directly to the go-kit logger of a
+// FilteredLogger built with MakeSlogLogger, such as the libvirt and qemu log lines
+type slogKitLogger struct {
+	handler slog.Handler
+}
+
+func (k *slogKitLogger) Log(keyvals ...interface{}) error {
+	ctx := context.Background()
+	var args []interface{}
+	level := slog.LevelInfo
+	msg := ""
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		switch keyvals[i] {
+		case "level":
+			if logLevel, err := ParseLogLevel(fmt.Sprint(keyvals[i+1])); err == nil {
+				level = toSlogLevel(logLevel, infoVerbosity)
+			}
+		case "msg":
+			msg = fmt.Sprint(keyvals[i+1])
+		case "timestamp":
+			// the record carries its own time
+		default:
+			args = append(args, keyvals[i], keyvals[i+1])
+		}
+	}
+	if !k.handler.Enabled(ctx, level) {
+		return nil
+	}
+	record := slog.NewRecord(time.Now(), level, msg, 0)
+	record.Add(args...)
+	return k.handler.Handle(ctx, record)
+}
+
+// splitMessage separates the "msg" value from the other key value pairs
+func splitMessage(params []interface{}) (string, []interface{}) {
+	for i := 0; i+1 < len(params); i += 2 {
+		if params[i] == "msg" {
+			args := make([]interface{}, 0, len(params)-2)
+			args = append(args, params[:i]...)
+			args = append(args, params[i+2:]...)
+			return fmt.Sprint(params[i+1]), args
+		}
+	}
+	return "", params
+}
+
+// argsToAttrs converts key value pairs into slog attributes, following the rules of slog.Record.Add
+func argsToAttrs(args []interface{}) []slog.Attr {
+	var record slog.Record
+	record.Add(args...)
+	attrs := make([]slog.Attr, 0, record.NumAttrs())
+	record.Attrs(func(attr slog.Attr) bool {
+		attrs = append(attrs, attr)
+		return true
+	})
+	return attrs
+}
+
+// NewSlogHandler returns an slog.Handler which writes through logger. Records are
+// filtered by the level and verbosity of logger, see fromSlogLevel for the mapping.
+// Attributes become fields of the log line, group names prefix the keys of the
+// attributes they contain, separated by a dot.
+func NewSlogHandler(logger *FilteredLogger) slog.Handler {
+	return &slogHandler{logger: logger}
+}
+
+type slogHandler struct {
+	logger *FilteredLogger
+	// prefix of the attribute keys, built from the open groups
+	prefix string
+}
+
+func (h *slogHandler) levelLogger(level slog.Level) *FilteredLogger {
+	logLevel, verbosity := fromSlogLevel(level)
+	l := h.logger.Level(logLevel)
+	l.currentVerbosityLevel = verbosity
+	return l
+}
+
+func (h *slogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return h.levelLogger(level).enabled()
+}
+
+func (h *slogHandler) Handle(_ context.Context, record slog.Record) error {
+	l := h.levelLogger(record.Level)
+	if !l.enabled() {
+		return nil
+	}
+
+	params := []interface{}{"msg", record.Message}
+	record.Attrs(func(attr slog.Attr) bool {
+		params = appendAttr(params, h.prefix, attr)
+		return true
+	})
+
+	now := record.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+	return l.write(now, record.PC, params...)
+}
+
+func (h *slogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+	var params []interface{}
+	for _, attr := range attrs {
+		params = appendAttr(params, h.prefix, attr)
+	}
+	return &slogHandler{
+		logger: h.logger.With(params...),
+		prefix: h.prefix,
+	}
+}
+
+func (h *slogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &slogHandler{
+		logger: h.logger,
+		prefix: h.prefix + name + ".",
+	}
+}
+
+// appendAttr flattens attr into key value pairs, error values are kept as errors
+// so that they are rendered like Reason(err)
+func appendAttr(params []interface{}, prefix string, attr slog.Attr) []interface{} {
+	attr.Value = attr.Value.Resolve()
+	if attr.Equal(slog.Attr{}) {
+		return params
+	}
+	if attr.Value.Kind() == slog.KindGroup {
+		groupPrefix := prefix
+		if attr.Key != "" {
+			groupPrefix = prefix + attr.Key + "."
+		}
+		for _, groupAttr := range attr.Value.Group() {
+			params = appendAttr(params, groupPrefix, groupAttr)
+		}
+		return params
+	}
+	return append(params, prefix+attr.Key, attr.Value.Any())
+}
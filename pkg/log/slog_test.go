@@ -0,0 +1,234 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	klog "github.com/go-kit/kit/log"
+)
+
+// decodeLines parses the json log lines written to buf
+func decodeLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			t.Fatalf("failed to parse log line %q: %v", line, err)
+		}
+		lines = append(lines, fields)
+	}
+	return lines
+}
+
+func TestToSlogLevel(t *testing.T) {
+	tests := []struct {
+		level     LogLevel
+		verbosity int
+		expected  slog.Level
+	}{
+		{level: INFO, verbosity: 0, expected: slog.LevelInfo},
+		{level: INFO, verbosity: 2, expected: slog.LevelInfo},
+		{level: INFO, verbosity: 3, expected: slog.LevelInfo - 2},
+		{level: INFO, verbosity: 4, expected: slog.LevelDebug},
+		{level: INFO, verbosity: 6, expected: slog.LevelDebug - 4},
+		{level: WARNING, verbosity: 4, expected: slog.LevelWarn},
+		{level: ERROR, verbosity: 2, expected: slog.LevelError},
+		{level: FATAL, verbosity: 2, expected: slog.LevelError + 4},
+	}
+	for _, test := range tests {
+		if level := toSlogLevel(test.level, test.verbosity); level != test.expected {
+			t.Errorf("expected %s V(%d) to be %s, got %s", LogLevelNames[test.level], test.verbosity, test.expected, level)
+		}
+	}
+}
+
+func TestFromSlogLevel(t *testing.T) {
+	tests := []struct {
+		level     slog.Level
+		expected  LogLevel
+		verbosity int
+	}{
+		{level: slog.LevelError + 8, expected: FATAL, verbosity: 2},
+		{level: slog.LevelError + 4, expected: FATAL, verbosity: 2},
+		{level: slog.LevelError + 1, expected: ERROR, verbosity: 2},
+		{level: slog.LevelError, expected: ERROR, verbosity: 2},
+		{level: slog.LevelWarn, expected: WARNING, verbosity: 2},
+		{level: slog.LevelInfo + 1, expected: INFO, verbosity: 2},
+		{level: slog.LevelInfo, expected: INFO, verbosity: 2},
+		// levels between two verbosity steps are rounded up
+		{level: slog.LevelInfo - 1, expected: INFO, verbosity: 3},
+		{level: slog.LevelInfo - 2, expected: INFO, verbosity: 3},
+		{level: slog.LevelDebug, expected: INFO, verbosity: 4},
+		{level: slog.LevelDebug - 1, expected: INFO, verbosity: 5},
+	}
+	for _, test := range tests {
+		level, verbosity := fromSlogLevel(test.level)
+		if level != test.expected || verbosity != test.verbosity {
+			t.Errorf("expected %s to be %s V(%d), got %s V(%d)", test.level, LogLevelNames[test.expected], test.verbosity, LogLevelNames[level], verbosity)
+		}
+	}
+	for verbosity := 0; verbosity < 10; verbosity++ {
+		level, roundTrip := fromSlogLevel(toSlogLevel(INFO, verbosity))
+		expected := verbosity
+		if expected < infoVerbosity {
+			expected = infoVerbosity
+		}
+		if level != INFO || roundTrip != expected {
+			t.Errorf("expected info V(%d) to map back to V(%d), got %s V(%d)", verbosity, expected, LogLevelNames[level], roundTrip)
+		}
+	}
+}
+
+func TestAppendAttr(t *testing.T) {
+	reason := errors.New("device is gone")
+	tests := []struct {
+		name     string
+		prefix   string
+		attr     slog.Attr
+		expected []interface{}
+	}{
+		{name: "plain", attr: slog.String("resource", "example.com/gpu"), expected: []interface{}{"resource", "example.com/gpu"}},
+		{name: "prefixed", prefix: "dev.", attr: slog.Int("numaNode", 1), expected: []interface{}{"dev.numaNode", int64(1)}},
+		{name: "group", prefix: "dev.", attr: slog.Group("health", "state", "ok", "since", 3), expected: []interface{}{"dev.health.state", "ok", "dev.health.since", int64(3)}},
+		{name: "inlined group", prefix: "dev.", attr: slog.Group("", "state", "ok"), expected: []interface{}{"dev.state", "ok"}},
+		{name: "empty attribute", attr: slog.Attr{}},
+		{name: "error", attr: slog.Any("reason", reason), expected: []interface{}{"reason", reason}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params := appendAttr(nil, test.prefix, test.attr)
+			if len(params) != len(test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, params)
+			}
+			for i := range params {
+				if params[i] != test.expected[i] {
+					t.Fatalf("expected %v, got %v", test.expected, params)
+				}
+			}
+		})
+	}
+}
+
+func TestSlogHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		verbosity int
+		log       func(*slog.Logger)
+		expected  []map[string]interface{}
+	}{
+		{
+			name: "levels",
+			log: func(logger *slog.Logger) {
+				logger.Info("probed")
+				logger.Warn("unhealthy")
+				logger.Error("failed")
+			},
+			expected: []map[string]interface{}{
+				{"level": "info", "msg": "probed"},
+				{"level": "warning", "msg": "unhealthy"},
+				{"level": "error", "msg": "failed"},
+			},
+		},
+		{
+			name: "debug filtered by the verbosity",
+			log: func(logger *slog.Logger) {
+				logger.Debug("details")
+			},
+		},
+		{
+			name:      "debug at verbosity 4",
+			verbosity: 4,
+			log: func(logger *slog.Logger) {
+				logger.Debug("details")
+				logger.Log(context.Background(), slog.LevelDebug-2, "more details")
+			},
+			expected: []map[string]interface{}{
+				{"level": "info", "msg": "details"},
+			},
+		},
+		{
+			name: "groups",
+			log: func(logger *slog.Logger) {
+				logger.WithGroup("dev").With("id", "12").Info("probed", slog.Group("health", "state", "ok"))
+			},
+			expected: []map[string]interface{}{
+				{"level": "info", "msg": "probed", "dev.id": "12", "dev.health.state": "ok"},
+			},
+		},
+		{
+			name: "errors rendered like Reason",
+			log: func(logger *slog.Logger) {
+				logger.Error("failed", "reason", errors.New("device is gone"))
+			},
+			expected: []map[string]interface{}{
+				{"level": "error", "msg": "failed", "reason": "device is gone"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			filtered := MakeLogger(klog.NewJSONLogger(&buf))
+			verbosity := infoVerbosity
+			if test.verbosity > 0 {
+				verbosity = test.verbosity
+			}
+			filtered.SetVerbosityLevel(verbosity)
+			test.log(slog.New(NewSlogHandler(filtered)))
+
+			lines := decodeLines(t, &buf)
+			if len(lines) != len(test.expected) {
+				t.Fatalf("expected %d lines, got %v", len(test.expected), lines)
+			}
+			for i, expected := range test.expected {
+				for key, value := range expected {
+					if lines[i][key] != value {
+						t.Errorf("expected %s to be %v, got %v", key, value, lines[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMakeSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	handler := slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+	logger := MakeSlogLogger(handler)
+	logger.SetVerbosityLevel(5)
+
+	logger.Resource("example.com/gpu").Reason(errors.New("device is gone")).Warning("unhealthy")
+	logger.V(4).Info("details")
+	// more verbose than the handler logs
+	logger.V(5).Info("more details")
+	// more verbose than the logger logs
+	logger.V(6).Info("even more details")
+
+	lines := decodeLines(t, &buf)
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %v", lines)
+	}
+	expected := []map[string]interface{}{
+		{"level": "WARN", "msg": "unhealthy", "resource": "example.com/gpu", "reason": "device is gone"},
+		{"level": "DEBUG", "msg": "details"},
+	}
+	for i := range expected {
+		for key, value := range expected[i] {
+			if lines[i][key] != value {
+				t.Errorf("expected %s to be %v, got %v", key, value, lines[i])
+			}
+		}
+	}
+	if _, set := lines[1]["reason"]; set {
+		t.Errorf("expected the reason not to be carried to the next line, got %v", lines[1])
+	}
+}
@@ -0,0 +1,165 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	namespace = "vfio_device_plugin"
+
+	MetricsPath = "/metrics"
+)
+
+var (
+	registry = prometheus.NewRegistry()
+
+	devicesAdvertised = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "devices_advertised",
+		Help:      "Number of devices advertised to kubelet per resource.",
+	}, []string{"resource"})
+
+	devicesHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "devices_healthy",
+		Help:      "Number of healthy devices per resource.",
+	}, []string{"resource"})
+
+	devicesAllocated = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "devices_allocated",
+		Help:      "Number of devices allocated to containers per resource, as reported by the PodResources API.",
+	}, []string{"resource"})
+
+	discoveryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "discovery_errors_total",
+		Help:      "Number of device discovery errors per resource and reason.",
+	}, []string{"resource", "reason"})
+
+	registrationAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "registration_attempts_total",
+		Help:      "Number of attempts to start and register a device plugin with kubelet.",
+	}, []string{"resource"})
+
+	registrationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "registration_failures_total",
+		Help:      "Number of device plugin start or registration attempts which failed.",
+	}, []string{"resource"})
+
+	pluginState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "plugin_state",
+		Help:      "Lifecycle state of the device plugin per resource, 1 for the current state.",
+	}, []string{"resource", "state"})
+
+	pluginStateSeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "plugin_state_seconds_total",
+		Help:      "Time the device plugin spent in each lifecycle state per resource.",
+	}, []string{"resource", "state"})
+
+	rpcRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rpc_requests_total",
+		Help:      "Number of device plugin RPC calls received from kubelet.",
+	}, []string{"resource", "method"})
+
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "Latency of device plugin RPC calls received from kubelet.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 8),
+	}, []string{"resource", "method"})
+
+	healthTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "health_transitions_total",
+		Help:      "Number of device health transitions per resource and new health state.",
+	}, []string{"resource", "health"})
+)
+
+func init() {
+	registry.MustRegister(
+		devicesAdvertised,
+		devicesHealthy,
+		devicesAllocated,
+		discoveryErrors,
+		registrationAttempts,
+		registrationFailures,
+		pluginState,
+		pluginStateSeconds,
+		rpcRequests,
+		rpcDuration,
+		healthTransitions,
+	)
+}
+
+// Handler returns the http handler serving all plugin metrics
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+func SetDevicesAdvertised(resourceName string, count int) {
+	devicesAdvertised.WithLabelValues(resourceName).Set(float64(count))
+}
+
+func SetDevicesHealthy(resourceName string, count int) {
+	devicesHealthy.WithLabelValues(resourceName).Set(float64(count))
+}
+
+func SetDevicesAllocated(resourceName string, count int) {
+	devicesAllocated.WithLabelValues(resourceName).Set(float64(count))
+}
+
+// ResetDeviceGauges drops the device gauges of all resources, used when the set of resources changes
+func ResetDeviceGauges() {
+	devicesAdvertised.Reset()
+	devicesHealthy.Reset()
+	devicesAllocated.Reset()
+}
+
+func IncDiscoveryErrors(resourceName string, reason string) {
+	discoveryErrors.WithLabelValues(resourceName, reason).Inc()
+}
+
+func IncRegistrationAttempts(resourceName string) {
+	registrationAttempts.WithLabelValues(resourceName).Inc()
+}
+
+func IncRegistrationFailures(resourceName string) {
+	registrationFailures.WithLabelValues(resourceName).Inc()
+}
+
+// SetPluginState sets the current lifecycle state of the device plugin of a resource among all its states
+func SetPluginState(resourceName string, state string, states []string) {
+	for _, s := range states {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		pluginState.WithLabelValues(resourceName, s).Set(value)
+	}
+}
+
+func AddPluginStateSeconds(resourceName string, state string, seconds float64) {
+	pluginStateSeconds.WithLabelValues(resourceName, state).Add(seconds)
+}
+
+func IncHealthTransitions(resourceName string, health string) {
+	healthTransitions.WithLabelValues(resourceName, health).Inc()
+}
+
+// ObserveRPC counts a device plugin RPC call and records its latency, meant to be deferred:
+//
+//	defer metrics.ObserveRPC(dpi.resourceName, "Allocate", time.Now())
+func ObserveRPC(resourceName string, method string, start time.Time) {
+	rpcRequests.WithLabelValues(resourceName, method).Inc()
+	rpcDuration.WithLabelValues(resourceName, method).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,161 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrape returns the metrics served by Handler in the text format
+func scrape(t *testing.T) string {
+	t.Helper()
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+	resp, err := http.Get(server.URL + MetricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+// sample returns the value of a series of the scraped metrics, e.g.
+// vfio_device_plugin_devices_healthy{resource="example.com/gpu"}, and whether it is served
+func sample(metrics string, series string) (string, bool) {
+	for _, line := range strings.Split(metrics, "\n") {
+		if strings.HasPrefix(line, series+" ") {
+			return strings.TrimPrefix(line, series+" "), true
+		}
+	}
+	return "", false
+}
+
+func expectSamples(t *testing.T, metrics string, expected map[string]string) {
+	t.Helper()
+	for series, value := range expected {
+		if actual, served := sample(metrics, series); !served || actual != value {
+			t.Errorf("expected %s to be %s, got %q (served: %v)", series, value, actual, served)
+		}
+	}
+}
+
+func TestRegistration(t *testing.T) {
+	const resourceName = "example.com/registered"
+	SetDevicesAdvertised(resourceName, 1)
+	SetDevicesHealthy(resourceName, 1)
+	SetDevicesAllocated(resourceName, 0)
+	IncDiscoveryErrors(resourceName, "DeviceNotVfioBound")
+	IncRegistrationAttempts(resourceName)
+	IncRegistrationFailures(resourceName)
+	SetPluginState(resourceName, "serving", []string{"serving"})
+	AddPluginStateSeconds(resourceName, "serving", 1)
+	IncHealthTransitions(resourceName, "Healthy")
+	ObserveRPC(resourceName, "Allocate", time.Now())
+
+	metrics := scrape(t)
+	expected := map[string]string{
+		"devices_advertised":          "gauge",
+		"devices_healthy":             "gauge",
+		"devices_allocated":           "gauge",
+		"discovery_errors_total":      "counter",
+		"registration_attempts_total": "counter",
+		"registration_failures_total": "counter",
+		"plugin_state":                "gauge",
+		"plugin_state_seconds_total":  "counter",
+		"rpc_requests_total":          "counter",
+		"rpc_duration_seconds":        "histogram",
+		"health_transitions_total":    "counter",
+	}
+	for name, metricType := range expected {
+		if !strings.Contains(metrics, "# HELP "+namespace+"_"+name+" ") {
+			t.Errorf("expected %s to be served with its help", name)
+		}
+		if !strings.Contains(metrics, "# TYPE "+namespace+"_"+name+" "+metricType+"\n") {
+			t.Errorf("expected %s to be served as a %s", name, metricType)
+		}
+	}
+}
+
+func TestDeviceGauges(t *testing.T) {
+	SetDevicesAdvertised("example.com/gpu", 4)
+	SetDevicesHealthy("example.com/gpu", 3)
+	SetDevicesAllocated("example.com/gpu", 2)
+	SetDevicesAdvertised("example.com/nic", 1)
+	// the last value is kept
+	SetDevicesHealthy("example.com/gpu", 2)
+
+	expectSamples(t, scrape(t), map[string]string{
+		`vfio_device_plugin_devices_advertised{resource="example.com/gpu"}`: "4",
+		`vfio_device_plugin_devices_healthy{resource="example.com/gpu"}`:    "2",
+		`vfio_device_plugin_devices_allocated{resource="example.com/gpu"}`:  "2",
+		`vfio_device_plugin_devices_advertised{resource="example.com/nic"}`: "1",
+	})
+
+	// the resources which are gone aren't reported anymore
+	ResetDeviceGauges()
+	SetDevicesAdvertised("example.com/gpu", 4)
+	metrics := scrape(t)
+	expectSamples(t, metrics, map[string]string{`vfio_device_plugin_devices_advertised{resource="example.com/gpu"}`: "4"})
+	for _, series := range []string{
+		`vfio_device_plugin_devices_healthy{resource="example.com/gpu"}`,
+		`vfio_device_plugin_devices_advertised{resource="example.com/nic"}`,
+	} {
+		if value, served := sample(metrics, series); served {
+			t.Errorf("expected %s to be reset, got %s", series, value)
+		}
+	}
+}
+
+func TestSetPluginState(t *testing.T) {
+	const resourceName = "example.com/state"
+	states := []string{"starting", "serving", "stopped"}
+	SetPluginState(resourceName, "starting", states)
+	SetPluginState(resourceName, "serving", states)
+	AddPluginStateSeconds(resourceName, "starting", 1.5)
+	AddPluginStateSeconds(resourceName, "starting", 0.5)
+
+	expectSamples(t, scrape(t), map[string]string{
+		`vfio_device_plugin_plugin_state{resource="example.com/state",state="starting"}`:               "0",
+		`vfio_device_plugin_plugin_state{resource="example.com/state",state="serving"}`:                "1",
+		`vfio_device_plugin_plugin_state{resource="example.com/state",state="stopped"}`:                "0",
+		`vfio_device_plugin_plugin_state_seconds_total{resource="example.com/state",state="starting"}`: "2",
+	})
+}
+
+func TestCounters(t *testing.T) {
+	const resourceName = "example.com/counters"
+	IncDiscoveryErrors(resourceName, "DeviceNotVfioBound")
+	IncDiscoveryErrors(resourceName, "DeviceNotVfioBound")
+	IncDiscoveryErrors(resourceName, "IOMMUGroupUnviable")
+	IncRegistrationAttempts(resourceName)
+	IncRegistrationAttempts(resourceName)
+	IncRegistrationFailures(resourceName)
+	IncHealthTransitions(resourceName, "Unhealthy")
+	IncHealthTransitions(resourceName, "Healthy")
+	IncHealthTransitions(resourceName, "Unhealthy")
+	ObserveRPC(resourceName, "Allocate", time.Now())
+	ObserveRPC(resourceName, "Allocate", time.Now().Add(-time.Second))
+	ObserveRPC(resourceName, "ListAndWatch", time.Now())
+
+	expectSamples(t, scrape(t), map[string]string{
+		`vfio_device_plugin_discovery_errors_total{reason="DeviceNotVfioBound",resource="example.com/counters"}`: "2",
+		`vfio_device_plugin_discovery_errors_total{reason="IOMMUGroupUnviable",resource="example.com/counters"}`: "1",
+		`vfio_device_plugin_registration_attempts_total{resource="example.com/counters"}`:                        "2",
+		`vfio_device_plugin_registration_failures_total{resource="example.com/counters"}`:                        "1",
+		`vfio_device_plugin_health_transitions_total{health="Unhealthy",resource="example.com/counters"}`:        "2",
+		`vfio_device_plugin_health_transitions_total{health="Healthy",resource="example.com/counters"}`:          "1",
+		`vfio_device_plugin_rpc_requests_total{method="Allocate",resource="example.com/counters"}`:               "2",
+		`vfio_device_plugin_rpc_requests_total{method="ListAndWatch",resource="example.com/counters"}`:           "1",
+		`vfio_device_plugin_rpc_duration_seconds_count{method="Allocate",resource="example.com/counters"}`:       "2",
+		// the call of a second falls in the 2.048s bucket
+		`vfio_device_plugin_rpc_duration_seconds_bucket{method="Allocate",resource="example.com/counters",le="0.512"}`: "1",
+		`vfio_device_plugin_rpc_duration_seconds_bucket{method="Allocate",resource="example.com/counters",le="2.048"}`: "2",
+	})
+}
@@ -0,0 +1,267 @@
+package preflight
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jonkeyguan/vfio-device-plugin/pkg/log"
+)
+
+type Status string
+
+const (
+	Pass Status = "pass"
+	Warn Status = "warn"
+	Fail Status = "fail"
+)
+
+const (
+	iommuGroupsPath            = "sys/kernel/iommu_groups"
+	vfioPCIModulePath          = "sys/module/vfio_pci"
+	kernelCmdlinePath          = "proc/cmdline"
+	allowUnsafeInterruptsPath  = "sys/module/vfio_iommu_type1/parameters/allow_unsafe_interrupts"
+	vfioContainerDevicePath    = "dev/vfio/vfio"
+	kernelCmdlineIntelIOMMUArg = "intel_iommu"
+	kernelCmdlineAMDIOMMUArg   = "amd_iommu"
+)
+
+// VfioViableDrivers are the drivers the other devices of an iommu group may be bound to
+// without making the group unusable for vfio
+var VfioViableDrivers = map[string]struct{}{
+	"vfio-pci":      {},
+	"pci-stub":      {},
+	"pcieport":      {},
+	"vfio-platform": {},
+	"vfio_ap_mdev":  {},
+	"vfio_ccw_mdev": {},
+	"vfio_mdev":     {},
+}
+
+// Finding is the outcome of a single host check
+type Finding struct {
+	Check   string `json:"check"`
+	Status  Status `json:"status"`
+	Message string `json:"message"`
+}
+
+// Checker verifies that a host is set up for VFIO device assignment.
+// All paths are resolved below root, which allows running the checks against a fake tree.
+type Checker struct {
+	root string
+}
+
+func NewChecker(root string) *Checker {
+	return &Checker{root: root}
+}
+
+// Run executes every check and returns their findings in a stable order
+func (c *Checker) Run() []Finding {
+	return []Finding{
+		c.checkIOMMUGroups(),
+		c.checkIOMMUGroupViability(),
+		c.checkVfioPCIModule(),
+		c.checkKernelCmdline(),
+		c.checkUnsafeInterrupts(),
+		c.checkVfioContainerDevice(),
+	}
+}
+
+func (c *Checker) path(relative string) string {
+	return filepath.Join(c.root, relative)
+}
+
+func (c *Checker) checkIOMMUGroups() Finding {
+	finding := Finding{Check: "iommu-groups"}
+	groups, err := os.ReadDir(c.path(iommuGroupsPath))
+	switch {
+	case err != nil:
+		finding.Status = Fail
+		finding.Message = fmt.Sprintf("cannot read %s, the IOMMU is disabled or not supported: %v", c.path(iommuGroupsPath), err)
+	case len(groups) == 0:
+		finding.Status = Fail
+		finding.Message = "no IOMMU groups found, the IOMMU is disabled or not supported"
+	default:
+		finding.Status = Pass
+		finding.Message = fmt.Sprintf("%d IOMMU groups found", len(groups))
+	}
+	return finding
+}
+
+// checkIOMMUGroupViability verifies that the groups of the devices bound to vfio-pci hold no
+// device bound to a driver vfio doesn't accept, such a group can't be assigned to a guest
+func (c *Checker) checkIOMMUGroupViability() Finding {
+	finding := Finding{Check: "iommu-group-viability"}
+	groups, err := os.ReadDir(c.path(iommuGroupsPath))
+	if err != nil {
+		finding.Status = Warn
+		finding.Message = fmt.Sprintf("cannot read %s, the IOMMU groups are not checked: %v", c.path(iommuGroupsPath), err)
+		return finding
+	}
+
+	var unviable []string
+	vfioGroups := 0
+	for _, group := range groups {
+		devicesPath := filepath.Join(c.path(iommuGroupsPath), group.Name(), "devices")
+		devices, err := os.ReadDir(devicesPath)
+		if err != nil {
+			continue
+		}
+		drivers := make(map[string]string)
+		hasVfio := false
+		for _, device := range devices {
+			driverPath, err := os.Readlink(filepath.Join(devicesPath, device.Name(), "driver"))
+			if err != nil {
+				// unbound
+				continue
+			}
+			drivers[device.Name()] = filepath.Base(driverPath)
+			if drivers[device.Name()] == "vfio-pci" {
+				hasVfio = true
+			}
+		}
+		if !hasVfio {
+			continue
+		}
+		vfioGroups++
+		for address, driver := range drivers {
+			if _, viable := VfioViableDrivers[driver]; !viable {
+				unviable = append(unviable, fmt.Sprintf("group %s: %s is bound to %s", group.Name(), address, driver))
+			}
+		}
+	}
+
+	switch {
+	case len(unviable) > 0:
+		sort.Strings(unviable)
+		finding.Status = Fail
+		finding.Message = fmt.Sprintf("IOMMU groups of vfio-pci devices are not viable: %s", strings.Join(unviable, ", "))
+	case vfioGroups == 0:
+		finding.Status = Pass
+		finding.Message = "no device is bound to vfio-pci"
+	default:
+		finding.Status = Pass
+		finding.Message = fmt.Sprintf("%d IOMMU groups of vfio-pci devices are viable", vfioGroups)
+	}
+	return finding
+}
+
+func (c *Checker) checkVfioPCIModule() Finding {
+	finding := Finding{Check: "vfio-pci-module"}
+	if _, err := os.Stat(c.path(vfioPCIModulePath)); err != nil {
+		finding.Status = Fail
+		finding.Message = "the vfio-pci module is not loaded"
+		return finding
+	}
+	finding.Status = Pass
+	finding.Message = "the vfio-pci module is loaded"
+	return finding
+}
+
+func (c *Checker) checkKernelCmdline() Finding {
+	finding := Finding{Check: "kernel-cmdline"}
+	data, err := os.ReadFile(c.path(kernelCmdlinePath))
+	if err != nil {
+		finding.Status = Warn
+		finding.Message = fmt.Sprintf("cannot read the kernel command line: %v", err)
+		return finding
+	}
+
+	var enabled, disabled []string
+	for _, arg := range strings.Fields(string(data)) {
+		name, value, _ := strings.Cut(arg, "=")
+		if name != kernelCmdlineIntelIOMMUArg && name != kernelCmdlineAMDIOMMUArg {
+			continue
+		}
+		for _, option := range strings.Split(value, ",") {
+			switch option {
+			case "on":
+				enabled = append(enabled, arg)
+			case "off":
+				disabled = append(disabled, arg)
+			}
+		}
+	}
+
+	switch {
+	case len(disabled) > 0:
+		finding.Status = Fail
+		finding.Message = fmt.Sprintf("the IOMMU is disabled on the kernel command line: %s", strings.Join(disabled, " "))
+	case len(enabled) > 0:
+		finding.Status = Pass
+		finding.Message = fmt.Sprintf("the IOMMU is enabled on the kernel command line: %s", strings.Join(enabled, " "))
+	default:
+		finding.Status = Warn
+		finding.Message = fmt.Sprintf("neither %s nor %s is set on the kernel command line, relying on the kernel default",
+			kernelCmdlineIntelIOMMUArg, kernelCmdlineAMDIOMMUArg)
+	}
+	return finding
+}
+
+func (c *Checker) checkUnsafeInterrupts() Finding {
+	finding := Finding{Check: "interrupt-remapping"}
+	data, err := os.ReadFile(c.path(allowUnsafeInterruptsPath))
+	if err != nil {
+		finding.Status = Warn
+		if errors.Is(err, os.ErrNotExist) {
+			finding.Message = "the vfio_iommu_type1 module is not loaded, cannot check allow_unsafe_interrupts"
+		} else {
+			finding.Message = fmt.Sprintf("cannot read allow_unsafe_interrupts: %v", err)
+		}
+		return finding
+	}
+
+	if strings.TrimSpace(string(data)) == "Y" {
+		finding.Status = Warn
+		finding.Message = "allow_unsafe_interrupts is enabled, devices are assigned without interrupt remapping protection"
+		return finding
+	}
+	finding.Status = Pass
+	finding.Message = "allow_unsafe_interrupts is disabled"
+	return finding
+}
+
+func (c *Checker) checkVfioContainerDevice() Finding {
+	finding := Finding{Check: "vfio-container-device"}
+	info, err := os.Stat(c.path(vfioContainerDevicePath))
+	switch {
+	case err != nil:
+		finding.Status = Fail
+		finding.Message = fmt.Sprintf("%s is missing: %v", c.path(vfioContainerDevicePath), err)
+	case info.Mode()&os.ModeCharDevice == 0:
+		finding.Status = Fail
+		finding.Message = fmt.Sprintf("%s is not a character device", c.path(vfioContainerDevicePath))
+	default:
+		finding.Status = Pass
+		finding.Message = fmt.Sprintf("%s is present", c.path(vfioContainerDevicePath))
+	}
+	return finding
+}
+
+// LogFindings logs every finding at a level matching its status
+func LogFindings(findings []Finding) {
+	logger := log.DefaultLogger()
+	for _, finding := range findings {
+		switch finding.Status {
+		case Pass:
+			logger.Infof("preflight check %s passed: %s", finding.Check, finding.Message)
+		case Warn:
+			logger.Warningf("preflight check %s warned: %s", finding.Check, finding.Message)
+		default:
+			logger.Errorf("preflight check %s failed: %s", finding.Check, finding.Message)
+		}
+	}
+}
+
+// HasFailures returns true when any finding failed
+func HasFailures(findings []Finding) bool {
+	for _, finding := range findings {
+		if finding.Status == Fail {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package preflight
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeRoot builds the tree of a host set up for VFIO device assignment
+func fakeRoot(t *testing.T) string {
+	root := t.TempDir()
+	mkdir := func(path string) {
+		if err := os.MkdirAll(filepath.Join(root, path), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(path string, data string) {
+		mkdir(filepath.Dir(path))
+		if err := os.WriteFile(filepath.Join(root, path), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mkdir(vfioPCIModulePath)
+	write(kernelCmdlinePath, "BOOT_IMAGE=/vmlinuz intel_iommu=on iommu=pt\n")
+	write(allowUnsafeInterruptsPath, "N\n")
+	mkdir(filepath.Dir(vfioContainerDevicePath))
+	// any character device passes for the vfio container
+	if err := os.Symlink("/dev/null", filepath.Join(root, vfioContainerDevicePath)); err != nil {
+		t.Fatal(err)
+	}
+	bindDevice(t, root, "12", "0000:01:00.0", "vfio-pci")
+	bindDevice(t, root, "13", "0000:02:00.0", "e1000e")
+	return root
+}
+
+// bindDevice adds a device to an iommu group, bound to driver unless it is empty
+func bindDevice(t *testing.T, root string, group string, address string, driver string) {
+	devicePath := filepath.Join(root, iommuGroupsPath, group, "devices", address)
+	if err := os.MkdirAll(devicePath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if driver == "" {
+		return
+	}
+	if err := os.Symlink(filepath.Join("..", "..", "drivers", driver), filepath.Join(devicePath, "driver")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChecker(t *testing.T) {
+	tests := []struct {
+		name string
+		// breakHost modifies the healthy tree
+		breakHost func(t *testing.T, root string)
+		// statuses of the checks expected not to pass, every other check passes
+		statuses map[string]Status
+	}{
+		{
+			name:      "healthy host",
+			breakHost: func(t *testing.T, root string) {},
+		},
+		{
+			name: "IOMMU off",
+			breakHost: func(t *testing.T, root string) {
+				os.RemoveAll(filepath.Join(root, iommuGroupsPath))
+				os.WriteFile(filepath.Join(root, kernelCmdlinePath), []byte("BOOT_IMAGE=/vmlinuz intel_iommu=off\n"), 0644)
+			},
+			statuses: map[string]Status{"iommu-groups": Fail, "iommu-group-viability": Warn, "kernel-cmdline": Fail},
+		},
+		{
+			name: "vfio-pci missing",
+			breakHost: func(t *testing.T, root string) {
+				os.RemoveAll(filepath.Join(root, vfioPCIModulePath))
+				os.Remove(filepath.Join(root, vfioContainerDevicePath))
+			},
+			statuses: map[string]Status{"vfio-pci-module": Fail, "vfio-container-device": Fail},
+		},
+		{
+			name: "group not viable",
+			breakHost: func(t *testing.T, root string) {
+				bindDevice(t, root, "12", "0000:01:00.1", "snd_hda_intel")
+			},
+			statuses: map[string]Status{"iommu-group-viability": Fail},
+		},
+		{
+			name: "group with unbound and bridge devices",
+			breakHost: func(t *testing.T, root string) {
+				bindDevice(t, root, "12", "0000:01:00.1", "")
+				bindDevice(t, root, "12", "0000:00:01.0", "pcieport")
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := fakeRoot(t)
+			test.breakHost(t, root)
+
+			findings := NewChecker(root).Run()
+			for _, finding := range findings {
+				expected, listed := test.statuses[finding.Check]
+				if !listed {
+					expected = Pass
+				}
+				if finding.Status != expected {
+					t.Errorf("check %s: expected %s, got %s: %s", finding.Check, expected, finding.Status, finding.Message)
+				}
+			}
+			if HasFailures(findings) != (len(test.statuses) > 0) {
+				t.Errorf("expected %v, got findings %+v", test.statuses, findings)
+			}
+		})
+	}
+}